@@ -107,6 +107,16 @@ func seed(ctx context.Context) error {
 			return err
 		}
 
+		impersonatorRole := models.Role{
+			RealmId:     adminRealm.Id,
+			Immutable:   true,
+			Name:        "Impersonator",
+			Description: sql.NullString{Valid: true, String: "Built-in role allowed to impersonate users."},
+		}
+		if _, err := tx.NewInsert().Model(&impersonatorRole).Exec(ctx); err != nil {
+			return err
+		}
+
 		adminUser := models.User{
 			RealmId:   adminRealm.Id,
 			Approved:  true,
@@ -114,7 +124,7 @@ func seed(ctx context.Context) error {
 			Immutable: true,
 			Flags:     0b0000,
 			Attributes: map[string]string{
-				"profile.display_name": "Admin",
+				models.USER_ATTRIBUTE_PROFILE_DISPLAY_NAME: "Admin",
 			},
 			Description: sql.NullString{Valid: true, String: "Built-in admin user."},
 		}
@@ -132,6 +142,7 @@ func seed(ctx context.Context) error {
 
 		adminLogin := models.Login{
 			UserId:     adminUser.Id,
+			RealmId:    adminRealm.Id,
 			Immutable:  true,
 			Provider:   models.LOGIN_PROVIDER_FORM_PASSWORD,
 			Identifier: "admin",
@@ -22,6 +22,8 @@ import (
 
 	_ "github.com/choral-io/gommerce-server-aio/data/drivers" // register db drivers
 	srv "github.com/choral-io/gommerce-server-aio/server"
+	"github.com/choral-io/gommerce-server-aio/server/notify"
+	"github.com/choral-io/gommerce-server-aio/server/scim"
 	srv_v1 "github.com/choral-io/gommerce-server-aio/server/v1"
 	srv_v1b "github.com/choral-io/gommerce-server-aio/server/v1beta"
 	"github.com/choral-io/gommerce-server-aio/static"
@@ -30,7 +32,7 @@ import (
 var (
 	grpc_server_fx_tag = `group:"grpc_servers"`
 	grpc_servers_anns  = []fx.Annotation{fx.As(new(any)), fx.ResultTags(grpc_server_fx_tag)}
-	grpc_handler_anns  = fx.ParamTags(``, grpc_server_fx_tag, ``, ``, ``, ``, ``)
+	grpc_handler_anns  = fx.ParamTags(``, grpc_server_fx_tag, ``, ``, ``, ``, ``, ``, ``, ``, ``)
 )
 
 func main() {
@@ -46,8 +48,18 @@ func main() {
 		fx.Provide(secure.NewTokenStore, srv.NewBasicTokenStore),  // create token stores
 		fx.Provide(srv.NewServerAuthorizer),                       // create server authorizer
 		fx.Provide(srv.NewSelectorMatcher),                        // create selector matcher
+		fx.Provide(srv.NewSessionStore),                           // create session store
+		fx.Provide(srv.NewActivityTracker),                        // create activity tracker
+		fx.Provide(srv.NewImpersonationAuditor),                   // create impersonation auditor
+		fx.Provide(srv.NewLoginEventRecorder),                     // create login event recorder
+		fx.Provide(srv.NewAuditLogger),                            // create audit logger
+		fx.Provide(srv.NewSweeper),                                // create sweeper
 		fx.Provide(server.NewHTTPServer),                          // create http server
 		fx.Provide(events.NewNATSConn),                            // create nats connection
+		fx.Provide(notify.NewNotifier),                            // create notifier
+		fx.Provide(notify.NewPushProvider),                        // create push provider
+		fx.Provide(srv.NewPushDispatcher),                         // create push dispatcher
+		fx.Provide(scim.NewHandler),                               // create scim provisioning handler
 		fx.Provide( // register grpc servers
 			fx.Annotate(server.NewHealthServiceServer, grpc_servers_anns...),
 			fx.Annotate(srv_v1.NewSequenceServiceServer, grpc_servers_anns...),
@@ -56,22 +68,44 @@ func main() {
 			fx.Annotate(srv_v1.NewDateTimeServiceServer, grpc_servers_anns...),
 			fx.Annotate(srv_v1b.NewTokensServiceServer, grpc_servers_anns...),
 			fx.Annotate(srv_v1b.NewUsersServiceServer, grpc_servers_anns...),
+			fx.Annotate(srv_v1b.NewInvitationsServiceServer, grpc_servers_anns...),
+			fx.Annotate(srv_v1b.NewLoginsServiceServer, grpc_servers_anns...),
+			fx.Annotate(srv_v1b.NewAttributeSchemasServiceServer, grpc_servers_anns...),
+			fx.Annotate(srv_v1b.NewGroupsServiceServer, grpc_servers_anns...),
+			fx.Annotate(srv_v1b.NewDevicesServiceServer, grpc_servers_anns...),
+			fx.Annotate(srv_v1b.NewNotificationsServiceServer, grpc_servers_anns...),
+			fx.Annotate(srv_v1b.NewAuditLogsServiceServer, grpc_servers_anns...),
 			fx.Annotate(srv_v1b.NewStateStoreServiceServer, grpc_servers_anns...),
 		),
 		fx.Provide( // create grpc handler
 			fx.Annotate(func(cfg config.ServerHTTPConfig, regs []any,
 				logger logging.Logger, tp trace.TracerProvider, mp metric.MeterProvider,
-				auth *secure.ServerAuthorizer, matcher selector.Matcher,
+				auth *secure.ServerAuthorizer, matcher selector.Matcher, at *srv.ActivityTracker,
+				ia *srv.ImpersonationAuditor, al *srv.AuditLogger, sh *scim.Handler,
 			) (http.Handler, error) {
-				return server.NewGRPCHandler(cfg,
-					server.WithOTELStatsHandler(tp, mp),              // add opentelemetry stats handler
-					server.WithLoggingInterceptor(logger),            // add logging interceptor
-					server.WithRecoveryInterceptor(nil),              // add recovery interceptor
-					server.WithSecureInterceptor(auth, matcher),      // add secure interceptor
-					server.WithValidatorInterceptor(),                // add validator interceptor
-					server.WithRegistrations(regs...),                // add registrations
-					server.WithStaticFileHandler("/**", static.FS()), // add static file handler
+				h, err := server.NewGRPCHandler(cfg,
+					server.WithOTELStatsHandler(tp, mp),                                // add opentelemetry stats handler
+					server.WithLoggingInterceptor(logger),                              // add logging interceptor
+					server.WithRecoveryInterceptor(nil),                                // add recovery interceptor
+					server.WithUnaryInterceptor(al.UnaryServerInterceptor()),           // add audit log interceptor
+					server.WithStreamInterceptor(al.StreamServerInterceptor()),         // add audit log interceptor
+					server.WithSecureInterceptor(auth, matcher),                        // add secure interceptor
+					server.WithUnaryInterceptor(al.IdentityUnaryServerInterceptor()),   // add audit log identity interceptor
+					server.WithStreamInterceptor(al.IdentityStreamServerInterceptor()), // add audit log identity interceptor
+					server.WithUnaryInterceptor(srv.GuestUnaryServerInterceptor()),     // add guest interceptor
+					server.WithStreamInterceptor(srv.GuestStreamServerInterceptor()),   // add guest interceptor
+					server.WithUnaryInterceptor(at.UnaryServerInterceptor()),           // add activity tracking interceptor
+					server.WithStreamInterceptor(at.StreamServerInterceptor()),         // add activity tracking interceptor
+					server.WithUnaryInterceptor(ia.UnaryServerInterceptor()),           // add impersonation audit interceptor
+					server.WithStreamInterceptor(ia.StreamServerInterceptor()),         // add impersonation audit interceptor
+					server.WithValidatorInterceptor(),                                  // add validator interceptor
+					server.WithRegistrations(regs...),                                  // add registrations
+					server.WithStaticFileHandler("/**", static.FS()),                   // add static file handler
 				)
+				if err != nil {
+					return nil, err
+				}
+				return sh.Mount(h), nil // serve scim endpoints next to the grpc gateway
 			}, grpc_handler_anns)),
 		fx.Invoke(data.SetDefaultIdWorker), // set default id worker
 		fx.Invoke( // register db connection to lifecycle
@@ -86,6 +120,22 @@ func main() {
 					return nc.Drain()
 				}})
 			}),
+		fx.Invoke( // register activity tracker to lifecycle
+			func(at *srv.ActivityTracker, lc fx.Lifecycle) {
+				lc.Append(fx.Hook{OnStart: at.Start, OnStop: at.Stop})
+			}),
+		fx.Invoke( // register login event recorder to lifecycle
+			func(ler *srv.LoginEventRecorder, lc fx.Lifecycle) {
+				lc.Append(fx.Hook{OnStart: ler.Start, OnStop: ler.Stop})
+			}),
+		fx.Invoke( // register audit logger to lifecycle
+			func(al *srv.AuditLogger, lc fx.Lifecycle) {
+				lc.Append(fx.Hook{OnStart: al.Start, OnStop: al.Stop})
+			}),
+		fx.Invoke( // register sweeper to lifecycle
+			func(sw *srv.Sweeper, lc fx.Lifecycle) {
+				lc.Append(fx.Hook{OnStart: sw.Start, OnStop: sw.Stop})
+			}),
 		fx.Invoke( // register http server to lifecycle
 			func(srv *server.HTTPServer, lc fx.Lifecycle) {
 				lc.Append(fx.Hook{OnStart: srv.Start, OnStop: srv.Stop})
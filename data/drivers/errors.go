@@ -0,0 +1,20 @@
+package data
+
+import (
+	"errors"
+
+	"github.com/uptrace/bun/driver/pgdriver"
+)
+
+const (
+	PG_UNIQUE_VIOLATION = "23505"
+)
+
+// IsUniqueViolation reports whether err is caused by a violation of the named unique index, or of any unique index if name is empty.
+func IsUniqueViolation(err error, name string) bool {
+	var pgErr pgdriver.Error
+	if !errors.As(err, &pgErr) || pgErr.Field('C') != PG_UNIQUE_VIOLATION {
+		return false
+	}
+	return name == "" || pgErr.Field('n') == name
+}
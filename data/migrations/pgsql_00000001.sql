@@ -0,0 +1,4 @@
+-- users indexes for filtering and sorting
+
+CREATE INDEX "ix_users_created_at" ON "users" ("created_at");
+CREATE INDEX "ix_users_last_active_time" ON "users" ("last_active_time");
@@ -0,0 +1,24 @@
+-- invitations definition
+
+CREATE TABLE "invitations" (
+    "id" VARCHAR(16) NOT NULL,
+    "realm_id" VARCHAR(16) NOT NULL,
+    "creator_id" VARCHAR(16) NOT NULL,
+    "disabled" BOOLEAN NOT NULL DEFAULT FALSE,
+    "created_at" TIMESTAMP(6) NOT NULL,
+    "updated_at" TIMESTAMP(6) DEFAULT NULL,
+    "deleted_at" TIMESTAMP(6) DEFAULT NULL,
+    "expires_at" TIMESTAMP(6) DEFAULT NULL,
+    "code" VARCHAR(32) NOT NULL,
+    "max_uses" INTEGER NOT NULL DEFAULT 1,
+    "used_count" INTEGER NOT NULL DEFAULT 0,
+    "email_address" VARCHAR(128) DEFAULT NULL,
+    "role_ids" jsonb DEFAULT NULL,
+    "description" VARCHAR(255) DEFAULT NULL,
+    CONSTRAINT "pk_invitations" PRIMARY KEY ("id"),
+    CONSTRAINT "fk_invitations_realms_realm_id" FOREIGN KEY ("realm_id") REFERENCES "realms" ("id") ON DELETE RESTRICT ON UPDATE RESTRICT,
+    CONSTRAINT "fk_invitations_users_creator_id" FOREIGN KEY ("creator_id") REFERENCES "users" ("id") ON DELETE RESTRICT ON UPDATE RESTRICT
+);
+
+CREATE UNIQUE INDEX "ix_invitations_code" ON "invitations" ("code");
+CREATE INDEX "ix_invitations_creator_id" ON "invitations" ("creator_id");
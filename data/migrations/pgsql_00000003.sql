@@ -0,0 +1,12 @@
+-- logins scoped to realms
+
+ALTER TABLE "logins" ADD COLUMN "realm_id" VARCHAR(16) DEFAULT NULL;
+
+UPDATE "logins" SET "realm_id" = "users"."realm_id" FROM "users" WHERE "users"."id" = "logins"."user_id";
+
+ALTER TABLE "logins" ALTER COLUMN "realm_id" SET NOT NULL;
+ALTER TABLE "logins" ADD CONSTRAINT "fk_logins_realms_realm_id" FOREIGN KEY ("realm_id") REFERENCES "realms" ("id") ON DELETE RESTRICT ON UPDATE RESTRICT;
+
+DROP INDEX "ix_logins_provider_identifier";
+CREATE UNIQUE INDEX "ix_logins_realm_id_provider_identifier" ON "logins" ("realm_id", "provider", "identifier");
+CREATE INDEX "ix_logins_user_id" ON "logins" ("user_id");
@@ -0,0 +1,48 @@
+-- normalize existing usernames, email addresses and phone numbers, see server/normalize
+
+-- usernames: lower case, like normalize.Username; only ascii identifiers are rewritten, for them case folding equals
+-- lower() while other characters fold differently, those keep their identifier and sign in by the trimmed raw form.
+-- When several logins map to the same identifier only the oldest one is normalized, the others keep their identifier
+-- and still sign in by it exactly
+
+WITH "normalized" AS (
+    SELECT DISTINCT ON ("login"."realm_id", "login"."provider", "value") "login"."id", "value"
+    FROM (SELECT *, lower(btrim("identifier")) AS "value" FROM "logins") AS "login"
+    WHERE "login"."provider" = 'FORM_PASSWORD' AND "login"."identifier" <> "value" AND "value" ~ '^[ -~]*$'
+        AND "value" <> '' AND length("value") <= 64 AND "value" !~ '[@[:space:][:cntrl:]]'
+        AND NOT EXISTS (SELECT 1 FROM "logins" AS "other" WHERE "other"."realm_id" = "login"."realm_id" AND "other"."provider" = "login"."provider" AND "other"."identifier" = "value")
+    ORDER BY "login"."realm_id", "login"."provider", "value", "login"."created_at"
+)
+UPDATE "logins" SET "identifier" = "normalized"."value", "updated_at" = now()
+FROM "normalized" WHERE "logins"."id" = "normalized"."id";
+
+-- email addresses: up to normalize.MAX_EMAIL_ADDRESS_LENGTH characters, like invitations
+
+ALTER TABLE "users" ALTER COLUMN "email_address" TYPE VARCHAR(128);
+
+-- email addresses: lower case domain, like normalize.EmailAddress, internationalized domains are converted on their next change
+
+WITH "normalized" AS (
+    SELECT DISTINCT ON ("user"."realm_id", "value") "user"."id", "value"
+    FROM (SELECT *, btrim("email_address") AS "trimmed" FROM "users" WHERE "email_address" LIKE '%@%') AS "user",
+        LATERAL (SELECT left("trimmed", length("trimmed") - strpos(reverse("trimmed"), '@')) || lower(right("trimmed", strpos(reverse("trimmed"), '@'))) AS "value") AS "v"
+    WHERE "user"."email_address" <> "value"
+        AND NOT EXISTS (SELECT 1 FROM "users" AS "other" WHERE "other"."realm_id" = "user"."realm_id" AND "other"."email_address" = "value")
+    ORDER BY "user"."realm_id", "value", "user"."created_at"
+)
+UPDATE "users" SET "email_address" = "normalized"."value", "updated_at" = now()
+FROM "normalized" WHERE "users"."id" = "normalized"."id";
+
+-- phone numbers: E.164 for numbers with a "+" or "00" prefix, like normalize.PhoneNumber, national numbers depend on
+-- the configured default region and are converted on their next change
+
+WITH "normalized" AS (
+    SELECT DISTINCT ON ("user"."realm_id", "value") "user"."id", "value"
+    FROM (SELECT *, regexp_replace(btrim("phone_number"), '[ ().-]', '', 'g') AS "digits" FROM "users" WHERE "phone_number" IS NOT NULL) AS "user",
+        LATERAL (SELECT CASE WHEN "digits" LIKE '00%' THEN '+' || substr("digits", 3) ELSE "digits" END AS "value") AS "v"
+    WHERE "user"."phone_number" <> "value" AND "value" ~ '^\+[1-9][0-9]{7,14}$'
+        AND NOT EXISTS (SELECT 1 FROM "users" AS "other" WHERE "other"."realm_id" = "user"."realm_id" AND "other"."phone_number" = "value")
+    ORDER BY "user"."realm_id", "value", "user"."created_at"
+)
+UPDATE "users" SET "phone_number" = "normalized"."value", "updated_at" = now()
+FROM "normalized" WHERE "users"."id" = "normalized"."id";
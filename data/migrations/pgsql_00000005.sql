@@ -0,0 +1,3 @@
+-- logins last used time
+
+ALTER TABLE "logins" ADD COLUMN "last_used_at" TIMESTAMP(6) DEFAULT NULL;
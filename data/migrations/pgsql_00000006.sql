@@ -0,0 +1,5 @@
+-- users scheduled erasure
+
+ALTER TABLE "users" ADD COLUMN "erase_at" TIMESTAMP(6) DEFAULT NULL;
+
+CREATE INDEX "ix_users_erase_at" ON "users" ("erase_at");
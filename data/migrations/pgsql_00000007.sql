@@ -0,0 +1,21 @@
+-- attribute_schemas definition
+
+CREATE TABLE "attribute_schemas" (
+    "id" VARCHAR(16) NOT NULL,
+    "realm_id" VARCHAR(16) NOT NULL,
+    "created_at" TIMESTAMP(6) NOT NULL,
+    "updated_at" TIMESTAMP(6) DEFAULT NULL,
+    "key" VARCHAR(64) NOT NULL,
+    "type" VARCHAR(16) NOT NULL DEFAULT 'string',
+    "required" BOOLEAN NOT NULL DEFAULT FALSE,
+    "pattern" VARCHAR(255) DEFAULT NULL,
+    "enum" jsonb DEFAULT NULL,
+    "max_length" INTEGER NOT NULL DEFAULT 0,
+    "writer" VARCHAR(16) NOT NULL DEFAULT 'user',
+    "ordinal" INTEGER NOT NULL DEFAULT 0,
+    "description" VARCHAR(255) DEFAULT NULL,
+    CONSTRAINT "pk_attribute_schemas" PRIMARY KEY ("id"),
+    CONSTRAINT "fk_attribute_schemas_realms_realm_id" FOREIGN KEY ("realm_id") REFERENCES "realms" ("id") ON DELETE CASCADE ON UPDATE RESTRICT
+);
+
+CREATE UNIQUE INDEX "ix_attribute_schemas_realm_id_key" ON "attribute_schemas" ("realm_id", "key");
@@ -0,0 +1,6 @@
+-- impersonator role, only admins holding it are allowed to impersonate users
+
+INSERT INTO "roles" ("id", "realm_id", "disabled", "immutable", "created_at", "name", "description")
+SELECT '030a67b921005001', "realm"."id", FALSE, TRUE, now(), 'IMPERSONATOR', 'Built-in role allowed to impersonate users.'
+FROM "realms" AS "realm" WHERE "realm"."name" = 'admin'
+ON CONFLICT DO NOTHING;
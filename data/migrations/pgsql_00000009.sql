@@ -0,0 +1,19 @@
+-- login_events definition
+
+CREATE TABLE "login_events" (
+    "id" VARCHAR(16) NOT NULL,
+    "created_at" TIMESTAMP(6) NOT NULL,
+    "realm" VARCHAR(64) NOT NULL,
+    "provider" VARCHAR(16) NOT NULL,
+    "identifier" VARCHAR(64) NOT NULL,
+    "user_id" VARCHAR(16) DEFAULT NULL,
+    "client_id" VARCHAR(16) DEFAULT NULL,
+    "ip_address" VARCHAR(64) DEFAULT NULL,
+    "user_agent" VARCHAR(255) DEFAULT NULL,
+    "outcome" VARCHAR(16) NOT NULL,
+    "failure_reason" VARCHAR(255) DEFAULT NULL,
+    CONSTRAINT "pk_login_events" PRIMARY KEY ("id")
+);
+
+CREATE INDEX "ix_login_events_created_at" ON "login_events" ("created_at");
+CREATE INDEX "ix_login_events_user_id_created_at" ON "login_events" ("user_id", "created_at");
@@ -0,0 +1,33 @@
+-- audit_logs definition
+
+CREATE TABLE "audit_logs" (
+    "id" VARCHAR(16) NOT NULL,
+    "created_at" TIMESTAMP(6) NOT NULL,
+    "schema" VARCHAR(16) DEFAULT NULL,
+    "realm" VARCHAR(64) DEFAULT NULL,
+    "client_id" VARCHAR(16) DEFAULT NULL,
+    "subject" VARCHAR(16) DEFAULT NULL,
+    "actor_id" VARCHAR(16) DEFAULT NULL,
+    "method" VARCHAR(255) NOT NULL,
+    "request" jsonb DEFAULT NULL,
+    "code" VARCHAR(32) NOT NULL,
+    "message" VARCHAR(255) DEFAULT NULL,
+    "latency_ms" BIGINT NOT NULL DEFAULT 0,
+    "ip_address" VARCHAR(64) DEFAULT NULL,
+    CONSTRAINT "pk_audit_logs" PRIMARY KEY ("id")
+);
+
+CREATE INDEX "ix_audit_logs_created_at" ON "audit_logs" ("created_at");
+CREATE INDEX "ix_audit_logs_subject_created_at" ON "audit_logs" ("subject", "created_at");
+CREATE INDEX "ix_audit_logs_method_created_at" ON "audit_logs" ("method", "created_at");
+
+-- audit_logs are append only
+
+CREATE FUNCTION "fn_audit_logs_immutable"() RETURNS TRIGGER AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_logs are append only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER "tr_audit_logs_immutable" BEFORE UPDATE OR DELETE ON "audit_logs"
+    FOR EACH ROW EXECUTE FUNCTION "fn_audit_logs_immutable"();
@@ -0,0 +1,7 @@
+-- clients flags
+
+ALTER TABLE "clients" ADD COLUMN "flags" BIGINT NOT NULL DEFAULT 0;
+
+-- devices push token, FCM registration tokens are longer than 64 characters
+
+ALTER TABLE "devices" ALTER COLUMN "push_token" TYPE VARCHAR(255);
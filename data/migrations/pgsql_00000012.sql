@@ -0,0 +1,4 @@
+-- clients realm, the realm provisioned through a provisioning client
+
+ALTER TABLE "clients" ADD COLUMN "realm_id" VARCHAR(16) DEFAULT NULL;
+ALTER TABLE "clients" ADD CONSTRAINT "fk_clients_realms_realm_id" FOREIGN KEY ("realm_id") REFERENCES "realms" ("id") ON DELETE RESTRICT ON UPDATE RESTRICT;
@@ -0,0 +1,41 @@
+-- groups definition
+
+CREATE TABLE "groups" (
+    "id" VARCHAR(16) NOT NULL,
+    "realm_id" VARCHAR(16) NOT NULL,
+    "parent_id" VARCHAR(16) DEFAULT NULL,
+    "created_at" TIMESTAMP(6) NOT NULL,
+    "updated_at" TIMESTAMP(6) DEFAULT NULL,
+    "name" VARCHAR(64) NOT NULL,
+    "description" VARCHAR(255) DEFAULT NULL,
+    CONSTRAINT "pk_groups" PRIMARY KEY ("id"),
+    CONSTRAINT "fk_groups_realms_realm_id" FOREIGN KEY ("realm_id") REFERENCES "realms" ("id") ON DELETE RESTRICT ON UPDATE RESTRICT,
+    CONSTRAINT "fk_groups_groups_parent_id" FOREIGN KEY ("parent_id") REFERENCES "groups" ("id") ON DELETE RESTRICT ON UPDATE RESTRICT
+);
+
+CREATE UNIQUE INDEX "ix_groups_realm_id_name" ON "groups" ("realm_id", "name");
+CREATE INDEX "ix_groups_parent_id" ON "groups" ("parent_id");
+
+-- group_users definition
+
+CREATE TABLE "group_users" (
+    "group_id" VARCHAR(16) NOT NULL,
+    "user_id" VARCHAR(16) NOT NULL,
+    "created_at" TIMESTAMP(6) NOT NULL,
+    CONSTRAINT "pk_group_users" PRIMARY KEY ("group_id", "user_id"),
+    CONSTRAINT "fk_group_users_groups_group_id" FOREIGN KEY ("group_id") REFERENCES "groups" ("id") ON DELETE CASCADE ON UPDATE RESTRICT,
+    CONSTRAINT "fk_group_users_users_user_id" FOREIGN KEY ("user_id") REFERENCES "users" ("id") ON DELETE CASCADE ON UPDATE RESTRICT
+);
+
+CREATE INDEX "ix_group_users_user_id" ON "group_users" ("user_id");
+
+-- group_roles definition
+
+CREATE TABLE "group_roles" (
+    "group_id" VARCHAR(16) NOT NULL,
+    "role_id" VARCHAR(16) NOT NULL,
+    "created_at" TIMESTAMP(6) NOT NULL,
+    CONSTRAINT "pk_group_roles" PRIMARY KEY ("group_id", "role_id"),
+    CONSTRAINT "fk_group_roles_groups_group_id" FOREIGN KEY ("group_id") REFERENCES "groups" ("id") ON DELETE CASCADE ON UPDATE RESTRICT,
+    CONSTRAINT "fk_group_roles_roles_role_id" FOREIGN KEY ("role_id") REFERENCES "roles" ("id") ON DELETE CASCADE ON UPDATE RESTRICT
+);
@@ -40,12 +40,13 @@ CREATE TABLE "users" (
     "expires_at" TIMESTAMP(6) DEFAULT NULL,
     "first_login_time" TIMESTAMP(6) DEFAULT NULL,
     "last_active_time" TIMESTAMP(6) DEFAULT NULL,
+    "erase_at" TIMESTAMP(6) DEFAULT NULL,
     "flags" BIGINT NOT NULL,
     "attributes" jsonb DEFAULT NULL,
     "display_name" VARCHAR(128) DEFAULT NULL,
     "gender" VARCHAR(32) DEFAULT NULL,
     "phone_number" VARCHAR(64) DEFAULT NULL,
-    "email_address" VARCHAR(64) DEFAULT NULL,
+    "email_address" VARCHAR(128) DEFAULT NULL,
     "description" VARCHAR(255) DEFAULT NULL,
     CONSTRAINT "pk_users" PRIMARY KEY ("id"),
     CONSTRAINT "fk_users_realms_realm_id" FOREIGN KEY ("realm_id") REFERENCES "realms" ("id") ON DELETE RESTRICT ON UPDATE RESTRICT,
@@ -54,10 +55,13 @@ CREATE TABLE "users" (
 
 CREATE UNIQUE INDEX "ix_users_realm_id_phone_number" ON "users" ("realm_id", "phone_number");
 CREATE UNIQUE INDEX "ix_users_realm_id_email_address" ON "users" ("realm_id", "email_address");
+CREATE INDEX "ix_users_created_at" ON "users" ("created_at");
+CREATE INDEX "ix_users_last_active_time" ON "users" ("last_active_time");
+CREATE INDEX "ix_users_erase_at" ON "users" ("erase_at");
 
 -- users data
 
-INSERT INTO "users" VALUES ('030a67b921005000', '030a67b921005000', NULL, FALSE, TRUE, TRUE, TRUE, '2023-08-28 22:31:26.596', NULL, NULL, NULL, NULL, NULL, 0, '{"profile.display_name": "Admin"}', 'Admin', NULL, NULL, NULL, NULL);
+INSERT INTO "users" VALUES ('030a67b921005000', '030a67b921005000', NULL, FALSE, TRUE, TRUE, TRUE, '2023-08-28 22:31:26.596', NULL, NULL, NULL, NULL, NULL, NULL, 0, '{"profile.display_name": "Admin"}', 'Admin', NULL, NULL, NULL, NULL);
 
 
 -- clients definition
@@ -69,17 +73,20 @@ CREATE TABLE "clients" (
     "updated_at" TIMESTAMP(6) DEFAULT NULL,
     "deleted_at" TIMESTAMP(6) DEFAULT NULL,
     "expires_at" TIMESTAMP(6) DEFAULT NULL,
+    "flags" BIGINT NOT NULL DEFAULT 0,
     "secret_key" VARCHAR(32) NOT NULL,
     "secret_code" VARCHAR(64) DEFAULT NULL,
     "description" VARCHAR(255) DEFAULT NULL,
-    CONSTRAINT "pk_clients" PRIMARY KEY ("id")
+    "realm_id" VARCHAR(16) DEFAULT NULL,
+    CONSTRAINT "pk_clients" PRIMARY KEY ("id"),
+    CONSTRAINT "fk_clients_realms_realm_id" FOREIGN KEY ("realm_id") REFERENCES "realms" ("id") ON DELETE RESTRICT ON UPDATE RESTRICT
 );
 
 CREATE UNIQUE INDEX "ix_clients_secret_key" ON "clients" ("secret_key");
 
 -- clients data
 
-INSERT INTO "clients" VALUES ('030a67b921005000', FALSE, TRUE, '2023-08-28 22:31:26.596', NULL, NULL, NULL, '030a67b921005000', NULL, NULL);
+INSERT INTO "clients" VALUES ('030a67b921005000', FALSE, TRUE, '2023-08-28 22:31:26.596', NULL, NULL, NULL, 0, '030a67b921005000', NULL, NULL, NULL);
 
 
 -- client_users definition
@@ -118,6 +125,7 @@ CREATE UNIQUE INDEX "ix_roles_realm_id_name" ON "roles" ("realm_id", "name");
 -- roles data
 
 INSERT INTO "roles" VALUES ('030a67b921005000', '030a67b921005000', FALSE, TRUE, '2023-08-28 22:31:26.596', NULL, NULL, 'ADMIN', NULL);
+INSERT INTO "roles" VALUES ('030a67b921005001', '030a67b921005000', FALSE, TRUE, '2023-08-28 22:31:26.596', NULL, NULL, 'IMPERSONATOR', 'Built-in role allowed to impersonate users.');
 
 
 -- role_users definition
@@ -139,30 +147,77 @@ CREATE TABLE "role_users" (
 INSERT INTO "role_users" VALUES ('030a67b921005000', '030a67b921005000', TRUE, '2023-08-28 22:31:26.596', NULL, NULL);
 
 
+-- groups definition
+
+CREATE TABLE "groups" (
+    "id" VARCHAR(16) NOT NULL,
+    "realm_id" VARCHAR(16) NOT NULL,
+    "parent_id" VARCHAR(16) DEFAULT NULL,
+    "created_at" TIMESTAMP(6) NOT NULL,
+    "updated_at" TIMESTAMP(6) DEFAULT NULL,
+    "name" VARCHAR(64) NOT NULL,
+    "description" VARCHAR(255) DEFAULT NULL,
+    CONSTRAINT "pk_groups" PRIMARY KEY ("id"),
+    CONSTRAINT "fk_groups_realms_realm_id" FOREIGN KEY ("realm_id") REFERENCES "realms" ("id") ON DELETE RESTRICT ON UPDATE RESTRICT,
+    CONSTRAINT "fk_groups_groups_parent_id" FOREIGN KEY ("parent_id") REFERENCES "groups" ("id") ON DELETE RESTRICT ON UPDATE RESTRICT
+);
+
+CREATE UNIQUE INDEX "ix_groups_realm_id_name" ON "groups" ("realm_id", "name");
+CREATE INDEX "ix_groups_parent_id" ON "groups" ("parent_id");
+
+-- group_users definition
+
+CREATE TABLE "group_users" (
+    "group_id" VARCHAR(16) NOT NULL,
+    "user_id" VARCHAR(16) NOT NULL,
+    "created_at" TIMESTAMP(6) NOT NULL,
+    CONSTRAINT "pk_group_users" PRIMARY KEY ("group_id", "user_id"),
+    CONSTRAINT "fk_group_users_groups_group_id" FOREIGN KEY ("group_id") REFERENCES "groups" ("id") ON DELETE CASCADE ON UPDATE RESTRICT,
+    CONSTRAINT "fk_group_users_users_user_id" FOREIGN KEY ("user_id") REFERENCES "users" ("id") ON DELETE CASCADE ON UPDATE RESTRICT
+);
+
+CREATE INDEX "ix_group_users_user_id" ON "group_users" ("user_id");
+
+-- group_roles definition
+
+CREATE TABLE "group_roles" (
+    "group_id" VARCHAR(16) NOT NULL,
+    "role_id" VARCHAR(16) NOT NULL,
+    "created_at" TIMESTAMP(6) NOT NULL,
+    CONSTRAINT "pk_group_roles" PRIMARY KEY ("group_id", "role_id"),
+    CONSTRAINT "fk_group_roles_groups_group_id" FOREIGN KEY ("group_id") REFERENCES "groups" ("id") ON DELETE CASCADE ON UPDATE RESTRICT,
+    CONSTRAINT "fk_group_roles_roles_role_id" FOREIGN KEY ("role_id") REFERENCES "roles" ("id") ON DELETE CASCADE ON UPDATE RESTRICT
+);
+
+
 -- logins definition
 
 CREATE TABLE "logins" (
     "id" VARCHAR(16) NOT NULL,
     "user_id" VARCHAR(16) NOT NULL,
+    "realm_id" VARCHAR(16) NOT NULL,
     "disabled" BOOLEAN NOT NULL DEFAULT FALSE,
     "immutable" BOOLEAN NOT NULL DEFAULT FALSE,
     "created_at" TIMESTAMP(6) NOT NULL,
     "updated_at" TIMESTAMP(6) DEFAULT NULL,
     "deleted_at" TIMESTAMP(6) DEFAULT NULL,
     "expires_at" TIMESTAMP(6) DEFAULT NULL,
+    "last_used_at" TIMESTAMP(6) DEFAULT NULL,
     "provider" VARCHAR(16) NOT NULL,
     "identifier" VARCHAR(64) NOT NULL,
     "credential" VARCHAR(64) DEFAULT NULL,
     "metadata" jsonb DEFAULT NULL,
     CONSTRAINT "pk_logins" PRIMARY KEY ("id"),
-    CONSTRAINT "fk_logins_users_user_id" FOREIGN KEY ("user_id") REFERENCES "users" ("id") ON DELETE RESTRICT ON UPDATE RESTRICT
+    CONSTRAINT "fk_logins_users_user_id" FOREIGN KEY ("user_id") REFERENCES "users" ("id") ON DELETE RESTRICT ON UPDATE RESTRICT,
+    CONSTRAINT "fk_logins_realms_realm_id" FOREIGN KEY ("realm_id") REFERENCES "realms" ("id") ON DELETE RESTRICT ON UPDATE RESTRICT
 );
 
-CREATE UNIQUE INDEX "ix_logins_provider_identifier" ON "logins" ("provider", "identifier");
+CREATE UNIQUE INDEX "ix_logins_realm_id_provider_identifier" ON "logins" ("realm_id", "provider", "identifier");
+CREATE INDEX "ix_logins_user_id" ON "logins" ("user_id");
 
 -- logins data
 
-INSERT INTO "logins" VALUES ('030a67b921005000', '030a67b921005000', FALSE, FALSE, '2023-08-28 22:31:26.596', NULL, NULL, NULL, 'FORM_PASSWORD', 'admin', NULL, '{}');
+INSERT INTO "logins" VALUES ('030a67b921005000', '030a67b921005000', '030a67b921005000', FALSE, FALSE, '2023-08-28 22:31:26.596', NULL, NULL, NULL, NULL, 'FORM_PASSWORD', 'admin', NULL, '{}');
 
 
 -- devices definition
@@ -174,7 +229,7 @@ CREATE TABLE "devices" (
     "created_at" TIMESTAMP(6) NOT NULL,
     "updated_at" TIMESTAMP(6) DEFAULT NULL,
     "trace_code" VARCHAR(64) NOT NULL,
-    "push_token" VARCHAR(64) DEFAULT NULL,
+    "push_token" VARCHAR(255) DEFAULT NULL,
     "metadata" jsonb DEFAULT NULL,
     CONSTRAINT "pk_devices" PRIMARY KEY ("id"),
     CONSTRAINT "fk_devices_users_user_id" FOREIGN KEY ("user_id") REFERENCES "users" ("id") ON DELETE RESTRICT ON UPDATE RESTRICT,
@@ -196,3 +251,105 @@ CREATE TABLE "user_devices" (
     CONSTRAINT "fk_user_devices_users_user_id" FOREIGN KEY ("user_id") REFERENCES "users" ("id") ON DELETE RESTRICT ON UPDATE RESTRICT,
     CONSTRAINT "fk_user_devices_devices_device_id" FOREIGN KEY ("device_id") REFERENCES "devices" ("id") ON DELETE RESTRICT ON UPDATE RESTRICT
 );
+
+
+-- invitations definition
+
+CREATE TABLE "invitations" (
+    "id" VARCHAR(16) NOT NULL,
+    "realm_id" VARCHAR(16) NOT NULL,
+    "creator_id" VARCHAR(16) NOT NULL,
+    "disabled" BOOLEAN NOT NULL DEFAULT FALSE,
+    "created_at" TIMESTAMP(6) NOT NULL,
+    "updated_at" TIMESTAMP(6) DEFAULT NULL,
+    "deleted_at" TIMESTAMP(6) DEFAULT NULL,
+    "expires_at" TIMESTAMP(6) DEFAULT NULL,
+    "code" VARCHAR(32) NOT NULL,
+    "max_uses" INTEGER NOT NULL DEFAULT 1,
+    "used_count" INTEGER NOT NULL DEFAULT 0,
+    "email_address" VARCHAR(128) DEFAULT NULL,
+    "role_ids" jsonb DEFAULT NULL,
+    "description" VARCHAR(255) DEFAULT NULL,
+    CONSTRAINT "pk_invitations" PRIMARY KEY ("id"),
+    CONSTRAINT "fk_invitations_realms_realm_id" FOREIGN KEY ("realm_id") REFERENCES "realms" ("id") ON DELETE RESTRICT ON UPDATE RESTRICT,
+    CONSTRAINT "fk_invitations_users_creator_id" FOREIGN KEY ("creator_id") REFERENCES "users" ("id") ON DELETE RESTRICT ON UPDATE RESTRICT
+);
+
+CREATE UNIQUE INDEX "ix_invitations_code" ON "invitations" ("code");
+CREATE INDEX "ix_invitations_creator_id" ON "invitations" ("creator_id");
+
+-- attribute_schemas definition
+
+CREATE TABLE "attribute_schemas" (
+    "id" VARCHAR(16) NOT NULL,
+    "realm_id" VARCHAR(16) NOT NULL,
+    "created_at" TIMESTAMP(6) NOT NULL,
+    "updated_at" TIMESTAMP(6) DEFAULT NULL,
+    "key" VARCHAR(64) NOT NULL,
+    "type" VARCHAR(16) NOT NULL DEFAULT 'string',
+    "required" BOOLEAN NOT NULL DEFAULT FALSE,
+    "pattern" VARCHAR(255) DEFAULT NULL,
+    "enum" jsonb DEFAULT NULL,
+    "max_length" INTEGER NOT NULL DEFAULT 0,
+    "writer" VARCHAR(16) NOT NULL DEFAULT 'user',
+    "ordinal" INTEGER NOT NULL DEFAULT 0,
+    "description" VARCHAR(255) DEFAULT NULL,
+    CONSTRAINT "pk_attribute_schemas" PRIMARY KEY ("id"),
+    CONSTRAINT "fk_attribute_schemas_realms_realm_id" FOREIGN KEY ("realm_id") REFERENCES "realms" ("id") ON DELETE CASCADE ON UPDATE RESTRICT
+);
+
+CREATE UNIQUE INDEX "ix_attribute_schemas_realm_id_key" ON "attribute_schemas" ("realm_id", "key");
+
+-- login_events definition
+
+CREATE TABLE "login_events" (
+    "id" VARCHAR(16) NOT NULL,
+    "created_at" TIMESTAMP(6) NOT NULL,
+    "realm" VARCHAR(64) NOT NULL,
+    "provider" VARCHAR(16) NOT NULL,
+    "identifier" VARCHAR(64) NOT NULL,
+    "user_id" VARCHAR(16) DEFAULT NULL,
+    "client_id" VARCHAR(16) DEFAULT NULL,
+    "ip_address" VARCHAR(64) DEFAULT NULL,
+    "user_agent" VARCHAR(255) DEFAULT NULL,
+    "outcome" VARCHAR(16) NOT NULL,
+    "failure_reason" VARCHAR(255) DEFAULT NULL,
+    CONSTRAINT "pk_login_events" PRIMARY KEY ("id")
+);
+
+CREATE INDEX "ix_login_events_created_at" ON "login_events" ("created_at");
+CREATE INDEX "ix_login_events_user_id_created_at" ON "login_events" ("user_id", "created_at");
+
+-- audit_logs definition
+
+CREATE TABLE "audit_logs" (
+    "id" VARCHAR(16) NOT NULL,
+    "created_at" TIMESTAMP(6) NOT NULL,
+    "schema" VARCHAR(16) DEFAULT NULL,
+    "realm" VARCHAR(64) DEFAULT NULL,
+    "client_id" VARCHAR(16) DEFAULT NULL,
+    "subject" VARCHAR(16) DEFAULT NULL,
+    "actor_id" VARCHAR(16) DEFAULT NULL,
+    "method" VARCHAR(255) NOT NULL,
+    "request" jsonb DEFAULT NULL,
+    "code" VARCHAR(32) NOT NULL,
+    "message" VARCHAR(255) DEFAULT NULL,
+    "latency_ms" BIGINT NOT NULL DEFAULT 0,
+    "ip_address" VARCHAR(64) DEFAULT NULL,
+    CONSTRAINT "pk_audit_logs" PRIMARY KEY ("id")
+);
+
+CREATE INDEX "ix_audit_logs_created_at" ON "audit_logs" ("created_at");
+CREATE INDEX "ix_audit_logs_subject_created_at" ON "audit_logs" ("subject", "created_at");
+CREATE INDEX "ix_audit_logs_method_created_at" ON "audit_logs" ("method", "created_at");
+
+-- audit_logs are append only
+
+CREATE FUNCTION "fn_audit_logs_immutable"() RETURNS TRIGGER AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_logs are append only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER "tr_audit_logs_immutable" BEFORE UPDATE OR DELETE ON "audit_logs"
+    FOR EACH ROW EXECUTE FUNCTION "fn_audit_logs_immutable"();
@@ -0,0 +1,85 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/choral-io/gommerce-server-core/data"
+	"github.com/uptrace/bun"
+)
+
+const (
+	ATTRIBUTE_TYPE_STRING  = "string"
+	ATTRIBUTE_TYPE_INTEGER = "integer"
+	ATTRIBUTE_TYPE_NUMBER  = "number"
+	ATTRIBUTE_TYPE_BOOLEAN = "boolean"
+	ATTRIBUTE_TYPE_DATE    = "date"
+
+	ATTRIBUTE_WRITER_USER   = "user"
+	ATTRIBUTE_WRITER_ADMIN  = "admin"
+	ATTRIBUTE_WRITER_SYSTEM = "system"
+
+	ATTRIBUTE_SCHEMA_UNIQUE_INDEX = "ix_attribute_schemas_realm_id_key"
+)
+
+var attributeWriterLevels = map[string]int{
+	ATTRIBUTE_WRITER_USER:   1,
+	ATTRIBUTE_WRITER_ADMIN:  2,
+	ATTRIBUTE_WRITER_SYSTEM: 3,
+}
+
+// ValidAttributeType reports whether t is one of the supported attribute types.
+func ValidAttributeType(t string) bool {
+	switch t {
+	case ATTRIBUTE_TYPE_STRING, ATTRIBUTE_TYPE_INTEGER, ATTRIBUTE_TYPE_NUMBER, ATTRIBUTE_TYPE_BOOLEAN, ATTRIBUTE_TYPE_DATE:
+		return true
+	}
+	return false
+}
+
+// ValidAttributeWriter reports whether w is one of the supported attribute writers.
+func ValidAttributeWriter(w string) bool {
+	_, ok := attributeWriterLevels[w]
+	return ok
+}
+
+type AttributeSchema struct {
+	bun.BaseModel `bun:"table:attribute_schemas,alias:attribute_schema"`
+
+	// Columns
+	Id          string         `json:"id" bun:"id,pk"`
+	RealmId     string         `json:"realm_id" bun:"realm_id"`
+	CreatedAt   time.Time      `json:"created_at" bun:"created_at"`
+	UpdatedAt   sql.NullTime   `json:"updated_at" bun:"updated_at"`
+	Key         string         `json:"key" bun:"key"`
+	Type        string         `json:"type" bun:"type"`
+	Required    bool           `json:"required" bun:"required"`
+	Pattern     sql.NullString `json:"pattern" bun:"pattern"`
+	Enum        []string       `json:"enum" bun:"enum,type:jsonb"`
+	MaxLength   int32          `json:"max_length" bun:"max_length"`
+	Writer      string         `json:"writer" bun:"writer"`
+	Ordinal     int32          `json:"ordinal" bun:"ordinal"`
+	Description sql.NullString `json:"description" bun:"description"`
+
+	// Relations
+	Realm *Realm `bun:"rel:belongs-to,join:realm_id=id"`
+}
+
+func (m *AttributeSchema) BeforeAppendModel(ctx context.Context, query bun.Query) error {
+	switch query.(type) {
+	case *bun.InsertQuery:
+		m.Id = data.DefaultIdWorker().NextHex()
+		m.CreatedAt = time.Now()
+		m.UpdatedAt = sql.NullTime{Valid: false}
+	case *bun.UpdateQuery:
+		m.UpdatedAt = sql.NullTime{Valid: true, Time: time.Now()}
+	}
+	return nil
+}
+
+// WritableBy reports whether the attribute can be written by the given writer,
+// a writer may write attributes of its own level and all levels below it.
+func (m *AttributeSchema) WritableBy(writer string) bool {
+	return attributeWriterLevels[writer] >= attributeWriterLevels[m.Writer]
+}
@@ -0,0 +1,44 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/choral-io/gommerce-server-core/data"
+	"github.com/uptrace/bun"
+)
+
+// AuditLog records a call of a mutating rpc, an impersonation or a call made while impersonating, rows are never updated or deleted.
+type AuditLog struct {
+	bun.BaseModel `bun:"table:audit_logs,alias:audit_log"`
+
+	// Columns
+	Id        string          `json:"id" bun:"id,pk"`
+	CreatedAt time.Time       `json:"created_at" bun:"created_at"`
+	Schema    sql.NullString  `json:"schema" bun:"schema"`
+	Realm     sql.NullString  `json:"realm" bun:"realm"`
+	ClientId  sql.NullString  `json:"client_id" bun:"client_id"`
+	Subject   sql.NullString  `json:"subject" bun:"subject"`
+	ActorId   sql.NullString  `json:"actor_id" bun:"actor_id"`
+	Method    string          `json:"method" bun:"method"`
+	Request   json.RawMessage `json:"request" bun:"request,type:jsonb"`
+	Code      string          `json:"code" bun:"code"`
+	Message   sql.NullString  `json:"message" bun:"message"`
+	LatencyMs int64           `json:"latency_ms" bun:"latency_ms"`
+	IpAddress sql.NullString  `json:"ip_address" bun:"ip_address"`
+}
+
+func (m *AuditLog) BeforeAppendModel(ctx context.Context, query bun.Query) error {
+	switch query.(type) {
+	case *bun.InsertQuery:
+		if m.Id == "" {
+			m.Id = data.DefaultIdWorker().NextHex()
+		}
+		if m.CreatedAt.IsZero() {
+			m.CreatedAt = time.Now()
+		}
+	}
+	return nil
+}
@@ -9,6 +9,11 @@ import (
 	"github.com/uptrace/bun"
 )
 
+const (
+	CLIENT_FLAGS_TRUSTED      int64 = 1 << 0
+	CLIENT_FLAGS_PROVISIONING int64 = 1 << 1
+)
+
 type Client struct {
 	bun.BaseModel `bun:"table:clients,alias:client"`
 
@@ -20,9 +25,14 @@ type Client struct {
 	UpdatedAt   sql.NullTime   `json:"updated_at" bun:"updated_at"`
 	DeletedAt   sql.NullTime   `json:"deleted_at" bun:"deleted_at,soft_delete,nullzero"`
 	ExpiresAt   sql.NullTime   `json:"expires_at" bun:"expires_at"`
+	Flags       int64          `json:"flags" bun:"flags"`
 	SecretKey   string         `json:"secret_key" bun:"secret_key"`
 	SecretCode  sql.NullString `json:"_" bun:"secret_code"`
 	Description sql.NullString `json:"description" bun:"description"`
+	RealmId     sql.NullString `json:"realm_id" bun:"realm_id"`
+
+	// Relations
+	Realm *Realm `bun:"rel:belongs-to,join:realm_id=id"`
 }
 
 func (m *Client) BeforeAppendModel(ctx context.Context, query bun.Query) error {
@@ -38,3 +48,13 @@ func (m *Client) BeforeAppendModel(ctx context.Context, query bun.Query) error {
 	}
 	return nil
 }
+
+// Trusted reports whether the client is a trusted server client, which may act on behalf of any user.
+func (m *Client) Trusted() bool {
+	return m.Flags&CLIENT_FLAGS_TRUSTED != 0
+}
+
+// Provisioning reports whether the client provisions the users and roles of its realm, e.g. through scim.
+func (m *Client) Provisioning() bool {
+	return m.Flags&CLIENT_FLAGS_PROVISIONING != 0 && m.RealmId.Valid
+}
@@ -0,0 +1,43 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/choral-io/gommerce-server-core/data"
+	"github.com/uptrace/bun"
+)
+
+const (
+	GROUP_UNIQUE_INDEX = "ix_groups_realm_id_name"
+)
+
+type Group struct {
+	bun.BaseModel `bun:"table:groups,alias:group"`
+
+	// Columns
+	Id          string         `json:"id" bun:"id,pk"`
+	RealmId     string         `json:"realm_id" bun:"realm_id"`
+	ParentId    sql.NullString `json:"parent_id" bun:"parent_id"`
+	CreatedAt   time.Time      `json:"created_at" bun:"created_at"`
+	UpdatedAt   sql.NullTime   `json:"updated_at" bun:"updated_at"`
+	Name        string         `json:"name" bun:"name"`
+	Description sql.NullString `json:"description" bun:"description"`
+
+	// Relations
+	Realm  *Realm `bun:"rel:belongs-to,join:realm_id=id"`
+	Parent *Group `bun:"rel:belongs-to,join:parent_id=id"`
+}
+
+func (m *Group) BeforeAppendModel(ctx context.Context, query bun.Query) error {
+	switch query.(type) {
+	case *bun.InsertQuery:
+		m.Id = data.DefaultIdWorker().NextHex()
+		m.CreatedAt = time.Now()
+		m.UpdatedAt = sql.NullTime{Valid: false}
+	case *bun.UpdateQuery:
+		m.UpdatedAt = sql.NullTime{Valid: true, Time: time.Now()}
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"github.com/uptrace/bun"
+)
+
+type GroupRole struct {
+	bun.BaseModel `bun:"table:group_roles,alias:group_role"`
+
+	// Columns
+	GroupId   string    `json:"group_id" bun:"group_id,pk"`
+	RoleId    string    `json:"role_id" bun:"role_id,pk"`
+	CreatedAt time.Time `json:"created_at" bun:"created_at"`
+
+	// Relations
+	Group *Group `bun:"rel:belongs-to,join:group_id=id"`
+	Role  *Role  `bun:"rel:belongs-to,join:role_id=id"`
+}
+
+func (m *GroupRole) BeforeAppendModel(ctx context.Context, query bun.Query) error {
+	switch query.(type) {
+	case *bun.InsertQuery:
+		m.CreatedAt = time.Now()
+	}
+	return nil
+}
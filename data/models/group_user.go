@@ -0,0 +1,29 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"github.com/uptrace/bun"
+)
+
+type GroupUser struct {
+	bun.BaseModel `bun:"table:group_users,alias:group_user"`
+
+	// Columns
+	GroupId   string    `json:"group_id" bun:"group_id,pk"`
+	UserId    string    `json:"user_id" bun:"user_id,pk"`
+	CreatedAt time.Time `json:"created_at" bun:"created_at"`
+
+	// Relations
+	Group *Group `bun:"rel:belongs-to,join:group_id=id"`
+	User  *User  `bun:"rel:belongs-to,join:user_id=id"`
+}
+
+func (m *GroupUser) BeforeAppendModel(ctx context.Context, query bun.Query) error {
+	switch query.(type) {
+	case *bun.InsertQuery:
+		m.CreatedAt = time.Now()
+	}
+	return nil
+}
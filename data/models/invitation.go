@@ -0,0 +1,55 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/choral-io/gommerce-server-core/data"
+	"github.com/uptrace/bun"
+)
+
+type Invitation struct {
+	bun.BaseModel `bun:"table:invitations,alias:invitation"`
+
+	// Columns
+	Id           string         `json:"id" bun:"id,pk"`
+	RealmId      string         `json:"realm_id" bun:"realm_id"`
+	CreatorId    string         `json:"creator_id" bun:"creator_id"`
+	Disabled     bool           `json:"disabled" bun:"disabled"`
+	CreatedAt    time.Time      `json:"created_at" bun:"created_at"`
+	UpdatedAt    sql.NullTime   `json:"updated_at" bun:"updated_at"`
+	DeletedAt    sql.NullTime   `json:"deleted_at" bun:"deleted_at,soft_delete,nullzero"`
+	ExpiresAt    sql.NullTime   `json:"expires_at" bun:"expires_at"`
+	Code         string         `json:"code" bun:"code"`
+	MaxUses      int32          `json:"max_uses" bun:"max_uses"`
+	UsedCount    int32          `json:"used_count" bun:"used_count"`
+	EmailAddress sql.NullString `json:"-" bun:"email_address"`
+	RoleIds      []string       `json:"role_ids" bun:"role_ids,type:jsonb"`
+	Description  sql.NullString `json:"description" bun:"description"`
+
+	// Relations
+	Realm   *Realm `bun:"rel:belongs-to,join:realm_id=id"`
+	Creator *User  `bun:"rel:belongs-to,join:creator_id=id"`
+}
+
+func (m *Invitation) BeforeAppendModel(ctx context.Context, query bun.Query) error {
+	switch query.(type) {
+	case *bun.InsertQuery:
+		m.Id = data.DefaultIdWorker().NextHex()
+		m.CreatedAt = time.Now()
+		m.UpdatedAt = sql.NullTime{Valid: false}
+		m.DeletedAt = sql.NullTime{Valid: false}
+	case *bun.UpdateQuery:
+		m.UpdatedAt = sql.NullTime{Valid: true, Time: time.Now()}
+	}
+	return nil
+}
+
+// Usable reports whether the invitation can still be used to register at the given time.
+func (m *Invitation) Usable(now time.Time) bool {
+	if m.Disabled || m.UsedCount >= m.MaxUses {
+		return false
+	}
+	return !m.ExpiresAt.Valid || m.ExpiresAt.Time.After(now)
+}
@@ -12,6 +12,9 @@ import (
 const (
 	LOGIN_PROVIDER_FORM_PASSWORD = "FORM_PASSWORD"
 	LOGIN_PROVIDER_SMS_OTP_CODE  = "SMS_OTP_CODE"
+	LOGIN_PROVIDER_LDAP          = "LDAP"
+
+	LOGIN_UNIQUE_INDEX = "ix_logins_realm_id_provider_identifier"
 )
 
 type Login struct {
@@ -20,19 +23,22 @@ type Login struct {
 	// Columns
 	Id         string            `json:"id" bun:"id,pk"`
 	UserId     string            `json:"user_id" bun:"user_id"`
+	RealmId    string            `json:"realm_id" bun:"realm_id"`
 	Disabled   bool              `json:"disabled" bun:"disabled"`
 	Immutable  bool              `json:"immutable" bun:"immutable"`
 	CreatedAt  time.Time         `json:"created_at" bun:"created_at"`
 	UpdatedAt  sql.NullTime      `json:"updated_at" bun:"updated_at"`
 	DeletedAt  sql.NullTime      `json:"deleted_at" bun:"deleted_at,soft_delete,nullzero"`
 	ExpiresAt  sql.NullTime      `json:"expires_at" bun:"expires_at"`
+	LastUsedAt sql.NullTime      `json:"last_used_at" bun:"last_used_at"`
 	Provider   string            `json:"provider" bun:"provider"`
 	Identifier string            `json:"identifier" bun:"identifier"`
 	Credential sql.NullString    `json:"-" bun:"credential"`
 	Metadata   map[string]string `json:"metadata" bun:"metadata,json_use_number"`
 
 	// Relations
-	User *User `bun:"rel:belongs-to,join:user_id=id"`
+	User  *User  `bun:"rel:belongs-to,join:user_id=id"`
+	Realm *Realm `bun:"rel:belongs-to,join:realm_id=id"`
 }
 
 func (m *Login) BeforeAppendModel(ctx context.Context, query bun.Query) error {
@@ -48,3 +54,8 @@ func (m *Login) BeforeAppendModel(ctx context.Context, query bun.Query) error {
 	}
 	return nil
 }
+
+// Usable reports whether the login is enabled and not expired at the given time.
+func (m *Login) Usable(now time.Time) bool {
+	return !m.Disabled && (!m.ExpiresAt.Valid || m.ExpiresAt.Time.After(now))
+}
@@ -0,0 +1,47 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/choral-io/gommerce-server-core/data"
+	"github.com/uptrace/bun"
+)
+
+const (
+	LOGIN_EVENT_OUTCOME_SUCCESS = "success"
+	LOGIN_EVENT_OUTCOME_FAILURE = "failure"
+)
+
+// LoginEvent records a single attempt to create a token, the realm is kept by name so that
+// attempts against unknown realms can be recorded as well.
+type LoginEvent struct {
+	bun.BaseModel `bun:"table:login_events,alias:login_event"`
+
+	// Columns
+	Id            string         `json:"id" bun:"id,pk"`
+	CreatedAt     time.Time      `json:"created_at" bun:"created_at"`
+	Realm         string         `json:"realm" bun:"realm"`
+	Provider      string         `json:"provider" bun:"provider"`
+	Identifier    string         `json:"identifier" bun:"identifier"`
+	UserId        sql.NullString `json:"user_id" bun:"user_id"`
+	ClientId      sql.NullString `json:"client_id" bun:"client_id"`
+	IpAddress     sql.NullString `json:"ip_address" bun:"ip_address"`
+	UserAgent     sql.NullString `json:"user_agent" bun:"user_agent"`
+	Outcome       string         `json:"outcome" bun:"outcome"`
+	FailureReason sql.NullString `json:"failure_reason" bun:"failure_reason"`
+}
+
+func (m *LoginEvent) BeforeAppendModel(ctx context.Context, query bun.Query) error {
+	switch query.(type) {
+	case *bun.InsertQuery:
+		if m.Id == "" {
+			m.Id = data.DefaultIdWorker().NextHex()
+		}
+		if m.CreatedAt.IsZero() {
+			m.CreatedAt = time.Now()
+		}
+	}
+	return nil
+}
@@ -8,6 +8,12 @@ import (
 	"github.com/uptrace/bun"
 )
 
+const (
+	USER_ATTRIBUTE_PROFILE_DISPLAY_NAME = "profile.display_name"
+	USER_ATTRIBUTE_PROFILE_AVATAR_URL   = "profile.avatar_url"
+	USER_ATTRIBUTE_PROFILE_GENDER       = "profile.gender"
+)
+
 type Profile struct {
 	bun.BaseModel `bun:"table:profiles,alias:profile"`
 
@@ -35,3 +41,18 @@ func (m *Profile) BeforeAppendModel(ctx context.Context, query bun.Query) error
 	}
 	return nil
 }
+
+// ApplyAttributes copies the denormalized profile fields into the given user attributes.
+func (m *Profile) ApplyAttributes(attrs map[string]string) {
+	for k, v := range map[string]sql.NullString{
+		USER_ATTRIBUTE_PROFILE_DISPLAY_NAME: m.DisplayName,
+		USER_ATTRIBUTE_PROFILE_AVATAR_URL:   m.AvatarUrl,
+		USER_ATTRIBUTE_PROFILE_GENDER:       m.Gender,
+	} {
+		if v.Valid {
+			attrs[k] = v.String
+		} else {
+			delete(attrs, k)
+		}
+	}
+}
@@ -10,7 +10,10 @@ import (
 )
 
 const (
-	REALM_FLAGS_ALLOW_REGISTRATION int64 = 1 << 0
+	REALM_FLAGS_ALLOW_REGISTRATION   int64 = 1 << 0
+	REALM_FLAGS_REQUIRE_VERIFICATION int64 = 1 << 1
+	REALM_FLAGS_REQUIRE_APPROVAL     int64 = 1 << 2
+	REALM_FLAGS_REQUIRE_INVITATION   int64 = 1 << 3
 )
 
 type Realm struct {
@@ -48,3 +51,17 @@ func (m *Realm) BeforeAppendModel(ctx context.Context, query bun.Query) error {
 func (m *Realm) AllowRegistration() bool {
 	return m.Flags&REALM_FLAGS_ALLOW_REGISTRATION != 0
 }
+
+func (m *Realm) RequireVerification() bool {
+	return m.Flags&REALM_FLAGS_REQUIRE_VERIFICATION != 0
+}
+
+func (m *Realm) RequireApproval() bool {
+	return m.Flags&REALM_FLAGS_REQUIRE_APPROVAL != 0
+}
+
+// RequireInvitation restricts registration to invited users, it enables registration by itself whether or not
+// registration is allowed to everyone.
+func (m *Realm) RequireInvitation() bool {
+	return m.Flags&REALM_FLAGS_REQUIRE_INVITATION != 0
+}
@@ -9,6 +9,10 @@ import (
 	"github.com/uptrace/bun"
 )
 
+const (
+	ROLE_UNIQUE_INDEX = "ix_roles_realm_id_name"
+)
+
 type Role struct {
 	bun.BaseModel `bun:"table:roles,alias:role"`
 
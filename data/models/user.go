@@ -9,6 +9,15 @@ import (
 	"github.com/uptrace/bun"
 )
 
+const (
+	USER_FLAGS_EMAIL_ADDRESS_VERIFIED int64 = 1 << 0
+	USER_FLAGS_PHONE_NUMBER_VERIFIED  int64 = 1 << 1
+
+	USER_ATTRIBUTE_APPROVED_REASON  = "approval.approved_reason"
+	USER_ATTRIBUTE_REJECTED_REASON  = "approval.rejected_reason"
+	USER_ATTRIBUTE_SCIM_EXTERNAL_ID = "scim.external_id"
+)
+
 type User struct {
 	bun.BaseModel `bun:"table:users,alias:user"`
 
@@ -26,6 +35,7 @@ type User struct {
 	ExpiresAt      sql.NullTime      `json:"expires_at" bun:"expires_at"`
 	FirstLoginTime sql.NullTime      `json:"first_login_time" bun:"first_login_time"`
 	LastActiveTime sql.NullTime      `json:"last_active_time" bun:"last_active_time"`
+	EraseAt        sql.NullTime      `json:"erase_at" bun:"erase_at"`
 	Flags          int64             `json:"flags" bun:"flags"`
 	Attributes     map[string]string `json:"attributes" bun:"attributes,json_use_number"`
 	PhoneNumber    sql.NullString    `json:"-" bun:"phone_number"`
@@ -51,3 +61,11 @@ func (m *User) BeforeAppendModel(ctx context.Context, query bun.Query) error {
 	}
 	return nil
 }
+
+func (m *User) EmailAddressVerified() bool {
+	return m.EmailAddress.Valid && m.Flags&USER_FLAGS_EMAIL_ADDRESS_VERIFIED != 0
+}
+
+func (m *User) PhoneNumberVerified() bool {
+	return m.PhoneNumber.Valid && m.Flags&USER_FLAGS_PHONE_NUMBER_VERIFIED != 0
+}
@@ -0,0 +1,232 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/choral-io/gommerce-server-aio/data/models"
+	"github.com/choral-io/gommerce-server-core/logging"
+	"github.com/choral-io/gommerce-server-core/secure"
+	"github.com/redis/rueidis"
+	"github.com/uptrace/bun"
+	"google.golang.org/grpc"
+)
+
+const (
+	ACTIVITY_INTERVAL_ENV         = "GOMMERCE_ACTIVITY_INTERVAL"
+	ACTIVITY_DEFAULT_INTERVAL     = 5 * time.Minute
+	ACTIVITY_PUSH_INTERVAL        = 10 * time.Second
+	ACTIVITY_PENDING_KEY          = "users:activity:pending"
+	ACTIVITY_FLUSH_BATCH_SIZE     = 500
+	ACTIVITY_FLUSH_TIMEOUT        = 30 * time.Second
+	ACTIVITY_PUSH_TIMEOUT         = 5 * time.Second
+	ACTIVITY_PENDING_KEY_LIFETIME = 24 * time.Hour
+)
+
+// ActivityTracker records the activity of bearer identities in memory, pushes it into redis in the background
+// and flushes it from there into the last active time of users.
+// Activities are debounced per user, so the database is written at most once per interval for each user.
+type ActivityTracker struct {
+	bdb      bun.IDB
+	rdb      rueidis.Client
+	logger   logging.Logger
+	interval time.Duration
+
+	recorded sync.Map // user id -> time.Time of the last recorded activity
+	pending  sync.Map // user id -> unix milliseconds not pushed into redis yet
+
+	stop chan struct{}
+	done sync.WaitGroup
+}
+
+func NewActivityTracker(bdb bun.IDB, rdb rueidis.Client, logger logging.Logger) *ActivityTracker {
+	interval := ACTIVITY_DEFAULT_INTERVAL
+	if v, err := time.ParseDuration(os.Getenv(ACTIVITY_INTERVAL_ENV)); err == nil && v > 0 {
+		interval = v
+	}
+	return &ActivityTracker{
+		bdb:      bdb,
+		rdb:      rdb,
+		logger:   logger,
+		interval: interval,
+		stop:     make(chan struct{}),
+	}
+}
+
+// Record marks the user as active now, unless the user has already been recorded within the interval.
+// It never does any io, the activity is pushed into redis by the background loop.
+func (t *ActivityTracker) Record(userId string, now time.Time) {
+	if v, ok := t.recorded.Load(userId); ok && now.Sub(v.(time.Time)) < t.interval {
+		return
+	}
+	t.recorded.Store(userId, now)
+	t.pending.Store(userId, now.UnixMilli())
+}
+
+// Push moves the activities recorded in memory into the pending set in redis with a single pipeline.
+// Activities which could not be pushed are kept in memory for the next push.
+func (t *ActivityTracker) Push(ctx context.Context) (int, error) {
+	entries := map[string]int64{}
+	t.pending.Range(func(key, value any) bool {
+		if v, ok := t.pending.LoadAndDelete(key); ok {
+			entries[key.(string)] = v.(int64)
+		}
+		return true
+	})
+	// forget users whose debounce interval has passed, so the map does not grow with every user ever seen
+	now := time.Now()
+	t.recorded.Range(func(key, value any) bool {
+		if now.Sub(value.(time.Time)) >= t.interval {
+			t.recorded.CompareAndDelete(key, value)
+		}
+		return true
+	})
+	if len(entries) == 0 {
+		return 0, nil
+	}
+	cmd := t.rdb.B().Zadd().Key(ACTIVITY_PENDING_KEY).Gt().ScoreMember()
+	for userId, ms := range entries {
+		cmd = cmd.ScoreMember(float64(ms), userId)
+	}
+	cmds := rueidis.Commands{
+		cmd.Build(),
+		t.rdb.B().Expire().Key(ACTIVITY_PENDING_KEY).Seconds(int64(ACTIVITY_PENDING_KEY_LIFETIME.Seconds())).Build(),
+	}
+	for _, res := range t.rdb.DoMulti(ctx, cmds...) {
+		if err := res.Error(); err != nil {
+			for userId, ms := range entries {
+				// keep a newer activity recorded while pushing
+				if v, loaded := t.pending.LoadOrStore(userId, ms); loaded && v.(int64) < ms {
+					t.pending.Store(userId, ms)
+				}
+			}
+			return 0, err
+		}
+	}
+	return len(entries), nil
+}
+
+func (t *ActivityTracker) record(ctx context.Context) {
+	if secure.Authorize(ctx, secure.AuthFuncAuthenticated, secure.AuthFuncRequireSchema(secure.AUTH_SCHEMA_BEARER)) != nil {
+		return
+	}
+	// an admin acting as the user does not make the user active
+	if ActorFromContext(ctx) != "" {
+		return
+	}
+	t.Record(secure.IdentityFromContext(ctx).Token().Subject(), time.Now())
+}
+
+func (t *ActivityTracker) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		t.record(ctx)
+		return handler(ctx, req)
+	}
+}
+
+func (t *ActivityTracker) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		t.record(ss.Context())
+		return handler(srv, ss)
+	}
+}
+
+// Flush moves all pending activities into the database in batches.
+func (t *ActivityTracker) Flush(ctx context.Context) (int, error) {
+	var total int
+	for {
+		entries, err := t.rdb.Do(ctx, t.rdb.B().Zpopmin().Key(ACTIVITY_PENDING_KEY).Count(ACTIVITY_FLUSH_BATCH_SIZE).Build()).AsZScores()
+		if err != nil && err != rueidis.Nil {
+			return total, err
+		}
+		if len(entries) == 0 {
+			return total, nil
+		}
+		users := make([]models.User, len(entries))
+		for i, e := range entries {
+			users[i] = models.User{
+				Id:             e.Member,
+				LastActiveTime: sql.NullTime{Valid: true, Time: time.UnixMilli(int64(e.Score))},
+			}
+		}
+		if _, err := t.bdb.NewUpdate().
+			With("_data", t.bdb.NewValues(&users).Column("id", "last_active_time")).
+			Model((*models.User)(nil)).
+			TableExpr("_data").
+			Set(`"last_active_time" = GREATEST("user"."last_active_time", "_data"."last_active_time")`).
+			Where(`"user"."id" = "_data"."id"`).
+			Exec(ctx); err != nil {
+			// put the activities back, so they are retried by the next flush
+			cmd := t.rdb.B().Zadd().Key(ACTIVITY_PENDING_KEY).Gt().ScoreMember()
+			for _, e := range entries {
+				cmd = cmd.ScoreMember(e.Score, e.Member)
+			}
+			_ = t.rdb.Do(ctx, cmd.Build()).Error()
+			return total, err
+		}
+		total += len(entries)
+		if len(entries) < ACTIVITY_FLUSH_BATCH_SIZE {
+			return total, nil
+		}
+	}
+}
+
+func (t *ActivityTracker) Start(context.Context) error {
+	t.done.Add(1)
+	go func() {
+		defer t.done.Done()
+		pusher := time.NewTicker(min(ACTIVITY_PUSH_INTERVAL, t.interval))
+		defer pusher.Stop()
+		flusher := time.NewTicker(t.interval)
+		defer flusher.Stop()
+		for {
+			select {
+			case <-pusher.C:
+				t.push()
+			case <-flusher.C:
+				t.flush()
+			case <-t.stop:
+				t.push()
+				t.flush()
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (t *ActivityTracker) Stop(ctx context.Context) error {
+	close(t.stop)
+	waited := make(chan struct{})
+	go func() {
+		t.done.Wait()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (t *ActivityTracker) push() {
+	ctx, cancel := context.WithTimeout(context.Background(), ACTIVITY_PUSH_TIMEOUT)
+	defer cancel()
+	if _, err := t.Push(ctx); err != nil {
+		t.logger.Warn("failed to push user activities", "error", err)
+	}
+}
+
+func (t *ActivityTracker) flush() {
+	ctx, cancel := context.WithTimeout(context.Background(), ACTIVITY_FLUSH_TIMEOUT)
+	defer cancel()
+	if n, err := t.Flush(ctx); err != nil {
+		t.logger.Error("failed to flush user activities", "flushed", n, "error", err)
+	} else if n > 0 {
+		t.logger.Debug("flushed user activities", "flushed", n)
+	}
+}
@@ -0,0 +1,259 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/choral-io/gommerce-server-aio/data/models"
+	"github.com/choral-io/gommerce-server-core/logging"
+	"github.com/choral-io/gommerce-server-core/secure"
+	middleware "github.com/grpc-ecosystem/go-grpc-middleware/v2"
+	"github.com/uptrace/bun"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	AUDIT_REDACTED           = "[REDACTED]"
+	AUDIT_REALM_MAX_LENGTH   = 64
+	AUDIT_METHOD_MAX_LENGTH  = 255
+	AUDIT_MESSAGE_MAX_LENGTH = 255
+)
+
+// auditSensitiveFields are redacted from recorded requests, a field is sensitive if its name
+// equals or contains one of these words.
+var auditSensitiveFields = []string{"password", "credential", "secret", "token", "code"}
+
+// auditPersonalFields are redacted from recorded requests as well, audit logs can not be erased
+// so personal data and state values must never reach them. Only exact field names are matched.
+var auditPersonalFields = map[string]bool{
+	"email_address": true,
+	"phone_number":  true,
+	"display_name":  true,
+	"avatar_url":    true,
+	"gender":        true,
+	"birthdate":     true,
+	"introduction":  true,
+	"attributes":    true,
+	"data":          true,
+	"metadata":      true,
+}
+
+// auditCall carries the context of a call from the audit interceptor, which runs before the secure
+// interceptor so that denied calls are recorded too, to the identity interceptor behind it.
+type auditCall struct {
+	ctx context.Context
+}
+
+type auditCallKey struct{}
+
+// MutatingService is implemented by services which report the procedures that change state,
+// only calls of those procedures are recorded by the audit logger.
+type MutatingService interface {
+	Mutating(procedure string) bool
+}
+
+// AuditLogger records who called which mutating procedure with which request and result.
+type AuditLogger struct {
+	w *batchWriter[models.AuditLog]
+}
+
+func NewAuditLogger(bdb bun.IDB, logger logging.Logger) *AuditLogger {
+	return &AuditLogger{
+		w: newBatchWriter[models.AuditLog](bdb, logger, "audit_logs"),
+	}
+}
+
+func (a *AuditLogger) Start(ctx context.Context) error {
+	return a.w.Start(ctx)
+}
+
+func (a *AuditLogger) Stop(ctx context.Context) error {
+	return a.w.Stop(ctx)
+}
+
+func (a *AuditLogger) record(ctx context.Context, method string, req any, err error, latency time.Duration) {
+	entry := models.AuditLog{
+		CreatedAt: time.Now(),
+		Method:    truncate(method, AUDIT_METHOD_MAX_LENGTH),
+		Request:   redactRequest(req),
+		Code:      status.Code(err).String(),
+		LatencyMs: latency.Milliseconds(),
+	}
+	if err != nil {
+		entry.Message = nullString(truncate(status.Convert(err).Message(), AUDIT_MESSAGE_MAX_LENGTH))
+	}
+	if ip, _ := RequestOrigin(ctx); ip != "" {
+		entry.IpAddress = nullString(ip)
+	}
+	if secure.Authorize(ctx, secure.AuthFuncAuthenticated) == nil {
+		token := secure.IdentityFromContext(ctx).Token()
+		entry.Schema = nullString(identitySchema(ctx))
+		entry.Realm = nullString(truncate(token.Realm(), AUDIT_REALM_MAX_LENGTH))
+		entry.ClientId = nullString(token.Client())
+		entry.Subject = nullString(token.Subject())
+		entry.ActorId = nullString(ActorFromContext(ctx))
+	}
+	a.w.Write(entry)
+}
+
+// RecordRequest records a mutating http request which is not served through the grpc chain, like a scim
+// provisioning request, made with the credentials of the given client, which is nil if the request was denied. The request body is not recorded,
+// req describes the call instead and is redacted like grpc requests.
+func (a *AuditLogger) RecordRequest(r *http.Request, method string, client *models.Client, req any, err error, latency time.Duration) {
+	entry := models.AuditLog{
+		CreatedAt: time.Now(),
+		Method:    truncate(method, AUDIT_METHOD_MAX_LENGTH),
+		Request:   redactRequest(req),
+		Code:      status.Code(err).String(),
+		LatencyMs: latency.Milliseconds(),
+		IpAddress: nullString(httpRequestOrigin(r)),
+	}
+	if client != nil {
+		entry.Schema = nullString(secure.AUTH_SCHEMA_BASIC)
+		entry.ClientId = nullString(client.Id)
+		if client.Realm != nil {
+			entry.Realm = nullString(truncate(client.Realm.Name, AUDIT_REALM_MAX_LENGTH))
+		}
+	}
+	if err != nil {
+		entry.Message = nullString(truncate(status.Convert(err).Message(), AUDIT_MESSAGE_MAX_LENGTH))
+	}
+	a.w.Write(entry)
+}
+
+// httpRequestOrigin returns the ip address of the caller of an http request, like RequestOrigin does for grpc calls.
+func httpRequestOrigin(r *http.Request) string {
+	if v := r.Header.Get("X-Forwarded-For"); v != "" {
+		if ip := parseIP(strings.TrimSpace(strings.Split(v, ",")[0])); ip != "" {
+			return ip
+		}
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// UnaryServerInterceptor records mutating calls, it must be registered before the secure interceptor
+// together with IdentityUnaryServerInterceptor after it.
+func (a *AuditLogger) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if m, ok := info.Server.(MutatingService); !ok || !m.Mutating(info.FullMethod) {
+			return handler(ctx, req)
+		}
+		call := &auditCall{ctx: ctx}
+		start := time.Now()
+		res, err := handler(context.WithValue(ctx, auditCallKey{}, call), req)
+		a.record(call.ctx, info.FullMethod, req, err, time.Since(start))
+		return res, err
+	}
+}
+
+// StreamServerInterceptor records mutating stream calls, it must be registered before the secure interceptor
+// together with IdentityStreamServerInterceptor after it.
+func (a *AuditLogger) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if m, ok := srv.(MutatingService); !ok || !m.Mutating(info.FullMethod) {
+			return handler(srv, ss)
+		}
+		call := &auditCall{ctx: ss.Context()}
+		wrapped := middleware.WrapServerStream(ss)
+		wrapped.WrappedContext = context.WithValue(ss.Context(), auditCallKey{}, call)
+		start := time.Now()
+		err := handler(srv, wrapped)
+		// messages of a stream are not recorded, only the call itself
+		a.record(call.ctx, info.FullMethod, nil, err, time.Since(start))
+		return err
+	}
+}
+
+// IdentityUnaryServerInterceptor hands the authenticated context over to the audit interceptor.
+func (a *AuditLogger) IdentityUnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if call, ok := ctx.Value(auditCallKey{}).(*auditCall); ok {
+			call.ctx = ctx
+		}
+		return handler(ctx, req)
+	}
+}
+
+// IdentityStreamServerInterceptor hands the authenticated context over to the audit interceptor.
+func (a *AuditLogger) IdentityStreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if call, ok := ss.Context().Value(auditCallKey{}).(*auditCall); ok {
+			call.ctx = ss.Context()
+		}
+		return handler(srv, ss)
+	}
+}
+
+func identitySchema(ctx context.Context) string {
+	for _, schema := range []string{secure.AUTH_SCHEMA_BEARER, secure.AUTH_SCHEMA_BASIC} {
+		if secure.Authorize(ctx, secure.AuthFuncRequireSchema(schema)) == nil {
+			return schema
+		}
+	}
+	return ""
+}
+
+// redactRequest returns the json representation of a request with the values of sensitive fields replaced,
+// requests which are not protobuf messages are encoded as plain json.
+func redactRequest(req any) json.RawMessage {
+	var raw []byte
+	var err error
+	if msg, ok := req.(proto.Message); ok {
+		raw, err = protojson.MarshalOptions{UseProtoNames: true}.Marshal(msg)
+	} else if req != nil {
+		raw, err = json.Marshal(req)
+	}
+	if err != nil || raw == nil {
+		return nil
+	}
+	var v any
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return nil
+	}
+	redacted, err := json.Marshal(redactValue(v))
+	if err != nil {
+		return nil
+	}
+	return redacted
+}
+
+func redactValue(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, item := range v {
+			if isSensitiveField(k) {
+				v[k] = AUDIT_REDACTED
+			} else {
+				v[k] = redactValue(item)
+			}
+		}
+	case []any:
+		for i, item := range v {
+			v[i] = redactValue(item)
+		}
+	}
+	return v
+}
+
+func isSensitiveField(name string) bool {
+	name = strings.ToLower(name)
+	if auditPersonalFields[name] {
+		return true
+	}
+	for _, s := range auditSensitiveFields {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/choral-io/gommerce-server-core/logging"
+	"github.com/uptrace/bun"
+)
+
+const (
+	BATCH_WRITER_BUFFER_SIZE    = 1024
+	BATCH_WRITER_BATCH_SIZE     = 100
+	BATCH_WRITER_FLUSH_INTERVAL = time.Second
+	BATCH_WRITER_FLUSH_TIMEOUT  = 10 * time.Second
+)
+
+// batchWriter inserts rows into the database in the background, so that recording never slows down
+// a request. Rows are dropped with a warning when the buffer is full.
+type batchWriter[T any] struct {
+	bdb    bun.IDB
+	logger logging.Logger
+	name   string
+	rows   chan T
+
+	stop chan struct{}
+	done sync.WaitGroup
+}
+
+func newBatchWriter[T any](bdb bun.IDB, logger logging.Logger, name string) *batchWriter[T] {
+	return &batchWriter[T]{
+		bdb:    bdb,
+		logger: logger,
+		name:   name,
+		rows:   make(chan T, BATCH_WRITER_BUFFER_SIZE),
+		stop:   make(chan struct{}),
+	}
+}
+
+// Write queues a row, it reports false if the row has been dropped.
+func (w *batchWriter[T]) Write(row T) bool {
+	select {
+	case w.rows <- row:
+		return true
+	default:
+		w.logger.Warn("row dropped, buffer is full", "writer", w.name)
+		return false
+	}
+}
+
+func (w *batchWriter[T]) Start(context.Context) error {
+	w.done.Add(1)
+	go func() {
+		defer w.done.Done()
+		ticker := time.NewTicker(BATCH_WRITER_FLUSH_INTERVAL)
+		defer ticker.Stop()
+		batch := make([]T, 0, BATCH_WRITER_BATCH_SIZE)
+		for {
+			select {
+			case row := <-w.rows:
+				if batch = append(batch, row); len(batch) >= BATCH_WRITER_BATCH_SIZE {
+					batch = w.flush(batch)
+				}
+			case <-ticker.C:
+				batch = w.flush(batch)
+			case <-w.stop:
+				for len(w.rows) > 0 {
+					batch = append(batch, <-w.rows)
+				}
+				w.flush(batch)
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (w *batchWriter[T]) Stop(ctx context.Context) error {
+	close(w.stop)
+	waited := make(chan struct{})
+	go func() {
+		w.done.Wait()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (w *batchWriter[T]) flush(batch []T) []T {
+	if len(batch) == 0 {
+		return batch
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), BATCH_WRITER_FLUSH_TIMEOUT)
+	defer cancel()
+	if _, err := w.bdb.NewInsert().Model(&batch).Exec(ctx); err != nil {
+		// retry the rows one by one, so that a single bad row does not drop the whole batch
+		w.logger.Warn("failed to write rows, retrying one by one", "writer", w.name, "count", len(batch), "error", err)
+		for i := range batch {
+			if _, err := w.bdb.NewInsert().Model(&batch[i]).Exec(ctx); err != nil {
+				w.logger.Error("failed to write row", "writer", w.name, "error", err)
+			}
+		}
+	}
+	return batch[:0]
+}
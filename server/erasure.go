@@ -0,0 +1,119 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/choral-io/gommerce-server-aio/data/models"
+	"github.com/redis/rueidis"
+	"github.com/uptrace/bun"
+)
+
+const (
+	ERASURE_GRACE_PERIOD_ENV     = "GOMMERCE_ERASURE_GRACE_PERIOD"
+	ERASURE_DEFAULT_GRACE_PERIOD = 14 * 24 * time.Hour
+	ERASURE_SCAN_COUNT           = 100
+)
+
+// ErasureGracePeriod returns the time between an erasure request and the erasure of the account, configured by environment.
+func ErasureGracePeriod() time.Duration {
+	if v, err := time.ParseDuration(os.Getenv(ERASURE_GRACE_PERIOD_ENV)); err == nil && v > 0 {
+		return v
+	}
+	return ERASURE_DEFAULT_GRACE_PERIOD
+}
+
+// EraseUser anonymizes the personal fields of a user, removes its logins and devices, revokes its sessions and
+// soft deletes it. Rows referencing the user, e.g. orders, are kept intact.
+func EraseUser(ctx context.Context, bdb bun.IDB, rdb rueidis.Client, ss *SessionStore, userId string) error {
+	now := time.Now()
+	if err := bdb.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		user := &models.User{Id: userId}
+		if err := tx.NewSelect().Model(user).WherePK().For("UPDATE").Scan(ctx); err != nil {
+			return err
+		}
+		if user.Immutable {
+			return fmt.Errorf("user %s is immutable", userId)
+		}
+		if _, err := tx.NewUpdate().Model((*models.Profile)(nil)).
+			Set(`"display_name" = NULL`).
+			Set(`"avatar_url" = NULL`).
+			Set(`"gender" = NULL`).
+			Set(`"birthdate" = NULL`).
+			Set(`"introduction" = NULL`).
+			Set(`"updated_at" = ?`, now).
+			Where(`"id" = ?`, userId).Exec(ctx); err != nil {
+			return err
+		}
+		if _, err := tx.NewDelete().Model((*models.Login)(nil)).Where(`"user_id" = ?`, userId).ForceDelete().Exec(ctx); err != nil {
+			return err
+		}
+		if _, err := tx.NewDelete().Model((*models.LoginEvent)(nil)).Where(`"user_id" = ?`, userId).Exec(ctx); err != nil {
+			return err
+		}
+		var deviceIds []string
+		if err := tx.NewSelect().Model((*models.UserDevice)(nil)).Column("device_id").
+			Where(`"user_id" = ?`, userId).Scan(ctx, &deviceIds); err != nil {
+			return err
+		}
+		if _, err := tx.NewDelete().Model((*models.UserDevice)(nil)).Where(`"user_id" = ?`, userId).ForceDelete().Exec(ctx); err != nil {
+			return err
+		}
+		if _, err := tx.NewUpdate().Model((*models.Device)(nil)).
+			Set(`"user_id" = NULL`).
+			Set(`"push_token" = NULL`).
+			Set(`"metadata" = NULL`).
+			Set(`"updated_at" = ?`, now).
+			WhereGroup(" AND ", func(q *bun.UpdateQuery) *bun.UpdateQuery {
+				q = q.WhereOr(`"user_id" = ?`, userId)
+				if len(deviceIds) > 0 {
+					q = q.WhereOr(`"id" IN (?)`, bun.In(deviceIds))
+				}
+				return q
+			}).Exec(ctx); err != nil {
+			return err
+		}
+		user.Disabled = true
+		user.Flags = 0
+		user.Attributes = map[string]string{}
+		user.PhoneNumber = sql.NullString{}
+		user.EmailAddress = sql.NullString{}
+		user.Description = sql.NullString{}
+		user.EraseAt = sql.NullTime{}
+		if _, err := tx.NewUpdate().Model(user).
+			Column("disabled", "flags", "attributes", "phone_number", "email_address", "description", "erase_at", "updated_at").
+			WherePK().Exec(ctx); err != nil {
+			return err
+		}
+		_, err := tx.NewDelete().Model(user).WherePK().Exec(ctx)
+		return err
+	}); err != nil {
+		return err
+	}
+	if _, err := ss.RevokeUser(ctx, userId); err != nil {
+		return err
+	}
+	return deleteKeys(ctx, rdb, StateUserKeyPrefix(userId)+"*")
+}
+
+// deleteKeys deletes all redis keys matching the pattern.
+func deleteKeys(ctx context.Context, rdb rueidis.Client, pattern string) error {
+	var cursor uint64
+	for {
+		entry, err := rdb.Do(ctx, rdb.B().Scan().Cursor(cursor).Match(pattern).Count(ERASURE_SCAN_COUNT).Build()).AsScanEntry()
+		if err != nil {
+			return err
+		}
+		if len(entry.Elements) > 0 {
+			if err := rdb.Do(ctx, rdb.B().Unlink().Key(entry.Elements...).Build()).Error(); err != nil {
+				return err
+			}
+		}
+		if cursor = entry.Cursor; cursor == 0 {
+			return nil
+		}
+	}
+}
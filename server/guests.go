@@ -0,0 +1,68 @@
+package server
+
+import (
+	"context"
+	"slices"
+
+	"github.com/choral-io/gommerce-server-core/secure"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// SCOPE_GUEST marks anonymous tokens issued to a registered device, the subject of a guest token is the device id.
+const SCOPE_GUEST = "GUEST"
+
+// GuestService is implemented by services which accept guest tokens for some of their procedures,
+// guest tokens are rejected by all other services.
+type GuestService interface {
+	AllowGuest(procedure string) bool
+}
+
+// GuestScope returns the scope of guest tokens issued to the given device.
+func GuestScope(deviceId string) []string {
+	return []string{SCOPE_GUEST, DeviceScope(deviceId)}
+}
+
+// IsGuestScope reports whether the scope belongs to a guest token.
+func IsGuestScope(scope []string) bool {
+	return slices.Contains(scope, SCOPE_GUEST)
+}
+
+// IsGuest reports whether the request is authenticated with a guest token.
+func IsGuest(ctx context.Context) bool {
+	if secure.Authorize(ctx, secure.AuthFuncAuthenticated, secure.AuthFuncRequireSchema(secure.AUTH_SCHEMA_BEARER)) != nil {
+		return false
+	}
+	return IsGuestScope(secure.IdentityFromContext(ctx).Token().Scope())
+}
+
+func denyGuest(ctx context.Context, srv any, method string) error {
+	if !IsGuest(ctx) {
+		return nil
+	}
+	if g, ok := srv.(GuestService); ok && g.AllowGuest(method) {
+		return nil
+	}
+	return status.Errorf(codes.PermissionDenied, "procedure %s is not available to guests", method)
+}
+
+// GuestUnaryServerInterceptor rejects guest tokens for procedures which have not been opened to guests.
+func GuestUnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if err := denyGuest(ctx, info.Server, info.FullMethod); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// GuestStreamServerInterceptor rejects guest tokens for procedures which have not been opened to guests.
+func GuestStreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := denyGuest(ss.Context(), srv, info.FullMethod); err != nil {
+			return err
+		}
+		return handler(srv, ss)
+	}
+}
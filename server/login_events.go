@@ -0,0 +1,106 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/choral-io/gommerce-server-aio/data/models"
+	"github.com/choral-io/gommerce-server-core/logging"
+	"github.com/uptrace/bun"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+const (
+	LOGIN_EVENTS_REALM_MAX_LENGTH      = 64
+	LOGIN_EVENTS_PROVIDER_MAX_LENGTH   = 16
+	LOGIN_EVENTS_IDENTIFIER_MAX_LENGTH = 64
+	LOGIN_EVENTS_USER_AGENT_MAX_LENGTH = 255
+	LOGIN_EVENTS_REASON_MAX_LENGTH     = 255
+)
+
+// LoginEventRecorder writes login events into the database in the background, so that recording
+// never slows down a login.
+type LoginEventRecorder struct {
+	w *batchWriter[models.LoginEvent]
+}
+
+func NewLoginEventRecorder(bdb bun.IDB, logger logging.Logger) *LoginEventRecorder {
+	return &LoginEventRecorder{
+		w: newBatchWriter[models.LoginEvent](bdb, logger, "login_events"),
+	}
+}
+
+// Record queues a login event, the ip address and user agent are taken from the request context.
+func (r *LoginEventRecorder) Record(ctx context.Context, event models.LoginEvent) {
+	if event.CreatedAt.IsZero() {
+		event.CreatedAt = time.Now()
+	}
+	event.Realm = truncate(event.Realm, LOGIN_EVENTS_REALM_MAX_LENGTH)
+	event.Provider = truncate(event.Provider, LOGIN_EVENTS_PROVIDER_MAX_LENGTH)
+	event.Identifier = truncate(event.Identifier, LOGIN_EVENTS_IDENTIFIER_MAX_LENGTH)
+	ip, ua := RequestOrigin(ctx)
+	event.IpAddress = nullString(ip)
+	event.UserAgent = nullString(truncate(ua, LOGIN_EVENTS_USER_AGENT_MAX_LENGTH))
+	event.FailureReason = nullString(truncate(event.FailureReason.String, LOGIN_EVENTS_REASON_MAX_LENGTH))
+	r.w.Write(event)
+}
+
+func (r *LoginEventRecorder) Start(ctx context.Context) error {
+	return r.w.Start(ctx)
+}
+
+func (r *LoginEventRecorder) Stop(ctx context.Context) error {
+	return r.w.Stop(ctx)
+}
+
+// RequestOrigin returns the ip address and user agent of the caller, requests forwarded by the
+// gateway carry them in the metadata, otherwise the peer address of the connection is used.
+// Forwarded addresses which are not valid ip addresses are ignored, as the header is set by the client.
+func RequestOrigin(ctx context.Context) (ip string, userAgent string) {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get("x-forwarded-for"); len(v) > 0 {
+			ip = parseIP(strings.TrimSpace(strings.Split(v[0], ",")[0]))
+		}
+		if v := md.Get("grpcgateway-user-agent"); len(v) > 0 {
+			userAgent = v[0]
+		} else if v := md.Get("user-agent"); len(v) > 0 {
+			userAgent = v[0]
+		}
+	}
+	if ip == "" {
+		if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+			if host, _, err := net.SplitHostPort(p.Addr.String()); err == nil {
+				ip = host
+			} else {
+				ip = p.Addr.String()
+			}
+		}
+	}
+	return ip, userAgent
+}
+
+// parseIP returns the canonical form of an ip address, optionally followed by a port, or an empty string if it is invalid.
+func parseIP(s string) string {
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	if ip := net.ParseIP(s); ip != nil {
+		return ip.String()
+	}
+	return ""
+}
+
+func nullString(s string) sql.NullString {
+	return sql.NullString{Valid: s != "", String: s}
+}
+
+func truncate(s string, n int) string {
+	if r := []rune(s); len(r) > n {
+		return string(r[:n])
+	}
+	return s
+}
@@ -0,0 +1,136 @@
+package normalize
+
+import (
+	"errors"
+	"net/mail"
+	"os"
+	"strings"
+	"unicode"
+
+	"golang.org/x/net/idna"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	PHONE_DEFAULT_REGION_ENV = "GOMMERCE_PHONE_DEFAULT_REGION"
+
+	MAX_USERNAME_LENGTH      = 64
+	MAX_EMAIL_ADDRESS_LENGTH = 128
+)
+
+var (
+	ErrInvalidUsername     = errors.New("invalid username")
+	ErrInvalidEmailAddress = errors.New("invalid email address")
+	ErrInvalidPhoneNumber  = errors.New("invalid phone number")
+	ErrUnknownPhoneRegion  = errors.New("unknown phone region")
+)
+
+// country calling codes and trunk prefixes of the supported default regions
+var phoneRegions = map[string]struct {
+	code  string
+	trunk string
+}{
+	"AU": {"61", "0"},
+	"BR": {"55", "0"},
+	"CA": {"1", "1"},
+	"CN": {"86", "0"},
+	"DE": {"49", "0"},
+	"ES": {"34", ""},
+	"FR": {"33", "0"},
+	"GB": {"44", "0"},
+	"HK": {"852", ""},
+	"IN": {"91", "0"},
+	"IT": {"39", ""},
+	"JP": {"81", "0"},
+	"KR": {"82", "0"},
+	"MO": {"853", ""},
+	"NL": {"31", "0"},
+	"RU": {"7", "8"},
+	"SG": {"65", ""},
+	"TW": {"886", "0"},
+	"US": {"1", "1"},
+}
+
+var caseFolder = cases.Fold()
+
+// DefaultPhoneRegion returns the region used for phone numbers without country calling code, configured by environment.
+func DefaultPhoneRegion() string {
+	if region := os.Getenv(PHONE_DEFAULT_REGION_ENV); region != "" {
+		return strings.ToUpper(region)
+	}
+	return "CN"
+}
+
+// Username applies unicode NFKC normalization and case folding, so that visually equal usernames are stored equally.
+func Username(value string) (string, error) {
+	value = caseFolder.String(norm.NFKC.String(strings.TrimSpace(value)))
+	// folding may produce a non normalized string, e.g. for some greek letters
+	value = norm.NFKC.String(value)
+	if value == "" || len(value) > MAX_USERNAME_LENGTH {
+		return "", ErrInvalidUsername
+	}
+	for _, r := range value {
+		if unicode.IsSpace(r) || unicode.IsControl(r) || r == '@' {
+			return "", ErrInvalidUsername
+		}
+	}
+	return value, nil
+}
+
+// EmailAddress validates a bare address as defined by RFC 5322, lowercases its domain and converts an internationalized
+// domain into its ascii form. The local part is kept as is apart from unicode NFC normalization.
+func EmailAddress(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	addr, err := mail.ParseAddress(value)
+	if err != nil || addr.Name != "" || addr.Address != value {
+		return "", ErrInvalidEmailAddress
+	}
+	at := strings.LastIndexByte(value, '@')
+	domain, err := idna.Lookup.ToASCII(value[at+1:])
+	if err != nil || !strings.Contains(domain, ".") {
+		return "", ErrInvalidEmailAddress
+	}
+	value = norm.NFC.String(value[:at]) + "@" + strings.ToLower(domain)
+	if len(value) > MAX_EMAIL_ADDRESS_LENGTH {
+		return "", ErrInvalidEmailAddress
+	}
+	return value, nil
+}
+
+// PhoneNumber converts a phone number into E.164 format. Numbers without a leading "+" or "00" are treated as
+// national numbers of the given region, whose trunk prefix is removed before the country calling code is added.
+func PhoneNumber(value, region string) (string, error) {
+	var digits strings.Builder
+	value = strings.TrimSpace(value)
+	for i, r := range value {
+		switch {
+		case r >= '0' && r <= '9':
+			digits.WriteRune(r)
+		case r == '+' && i == 0:
+		case r == ' ' || r == '-' || r == '.' || r == '(' || r == ')':
+		default:
+			return "", ErrInvalidPhoneNumber
+		}
+	}
+	number := digits.String()
+	switch {
+	case strings.HasPrefix(value, "+"):
+	case strings.HasPrefix(number, "00"):
+		number = number[2:]
+	default:
+		r, ok := phoneRegions[strings.ToUpper(region)]
+		if !ok {
+			return "", ErrUnknownPhoneRegion
+		}
+		if r.trunk != "" && len(number) > len(r.trunk)+6 {
+			number = strings.TrimPrefix(number, r.trunk)
+		}
+		number = r.code + number
+	}
+	// E.164 allows at most 15 digits, country calling codes never start with 0
+	if len(number) < 8 || len(number) > 15 || number[0] == '0' {
+		return "", ErrInvalidPhoneNumber
+	}
+	return "+" + number, nil
+}
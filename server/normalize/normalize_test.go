@@ -0,0 +1,112 @@
+package normalize
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestUsername(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  string
+		err   error
+	}{
+		{"lower", "alice", "alice", nil},
+		{"case folding", "Alice", "alice", nil},
+		{"trimmed", "  bob  ", "bob", nil},
+		{"full width", "ＢＯＢ", "bob", nil},
+		{"german sharp s", "Straße", "strasse", nil},
+		{"greek final sigma", "ΟΔΟΣ", "οδοσ", nil},
+		{"empty", "   ", "", ErrInvalidUsername},
+		{"inner space", "a b", "", ErrInvalidUsername},
+		{"control", "a\tb", "", ErrInvalidUsername},
+		{"at sign", "a@b", "", ErrInvalidUsername},
+		{"too long", "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", "", ErrInvalidUsername},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Username(tt.value)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Username(%q) error = %v, want %v", tt.value, err, tt.err)
+			}
+			if got != tt.want {
+				t.Errorf("Username(%q) = %q, want %q", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEmailAddress(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  string
+		err   error
+	}{
+		{"plain", "alice@example.com", "alice@example.com", nil},
+		{"domain lowercased", "alice@Example.COM", "alice@example.com", nil},
+		{"local part kept", "Alice.Smith@example.com", "Alice.Smith@example.com", nil},
+		{"trimmed", "  alice@example.com ", "alice@example.com", nil},
+		{"plus tag", "alice+tag@example.com", "alice+tag@example.com", nil},
+		{"internationalized domain", "alice@Bücher.example", "alice@xn--bcher-kva.example", nil},
+		{"unicode local part", "用户@example.com", "用户@example.com", nil},
+		{"two at signs", "a@b@c.com", "", ErrInvalidEmailAddress},
+		{"display name", "Alice <alice@example.com>", "", ErrInvalidEmailAddress},
+		{"angle brackets", "<alice@example.com>", "", ErrInvalidEmailAddress},
+		{"missing local part", "@example.com", "", ErrInvalidEmailAddress},
+		{"missing domain", "alice@", "", ErrInvalidEmailAddress},
+		{"missing at sign", "alice.example.com", "", ErrInvalidEmailAddress},
+		{"dotless domain", "alice@localhost", "", ErrInvalidEmailAddress},
+		{"inner space", "ali ce@example.com", "", ErrInvalidEmailAddress},
+		{"too long", "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa@aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa.com", "", ErrInvalidEmailAddress},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := EmailAddress(tt.value)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("EmailAddress(%q) error = %v, want %v", tt.value, err, tt.err)
+			}
+			if got != tt.want {
+				t.Errorf("EmailAddress(%q) = %q, want %q", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPhoneNumber(t *testing.T) {
+	tests := []struct {
+		name   string
+		value  string
+		region string
+		want   string
+		err    error
+	}{
+		{"international", "+44 20 7946 0958", "CN", "+442079460958", nil},
+		{"international with 00", "0044 20 7946 0958", "CN", "+442079460958", nil},
+		{"national mobile", "138 0013 8000", "CN", "+8613800138000", nil},
+		{"national with trunk prefix", "010-1234-5678", "CN", "+861012345678", nil},
+		{"short national keeps leading trunk digit", "0123456", "CN", "+860123456", nil},
+		{"trunk prefix 1", "1 (202) 555-0123", "US", "+12025550123", nil},
+		{"without trunk prefix", "(202) 555-0123", "us", "+12025550123", nil},
+		{"trunk prefix 8", "8 (916) 123-45-67", "RU", "+79161234567", nil},
+		{"region without trunk prefix", "912 345 678", "ES", "+34912345678", nil},
+		{"unknown region", "12345678", "XX", "", ErrUnknownPhoneRegion},
+		{"letters", "+1 202 CALL NOW", "US", "", ErrInvalidPhoneNumber},
+		{"inner plus", "1+2025550123", "US", "", ErrInvalidPhoneNumber},
+		{"too short", "+1234567", "CN", "", ErrInvalidPhoneNumber},
+		{"too long", "+1234567890123456", "CN", "", ErrInvalidPhoneNumber},
+		{"zero country code", "+0123456789", "CN", "", ErrInvalidPhoneNumber},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := PhoneNumber(tt.value, tt.region)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("PhoneNumber(%q, %q) error = %v, want %v", tt.value, tt.region, err, tt.err)
+			}
+			if got != tt.want {
+				t.Errorf("PhoneNumber(%q, %q) = %q, want %q", tt.value, tt.region, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	CHANNEL_EMAIL = "EMAIL"
+	CHANNEL_SMS   = "SMS"
+
+	NOTIFY_DRIVER_ENV    = "GOMMERCE_NOTIFY_DRIVER"
+	NOTIFY_FILE_PATH_ENV = "GOMMERCE_NOTIFY_FILE_PATH"
+
+	// NOTIFY_DRIVER_FILE selects the FileNotifier, it must only be enabled in development and testing.
+	NOTIFY_DRIVER_FILE = "file"
+)
+
+// ErrNotifierDisabled is returned by the notifier used when no driver is configured.
+var ErrNotifierDisabled = errors.New("notifier is not configured")
+
+// Message is a notification sent to a single recipient through a channel.
+type Message struct {
+	Channel   string            `json:"channel"`
+	Recipient string            `json:"recipient"`
+	Subject   string            `json:"subject,omitempty"`
+	Body      string            `json:"body"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+}
+
+// Notifier delivers messages to users, e.g. by email or sms.
+type Notifier interface {
+	Notify(ctx context.Context, msg *Message) error
+}
+
+// FileNotifier writes messages as json lines into a local file, or into the standard logger when no file is configured.
+// It is meant for development and testing only.
+type FileNotifier struct {
+	mu   sync.Mutex
+	path string
+}
+
+var _ Notifier = (*FileNotifier)(nil)
+
+// NewNotifier returns the notifier selected by the driver environment variable.
+// Without a driver every message is rejected with ErrNotifierDisabled, so messages are never leaked into logs by default.
+func NewNotifier() Notifier {
+	switch os.Getenv(NOTIFY_DRIVER_ENV) {
+	case NOTIFY_DRIVER_FILE:
+		return NewFileNotifier(os.Getenv(NOTIFY_FILE_PATH_ENV))
+	default:
+		return disabledNotifier{}
+	}
+}
+
+func NewFileNotifier(path string) Notifier {
+	return &FileNotifier{path: path}
+}
+
+type disabledNotifier struct{}
+
+func (disabledNotifier) Notify(context.Context, *Message) error {
+	return ErrNotifierDisabled
+}
+
+func (n *FileNotifier) Notify(_ context.Context, msg *Message) error {
+	line, err := json.Marshal(struct {
+		Time time.Time `json:"time"`
+		*Message
+	}{time.Now(), msg})
+	if err != nil {
+		return err
+	}
+	if n.path == "" {
+		log.Printf("notify: %s", line)
+		return nil
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	f, err := os.OpenFile(n.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
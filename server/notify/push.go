@@ -0,0 +1,174 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	PLATFORM_IOS     = "ios"
+	PLATFORM_ANDROID = "android"
+	PLATFORM_WEB     = "web"
+
+	// DEVICE_METADATA_PLATFORM is the device metadata key which selects the payload format of a device.
+	DEVICE_METADATA_PLATFORM = "platform"
+
+	PUSH_DRIVER_ENV    = "GOMMERCE_PUSH_DRIVER"
+	PUSH_FILE_PATH_ENV = "GOMMERCE_PUSH_FILE_PATH"
+
+	// PUSH_DRIVER_FILE selects the FilePushProvider, it must only be enabled in development and testing.
+	PUSH_DRIVER_FILE = "file"
+
+	// PUSH_TOKEN_REDACTED replaces push tokens in the payloads written by the FilePushProvider.
+	PUSH_TOKEN_REDACTED = "[REDACTED]"
+)
+
+var (
+	// ErrInvalidPushToken is reported by providers when a push token is no longer valid,
+	// e.g. the app has been uninstalled, the token should not be used again.
+	ErrInvalidPushToken = errors.New("invalid push token")
+	// ErrPushDisabled is returned by the push provider used when no driver is configured.
+	ErrPushDisabled = errors.New("push provider is not configured")
+)
+
+// PushMessage is a notification shown on the devices of a user.
+type PushMessage struct {
+	Title    string            `json:"title,omitempty"`
+	Body     string            `json:"body"`
+	Data     map[string]string `json:"data,omitempty"`
+	Badge    *int32            `json:"badge,omitempty"`
+	Sound    string            `json:"sound,omitempty"`
+	Category string            `json:"category,omitempty"`
+	TTL      time.Duration     `json:"ttl,omitempty"`
+}
+
+// PushTarget is a single device a push message is delivered to.
+type PushTarget struct {
+	DeviceId string `json:"device_id"`
+	Platform string `json:"platform"`
+	Token    string `json:"-"`
+}
+
+// PushProvider delivers push messages to devices, e.g. through APNs or FCM.
+// Implementations return ErrInvalidPushToken (optionally wrapped) for tokens which must be pruned.
+type PushProvider interface {
+	Push(ctx context.Context, target PushTarget, msg *PushMessage) error
+}
+
+// BuildAPNsPayload builds the json payload of a message in the format of the Apple Push Notification service.
+func BuildAPNsPayload(msg *PushMessage) ([]byte, error) {
+	aps := map[string]any{
+		"alert": map[string]string{"title": msg.Title, "body": msg.Body},
+	}
+	if msg.Badge != nil {
+		aps["badge"] = *msg.Badge
+	}
+	if msg.Sound != "" {
+		aps["sound"] = msg.Sound
+	}
+	if msg.Category != "" {
+		aps["category"] = msg.Category
+	}
+	payload := map[string]any{"aps": aps}
+	for k, v := range msg.Data {
+		if k != "aps" {
+			payload[k] = v
+		}
+	}
+	return json.Marshal(payload)
+}
+
+// BuildFCMPayload builds the json payload of a message in the format of the Firebase Cloud Messaging http v1 api.
+func BuildFCMPayload(token string, msg *PushMessage) ([]byte, error) {
+	message := map[string]any{
+		"token":        token,
+		"notification": map[string]string{"title": msg.Title, "body": msg.Body},
+	}
+	if len(msg.Data) > 0 {
+		message["data"] = msg.Data
+	}
+	android := map[string]any{}
+	if msg.TTL > 0 {
+		android["ttl"] = msg.TTL.Round(time.Second).String()
+	}
+	if msg.Sound != "" || msg.Category != "" {
+		android["notification"] = map[string]string{"sound": msg.Sound, "click_action": msg.Category}
+	}
+	if len(android) > 0 {
+		message["android"] = android
+	}
+	return json.Marshal(map[string]any{"message": message})
+}
+
+// BuildPushPayload builds the payload of a message for the platform of the target.
+func BuildPushPayload(target PushTarget, msg *PushMessage) ([]byte, error) {
+	if target.Platform == PLATFORM_IOS {
+		return BuildAPNsPayload(msg)
+	}
+	return BuildFCMPayload(target.Token, msg)
+}
+
+// FilePushProvider writes built payloads as json lines into a local file, or into the standard logger when no file
+// is configured. It is meant for development and testing only.
+type FilePushProvider struct {
+	mu   sync.Mutex
+	path string
+}
+
+var _ PushProvider = (*FilePushProvider)(nil)
+
+// NewPushProvider returns the push provider selected by the driver environment variable.
+// Without a driver every message is rejected with ErrPushDisabled, so payloads are never leaked into logs by default.
+func NewPushProvider() PushProvider {
+	switch os.Getenv(PUSH_DRIVER_ENV) {
+	case PUSH_DRIVER_FILE:
+		return NewFilePushProvider(os.Getenv(PUSH_FILE_PATH_ENV))
+	default:
+		return disabledPushProvider{}
+	}
+}
+
+func NewFilePushProvider(path string) PushProvider {
+	return &FilePushProvider{path: path}
+}
+
+type disabledPushProvider struct{}
+
+func (disabledPushProvider) Push(context.Context, PushTarget, *PushMessage) error {
+	return ErrPushDisabled
+}
+
+func (p *FilePushProvider) Push(_ context.Context, target PushTarget, msg *PushMessage) error {
+	// tokens are credentials of the device, they must not end up in files or logs
+	target.Token = PUSH_TOKEN_REDACTED
+	payload, err := BuildPushPayload(target, msg)
+	if err != nil {
+		return err
+	}
+	line, err := json.Marshal(struct {
+		Time    time.Time       `json:"time"`
+		Target  PushTarget      `json:"target"`
+		Payload json.RawMessage `json:"payload"`
+	}{time.Now(), target, payload})
+	if err != nil {
+		return err
+	}
+	if p.path == "" {
+		log.Printf("push: %s", line)
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	f, err := os.OpenFile(p.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/choral-io/gommerce-server-aio/data/models"
+	"github.com/choral-io/gommerce-server-aio/server/notify"
+	"github.com/choral-io/gommerce-server-core/logging"
+	"github.com/uptrace/bun"
+)
+
+const (
+	PUSH_MAX_ATTEMPTS    = 3
+	PUSH_INITIAL_BACKOFF = 200 * time.Millisecond
+	PUSH_MAX_BACKOFF     = 5 * time.Second
+	PUSH_MAX_CONCURRENCY = 8
+)
+
+// PushResult summarizes the delivery of a push message to the devices of a user.
+type PushResult struct {
+	Delivered int
+	Failed    int
+	Pruned    int
+}
+
+// PushDispatcher fans push messages out to all devices bound to a user, failed deliveries are retried with
+// exponential backoff and tokens reported as invalid by the provider are removed from their devices.
+type PushDispatcher struct {
+	bdb      bun.IDB
+	provider notify.PushProvider
+	logger   logging.Logger
+}
+
+func NewPushDispatcher(bdb bun.IDB, provider notify.PushProvider, logger logging.Logger) *PushDispatcher {
+	return &PushDispatcher{
+		bdb:      bdb,
+		provider: provider,
+		logger:   logger,
+	}
+}
+
+// PushToUser delivers the message to every device bound to the user which carries a push token.
+func (d *PushDispatcher) PushToUser(ctx context.Context, userId string, msg *notify.PushMessage) (PushResult, error) {
+	var devices []models.Device
+	if err := d.bdb.NewSelect().Model(&devices).
+		Column("id", "push_token", "metadata").
+		Where(`"device"."push_token" IS NOT NULL`).
+		Where(`"device"."id" IN (?)`, d.bdb.NewSelect().Model((*models.UserDevice)(nil)).
+			Column("device_id").Where(`"user_device"."user_id" = ?`, userId)).
+		Scan(ctx); err != nil {
+		return PushResult{}, err
+	}
+	var result PushResult
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, PUSH_MAX_CONCURRENCY)
+	for _, device := range devices {
+		target := notify.PushTarget{
+			DeviceId: device.Id,
+			Platform: device.Metadata[notify.DEVICE_METADATA_PLATFORM],
+			Token:    device.PushToken.String,
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			err := d.push(ctx, target, msg)
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil:
+				result.Delivered++
+			case errors.Is(err, notify.ErrInvalidPushToken):
+				result.Failed++
+				if perr := d.prune(ctx, target); perr != nil {
+					d.logger.Warn("failed to prune push token", "device_id", target.DeviceId, "error", perr)
+				} else {
+					result.Pruned++
+				}
+			default:
+				result.Failed++
+				d.logger.Warn("failed to push message", "device_id", target.DeviceId, "error", err)
+			}
+		}()
+	}
+	wg.Wait()
+	return result, nil
+}
+
+func (d *PushDispatcher) push(ctx context.Context, target notify.PushTarget, msg *notify.PushMessage) error {
+	backoff := PUSH_INITIAL_BACKOFF
+	var err error
+	for attempt := 1; attempt <= PUSH_MAX_ATTEMPTS; attempt++ {
+		if err = d.provider.Push(ctx, target, msg); err == nil || errors.Is(err, notify.ErrInvalidPushToken) || errors.Is(err, notify.ErrPushDisabled) {
+			return err
+		}
+		if attempt == PUSH_MAX_ATTEMPTS {
+			break
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if backoff *= 2; backoff > PUSH_MAX_BACKOFF {
+			backoff = PUSH_MAX_BACKOFF
+		}
+	}
+	return err
+}
+
+// prune removes an invalid push token from its device, unless the device has been given a new token meanwhile.
+func (d *PushDispatcher) prune(ctx context.Context, target notify.PushTarget) error {
+	_, err := d.bdb.NewUpdate().Model((*models.Device)(nil)).
+		Set(`"push_token" = NULL`).
+		Set(`"updated_at" = ?`, time.Now()).
+		Where(`"id" = ?`, target.DeviceId).
+		Where(`"push_token" = ?`, target.Token).
+		Exec(ctx)
+	return err
+}
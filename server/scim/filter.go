@@ -0,0 +1,217 @@
+package scim
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/uptrace/bun"
+)
+
+const (
+	FILTER_TYPE_STRING  = "string"
+	FILTER_TYPE_BOOLEAN = "boolean"
+)
+
+// filterExpr is a single attribute expression of a scim filter, e.g. `userName eq "alice"`.
+type filterExpr struct {
+	Attr  string
+	Op    string
+	Value string
+}
+
+// filterAttr maps a filterable scim attribute to a sql expression. Attributes stored in normalized form,
+// like usernames, compare against the normalized filter value instead of lower casing both sides.
+type filterAttr struct {
+	Expr      string
+	Type      string
+	CaseExact bool
+	Normalize func(string) (string, error)
+}
+
+type filterToken struct {
+	text   string
+	quoted bool
+}
+
+// parseFilter parses the subset of the scim filter syntax which is supported: attribute expressions
+// with the operators eq, ne, co, sw, ew, gt, ge, lt, le and pr, joined by "and".
+func parseFilter(filter string) ([]filterExpr, error) {
+	tokens, err := tokenizeFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	var exprs []filterExpr
+	for i := 0; i < len(tokens); {
+		if len(exprs) > 0 {
+			if tokens[i].quoted || !strings.EqualFold(tokens[i].text, "and") {
+				return nil, newError(http.StatusBadRequest, "invalidFilter", "only \"and\" is supported to combine filter expressions")
+			}
+			i++
+		}
+		if i+1 >= len(tokens) || tokens[i].quoted {
+			return nil, newError(http.StatusBadRequest, "invalidFilter", "filter %q is incomplete", filter)
+		}
+		expr := filterExpr{Attr: tokens[i].text, Op: strings.ToLower(tokens[i+1].text)}
+		i += 2
+		switch expr.Op {
+		case "pr":
+		case "eq", "ne", "co", "sw", "ew", "gt", "ge", "lt", "le":
+			if i >= len(tokens) {
+				return nil, newError(http.StatusBadRequest, "invalidFilter", "filter %q is incomplete", filter)
+			}
+			expr.Value = tokens[i].text
+			i++
+		default:
+			return nil, newError(http.StatusBadRequest, "invalidFilter", "operator %s is not supported", expr.Op)
+		}
+		exprs = append(exprs, expr)
+	}
+	return exprs, nil
+}
+
+func tokenizeFilter(filter string) ([]filterToken, error) {
+	var tokens []filterToken
+	for i := 0; i < len(filter); {
+		switch c := filter[i]; {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '(' || c == ')':
+			return nil, newError(http.StatusBadRequest, "invalidFilter", "grouping is not supported in filters")
+		case c == '"':
+			var b strings.Builder
+			i++
+			for ; i < len(filter) && filter[i] != '"'; i++ {
+				if filter[i] == '\\' && i+1 < len(filter) {
+					i++
+				}
+				b.WriteByte(filter[i])
+			}
+			if i >= len(filter) {
+				return nil, newError(http.StatusBadRequest, "invalidFilter", "unterminated string in filter")
+			}
+			i++
+			tokens = append(tokens, filterToken{text: b.String(), quoted: true})
+		default:
+			j := i
+			for j < len(filter) && filter[j] != ' ' && filter[j] != '\t' {
+				j++
+			}
+			tokens = append(tokens, filterToken{text: filter[i:j]})
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+// withFilter applies the filter of a list request to the query, attributes are looked up case-insensitively.
+func withFilter(filter string, attrs map[string]filterAttr) (func(*bun.SelectQuery) *bun.SelectQuery, error) {
+	if strings.TrimSpace(filter) == "" {
+		return func(q *bun.SelectQuery) *bun.SelectQuery { return q }, nil
+	}
+	exprs, err := parseFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	wheres := make([]func(*bun.SelectQuery) *bun.SelectQuery, len(exprs))
+	for i, expr := range exprs {
+		attr, ok := attrs[strings.ToLower(expr.Attr)]
+		if !ok {
+			return nil, newError(http.StatusBadRequest, "invalidFilter", "attribute %s can not be filtered", expr.Attr)
+		}
+		where, err := filterWhere(attr, expr)
+		if err != nil {
+			return nil, err
+		}
+		wheres[i] = where
+	}
+	return func(q *bun.SelectQuery) *bun.SelectQuery {
+		for _, where := range wheres {
+			q = where(q)
+		}
+		return q
+	}, nil
+}
+
+func filterWhere(attr filterAttr, expr filterExpr) (func(*bun.SelectQuery) *bun.SelectQuery, error) {
+	column := bun.Safe(attr.Expr)
+	if expr.Op == "pr" {
+		return func(q *bun.SelectQuery) *bun.SelectQuery { return q.Where("? IS NOT NULL", column) }, nil
+	}
+	if attr.Type == FILTER_TYPE_BOOLEAN {
+		value := strings.EqualFold(expr.Value, "true")
+		if !value && !strings.EqualFold(expr.Value, "false") {
+			return nil, newError(http.StatusBadRequest, "invalidFilter", "attribute %s must be compared with a boolean", expr.Attr)
+		}
+		switch expr.Op {
+		case "eq":
+			return func(q *bun.SelectQuery) *bun.SelectQuery { return q.Where("? = ?", column, value) }, nil
+		case "ne":
+			return func(q *bun.SelectQuery) *bun.SelectQuery { return q.Where("? <> ?", column, value) }, nil
+		}
+		return nil, newError(http.StatusBadRequest, "invalidFilter", "operator %s is not supported for attribute %s", expr.Op, expr.Attr)
+	}
+	value := expr.Value
+	switch {
+	case attr.Normalize != nil:
+		// a value which can not be normalized can not be stored either, it is compared as is and matches nothing
+		if v, err := attr.Normalize(value); err == nil {
+			value = v
+		}
+	case !attr.CaseExact:
+		column = bun.Safe("LOWER(" + attr.Expr + ")")
+		value = strings.ToLower(value)
+	}
+	var where string
+	switch expr.Op {
+	case "eq":
+		where = "? = ?"
+	case "ne":
+		where = "? IS DISTINCT FROM ?"
+	case "co":
+		where, value = "? LIKE ?", "%"+escapeLikePattern(value)+"%"
+	case "sw":
+		where, value = "? LIKE ?", escapeLikePattern(value)+"%"
+	case "ew":
+		where, value = "? LIKE ?", "%"+escapeLikePattern(value)
+	case "gt":
+		where = "? > ?"
+	case "ge":
+		where = "? >= ?"
+	case "lt":
+		where = "? < ?"
+	case "le":
+		where = "? <= ?"
+	}
+	return func(q *bun.SelectQuery) *bun.SelectQuery { return q.Where(where, column, value) }, nil
+}
+
+func escapeLikePattern(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// matchFilter reports whether the fields of a multi-valued attribute element match the filter of a patch path,
+// e.g. `type eq "work"`. Only eq comparisons are supported.
+func matchFilter(exprs []filterExpr, element map[string]any) bool {
+	for _, expr := range exprs {
+		if expr.Op != "eq" {
+			return false
+		}
+		value, ok := element[lookupKey(element, expr.Attr)]
+		if !ok {
+			return false
+		}
+		if s, ok := value.(string); !ok || !strings.EqualFold(s, expr.Value) {
+			if b, ok := value.(bool); !ok || !strings.EqualFold(expr.Value, boolString(b)) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func boolString(b bool) string {
+	if b {
+		return "true"
+	}
+	return "false"
+}
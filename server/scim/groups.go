@@ -0,0 +1,304 @@
+package scim
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strings"
+
+	drivers "github.com/choral-io/gommerce-server-aio/data/drivers"
+	"github.com/choral-io/gommerce-server-aio/data/models"
+	"github.com/uptrace/bun"
+)
+
+const (
+	ROLE_NAME_MAX_LENGTH = 64
+)
+
+var groupFilterAttrs = map[string]filterAttr{
+	"id":          {Expr: `"role"."id"`, Type: FILTER_TYPE_STRING, CaseExact: true},
+	"displayname": {Expr: `"role"."name"`, Type: FILTER_TYPE_STRING},
+}
+
+type groupResource struct {
+	Schemas     []string    `json:"schemas"`
+	Id          string      `json:"id,omitempty"`
+	DisplayName string      `json:"displayName"`
+	Members     []reference `json:"members,omitempty"`
+	Meta        *meta       `json:"meta,omitempty"`
+}
+
+func toGroupResource(base string, role models.Role, members []string) *groupResource {
+	res := &groupResource{
+		Schemas:     []string{SCHEMA_GROUP},
+		Id:          role.Id,
+		DisplayName: role.Name,
+		Meta:        newMeta("Group", base+"/Groups/"+role.Id, role.CreatedAt, role.UpdatedAt),
+	}
+	for _, userId := range members {
+		res.Members = append(res.Members, reference{Value: userId, Ref: base + "/Users/" + userId})
+	}
+	return res
+}
+
+func parseGroupResource(res *groupResource) (string, []string, error) {
+	name := strings.TrimSpace(res.DisplayName)
+	if name == "" || len(name) > ROLE_NAME_MAX_LENGTH {
+		return "", nil, newError(http.StatusBadRequest, "invalidValue", "displayName is required and must not exceed %d characters", ROLE_NAME_MAX_LENGTH)
+	}
+	seen := map[string]bool{}
+	members := make([]string, 0, len(res.Members))
+	for _, m := range res.Members {
+		if m.Value != "" && !seen[m.Value] {
+			seen[m.Value] = true
+			members = append(members, m.Value)
+		}
+	}
+	return name, members, nil
+}
+
+func (h *Handler) findRole(ctx context.Context, bdb bun.IDB, realmId, id string) (*models.Role, error) {
+	role := &models.Role{}
+	if err := bdb.NewSelect().Model(role).
+		Where(`"role"."id" = ?`, id).
+		Where(`"role"."realm_id" = ?`, realmId).
+		Scan(ctx); errors.Is(err, sql.ErrNoRows) {
+		return nil, newError(http.StatusNotFound, "", "group %s not found", id)
+	} else if err != nil {
+		return nil, err
+	}
+	return role, nil
+}
+
+// roleMembers returns the ids of the users of each role.
+func (h *Handler) roleMembers(ctx context.Context, roleIds ...string) (map[string][]string, error) {
+	result := map[string][]string{}
+	if len(roleIds) == 0 {
+		return result, nil
+	}
+	var roleUsers []models.RoleUser
+	if err := h.bdb.NewSelect().Model(&roleUsers).
+		Where(`"role_user"."role_id" IN (?)`, bun.In(roleIds)).
+		OrderExpr(`"role_user"."user_id" ASC`).
+		Scan(ctx); err != nil {
+		return nil, err
+	}
+	for _, ru := range roleUsers {
+		result[ru.RoleId] = append(result[ru.RoleId], ru.UserId)
+	}
+	return result, nil
+}
+
+// setRoleMembers replaces the users of the role, members must be users of the realm of the role.
+// Immutable assignments are never removed.
+func setRoleMembers(ctx context.Context, tx bun.Tx, role *models.Role, userIds []string) error {
+	if len(userIds) > 0 {
+		n, err := tx.NewSelect().Model((*models.User)(nil)).
+			Where(`"user"."realm_id" = ?`, role.RealmId).
+			Where(`"user"."id" IN (?)`, bun.In(userIds)).
+			Count(ctx)
+		if err != nil {
+			return err
+		}
+		if n != len(userIds) {
+			return newError(http.StatusBadRequest, "invalidValue", "members must be existing users of the realm")
+		}
+	}
+	query := tx.NewDelete().Model((*models.RoleUser)(nil)).
+		Where(`"role_id" = ?`, role.Id).
+		Where(`"immutable" = FALSE`)
+	if len(userIds) > 0 {
+		query = query.Where(`"user_id" NOT IN (?)`, bun.In(userIds))
+	}
+	if _, err := query.Exec(ctx); err != nil {
+		return err
+	}
+	if len(userIds) == 0 {
+		return nil
+	}
+	roleUsers := make([]models.RoleUser, len(userIds))
+	for i, userId := range userIds {
+		roleUsers[i] = models.RoleUser{RoleId: role.Id, UserId: userId}
+	}
+	_, err := tx.NewInsert().Model(&roleUsers).
+		On(`CONFLICT ("role_id", "user_id") DO UPDATE`).
+		Set(`"deleted_at" = NULL`).
+		Set(`"updated_at" = EXCLUDED."created_at"`).
+		Where(`"role_user"."deleted_at" IS NOT NULL`).
+		Exec(ctx)
+	return err
+}
+
+func (h *Handler) loadGroupResource(ctx context.Context, base, realmId, id string) (*groupResource, error) {
+	role, err := h.findRole(ctx, h.bdb, realmId, id)
+	if err != nil {
+		return nil, err
+	}
+	members, err := h.roleMembers(ctx, role.Id)
+	if err != nil {
+		return nil, err
+	}
+	return toGroupResource(base, *role, members[role.Id]), nil
+}
+
+func (h *Handler) listGroups(w http.ResponseWriter, r *http.Request, client *models.Client) error {
+	filter, err := withFilter(r.URL.Query().Get("filter"), groupFilterAttrs)
+	if err != nil {
+		return err
+	}
+	start, count := paging(r)
+	var roles []models.Role
+	query := h.bdb.NewSelect().Model(&roles).
+		Where(`"role"."realm_id" = ?`, client.RealmId.String).
+		Apply(filter).
+		OrderExpr(`"role"."id" ASC`)
+	var total int
+	if count == 0 {
+		total, err = query.Count(r.Context())
+	} else {
+		total, err = query.Offset(start - 1).Limit(count).ScanAndCount(r.Context())
+	}
+	if err != nil {
+		return err
+	}
+	members := map[string][]string{}
+	if !excluded(r, "members") {
+		ids := make([]string, len(roles))
+		for i, role := range roles {
+			ids[i] = role.Id
+		}
+		if members, err = h.roleMembers(r.Context(), ids...); err != nil {
+			return err
+		}
+	}
+	res := &listResponse{
+		Schemas:      []string{SCHEMA_LIST_RESPONSE},
+		TotalResults: total,
+		StartIndex:   start,
+		ItemsPerPage: len(roles),
+		Resources:    make([]any, len(roles)),
+	}
+	for i, role := range roles {
+		res.Resources[i] = toGroupResource(baseURL(r), role, members[role.Id])
+	}
+	return writeJSON(w, http.StatusOK, res)
+}
+
+func (h *Handler) getGroup(w http.ResponseWriter, r *http.Request, client *models.Client) error {
+	res, err := h.loadGroupResource(r.Context(), baseURL(r), client.RealmId.String, r.PathValue("id"))
+	if err != nil {
+		return err
+	}
+	if excluded(r, "members") {
+		res.Members = nil
+	}
+	return writeJSON(w, http.StatusOK, res)
+}
+
+func (h *Handler) createGroup(w http.ResponseWriter, r *http.Request, client *models.Client) error {
+	var req groupResource
+	if err := readJSON(r, &req); err != nil {
+		return err
+	}
+	name, members, err := parseGroupResource(&req)
+	if err != nil {
+		return err
+	}
+	role := &models.Role{RealmId: client.RealmId.String, Name: name}
+	err = h.bdb.RunInTx(r.Context(), nil, func(ctx context.Context, tx bun.Tx) error {
+		if _, err := tx.NewInsert().Model(role).Exec(ctx); drivers.IsUniqueViolation(err, models.ROLE_UNIQUE_INDEX) {
+			return newError(http.StatusConflict, "uniqueness", "group %s already exists", name)
+		} else if err != nil {
+			return err
+		}
+		return setRoleMembers(ctx, tx, role, members)
+	})
+	if err != nil {
+		return err
+	}
+	res := toGroupResource(baseURL(r), *role, members)
+	w.Header().Set("Location", res.Meta.Location)
+	return writeJSON(w, http.StatusCreated, res)
+}
+
+func (h *Handler) replaceGroup(w http.ResponseWriter, r *http.Request, client *models.Client) error {
+	var req groupResource
+	if err := readJSON(r, &req); err != nil {
+		return err
+	}
+	return h.updateGroup(w, r, client, &req)
+}
+
+func (h *Handler) patchGroup(w http.ResponseWriter, r *http.Request, client *models.Client) error {
+	var req patchRequest
+	if err := readJSON(r, &req); err != nil {
+		return err
+	}
+	current, err := h.loadGroupResource(r.Context(), baseURL(r), client.RealmId.String, r.PathValue("id"))
+	if err != nil {
+		return err
+	}
+	var patched groupResource
+	if err := patchResource(current, &req, &patched); err != nil {
+		return err
+	}
+	return h.updateGroup(w, r, client, &patched)
+}
+
+// updateGroup renames the role and replaces its members with those of the resource.
+func (h *Handler) updateGroup(w http.ResponseWriter, r *http.Request, client *models.Client, req *groupResource) error {
+	name, members, err := parseGroupResource(req)
+	if err != nil {
+		return err
+	}
+	realmId, id := client.RealmId.String, r.PathValue("id")
+	err = h.bdb.RunInTx(r.Context(), nil, func(ctx context.Context, tx bun.Tx) error {
+		role, err := h.findRole(ctx, tx, realmId, id)
+		if err != nil {
+			return err
+		}
+		if role.Name != name {
+			if role.Immutable {
+				return newError(http.StatusBadRequest, "mutability", "group %s is immutable", id)
+			}
+			role.Name = name
+			if _, err := tx.NewUpdate().Model(role).Column("name", "updated_at").WherePK().Exec(ctx); drivers.IsUniqueViolation(err, models.ROLE_UNIQUE_INDEX) {
+				return newError(http.StatusConflict, "uniqueness", "group %s already exists", name)
+			} else if err != nil {
+				return err
+			}
+		}
+		return setRoleMembers(ctx, tx, role, members)
+	})
+	if err != nil {
+		return err
+	}
+	res, err := h.loadGroupResource(r.Context(), baseURL(r), realmId, id)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, res)
+}
+
+// deleteGroup deletes the role with all its assignments, rows are removed for good so that the name can be reused.
+func (h *Handler) deleteGroup(w http.ResponseWriter, r *http.Request, client *models.Client) error {
+	err := h.bdb.RunInTx(r.Context(), nil, func(ctx context.Context, tx bun.Tx) error {
+		role, err := h.findRole(ctx, tx, client.RealmId.String, r.PathValue("id"))
+		if err != nil {
+			return err
+		}
+		if role.Immutable {
+			return newError(http.StatusBadRequest, "mutability", "group %s is immutable", role.Id)
+		}
+		if _, err := tx.NewDelete().Model((*models.RoleUser)(nil)).Where(`"role_id" = ?`, role.Id).ForceDelete().Exec(ctx); err != nil {
+			return err
+		}
+		_, err = tx.NewDelete().Model(role).WherePK().ForceDelete().Exec(ctx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusNoContent, nil)
+}
@@ -0,0 +1,222 @@
+package scim
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	PATCH_OP_ADD     = "add"
+	PATCH_OP_REPLACE = "replace"
+	PATCH_OP_REMOVE  = "remove"
+)
+
+type patchRequest struct {
+	Schemas    []string  `json:"schemas"`
+	Operations []patchOp `json:"Operations"`
+}
+
+type patchOp struct {
+	Op    string `json:"op"`
+	Path  string `json:"path"`
+	Value any    `json:"value"`
+}
+
+// flexBool accepts booleans sent as strings, e.g. "False", as some identity providers do.
+type flexBool bool
+
+func (b *flexBool) UnmarshalJSON(data []byte) error {
+	var v any
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case bool:
+		*b = flexBool(v)
+	case string:
+		parsed, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		*b = flexBool(parsed)
+	case nil:
+		*b = false
+	default:
+		return newError(http.StatusBadRequest, "invalidValue", "%v is not a boolean", v)
+	}
+	return nil
+}
+
+// patchResource applies the operations of a patch request to the json representation of a resource
+// and decodes the result into target.
+func patchResource(resource any, req *patchRequest, target any) error {
+	raw, err := json.Marshal(resource)
+	if err != nil {
+		return err
+	}
+	var m map[string]any
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return err
+	}
+	if len(req.Operations) == 0 {
+		return newError(http.StatusBadRequest, "invalidValue", "at least one operation is required")
+	}
+	for _, op := range req.Operations {
+		if err := applyPatchOp(m, op); err != nil {
+			return err
+		}
+	}
+	if raw, err = json.Marshal(m); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(raw, target); err != nil {
+		return newError(http.StatusBadRequest, "invalidValue", "patched resource is invalid: %v", err)
+	}
+	return nil
+}
+
+func applyPatchOp(m map[string]any, op patchOp) error {
+	kind := strings.ToLower(op.Op)
+	if kind != PATCH_OP_ADD && kind != PATCH_OP_REPLACE && kind != PATCH_OP_REMOVE {
+		return newError(http.StatusBadRequest, "invalidSyntax", "operation %s is not supported", op.Op)
+	}
+	if op.Path != "" {
+		return applyPatchPath(m, op.Path, kind, op.Value)
+	}
+	if kind == PATCH_OP_REMOVE {
+		return newError(http.StatusBadRequest, "noTarget", "path is required to remove attributes")
+	}
+	values, ok := op.Value.(map[string]any)
+	if !ok {
+		return newError(http.StatusBadRequest, "invalidValue", "value must be an object when no path is given")
+	}
+	for path, value := range values {
+		if err := applyPatchPath(m, path, kind, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyPatchPath applies an operation to the attribute at path, which is either `attr`, `attr.sub`,
+// `attr[filter]` or `attr[filter].sub`. Schema urn prefixes of core attributes are ignored.
+func applyPatchPath(m map[string]any, path, kind string, value any) error {
+	if strings.HasPrefix(strings.ToLower(path), "urn:") {
+		if i := strings.LastIndex(path, ":"); i >= 0 {
+			path = path[i+1:]
+		}
+	}
+	attr, filter, sub := path, "", ""
+	if i := strings.IndexByte(path, '['); i >= 0 {
+		j := strings.IndexByte(path, ']')
+		if j < i {
+			return newError(http.StatusBadRequest, "invalidPath", "path %s is invalid", path)
+		}
+		attr, filter, sub = path[:i], path[i+1:j], strings.TrimPrefix(path[j+1:], ".")
+	} else if i := strings.IndexByte(path, '.'); i >= 0 {
+		attr, sub = path[:i], path[i+1:]
+	}
+	key := lookupKey(m, attr)
+	if filter != "" {
+		return applyFilteredPatch(m, key, filter, sub, kind, value)
+	}
+	if sub != "" {
+		child, _ := m[key].(map[string]any)
+		if child == nil {
+			if kind == PATCH_OP_REMOVE {
+				return nil
+			}
+			child = map[string]any{}
+		}
+		if err := applyPatchPath(child, sub, kind, value); err != nil {
+			return err
+		}
+		m[key] = child
+		return nil
+	}
+	switch kind {
+	case PATCH_OP_REMOVE:
+		delete(m, key)
+	case PATCH_OP_ADD:
+		if items, ok := m[key].([]any); ok {
+			if values, ok := value.([]any); ok {
+				m[key] = append(items, values...)
+			} else {
+				m[key] = append(items, value)
+			}
+		} else {
+			m[key] = value
+		}
+	default:
+		m[key] = value
+	}
+	return nil
+}
+
+// applyFilteredPatch applies an operation to the elements of a multi-valued attribute which match the filter.
+func applyFilteredPatch(m map[string]any, key, filter, sub, kind string, value any) error {
+	exprs, err := parseFilter(filter)
+	if err != nil {
+		return err
+	}
+	items, _ := m[key].([]any)
+	result := make([]any, 0, len(items))
+	var matched bool
+	for _, item := range items {
+		element, ok := item.(map[string]any)
+		if !ok || !matchFilter(exprs, element) {
+			result = append(result, item)
+			continue
+		}
+		matched = true
+		switch {
+		case kind == PATCH_OP_REMOVE && sub == "":
+			continue
+		case kind == PATCH_OP_REMOVE:
+			delete(element, lookupKey(element, sub))
+		case sub == "":
+			if values, ok := value.(map[string]any); ok {
+				for k, v := range values {
+					element[lookupKey(element, k)] = v
+				}
+			}
+		default:
+			element[lookupKey(element, sub)] = value
+		}
+		result = append(result, element)
+	}
+	if !matched && kind != PATCH_OP_REMOVE {
+		// e.g. `emails[type eq "work"].value` creates the work email when there is none
+		element := map[string]any{}
+		for _, expr := range exprs {
+			if expr.Op == "eq" {
+				element[expr.Attr] = expr.Value
+			}
+		}
+		if sub != "" {
+			element[sub] = value
+		} else if values, ok := value.(map[string]any); ok {
+			for k, v := range values {
+				element[k] = v
+			}
+		}
+		result = append(result, element)
+	}
+	m[key] = result
+	return nil
+}
+
+// lookupKey returns the key of the map matching the name case-insensitively, or the name itself.
+func lookupKey(m map[string]any, name string) string {
+	if _, ok := m[name]; ok {
+		return name
+	}
+	for k := range m {
+		if strings.EqualFold(k, name) {
+			return k
+		}
+	}
+	return name
+}
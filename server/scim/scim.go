@@ -0,0 +1,309 @@
+package scim
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/choral-io/gommerce-server-aio/data/models"
+	srv "github.com/choral-io/gommerce-server-aio/server"
+	"github.com/choral-io/gommerce-server-core/logging"
+	"github.com/redis/rueidis"
+	"github.com/uptrace/bun"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	SCHEMA_USER                    = "urn:ietf:params:scim:schemas:core:2.0:User"
+	SCHEMA_GROUP                   = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	SCHEMA_SERVICE_PROVIDER_CONFIG = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+	SCHEMA_LIST_RESPONSE           = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	SCHEMA_PATCH_OP                = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	SCHEMA_ERROR                   = "urn:ietf:params:scim:api:messages:2.0:Error"
+
+	CONTENT_TYPE = "application/scim+json"
+	BASE_PATH    = "/scim/v2"
+
+	DEFAULT_PAGE_SIZE = 100
+	MAX_PAGE_SIZE     = 200
+	MAX_BODY_SIZE     = 1 << 20
+)
+
+// Error is a scim error response, see RFC 7644 section 3.12.
+type Error struct {
+	Status   int
+	ScimType string
+	Detail   string
+}
+
+func (e *Error) Error() string {
+	return e.Detail
+}
+
+func newError(status int, scimType, format string, args ...any) *Error {
+	return &Error{Status: status, ScimType: scimType, Detail: fmt.Sprintf(format, args...)}
+}
+
+type meta struct {
+	ResourceType string     `json:"resourceType"`
+	Created      time.Time  `json:"created"`
+	LastModified *time.Time `json:"lastModified,omitempty"`
+	Location     string     `json:"location"`
+}
+
+func newMeta(resourceType, location string, created time.Time, updated sql.NullTime) *meta {
+	m := &meta{ResourceType: resourceType, Created: created, Location: location}
+	if updated.Valid {
+		m.LastModified = &updated.Time
+	} else {
+		m.LastModified = &created
+	}
+	return m
+}
+
+type listResponse struct {
+	Schemas      []string `json:"schemas"`
+	TotalResults int      `json:"totalResults"`
+	StartIndex   int      `json:"startIndex"`
+	ItemsPerPage int      `json:"itemsPerPage"`
+	Resources    []any    `json:"Resources"`
+}
+
+type handlerFunc func(w http.ResponseWriter, r *http.Request, client *models.Client) error
+
+// Handler serves the scim 2.0 provisioning endpoints for users and groups, groups are mapped to roles.
+// Requests are authenticated with the credentials of a provisioning client, base64 encoded like basic
+// credentials and sent as bearer token, and are scoped to the realm of the client.
+type Handler struct {
+	bdb    bun.IDB
+	rdb    rueidis.Client
+	cts    *srv.BasicTokenStore
+	ss     *srv.SessionStore
+	al     *srv.AuditLogger
+	logger logging.Logger
+	mux    *http.ServeMux
+}
+
+func NewHandler(bdb bun.IDB, rdb rueidis.Client, cts *srv.BasicTokenStore, ss *srv.SessionStore, al *srv.AuditLogger, logger logging.Logger) *Handler {
+	h := &Handler{
+		bdb:    bdb,
+		rdb:    rdb,
+		cts:    cts,
+		ss:     ss,
+		al:     al,
+		logger: logger,
+		mux:    http.NewServeMux(),
+	}
+	h.mux.Handle("GET "+BASE_PATH+"/ServiceProviderConfig", h.handle(h.getServiceProviderConfig))
+	h.mux.Handle("GET "+BASE_PATH+"/Users", h.handle(h.listUsers))
+	h.mux.Handle("POST "+BASE_PATH+"/Users", h.handle(h.createUser))
+	h.mux.Handle("GET "+BASE_PATH+"/Users/{id}", h.handle(h.getUser))
+	h.mux.Handle("PUT "+BASE_PATH+"/Users/{id}", h.handle(h.replaceUser))
+	h.mux.Handle("PATCH "+BASE_PATH+"/Users/{id}", h.handle(h.patchUser))
+	h.mux.Handle("DELETE "+BASE_PATH+"/Users/{id}", h.handle(h.deleteUser))
+	h.mux.Handle("GET "+BASE_PATH+"/Groups", h.handle(h.listGroups))
+	h.mux.Handle("POST "+BASE_PATH+"/Groups", h.handle(h.createGroup))
+	h.mux.Handle("GET "+BASE_PATH+"/Groups/{id}", h.handle(h.getGroup))
+	h.mux.Handle("PUT "+BASE_PATH+"/Groups/{id}", h.handle(h.replaceGroup))
+	h.mux.Handle("PATCH "+BASE_PATH+"/Groups/{id}", h.handle(h.patchGroup))
+	h.mux.Handle("DELETE "+BASE_PATH+"/Groups/{id}", h.handle(h.deleteGroup))
+	h.mux.Handle(BASE_PATH+"/", h.handle(func(w http.ResponseWriter, r *http.Request, _ *models.Client) error {
+		return newError(http.StatusNotFound, "", "endpoint %s %s not found", r.Method, r.URL.Path)
+	}))
+	return h
+}
+
+// Mount returns a handler which serves the scim endpoints and passes all other requests on to next.
+func (h *Handler) Mount(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == BASE_PATH || strings.HasPrefix(r.URL.Path, BASE_PATH+"/") {
+			h.mux.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handle serves a scim request, requests other than GET are recorded by the audit logger, as scim is not
+// served through the grpc chain and its audit interceptor.
+func (h *Handler) handle(fn handlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		client, err := h.authenticate(r)
+		if err == nil {
+			err = fn(w, r, client)
+		}
+		if err != nil {
+			h.writeError(w, r, err)
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			h.audit(r, client, err, time.Since(start))
+		}
+	})
+}
+
+// audit records a mutating scim request, only the resource id is recorded as the body carries personal data.
+func (h *Handler) audit(r *http.Request, client *models.Client, err error, latency time.Duration) {
+	resource, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, BASE_PATH+"/"), "/")
+	var req map[string]string
+	if id := r.PathValue("id"); id != "" {
+		req = map[string]string{"id": id}
+	}
+	h.al.RecordRequest(r, "scim."+r.Method+" /"+resource, client, req, auditError(err), latency)
+}
+
+// auditError converts a scim error to the status error recorded by the audit logger.
+func auditError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var e *Error
+	if !errors.As(err, &e) {
+		return status.Error(codes.Internal, "internal server error")
+	}
+	code := codes.Unknown
+	switch e.Status {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge:
+		code = codes.InvalidArgument
+	case http.StatusUnauthorized:
+		code = codes.Unauthenticated
+	case http.StatusForbidden:
+		code = codes.PermissionDenied
+	case http.StatusNotFound:
+		code = codes.NotFound
+	case http.StatusConflict:
+		code = codes.AlreadyExists
+	case http.StatusInternalServerError:
+		code = codes.Internal
+	}
+	return status.Error(code, e.Detail)
+}
+
+// authenticate resolves the provisioning client of a request.
+func (h *Handler) authenticate(r *http.Request) (*models.Client, error) {
+	schema, value, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || (!strings.EqualFold(schema, "Bearer") && !strings.EqualFold(schema, "Basic")) {
+		return nil, newError(http.StatusUnauthorized, "", "bearer token is required")
+	}
+	token, err := h.cts.Verify(strings.TrimSpace(value))
+	if err != nil {
+		return nil, newError(http.StatusUnauthorized, "", "bearer token is invalid")
+	}
+	client := &models.Client{Id: token.Subject()}
+	if err := h.bdb.NewSelect().Model(client).Relation("Realm").WherePK().Scan(r.Context()); err != nil {
+		return nil, newError(http.StatusUnauthorized, "", "bearer token is invalid")
+	}
+	if !client.Provisioning() {
+		return nil, newError(http.StatusForbidden, "", "client %s is not allowed to provision users", client.Id)
+	}
+	return client, nil
+}
+
+func (h *Handler) getServiceProviderConfig(w http.ResponseWriter, r *http.Request, _ *models.Client) error {
+	supported := func(v bool) map[string]any { return map[string]any{"supported": v} }
+	return writeJSON(w, http.StatusOK, map[string]any{
+		"schemas":        []string{SCHEMA_SERVICE_PROVIDER_CONFIG},
+		"patch":          supported(true),
+		"bulk":           map[string]any{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+		"filter":         map[string]any{"supported": true, "maxResults": MAX_PAGE_SIZE},
+		"changePassword": supported(true),
+		"sort":           supported(false),
+		"etag":           supported(false),
+		"authenticationSchemes": []map[string]any{{
+			"type":        "oauthbearertoken",
+			"name":        "Provisioning client",
+			"description": "Base64 encoded credentials of a provisioning client sent as bearer token",
+		}},
+		"meta": map[string]any{"resourceType": "ServiceProviderConfig", "location": baseURL(r) + "/ServiceProviderConfig"},
+	})
+}
+
+func (h *Handler) writeError(w http.ResponseWriter, r *http.Request, err error) {
+	var e *Error
+	if !errors.As(err, &e) {
+		h.logger.Error("scim request failed", "method", r.Method, "path", r.URL.Path, "error", err)
+		e = newError(http.StatusInternalServerError, "", "internal server error")
+	}
+	if e.Status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="scim"`)
+	}
+	body := map[string]any{
+		"schemas": []string{SCHEMA_ERROR},
+		"status":  strconv.Itoa(e.Status),
+		"detail":  e.Detail,
+	}
+	if e.ScimType != "" {
+		body["scimType"] = e.ScimType
+	}
+	_ = writeJSON(w, e.Status, body)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) error {
+	var body []byte
+	if status != http.StatusNoContent {
+		var err error
+		if body, err = json.Marshal(v); err != nil {
+			return err
+		}
+	}
+	w.Header().Set("Content-Type", CONTENT_TYPE)
+	w.WriteHeader(status)
+	_, _ = w.Write(body)
+	return nil
+}
+
+func readJSON(r *http.Request, v any) error {
+	body, err := io.ReadAll(io.LimitReader(r.Body, MAX_BODY_SIZE+1))
+	if err != nil {
+		return newError(http.StatusBadRequest, "invalidSyntax", "error reading request body: %v", err)
+	}
+	if len(body) > MAX_BODY_SIZE {
+		return newError(http.StatusRequestEntityTooLarge, "", "request body exceeds %d bytes", MAX_BODY_SIZE)
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return newError(http.StatusBadRequest, "invalidSyntax", "request body is invalid: %v", err)
+	}
+	return nil
+}
+
+// baseURL returns the absolute url of the scim endpoints, honoring the scheme reported by proxies.
+func baseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	return scheme + "://" + r.Host + BASE_PATH
+}
+
+// paging returns the 1-based start index and the page size requested by the query parameters.
+func paging(r *http.Request) (int, int) {
+	start, err := strconv.Atoi(r.URL.Query().Get("startIndex"))
+	if err != nil || start < 1 {
+		start = 1
+	}
+	count, err := strconv.Atoi(r.URL.Query().Get("count"))
+	if err != nil {
+		count = DEFAULT_PAGE_SIZE
+	}
+	return start, max(0, min(count, MAX_PAGE_SIZE))
+}
+
+// excluded reports whether the attribute is listed in the excludedAttributes query parameter.
+func excluded(r *http.Request, attr string) bool {
+	for _, v := range strings.Split(r.URL.Query().Get("excludedAttributes"), ",") {
+		if strings.EqualFold(strings.TrimSpace(v), attr) {
+			return true
+		}
+	}
+	return false
+}
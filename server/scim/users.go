@@ -0,0 +1,510 @@
+package scim
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strings"
+
+	drivers "github.com/choral-io/gommerce-server-aio/data/drivers"
+	"github.com/choral-io/gommerce-server-aio/data/models"
+	srv "github.com/choral-io/gommerce-server-aio/server"
+	"github.com/choral-io/gommerce-server-aio/server/normalize"
+	"github.com/uptrace/bun"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	USER_USERNAME_EXPR = `(SELECT "l"."identifier" FROM "logins" AS "l" WHERE "l"."user_id" = "user"."id" AND "l"."provider" = '` +
+		models.LOGIN_PROVIDER_FORM_PASSWORD + `' AND "l"."deleted_at" IS NULL LIMIT 1)`
+	USER_DISPLAY_NAME_EXPR = `"user"."attributes"->>'` + models.USER_ATTRIBUTE_PROFILE_DISPLAY_NAME + `'`
+	USER_EXTERNAL_ID_EXPR  = `"user"."attributes"->>'` + models.USER_ATTRIBUTE_SCIM_EXTERNAL_ID + `'`
+)
+
+var userFilterAttrs = map[string]filterAttr{
+	"id":                 {Expr: `"user"."id"`, Type: FILTER_TYPE_STRING, CaseExact: true},
+	"username":           {Expr: USER_USERNAME_EXPR, Type: FILTER_TYPE_STRING, Normalize: normalize.Username},
+	"externalid":         {Expr: USER_EXTERNAL_ID_EXPR, Type: FILTER_TYPE_STRING, CaseExact: true},
+	"displayname":        {Expr: USER_DISPLAY_NAME_EXPR, Type: FILTER_TYPE_STRING},
+	"name.formatted":     {Expr: USER_DISPLAY_NAME_EXPR, Type: FILTER_TYPE_STRING},
+	"emails":             {Expr: `"user"."email_address"`, Type: FILTER_TYPE_STRING},
+	"emails.value":       {Expr: `"user"."email_address"`, Type: FILTER_TYPE_STRING},
+	"phonenumbers":       {Expr: `"user"."phone_number"`, Type: FILTER_TYPE_STRING},
+	"phonenumbers.value": {Expr: `"user"."phone_number"`, Type: FILTER_TYPE_STRING},
+	"active":             {Expr: `NOT "user"."disabled"`, Type: FILTER_TYPE_BOOLEAN},
+}
+
+type userName struct {
+	Formatted  string `json:"formatted,omitempty"`
+	GivenName  string `json:"givenName,omitempty"`
+	FamilyName string `json:"familyName,omitempty"`
+}
+
+type multiValue struct {
+	Value   string   `json:"value"`
+	Type    string   `json:"type,omitempty"`
+	Primary flexBool `json:"primary,omitempty"`
+}
+
+type reference struct {
+	Value   string `json:"value"`
+	Ref     string `json:"$ref,omitempty"`
+	Display string `json:"display,omitempty"`
+}
+
+type userResource struct {
+	Schemas      []string     `json:"schemas"`
+	Id           string       `json:"id,omitempty"`
+	ExternalId   string       `json:"externalId,omitempty"`
+	UserName     string       `json:"userName"`
+	Name         *userName    `json:"name,omitempty"`
+	DisplayName  string       `json:"displayName,omitempty"`
+	Active       *flexBool    `json:"active,omitempty"`
+	Password     string       `json:"password,omitempty"`
+	Emails       []multiValue `json:"emails,omitempty"`
+	PhoneNumbers []multiValue `json:"phoneNumbers,omitempty"`
+	Groups       []reference  `json:"groups,omitempty"`
+	Meta         *meta        `json:"meta,omitempty"`
+}
+
+// userInput is the normalized content of a user resource written by a provisioning client.
+type userInput struct {
+	username     string
+	externalId   string
+	displayName  sql.NullString
+	emailAddress sql.NullString
+	phoneNumber  sql.NullString
+	active       bool
+	password     string
+}
+
+func toUserResource(base string, u models.User, login *models.Login, roles []models.Role) *userResource {
+	active := flexBool(!u.Disabled)
+	res := &userResource{
+		Schemas:    []string{SCHEMA_USER},
+		Id:         u.Id,
+		ExternalId: u.Attributes[models.USER_ATTRIBUTE_SCIM_EXTERNAL_ID],
+		UserName:   u.Id,
+		Active:     &active,
+		Meta:       newMeta("User", base+"/Users/"+u.Id, u.CreatedAt, u.UpdatedAt),
+	}
+	if login != nil {
+		res.UserName = login.Identifier
+	}
+	if u.Profile != nil && u.Profile.DisplayName.Valid {
+		res.DisplayName = u.Profile.DisplayName.String
+		res.Name = &userName{Formatted: u.Profile.DisplayName.String}
+	}
+	if u.EmailAddress.Valid {
+		res.Emails = []multiValue{{Value: u.EmailAddress.String, Type: "work", Primary: true}}
+	}
+	if u.PhoneNumber.Valid {
+		res.PhoneNumbers = []multiValue{{Value: u.PhoneNumber.String, Type: "mobile", Primary: true}}
+	}
+	for _, r := range roles {
+		res.Groups = append(res.Groups, reference{Value: r.Id, Ref: base + "/Groups/" + r.Id, Display: r.Name})
+	}
+	return res
+}
+
+// primaryValue returns the value of the primary element of a multi-valued attribute, or of its first element.
+func primaryValue(values []multiValue) string {
+	for _, v := range values {
+		if v.Primary {
+			return v.Value
+		}
+	}
+	if len(values) > 0 {
+		return values[0].Value
+	}
+	return ""
+}
+
+func parseUserResource(res *userResource) (*userInput, error) {
+	username, err := normalize.Username(res.UserName)
+	if err != nil {
+		return nil, newError(http.StatusBadRequest, "invalidValue", "userName is invalid: %v", err)
+	}
+	in := &userInput{
+		username:   username,
+		externalId: res.ExternalId,
+		active:     res.Active == nil || bool(*res.Active),
+		password:   res.Password,
+	}
+	displayName := strings.TrimSpace(res.DisplayName)
+	if displayName == "" && res.Name != nil {
+		if displayName = strings.TrimSpace(res.Name.Formatted); displayName == "" {
+			displayName = strings.TrimSpace(res.Name.GivenName + " " + res.Name.FamilyName)
+		}
+	}
+	if displayName != "" {
+		in.displayName = sql.NullString{Valid: true, String: displayName}
+	}
+	if v := primaryValue(res.Emails); v != "" {
+		email, err := normalize.EmailAddress(v)
+		if err != nil {
+			return nil, newError(http.StatusBadRequest, "invalidValue", "email address %s is invalid: %v", v, err)
+		}
+		in.emailAddress = sql.NullString{Valid: true, String: email}
+	}
+	if v := primaryValue(res.PhoneNumbers); v != "" {
+		phone, err := normalize.PhoneNumber(v, normalize.DefaultPhoneRegion())
+		if err != nil {
+			return nil, newError(http.StatusBadRequest, "invalidValue", "phone number %s is invalid: %v", v, err)
+		}
+		in.phoneNumber = sql.NullString{Valid: true, String: phone}
+	}
+	return in, nil
+}
+
+// applyUserInput copies the input into the user, contacts asserted by the identity provider are considered verified.
+func applyUserInput(u *models.User, profile *models.Profile, in *userInput) {
+	u.Disabled = !in.active
+	u.EmailAddress = in.emailAddress
+	u.PhoneNumber = in.phoneNumber
+	u.Flags &^= models.USER_FLAGS_EMAIL_ADDRESS_VERIFIED | models.USER_FLAGS_PHONE_NUMBER_VERIFIED
+	if in.emailAddress.Valid {
+		u.Flags |= models.USER_FLAGS_EMAIL_ADDRESS_VERIFIED
+	}
+	if in.phoneNumber.Valid {
+		u.Flags |= models.USER_FLAGS_PHONE_NUMBER_VERIFIED
+	}
+	if u.Attributes == nil {
+		u.Attributes = map[string]string{}
+	}
+	if in.externalId != "" {
+		u.Attributes[models.USER_ATTRIBUTE_SCIM_EXTERNAL_ID] = in.externalId
+	} else {
+		delete(u.Attributes, models.USER_ATTRIBUTE_SCIM_EXTERNAL_ID)
+	}
+	profile.DisplayName = in.displayName
+	profile.ApplyAttributes(u.Attributes)
+}
+
+// checkContactsAvailable ensures that no other user of the realm uses the email address or phone number.
+func checkContactsAvailable(ctx context.Context, tx bun.IDB, realmId, userId string, in *userInput) error {
+	for column, value := range map[string]sql.NullString{"email_address": in.emailAddress, "phone_number": in.phoneNumber} {
+		if !value.Valid {
+			continue
+		}
+		exists, err := tx.NewSelect().Model((*models.User)(nil)).
+			Where(`"user"."realm_id" = ?`, realmId).
+			Where(`"user".? = ?`, bun.Ident(column), value.String).
+			Where(`"user"."id" <> ?`, userId).
+			Exists(ctx)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return newError(http.StatusConflict, "uniqueness", "%s %s is already in use", column, value.String)
+		}
+	}
+	return nil
+}
+
+func hashPassword(password string) (sql.NullString, error) {
+	hp, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+	return sql.NullString{Valid: true, String: string(hp)}, nil
+}
+
+func (h *Handler) findUser(ctx context.Context, bdb bun.IDB, realmId, id string) (*models.User, error) {
+	user := &models.User{}
+	if err := bdb.NewSelect().Model(user).Relation("Profile").
+		Where(`"user"."id" = ?`, id).
+		Where(`"user"."realm_id" = ?`, realmId).
+		Scan(ctx); errors.Is(err, sql.ErrNoRows) {
+		return nil, newError(http.StatusNotFound, "", "user %s not found", id)
+	} else if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// userLogins returns the password logins of the users, which carry their user names.
+func (h *Handler) userLogins(ctx context.Context, userIds ...string) (map[string]*models.Login, error) {
+	result := map[string]*models.Login{}
+	if len(userIds) == 0 {
+		return result, nil
+	}
+	var logins []models.Login
+	if err := h.bdb.NewSelect().Model(&logins).
+		Where(`"login"."user_id" IN (?)`, bun.In(userIds)).
+		Where(`"login"."provider" = ?`, models.LOGIN_PROVIDER_FORM_PASSWORD).
+		Scan(ctx); err != nil {
+		return nil, err
+	}
+	for i := range logins {
+		result[logins[i].UserId] = &logins[i]
+	}
+	return result, nil
+}
+
+// userRoles returns the roles of the users, which are exposed as their groups.
+func (h *Handler) userRoles(ctx context.Context, userIds ...string) (map[string][]models.Role, error) {
+	result := map[string][]models.Role{}
+	if len(userIds) == 0 {
+		return result, nil
+	}
+	var roleUsers []models.RoleUser
+	if err := h.bdb.NewSelect().Model(&roleUsers).Relation("Role").
+		Where(`"role_user"."user_id" IN (?)`, bun.In(userIds)).
+		Scan(ctx); err != nil {
+		return nil, err
+	}
+	for _, ru := range roleUsers {
+		if ru.Role != nil {
+			result[ru.UserId] = append(result[ru.UserId], *ru.Role)
+		}
+	}
+	return result, nil
+}
+
+func (h *Handler) loadUserResource(ctx context.Context, base, realmId, id string) (*userResource, error) {
+	user, err := h.findUser(ctx, h.bdb, realmId, id)
+	if err != nil {
+		return nil, err
+	}
+	logins, err := h.userLogins(ctx, user.Id)
+	if err != nil {
+		return nil, err
+	}
+	roles, err := h.userRoles(ctx, user.Id)
+	if err != nil {
+		return nil, err
+	}
+	return toUserResource(base, *user, logins[user.Id], roles[user.Id]), nil
+}
+
+func (h *Handler) listUsers(w http.ResponseWriter, r *http.Request, client *models.Client) error {
+	filter, err := withFilter(r.URL.Query().Get("filter"), userFilterAttrs)
+	if err != nil {
+		return err
+	}
+	start, count := paging(r)
+	var users []models.User
+	query := h.bdb.NewSelect().Model(&users).Relation("Profile").
+		Where(`"user"."realm_id" = ?`, client.RealmId.String).
+		Apply(filter).
+		OrderExpr(`"user"."id" ASC`)
+	var total int
+	if count == 0 {
+		total, err = query.Count(r.Context())
+	} else {
+		total, err = query.Offset(start - 1).Limit(count).ScanAndCount(r.Context())
+	}
+	if err != nil {
+		return err
+	}
+	ids := make([]string, len(users))
+	for i, u := range users {
+		ids[i] = u.Id
+	}
+	logins, err := h.userLogins(r.Context(), ids...)
+	if err != nil {
+		return err
+	}
+	roles, err := h.userRoles(r.Context(), ids...)
+	if err != nil {
+		return err
+	}
+	res := &listResponse{
+		Schemas:      []string{SCHEMA_LIST_RESPONSE},
+		TotalResults: total,
+		StartIndex:   start,
+		ItemsPerPage: len(users),
+		Resources:    make([]any, len(users)),
+	}
+	for i, u := range users {
+		res.Resources[i] = toUserResource(baseURL(r), u, logins[u.Id], roles[u.Id])
+	}
+	return writeJSON(w, http.StatusOK, res)
+}
+
+func (h *Handler) getUser(w http.ResponseWriter, r *http.Request, client *models.Client) error {
+	res, err := h.loadUserResource(r.Context(), baseURL(r), client.RealmId.String, r.PathValue("id"))
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, res)
+}
+
+func (h *Handler) createUser(w http.ResponseWriter, r *http.Request, client *models.Client) error {
+	var req userResource
+	if err := readJSON(r, &req); err != nil {
+		return err
+	}
+	in, err := parseUserResource(&req)
+	if err != nil {
+		return err
+	}
+	realmId := client.RealmId.String
+	user := &models.User{RealmId: realmId, Approved: true, Verified: true}
+	profile := &models.Profile{}
+	applyUserInput(user, profile, in)
+	login := &models.Login{
+		RealmId:    realmId,
+		Provider:   models.LOGIN_PROVIDER_FORM_PASSWORD,
+		Identifier: in.username,
+		Metadata:   map[string]string{},
+	}
+	if in.password != "" {
+		if login.Credential, err = hashPassword(in.password); err != nil {
+			return err
+		}
+	}
+	err = h.bdb.RunInTx(r.Context(), nil, func(ctx context.Context, tx bun.Tx) error {
+		if err := checkContactsAvailable(ctx, tx, realmId, "", in); err != nil {
+			return err
+		}
+		if _, err := tx.NewInsert().Model(user).Exec(ctx); err != nil {
+			return err
+		}
+		profile.Id = user.Id
+		if _, err := tx.NewInsert().Model(profile).Exec(ctx); err != nil {
+			return err
+		}
+		login.UserId = user.Id
+		if _, err := tx.NewInsert().Model(login).Exec(ctx); drivers.IsUniqueViolation(err, models.LOGIN_UNIQUE_INDEX) {
+			return newError(http.StatusConflict, "uniqueness", "userName %s is already taken", in.username)
+		} else if err != nil {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	user.Profile = profile
+	res := toUserResource(baseURL(r), *user, login, nil)
+	w.Header().Set("Location", res.Meta.Location)
+	return writeJSON(w, http.StatusCreated, res)
+}
+
+func (h *Handler) replaceUser(w http.ResponseWriter, r *http.Request, client *models.Client) error {
+	var req userResource
+	if err := readJSON(r, &req); err != nil {
+		return err
+	}
+	return h.updateUser(w, r, client, &req)
+}
+
+func (h *Handler) patchUser(w http.ResponseWriter, r *http.Request, client *models.Client) error {
+	var req patchRequest
+	if err := readJSON(r, &req); err != nil {
+		return err
+	}
+	current, err := h.loadUserResource(r.Context(), baseURL(r), client.RealmId.String, r.PathValue("id"))
+	if err != nil {
+		return err
+	}
+	var patched userResource
+	if err := patchResource(current, &req, &patched); err != nil {
+		return err
+	}
+	return h.updateUser(w, r, client, &patched)
+}
+
+// updateUser replaces the user with the given resource, the password is only changed when given.
+func (h *Handler) updateUser(w http.ResponseWriter, r *http.Request, client *models.Client, req *userResource) error {
+	in, err := parseUserResource(req)
+	if err != nil {
+		return err
+	}
+	var credential sql.NullString
+	if in.password != "" {
+		if credential, err = hashPassword(in.password); err != nil {
+			return err
+		}
+	}
+	realmId, id := client.RealmId.String, r.PathValue("id")
+	err = h.bdb.RunInTx(r.Context(), nil, func(ctx context.Context, tx bun.Tx) error {
+		user, err := h.findUser(ctx, tx, realmId, id)
+		if err != nil {
+			return err
+		}
+		if user.Immutable {
+			return newError(http.StatusBadRequest, "mutability", "user %s is immutable", id)
+		}
+		if err := checkContactsAvailable(ctx, tx, realmId, user.Id, in); err != nil {
+			return err
+		}
+		profile := user.Profile
+		if profile == nil {
+			profile = &models.Profile{Id: user.Id}
+		}
+		applyUserInput(user, profile, in)
+		if _, err := tx.NewUpdate().Model(user).
+			Column("disabled", "email_address", "phone_number", "flags", "attributes", "updated_at").
+			WherePK().Exec(ctx); err != nil {
+			return err
+		}
+		if _, err := tx.NewInsert().Model(profile).
+			On(`CONFLICT ("id") DO UPDATE`).
+			Set(`"display_name" = EXCLUDED."display_name"`).
+			Set(`"updated_at" = EXCLUDED."created_at"`).
+			Exec(ctx); err != nil {
+			return err
+		}
+		login := &models.Login{}
+		err = tx.NewSelect().Model(login).
+			Where(`"login"."user_id" = ?`, user.Id).
+			Where(`"login"."provider" = ?`, models.LOGIN_PROVIDER_FORM_PASSWORD).
+			Scan(ctx)
+		if errors.Is(err, sql.ErrNoRows) {
+			login = &models.Login{
+				UserId:     user.Id,
+				RealmId:    realmId,
+				Provider:   models.LOGIN_PROVIDER_FORM_PASSWORD,
+				Identifier: in.username,
+				Credential: credential,
+				Metadata:   map[string]string{},
+			}
+			_, err = tx.NewInsert().Model(login).Exec(ctx)
+		} else if err == nil {
+			columns := []string{"identifier", "updated_at"}
+			login.Identifier = in.username
+			if credential.Valid {
+				login.Credential = credential
+				columns = append(columns, "credential")
+			}
+			_, err = tx.NewUpdate().Model(login).Column(columns...).WherePK().Exec(ctx)
+		}
+		if drivers.IsUniqueViolation(err, models.LOGIN_UNIQUE_INDEX) {
+			return newError(http.StatusConflict, "uniqueness", "userName %s is already taken", in.username)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if !in.active || in.password != "" {
+		// deactivated users and changed passwords end all sessions
+		if _, err := h.ss.RevokeUser(r.Context(), id); err != nil {
+			return err
+		}
+	}
+	res, err := h.loadUserResource(r.Context(), baseURL(r), realmId, id)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, res)
+}
+
+// deleteUser erases the user, see srv.EraseUser.
+func (h *Handler) deleteUser(w http.ResponseWriter, r *http.Request, client *models.Client) error {
+	user, err := h.findUser(r.Context(), h.bdb, client.RealmId.String, r.PathValue("id"))
+	if err != nil {
+		return err
+	}
+	if user.Immutable {
+		return newError(http.StatusBadRequest, "mutability", "user %s is immutable", user.Id)
+	}
+	if err := srv.EraseUser(r.Context(), h.bdb, h.rdb, h.ss, user.Id); err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusNoContent, nil)
+}
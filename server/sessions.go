@@ -0,0 +1,124 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/choral-io/gommerce-server-core/config"
+	"github.com/choral-io/gommerce-server-core/secure"
+	"github.com/redis/rueidis"
+)
+
+const (
+	SESSIONS_USER_KEY_PREFIX   = "sessions:user:"
+	SESSIONS_CLIENT_KEY_PREFIX = "sessions:client:"
+	SESSIONS_DEVICE_KEY_PREFIX = "sessions:device:"
+
+	// SCOPE_DEVICE_PREFIX carries the id of the device a token has been issued on, so that refreshed
+	// tokens stay bound to the same device.
+	SCOPE_DEVICE_PREFIX = "DEVICE_"
+)
+
+// DeviceScope returns the scope entry which binds a token to the given device.
+func DeviceScope(deviceId string) string {
+	return SCOPE_DEVICE_PREFIX + deviceId
+}
+
+// DeviceFromScope returns the id of the device a token has been issued on, or an empty string.
+func DeviceFromScope(scope []string) string {
+	for _, s := range scope {
+		if strings.HasPrefix(s, SCOPE_DEVICE_PREFIX) {
+			return strings.TrimPrefix(s, SCOPE_DEVICE_PREFIX)
+		}
+	}
+	return ""
+}
+
+// SessionStore keeps track of the tokens issued to users and clients, so that all sessions of them can be revoked at once.
+type SessionStore struct {
+	cfg config.TokenConfig
+	rdb rueidis.Client
+	ts  secure.TokenStore
+}
+
+func NewSessionStore(cfg config.TokenConfig, rdb rueidis.Client, ts secure.TokenStore) *SessionStore {
+	return &SessionStore{
+		cfg: cfg,
+		rdb: rdb,
+		ts:  ts,
+	}
+}
+
+// Add records issued token values of the given user and client.
+func (s *SessionStore) Add(ctx context.Context, userId, clientId string, values ...string) error {
+	ttl := int64(s.cfg.GetRefreshTokenTTL().Seconds())
+	cmds := make(rueidis.Commands, 0, 4)
+	for _, key := range []string{SESSIONS_USER_KEY_PREFIX + userId, SESSIONS_CLIENT_KEY_PREFIX + clientId} {
+		cmds = append(cmds,
+			s.rdb.B().Sadd().Key(key).Member(values...).Build(),
+			s.rdb.B().Expire().Key(key).Seconds(ttl).Build(),
+		)
+	}
+	for _, res := range s.rdb.DoMulti(ctx, cmds...) {
+		if err := res.Error(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddDevice records issued token values of the given device.
+func (s *SessionStore) AddDevice(ctx context.Context, deviceId string, values ...string) error {
+	key := SESSIONS_DEVICE_KEY_PREFIX + deviceId
+	cmds := rueidis.Commands{
+		s.rdb.B().Sadd().Key(key).Member(values...).Build(),
+		s.rdb.B().Expire().Key(key).Seconds(int64(s.cfg.GetRefreshTokenTTL().Seconds())).Build(),
+	}
+	for _, res := range s.rdb.DoMulti(ctx, cmds...) {
+		if err := res.Error(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CountUser returns the number of tokens issued to the user which may still be valid.
+func (s *SessionStore) CountUser(ctx context.Context, userId string) (int64, error) {
+	return s.rdb.Do(ctx, s.rdb.B().Scard().Key(SESSIONS_USER_KEY_PREFIX+userId).Build()).AsInt64()
+}
+
+// RevokeUser revokes all tokens issued to the user and returns the number of revoked tokens.
+func (s *SessionStore) RevokeUser(ctx context.Context, userId string) (int, error) {
+	return s.revoke(ctx, SESSIONS_USER_KEY_PREFIX+userId)
+}
+
+// RevokeClient revokes all tokens issued through the client and returns the number of revoked tokens.
+func (s *SessionStore) RevokeClient(ctx context.Context, clientId string) (int, error) {
+	return s.revoke(ctx, SESSIONS_CLIENT_KEY_PREFIX+clientId)
+}
+
+// RevokeDevice revokes all tokens issued on the device and returns the number of revoked tokens.
+func (s *SessionStore) RevokeDevice(ctx context.Context, deviceId string) (int, error) {
+	return s.revoke(ctx, SESSIONS_DEVICE_KEY_PREFIX+deviceId)
+}
+
+func (s *SessionStore) revoke(ctx context.Context, key string) (int, error) {
+	values, err := s.rdb.Do(ctx, s.rdb.B().Smembers().Key(key).Build()).AsStrSlice()
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	for _, v := range values {
+		// tokens may have expired or been revoked already
+		if _, err := s.ts.Revoke(v); err == nil {
+			n++
+		} else if !errors.Is(err, secure.ErrInvalidToken) {
+			return n, err
+		}
+	}
+	if err := s.rdb.Do(ctx, s.rdb.B().Del().Key(key).Build()).Error(); err != nil {
+		return n, err
+	}
+	return n, nil
+}
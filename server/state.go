@@ -0,0 +1,81 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/choral-io/gommerce-server-aio/data/models"
+)
+
+// State keys hold the scope of their owner, client and user ids are not guaranteed to be distinct.
+const (
+	STATE_CLIENT_KEY_TEMPLATE = "state:store:client:%s:%s"
+	STATE_USER_KEY_TEMPLATE   = "state:store:user:%s:%s"
+	STATE_KEY_PREFIX          = "state:store:"
+	STATE_MIGRATED_KEY        = "state:migrated"
+	STATE_SCAN_COUNT          = 1000
+)
+
+// StateUserKeyPrefix returns the prefix of the state keys owned by the user or guest.
+func StateUserKeyPrefix(userId string) string {
+	return fmt.Sprintf(STATE_USER_KEY_TEMPLATE, userId, "")
+}
+
+// StateClientKeyPrefix returns the prefix of the state keys owned by the client.
+func StateClientKeyPrefix(clientId string) string {
+	return fmt.Sprintf(STATE_CLIENT_KEY_TEMPLATE, clientId, "")
+}
+
+// migrateStateKeys moves the state keys written before their scope was part of the key, "state:store:<owner>:<key>",
+// into the keyspace of the owner. Owners found in the clients table are clients, all others are users or guests.
+// Keys already present in the new keyspace are kept and the legacy values are dropped. Once all keys are moved a
+// marker is set, so later sweeps skip the scan.
+func (s *Sweeper) migrateStateKeys(ctx context.Context, res *SweeperResult) error {
+	if migrated, err := s.rdb.Do(ctx, s.rdb.B().Exists().Key(STATE_MIGRATED_KEY).Build()).AsInt64(); err != nil {
+		return err
+	} else if migrated > 0 {
+		return nil
+	}
+	clients := map[string]bool{}
+	var cursor uint64
+	for {
+		entry, err := s.rdb.Do(ctx, s.rdb.B().Scan().Cursor(cursor).Match(STATE_KEY_PREFIX+"*").Count(STATE_SCAN_COUNT).Build()).AsScanEntry()
+		if err != nil {
+			return err
+		}
+		for _, key := range entry.Elements {
+			owner, rest, ok := strings.Cut(strings.TrimPrefix(key, STATE_KEY_PREFIX), ":")
+			if !ok || owner == "client" || owner == "user" {
+				continue
+			}
+			isClient, ok := clients[owner]
+			if !ok {
+				if isClient, err = s.bdb.NewSelect().Model((*models.Client)(nil)).WhereAllWithDeleted().Where(`"id" = ?`, owner).Exists(ctx); err != nil {
+					return err
+				}
+				clients[owner] = isClient
+			}
+			target := fmt.Sprintf(STATE_USER_KEY_TEMPLATE, owner, rest)
+			if isClient {
+				target = fmt.Sprintf(STATE_CLIENT_KEY_TEMPLATE, owner, rest)
+			}
+			moved, err := s.rdb.Do(ctx, s.rdb.B().Renamenx().Key(key).Newkey(target).Build()).AsBool()
+			if err != nil && strings.Contains(err.Error(), "no such key") {
+				continue // expired meanwhile
+			} else if err != nil {
+				return err
+			}
+			if !moved {
+				if err := s.rdb.Do(ctx, s.rdb.B().Unlink().Key(key).Build()).Error(); err != nil {
+					return err
+				}
+			}
+			res.Migrated++
+		}
+		if cursor = entry.Cursor; cursor == 0 {
+			break
+		}
+	}
+	return s.rdb.Do(ctx, s.rdb.B().Set().Key(STATE_MIGRATED_KEY).Value("1").Build()).Error()
+}
@@ -0,0 +1,380 @@
+package server
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/choral-io/gommerce-server-aio/data/models"
+	"github.com/choral-io/gommerce-server-core/logging"
+	"github.com/choral-io/gommerce-server-core/secure"
+	"github.com/redis/rueidis"
+	"github.com/uptrace/bun"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+const (
+	SWEEPER_INTERVAL_ENV      = "GOMMERCE_SWEEPER_INTERVAL"
+	SWEEPER_RETENTION_ENV     = "GOMMERCE_SWEEPER_RETENTION"
+	SWEEPER_DEFAULT_INTERVAL  = 10 * time.Minute
+	SWEEPER_DEFAULT_RETENTION = 30 * 24 * time.Hour
+	SWEEPER_LOCK_KEY          = "sweeper:lock"
+	SWEEPER_PURGE_BATCH_SIZE  = 500
+	SWEEPER_METER_NAME        = "github.com/choral-io/gommerce-server-aio/server"
+)
+
+// releases the lock only if it is still held by the given owner
+var sweeperUnlockScript = rueidis.NewLuaScript(`if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("DEL", KEYS[1]) else return 0 end`)
+
+// SweeperResult is the summary of a single sweep.
+type SweeperResult struct {
+	Disabled map[string]int
+	Revoked  int
+	Erased   int
+	Purged   map[string]int
+	Migrated int
+}
+
+// Sweeper periodically disables expired users, logins and clients, revokes their sessions, erases
+// users whose erasure grace period is over and hard deletes rows which have been soft deleted longer
+// than the retention. Legacy state keys are migrated by the first sweep, which runs at start. A redis lock ensures
+// that only one node of a cluster sweeps at a time.
+type Sweeper struct {
+	bdb       bun.IDB
+	rdb       rueidis.Client
+	ss        *SessionStore
+	logger    logging.Logger
+	interval  time.Duration
+	retention time.Duration
+
+	disabled metric.Int64Counter
+	revoked  metric.Int64Counter
+	erased   metric.Int64Counter
+	purged   metric.Int64Counter
+
+	stop chan struct{}
+	done sync.WaitGroup
+}
+
+func NewSweeper(bdb bun.IDB, rdb rueidis.Client, ss *SessionStore, logger logging.Logger, mp metric.MeterProvider) (*Sweeper, error) {
+	s := &Sweeper{
+		bdb:       bdb,
+		rdb:       rdb,
+		ss:        ss,
+		logger:    logger,
+		interval:  SWEEPER_DEFAULT_INTERVAL,
+		retention: SWEEPER_DEFAULT_RETENTION,
+		stop:      make(chan struct{}),
+	}
+	if v, err := time.ParseDuration(os.Getenv(SWEEPER_INTERVAL_ENV)); err == nil && v > 0 {
+		s.interval = v
+	}
+	if v, err := time.ParseDuration(os.Getenv(SWEEPER_RETENTION_ENV)); err == nil && v > 0 {
+		s.retention = v
+	}
+	meter := mp.Meter(SWEEPER_METER_NAME)
+	var err error
+	if s.disabled, err = meter.Int64Counter("gommerce.sweeper.disabled",
+		metric.WithDescription("Number of expired rows disabled by the sweeper.")); err != nil {
+		return nil, err
+	}
+	if s.revoked, err = meter.Int64Counter("gommerce.sweeper.revoked",
+		metric.WithDescription("Number of tokens revoked by the sweeper.")); err != nil {
+		return nil, err
+	}
+	if s.erased, err = meter.Int64Counter("gommerce.sweeper.erased",
+		metric.WithDescription("Number of users erased by the sweeper.")); err != nil {
+		return nil, err
+	}
+	if s.purged, err = meter.Int64Counter("gommerce.sweeper.purged",
+		metric.WithDescription("Number of soft deleted rows hard deleted by the sweeper.")); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Sweeper) Start(context.Context) error {
+	s.done.Add(1)
+	go func() {
+		defer s.done.Done()
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+		s.run()
+		for {
+			select {
+			case <-ticker.C:
+				s.run()
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (s *Sweeper) Stop(ctx context.Context) error {
+	close(s.stop)
+	waited := make(chan struct{})
+	go func() {
+		s.done.Wait()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *Sweeper) run() {
+	ctx, cancel := context.WithTimeout(context.Background(), s.interval)
+	defer cancel()
+	owner, err := secure.RandString(16, secure.DEFAULT_PASSWORD_SYMBOLS)
+	if err != nil {
+		s.logger.Error("failed to create sweeper lock owner", "error", err)
+		return
+	}
+	err = s.rdb.Do(ctx, s.rdb.B().Set().Key(SWEEPER_LOCK_KEY).Value(owner).Nx().PxMilliseconds(s.interval.Milliseconds()).Build()).Error()
+	if rueidis.IsRedisNil(err) {
+		s.logger.Debug("sweeper is running on another node")
+		return
+	} else if err != nil {
+		s.logger.Error("failed to acquire sweeper lock", "error", err)
+		return
+	}
+	defer func() {
+		if err := sweeperUnlockScript.Exec(context.Background(), s.rdb, []string{SWEEPER_LOCK_KEY}, []string{owner}).Error(); err != nil {
+			s.logger.Warn("failed to release sweeper lock", "error", err)
+		}
+	}()
+	res, err := s.Sweep(ctx, time.Now())
+	if err != nil {
+		s.logger.Error("failed to sweep", "error", err)
+	}
+	if res != nil {
+		s.logger.Info("sweep finished", "disabled", res.Disabled, "revoked", res.Revoked, "erased", res.Erased, "purged", res.Purged, "migrated", res.Migrated)
+	}
+}
+
+// Sweep runs all sweeping steps once, the result holds the counts of the finished steps even if an error occurs.
+func (s *Sweeper) Sweep(ctx context.Context, now time.Time) (*SweeperResult, error) {
+	res := &SweeperResult{
+		Disabled: map[string]int{},
+		Purged:   map[string]int{},
+	}
+	if err := s.disableExpired(ctx, now, res); err != nil {
+		return res, err
+	}
+	if err := s.eraseScheduled(ctx, now, res); err != nil {
+		return res, err
+	}
+	if err := s.purgeDeleted(ctx, now.Add(-s.retention), res); err != nil {
+		return res, err
+	}
+	if err := s.migrateStateKeys(ctx, res); err != nil {
+		return res, err
+	}
+	return res, nil
+}
+
+func (s *Sweeper) disableExpired(ctx context.Context, now time.Time, res *SweeperResult) error {
+	for _, m := range []struct {
+		table  string
+		model  any
+		revoke func(context.Context, string) (int, error)
+	}{
+		{"users", (*models.User)(nil), s.ss.RevokeUser},
+		{"clients", (*models.Client)(nil), s.ss.RevokeClient},
+		{"logins", (*models.Login)(nil), s.revokeLoginUser},
+	} {
+		var ids []string
+		if _, err := s.bdb.NewUpdate().Model(m.model).
+			Set(`"disabled" = TRUE`).
+			Set(`"updated_at" = ?`, now).
+			Where(`"disabled" = FALSE`).
+			Where(`"expires_at" <= ?`, now).
+			Returning(`"id"`).
+			Exec(ctx, &ids); err != nil {
+			return err
+		}
+		res.Disabled[m.table] += len(ids)
+		s.disabled.Add(ctx, int64(len(ids)), metric.WithAttributes(attribute.String("table", m.table)))
+		if m.revoke == nil {
+			continue
+		}
+		for _, id := range ids {
+			n, err := m.revoke(ctx, id)
+			res.Revoked += n
+			s.revoked.Add(ctx, int64(n), metric.WithAttributes(attribute.String("table", m.table)))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// revokeLoginUser revokes the sessions of the user of a login, they may have been created through the expired login.
+func (s *Sweeper) revokeLoginUser(ctx context.Context, loginId string) (int, error) {
+	var userId string
+	if err := s.bdb.NewSelect().Model((*models.Login)(nil)).Column("user_id").
+		Where(`"id" = ?`, loginId).Scan(ctx, &userId); err != nil {
+		return 0, err
+	}
+	return s.ss.RevokeUser(ctx, userId)
+}
+
+func (s *Sweeper) eraseScheduled(ctx context.Context, now time.Time, res *SweeperResult) error {
+	// page in erase order, users which fail to be erased are logged and skipped by the following pages
+	var after *erasureCandidate
+	for {
+		var users []erasureCandidate
+		if err := s.bdb.NewSelect().Model((*models.User)(nil)).Column("id", "erase_at").
+			Where(`"erase_at" <= ?`, now).
+			Apply(func(q *bun.SelectQuery) *bun.SelectQuery {
+				if after != nil {
+					q = q.Where(`("erase_at", "id") > (?, ?)`, after.EraseAt, after.Id)
+				}
+				return q
+			}).
+			OrderExpr(`"erase_at" ASC, "id" ASC`).
+			Limit(SWEEPER_PURGE_BATCH_SIZE).
+			Scan(ctx, &users); err != nil {
+			return err
+		}
+		for _, u := range users {
+			if err := EraseUser(ctx, s.bdb, s.rdb, s.ss, u.Id); err != nil {
+				s.logger.Warn("failed to erase user", "id", u.Id, "error", err)
+				continue
+			}
+			res.Erased++
+			s.erased.Add(ctx, 1)
+		}
+		if len(users) < SWEEPER_PURGE_BATCH_SIZE {
+			return nil
+		}
+		after = &users[len(users)-1]
+	}
+}
+
+// erasureCandidate is a user whose erasure is due, its erase time is the key of the erasure paging.
+type erasureCandidate struct {
+	Id      string    `bun:"id"`
+	EraseAt time.Time `bun:"erase_at"`
+}
+
+// purgeDeleted hard deletes soft deleted rows, tables referencing others first. Users are deleted one by one
+// together with the rows referencing them, rows which still fail are skipped with a warning.
+func (s *Sweeper) purgeDeleted(ctx context.Context, before time.Time, res *SweeperResult) error {
+	for _, m := range []struct {
+		table string
+		model any
+	}{
+		{"logins", (*models.Login)(nil)},
+		{"role_users", (*models.RoleUser)(nil)},
+		{"client_users", (*models.ClientUser)(nil)},
+		{"user_devices", (*models.UserDevice)(nil)},
+		{"invitations", (*models.Invitation)(nil)},
+	} {
+		r, err := s.bdb.NewDelete().Model(m.model).
+			WhereDeleted().
+			Where(`"deleted_at" < ?`, before).
+			ForceDelete().
+			Exec(ctx)
+		if err != nil {
+			return err
+		}
+		if n, err := r.RowsAffected(); err == nil {
+			res.Purged[m.table] += int(n)
+			s.purged.Add(ctx, n, metric.WithAttributes(attribute.String("table", m.table)))
+		}
+	}
+	for _, m := range []struct {
+		table string
+		model any
+		purge func(context.Context, bun.Tx, string) error
+	}{
+		{"users", (*models.User)(nil), func(ctx context.Context, tx bun.Tx, id string) error {
+			// remove the rows left behind by the user, e.g. logins of a deleted but not erased user
+			for _, model := range []any{(*models.Login)(nil), (*models.RoleUser)(nil), (*models.ClientUser)(nil), (*models.UserDevice)(nil)} {
+				if _, err := tx.NewDelete().Model(model).Where(`"user_id" = ?`, id).ForceDelete().Exec(ctx); err != nil {
+					return err
+				}
+			}
+			if _, err := tx.NewUpdate().Model((*models.Device)(nil)).
+				Set(`"user_id" = NULL`).
+				Set(`"push_token" = NULL`).
+				Set(`"updated_at" = ?`, time.Now()).
+				Where(`"user_id" = ?`, id).Exec(ctx); err != nil {
+				return err
+			}
+			// invitations of the user can not outlive their creator, users it has created only lose the reference
+			if _, err := tx.NewDelete().Model((*models.Invitation)(nil)).Where(`"creator_id" = ?`, id).ForceDelete().Exec(ctx); err != nil {
+				return err
+			}
+			if _, err := tx.NewUpdate().Model((*models.User)(nil)).
+				Set(`"creator_id" = NULL`).
+				Where(`"creator_id" = ?`, id).
+				WhereAllWithDeleted().Exec(ctx); err != nil {
+				return err
+			}
+			if _, err := tx.NewDelete().Model((*models.Profile)(nil)).Where(`"id" = ?`, id).Exec(ctx); err != nil {
+				return err
+			}
+			_, err := tx.NewDelete().Model((*models.User)(nil)).WhereDeleted().Where(`"id" = ?`, id).ForceDelete().Exec(ctx)
+			return err
+		}},
+		{"clients", (*models.Client)(nil), func(ctx context.Context, tx bun.Tx, id string) error {
+			_, err := tx.NewDelete().Model((*models.Client)(nil)).WhereDeleted().Where(`"id" = ?`, id).ForceDelete().Exec(ctx)
+			return err
+		}},
+		{"roles", (*models.Role)(nil), func(ctx context.Context, tx bun.Tx, id string) error {
+			_, err := tx.NewDelete().Model((*models.Role)(nil)).WhereDeleted().Where(`"id" = ?`, id).ForceDelete().Exec(ctx)
+			return err
+		}},
+	} {
+		// page through the rows in deletion order, so rows which can not be purged never block the ones behind them
+		var after *purgeCandidate
+		for {
+			var rows []purgeCandidate
+			if err := s.bdb.NewSelect().Model(m.model).Column("id", "deleted_at").
+				WhereDeleted().
+				Where(`"deleted_at" < ?`, before).
+				Apply(func(q *bun.SelectQuery) *bun.SelectQuery {
+					if after != nil {
+						q = q.Where(`("deleted_at", "id") > (?, ?)`, after.DeletedAt, after.Id)
+					}
+					return q
+				}).
+				OrderExpr(`"deleted_at" ASC, "id" ASC`).
+				Limit(SWEEPER_PURGE_BATCH_SIZE).
+				Scan(ctx, &rows); err != nil {
+				return err
+			}
+			for _, row := range rows {
+				if err := s.bdb.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+					return m.purge(ctx, tx, row.Id)
+				}); err != nil {
+					s.logger.Warn("skipped purging row", "table", m.table, "id", row.Id, "error", err)
+					continue
+				}
+				res.Purged[m.table]++
+				s.purged.Add(ctx, 1, metric.WithAttributes(attribute.String("table", m.table)))
+			}
+			if len(rows) < SWEEPER_PURGE_BATCH_SIZE {
+				break
+			}
+			after = &rows[len(rows)-1]
+		}
+	}
+	return nil
+}
+
+// purgeCandidate is a soft deleted row, its deletion time is the key of the purge paging.
+type purgeCandidate struct {
+	Id        string    `bun:"id"`
+	DeletedAt time.Time `bun:"deleted_at"`
+}
@@ -0,0 +1,194 @@
+package v1beta
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	iam "github.com/choral-io/gommerce-protobuf-go/iam/v1beta"
+	sqlpb "github.com/choral-io/gommerce-protobuf-go/types/v1/sqlpb"
+	"github.com/choral-io/gommerce-server-aio/data/models"
+	"github.com/choral-io/gommerce-server-core/validator"
+	"github.com/uptrace/bun"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	ATTRIBUTE_KEY_MAX_LENGTH = 64
+	ATTRIBUTE_DATE_LAYOUT    = "2006-01-02"
+)
+
+var (
+	attributeKeyPattern = regexp.MustCompile(`^[a-z][a-z0-9_]*(\.[a-z][a-z0-9_]*)*$`)
+
+	// builtinAttributePrefixes are maintained by the server itself, e.g. the denormalized profile fields,
+	// they don't need to be declared and can't be written through the attributes of a request.
+	builtinAttributePrefixes = []string{"profile.", "approval.", "scim."}
+)
+
+func toAttributeSchemaPB(m models.AttributeSchema) *iam.AttributeSchema {
+	return &iam.AttributeSchema{
+		Id:          m.Id,
+		CreatedAt:   timestamppb.New(m.CreatedAt),
+		UpdatedAt:   sqlpb.FromNullTime(m.UpdatedAt),
+		Key:         m.Key,
+		Type:        m.Type,
+		Required:    m.Required,
+		Pattern:     sqlpb.FromNullString(m.Pattern),
+		Enum:        m.Enum,
+		MaxLength:   m.MaxLength,
+		Writer:      m.Writer,
+		Ordinal:     m.Ordinal,
+		Description: sqlpb.FromNullString(m.Description),
+	}
+}
+
+func isBuiltinAttribute(key string) bool {
+	for _, prefix := range builtinAttributePrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func attributeField(key string) string {
+	return "attributes." + key
+}
+
+// getAttributeSchemas returns the declared attributes of a realm keyed by attribute key.
+func getAttributeSchemas(ctx context.Context, bdb bun.IDB, realmId string) (map[string]models.AttributeSchema, error) {
+	var items []models.AttributeSchema
+	if err := bdb.NewSelect().Model(&items).Where(`"attribute_schema"."realm_id" = ?`, realmId).Scan(ctx); err != nil {
+		return nil, status.Errorf(codes.Unknown, "error retrieving attribute schemas: %v", err)
+	}
+	schemas := make(map[string]models.AttributeSchema, len(items))
+	for _, item := range items {
+		schemas[item.Key] = item
+	}
+	return schemas, nil
+}
+
+// validateAttributeSchema checks the definition of an attribute before it is stored.
+func validateAttributeSchema(m *models.AttributeSchema) error {
+	if len(m.Key) > ATTRIBUTE_KEY_MAX_LENGTH || !attributeKeyPattern.MatchString(m.Key) {
+		return validator.NewError("key", "key must be dot separated lower case identifiers")
+	}
+	if !models.ValidAttributeType(m.Type) {
+		return validator.NewError("type", fmt.Sprintf("type %s is not supported", m.Type))
+	}
+	if !models.ValidAttributeWriter(m.Writer) {
+		return validator.NewError("writer", fmt.Sprintf("writer %s is not supported", m.Writer))
+	}
+	if m.MaxLength < 0 {
+		return validator.NewError("max_length", "max_length must not be negative")
+	}
+	if m.Pattern.Valid {
+		if _, err := regexp.Compile(m.Pattern.String); err != nil {
+			return validator.NewErrorWithCause("pattern", "pattern is not a valid regular expression", err)
+		}
+	}
+	for _, v := range m.Enum {
+		if err := checkAttributeValue(m, v); err != nil {
+			return validator.NewErrorWithCause("enum", fmt.Sprintf("enum value %q does not match the attribute", v), err)
+		}
+	}
+	return nil
+}
+
+// checkAttributeValue checks a non empty value against the type and constraints of an attribute.
+func checkAttributeValue(m *models.AttributeSchema, value string) error {
+	var err error
+	switch m.Type {
+	case models.ATTRIBUTE_TYPE_INTEGER:
+		_, err = strconv.ParseInt(value, 10, 64)
+	case models.ATTRIBUTE_TYPE_NUMBER:
+		_, err = strconv.ParseFloat(value, 64)
+	case models.ATTRIBUTE_TYPE_BOOLEAN:
+		_, err = strconv.ParseBool(value)
+	case models.ATTRIBUTE_TYPE_DATE:
+		_, err = time.Parse(ATTRIBUTE_DATE_LAYOUT, value)
+	}
+	if err != nil {
+		return fmt.Errorf("value must be of type %s", m.Type)
+	}
+	if m.MaxLength > 0 && utf8.RuneCountInString(value) > int(m.MaxLength) {
+		return fmt.Errorf("value must not exceed %d characters", m.MaxLength)
+	}
+	if m.Pattern.Valid {
+		if ok, err := regexp.MatchString(m.Pattern.String, value); err != nil || !ok {
+			return fmt.Errorf("value must match %s", m.Pattern.String)
+		}
+	}
+	if len(m.Enum) > 0 && !slices.Contains(m.Enum, value) {
+		return fmt.Errorf("value must be one of %s", strings.Join(m.Enum, ", "))
+	}
+	return nil
+}
+
+// validateAttributes checks attribute changes written by the given writer against the schema of the realm,
+// an empty value removes the attribute. Undeclared attributes can only be written by the system, except for
+// built-in attributes. Pass nil as current for a new user, so that missing required attributes are reported.
+func validateAttributes(schemas map[string]models.AttributeSchema, writer string, current, changes map[string]string) error {
+	keys := make([]string, 0, len(changes))
+	for k := range changes {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		value := changes[key]
+		schema, ok := schemas[key]
+		if !ok {
+			if writer != models.ATTRIBUTE_WRITER_SYSTEM && !isBuiltinAttribute(key) {
+				return validator.NewError(attributeField(key), fmt.Sprintf("attribute %s is not declared", key))
+			}
+			continue
+		}
+		if !schema.WritableBy(writer) {
+			return validator.NewError(attributeField(key), fmt.Sprintf("attribute %s can only be written by %s", key, schema.Writer))
+		}
+		if value == "" {
+			if schema.Required {
+				return validator.NewError(attributeField(key), fmt.Sprintf("attribute %s is required", key))
+			}
+			continue
+		}
+		if err := checkAttributeValue(&schema, value); err != nil {
+			return validator.NewErrorWithCause(attributeField(key), err.Error(), err)
+		}
+	}
+	if current == nil {
+		for key, schema := range schemas {
+			if _, ok := changes[key]; !ok && schema.Required && schema.WritableBy(writer) {
+				return validator.NewError(attributeField(key), fmt.Sprintf("attribute %s is required", key))
+			}
+		}
+	}
+	return nil
+}
+
+// applyAttributes writes validated attribute changes into attrs, empty values remove the attribute.
+func applyAttributes(attrs, changes map[string]string) {
+	for k, v := range changes {
+		if v == "" {
+			delete(attrs, k)
+		} else {
+			attrs[k] = v
+		}
+	}
+}
+
+// attributeWriter returns the writer level of the caller, admins write as admin and everyone else as user.
+func attributeWriter(ctx context.Context) string {
+	if isAdmin(ctx) {
+		return models.ATTRIBUTE_WRITER_ADMIN
+	}
+	return models.ATTRIBUTE_WRITER_USER
+}
@@ -0,0 +1,169 @@
+package v1beta
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	iam "github.com/choral-io/gommerce-protobuf-go/iam/v1beta"
+	sqlpb "github.com/choral-io/gommerce-protobuf-go/types/v1/sqlpb"
+	drivers "github.com/choral-io/gommerce-server-aio/data/drivers"
+	"github.com/choral-io/gommerce-server-aio/data/models"
+	"github.com/choral-io/gommerce-server-core/secure"
+	"github.com/choral-io/gommerce-server-core/validator"
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/uptrace/bun"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type attributeSchemasServiceServer struct {
+	iam.UnimplementedAttributeSchemasServiceServer
+
+	bdb bun.IDB
+}
+
+func NewAttributeSchemasServiceServer(bdb bun.IDB) iam.AttributeSchemasServiceServer {
+	return &attributeSchemasServiceServer{bdb: bdb}
+}
+
+func (s *attributeSchemasServiceServer) RegisterServerService(reg grpc.ServiceRegistrar) {
+	reg.RegisterService(&iam.AttributeSchemasService_ServiceDesc, s)
+}
+
+func (s *attributeSchemasServiceServer) RegisterGatewayClient(ctx context.Context, mux *runtime.ServeMux, conn *grpc.ClientConn) error {
+	return iam.RegisterAttributeSchemasServiceHandler(ctx, mux, conn)
+}
+
+func (s *attributeSchemasServiceServer) Authorize(ctx context.Context, procedure string) error {
+	if procedure == iam.AttributeSchemasService_ListAttributeSchemas_FullMethodName {
+		// clients need the schema to build registration forms before any user is signed in
+		return secure.Authorize(ctx, secure.AuthFuncAuthenticated)
+	}
+	return secure.Authorize(ctx, secure.AuthFuncAuthenticated, secure.AuthFuncRequireRealm(REALM_ADMIN))
+}
+
+func (s *attributeSchemasServiceServer) Mutating(procedure string) bool {
+	switch procedure {
+	case iam.AttributeSchemasService_PutAttributeSchema_FullMethodName,
+		iam.AttributeSchemasService_DeleteAttributeSchema_FullMethodName:
+		return true
+	}
+	return false
+}
+
+func (s *attributeSchemasServiceServer) getRealm(ctx context.Context, name string) (*models.Realm, error) {
+	realm := &models.Realm{}
+	if err := s.bdb.NewSelect().Model(realm).Where(`"realm"."name" = ?`, name).Scan(ctx); errors.Is(err, sql.ErrNoRows) {
+		return nil, validator.NewError("realm", fmt.Sprintf("realm %s not found", name))
+	} else if err != nil {
+		return nil, err
+	}
+	return realm, nil
+}
+
+func (s *attributeSchemasServiceServer) ListAttributeSchemas(ctx context.Context, req *iam.ListAttributeSchemasRequest) (*iam.ListAttributeSchemasResponse, error) {
+	name := req.GetRealm()
+	if name == "" {
+		name = secure.IdentityFromContext(ctx).Token().Realm()
+	}
+	realm, err := s.getRealm(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	var items []models.AttributeSchema
+	if err := s.bdb.NewSelect().Model(&items).
+		Where(`"attribute_schema"."realm_id" = ?`, realm.Id).
+		Order("attribute_schema.ordinal ASC", "attribute_schema.key ASC").
+		Scan(ctx); err != nil {
+		return nil, err
+	}
+	res := &iam.ListAttributeSchemasResponse{
+		Items: make([]*iam.AttributeSchema, len(items)),
+	}
+	for i, item := range items {
+		res.Items[i] = toAttributeSchemaPB(item)
+	}
+	return res, nil
+}
+
+// PutAttributeSchema creates or replaces the definition of an attribute in a realm,
+// existing attribute values are not revalidated until they are written again.
+func (s *attributeSchemasServiceServer) PutAttributeSchema(ctx context.Context, req *iam.PutAttributeSchemaRequest) (*iam.PutAttributeSchemaResponse, error) {
+	realm, err := s.getRealm(ctx, req.GetRealm())
+	if err != nil {
+		return nil, err
+	}
+	schema := &models.AttributeSchema{
+		RealmId:     realm.Id,
+		Key:         req.GetKey(),
+		Type:        req.GetType(),
+		Required:    req.GetRequired(),
+		Pattern:     sqlpb.ToNullString(req.Pattern),
+		Enum:        req.GetEnum(),
+		MaxLength:   req.GetMaxLength(),
+		Writer:      req.GetWriter(),
+		Ordinal:     req.GetOrdinal(),
+		Description: sqlpb.ToNullString(req.Description),
+	}
+	if schema.Type == "" {
+		schema.Type = models.ATTRIBUTE_TYPE_STRING
+	}
+	if schema.Writer == "" {
+		schema.Writer = models.ATTRIBUTE_WRITER_USER
+	}
+	if err := validateAttributeSchema(schema); err != nil {
+		return nil, err
+	}
+	err = s.bdb.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		existing := &models.AttributeSchema{}
+		err := tx.NewSelect().Model(existing).
+			Where(`"attribute_schema"."realm_id" = ?`, realm.Id).
+			Where(`"attribute_schema"."key" = ?`, schema.Key).
+			For("UPDATE").Scan(ctx)
+		if errors.Is(err, sql.ErrNoRows) {
+			if _, err := tx.NewInsert().Model(schema).Exec(ctx); drivers.IsUniqueViolation(err, models.ATTRIBUTE_SCHEMA_UNIQUE_INDEX) {
+				return newAlreadyExistsError("key", fmt.Sprintf("attribute %s already exists", schema.Key))
+			} else if err != nil {
+				return status.Errorf(codes.Unknown, "error creating attribute schema: %v", err)
+			}
+			return nil
+		} else if err != nil {
+			return err
+		}
+		schema.Id = existing.Id
+		schema.CreatedAt = existing.CreatedAt
+		if _, err := tx.NewUpdate().Model(schema).WherePK().
+			Column("type", "required", "pattern", "enum", "max_length", "writer", "ordinal", "description", "updated_at").
+			Exec(ctx); err != nil {
+			return status.Errorf(codes.Unknown, "error updating attribute schema: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &iam.PutAttributeSchemaResponse{
+		Schema: toAttributeSchemaPB(*schema),
+	}, nil
+}
+
+func (s *attributeSchemasServiceServer) DeleteAttributeSchema(ctx context.Context, req *iam.DeleteAttributeSchemaRequest) (*iam.DeleteAttributeSchemaResponse, error) {
+	realm, err := s.getRealm(ctx, req.GetRealm())
+	if err != nil {
+		return nil, err
+	}
+	res, err := s.bdb.NewDelete().Model((*models.AttributeSchema)(nil)).
+		Where(`"realm_id" = ?`, realm.Id).
+		Where(`"key" = ?`, req.GetKey()).
+		Exec(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil, status.Errorf(codes.NotFound, "attribute %s not found", req.GetKey())
+	}
+	return &iam.DeleteAttributeSchemaResponse{}, nil
+}
@@ -0,0 +1,101 @@
+package v1beta
+
+import (
+	"context"
+
+	iam "github.com/choral-io/gommerce-protobuf-go/iam/v1beta"
+	sqlpb "github.com/choral-io/gommerce-protobuf-go/types/v1/sqlpb"
+	"github.com/choral-io/gommerce-server-aio/data/models"
+	"github.com/choral-io/gommerce-server-core/data"
+	"github.com/choral-io/gommerce-server-core/secure"
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/uptrace/bun"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func toAuditLogPB(m models.AuditLog) *iam.AuditLog {
+	return &iam.AuditLog{
+		Id:        m.Id,
+		CreatedAt: timestamppb.New(m.CreatedAt),
+		Schema:    sqlpb.FromNullString(m.Schema),
+		Realm:     sqlpb.FromNullString(m.Realm),
+		ClientId:  sqlpb.FromNullString(m.ClientId),
+		Subject:   sqlpb.FromNullString(m.Subject),
+		ActorId:   sqlpb.FromNullString(m.ActorId),
+		Method:    m.Method,
+		Request:   string(m.Request),
+		Code:      m.Code,
+		Message:   sqlpb.FromNullString(m.Message),
+		LatencyMs: m.LatencyMs,
+		IpAddress: sqlpb.FromNullString(m.IpAddress),
+	}
+}
+
+type auditLogsServiceServer struct {
+	iam.UnimplementedAuditLogsServiceServer
+
+	bdb bun.IDB
+}
+
+func NewAuditLogsServiceServer(bdb bun.IDB) iam.AuditLogsServiceServer {
+	return &auditLogsServiceServer{bdb: bdb}
+}
+
+func (s *auditLogsServiceServer) RegisterServerService(reg grpc.ServiceRegistrar) {
+	reg.RegisterService(&iam.AuditLogsService_ServiceDesc, s)
+}
+
+func (s *auditLogsServiceServer) RegisterGatewayClient(ctx context.Context, mux *runtime.ServeMux, conn *grpc.ClientConn) error {
+	return iam.RegisterAuditLogsServiceHandler(ctx, mux, conn)
+}
+
+func (s *auditLogsServiceServer) Authorize(ctx context.Context, procedure string) error {
+	return secure.Authorize(ctx, secure.AuthFuncAuthenticated, secure.AuthFuncRequireSchema(secure.AUTH_SCHEMA_BEARER), secure.AuthFuncRequireRealm(REALM_ADMIN))
+}
+
+func (s *auditLogsServiceServer) ListAuditLogs(ctx context.Context, req *iam.ListAuditLogsRequest) (*iam.ListAuditLogsResponse, error) {
+	var logs []models.AuditLog
+	total, err := s.bdb.NewSelect().Model(&logs).Apply(data.WithPaging(req)).
+		Apply(func(q *bun.SelectQuery) *bun.SelectQuery {
+			if req.GetRealm() != "" {
+				q = q.Where(`"audit_log"."realm" = ?`, req.GetRealm())
+			}
+			if req.GetClientId() != "" {
+				q = q.Where(`"audit_log"."client_id" = ?`, req.GetClientId())
+			}
+			if req.GetSubject() != "" {
+				q = q.Where(`"audit_log"."subject" = ?`, req.GetSubject())
+			}
+			if req.GetActorId() != "" {
+				q = q.Where(`"audit_log"."actor_id" = ?`, req.GetActorId())
+			}
+			if req.GetMethod() != "" {
+				q = q.Where(`"audit_log"."method" = ?`, req.GetMethod())
+			}
+			if req.GetCode() != "" {
+				q = q.Where(`"audit_log"."code" = ?`, req.GetCode())
+			}
+			if req.GetCreatedAfter() != nil {
+				q = q.Where(`"audit_log"."created_at" >= ?`, req.GetCreatedAfter().AsTime())
+			}
+			if req.GetCreatedBefore() != nil {
+				q = q.Where(`"audit_log"."created_at" < ?`, req.GetCreatedBefore().AsTime())
+			}
+			return q.OrderExpr(`"audit_log"."created_at" DESC, "audit_log"."id" DESC`)
+		}).
+		ScanAndCount(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res := &iam.ListAuditLogsResponse{
+		Page:  req.Page,
+		Size:  req.Size,
+		Total: int64(total),
+		Items: make([]*iam.AuditLog, len(logs)),
+	}
+	for i, l := range logs {
+		res.Items[i] = toAuditLogPB(l)
+	}
+	return res, nil
+}
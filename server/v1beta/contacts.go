@@ -0,0 +1,286 @@
+package v1beta
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	drivers "github.com/choral-io/gommerce-server-aio/data/drivers"
+	"github.com/choral-io/gommerce-server-aio/data/models"
+	"github.com/choral-io/gommerce-server-aio/server/normalize"
+	"github.com/choral-io/gommerce-server-aio/server/notify"
+	"github.com/choral-io/gommerce-server-core/secure"
+	"github.com/choral-io/gommerce-server-core/validator"
+	"github.com/redis/rueidis"
+	"github.com/uptrace/bun"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	CONTACT_CHANNEL_EMAIL_ADDRESS = "email_address"
+	CONTACT_CHANNEL_PHONE_NUMBER  = "phone_number"
+
+	CONTACT_VERIFICATION_KEY_TEMPLATE          = "users:verification:%s:%s"
+	CONTACT_VERIFICATION_LINK_KEY_TEMPLATE     = "users:verification:link:%s"
+	CONTACT_VERIFICATION_ATTEMPTS_KEY_TEMPLATE = "users:verification:attempts:%s:%s"
+	CONTACT_VERIFICATION_RESEND_KEY_TEMPLATE   = "users:verification:resend:%s:%s"
+	CONTACT_VERIFICATION_TTL                   = 15 * time.Minute
+	CONTACT_VERIFICATION_RESEND_INTERVAL       = time.Minute
+	CONTACT_VERIFICATION_MAX_ATTEMPTS          = 5
+	CONTACT_VERIFICATION_CODE_SYMBOLS          = "0123456789"
+	CONTACT_VERIFICATION_TOKEN_SYMBOLS         = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+)
+
+var (
+	contactUniqueIndexes = map[string]string{
+		CONTACT_CHANNEL_EMAIL_ADDRESS: "ix_users_realm_id_email_address",
+		CONTACT_CHANNEL_PHONE_NUMBER:  "ix_users_realm_id_phone_number",
+	}
+	contactVerifiedFlags = map[string]int64{
+		CONTACT_CHANNEL_EMAIL_ADDRESS: models.USER_FLAGS_EMAIL_ADDRESS_VERIFIED,
+		CONTACT_CHANNEL_PHONE_NUMBER:  models.USER_FLAGS_PHONE_NUMBER_VERIFIED,
+	}
+	contactNotifyChannels = map[string]string{
+		CONTACT_CHANNEL_EMAIL_ADDRESS: notify.CHANNEL_EMAIL,
+		CONTACT_CHANNEL_PHONE_NUMBER:  notify.CHANNEL_SMS,
+	}
+)
+
+// contactVerification is a pending email address or phone number, stored in redis until it is confirmed or expires.
+type contactVerification struct {
+	UserId   string `json:"user_id"`
+	Channel  string `json:"channel"`
+	Value    string `json:"value"`
+	CodeHash string `json:"code_hash"`
+	Token    string `json:"token,omitempty"`
+}
+
+func hashVerificationCode(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// normalizeEmailAddress returns the normalized form of an email address, or a validator error for the given field.
+func normalizeEmailAddress(field, value string) (string, error) {
+	if v, err := normalize.EmailAddress(value); err != nil {
+		return "", validator.NewErrorWithCause(field, "email address is invalid", err)
+	} else {
+		return v, nil
+	}
+}
+
+// normalizePhoneNumber returns the E.164 form of a phone number, or a validator error for the given field.
+func normalizePhoneNumber(field, value string) (string, error) {
+	if v, err := normalize.PhoneNumber(value, normalize.DefaultPhoneRegion()); err != nil {
+		return "", validator.NewErrorWithCause(field, "phone number is invalid", err)
+	} else {
+		return v, nil
+	}
+}
+
+// normalizeUsername returns the normalized form of a username, or a validator error for the given field.
+func normalizeUsername(field, value string) (string, error) {
+	if v, err := normalize.Username(value); err != nil {
+		return "", validator.NewErrorWithCause(field, "username is invalid", err)
+	} else {
+		return v, nil
+	}
+}
+
+// checkContactAvailable ensures that no other user of the realm uses the given email address or phone number.
+func checkContactAvailable(ctx context.Context, bdb bun.IDB, realmId, userId, channel, value string) error {
+	exists, err := bdb.NewSelect().Model((*models.User)(nil)).
+		Where(`"user"."realm_id" = ?`, realmId).
+		Where(`"user".? = ?`, bun.Ident(channel), value).
+		Where(`"user"."id" <> ?`, userId).
+		Exists(ctx)
+	if err != nil {
+		return status.Errorf(codes.Unknown, "error checking %s: %v", channel, err)
+	}
+	if exists {
+		return newAlreadyExistsError(channel, fmt.Sprintf("%s is already in use", channel))
+	}
+	return nil
+}
+
+// startContactVerification stores the value as pending and sends a verification code, and for email addresses a link token, to it.
+// A previous pending value of the same channel is replaced.
+func startContactVerification(ctx context.Context, rdb rueidis.Client, notifier notify.Notifier, userId, channel, value string) error {
+	msg, err := storeContactVerification(ctx, rdb, userId, channel, value)
+	if err != nil {
+		return err
+	}
+	if err := notifier.Notify(ctx, msg); err != nil {
+		return status.Errorf(codes.Unavailable, "error sending verification code: %v", err)
+	}
+	return nil
+}
+
+// storeContactVerification stores the value as pending and returns the message carrying its verification code, which
+// is left to the caller to send. A previous pending value of the same channel is replaced.
+func storeContactVerification(ctx context.Context, rdb rueidis.Client, userId, channel, value string) (*notify.Message, error) {
+	code, err := secure.RandString(6, CONTACT_VERIFICATION_CODE_SYMBOLS)
+	if err != nil {
+		return nil, err
+	}
+	v := &contactVerification{
+		UserId:   userId,
+		Channel:  channel,
+		Value:    value,
+		CodeHash: hashVerificationCode(code),
+	}
+	msg := &notify.Message{
+		Channel:   contactNotifyChannels[channel],
+		Recipient: value,
+		Subject:   "Verification code",
+		Body:      fmt.Sprintf("Your verification code is %s, it expires in %d minutes.", code, int(CONTACT_VERIFICATION_TTL.Minutes())),
+		Metadata:  map[string]string{"code": code},
+	}
+	cmds := make(rueidis.Commands, 0, 3)
+	cmds = append(cmds, rdb.B().Del().Key(fmt.Sprintf(CONTACT_VERIFICATION_ATTEMPTS_KEY_TEMPLATE, channel, userId)).Build())
+	if channel == CONTACT_CHANNEL_EMAIL_ADDRESS {
+		if v.Token, err = secure.RandString(32, CONTACT_VERIFICATION_TOKEN_SYMBOLS); err != nil {
+			return nil, err
+		}
+		msg.Metadata["token"] = v.Token
+		cmds = append(cmds, rdb.B().Set().Key(fmt.Sprintf(CONTACT_VERIFICATION_LINK_KEY_TEMPLATE, v.Token)).
+			Value(fmt.Sprintf(CONTACT_VERIFICATION_KEY_TEMPLATE, channel, userId)).ExSeconds(int64(CONTACT_VERIFICATION_TTL.Seconds())).Build())
+	}
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	cmds = append(cmds, rdb.B().Set().Key(fmt.Sprintf(CONTACT_VERIFICATION_KEY_TEMPLATE, channel, userId)).
+		Value(string(payload)).ExSeconds(int64(CONTACT_VERIFICATION_TTL.Seconds())).Build())
+	for _, res := range rdb.DoMulti(ctx, cmds...) {
+		if err := res.Error(); err != nil {
+			return nil, err
+		}
+	}
+	return msg, nil
+}
+
+// resolveContactLink returns the user id and channel of the pending verification referenced by a link token.
+func resolveContactLink(ctx context.Context, rdb rueidis.Client, token string) (string, string, error) {
+	key, err := rdb.Do(ctx, rdb.B().Get().Key(fmt.Sprintf(CONTACT_VERIFICATION_LINK_KEY_TEMPLATE, token)).Build()).ToString()
+	if err == rueidis.Nil {
+		return "", "", validator.NewError("token", "verification token is invalid or expired")
+	} else if err != nil {
+		return "", "", err
+	}
+	var channel, userId string
+	if splits := strings.Split(key, ":"); len(splits) == 4 {
+		channel, userId = splits[2], splits[3]
+	} else {
+		return "", "", validator.NewError("token", "verification token is invalid or expired")
+	}
+	return userId, channel, nil
+}
+
+// confirmContactVerification checks the code, or the link token, of a pending verification and removes it on success.
+// Every attempt is counted atomically before it is checked, after too many attempts the pending verification
+// is dropped and has to be started again.
+func confirmContactVerification(ctx context.Context, rdb rueidis.Client, userId, channel, code, token string) (*contactVerification, error) {
+	key := fmt.Sprintf(CONTACT_VERIFICATION_KEY_TEMPLATE, channel, userId)
+	attemptsKey := fmt.Sprintf(CONTACT_VERIFICATION_ATTEMPTS_KEY_TEMPLATE, channel, userId)
+	payload, err := rdb.Do(ctx, rdb.B().Get().Key(key).Build()).AsBytes()
+	if err == rueidis.Nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "no pending %s verification", channel)
+	} else if err != nil {
+		return nil, err
+	}
+	var v contactVerification
+	if err := json.Unmarshal(payload, &v); err != nil {
+		return nil, err
+	}
+	res := rdb.DoMulti(ctx,
+		rdb.B().Incr().Key(attemptsKey).Build(),
+		rdb.B().Expire().Key(attemptsKey).Seconds(int64(CONTACT_VERIFICATION_TTL.Seconds())).Build())
+	attempts, err := res[0].AsInt64()
+	if err != nil {
+		return nil, err
+	}
+	if attempts > CONTACT_VERIFICATION_MAX_ATTEMPTS {
+		if err := dropContactVerification(ctx, rdb, &v); err != nil {
+			return nil, err
+		}
+		return nil, status.Errorf(codes.FailedPrecondition, "no pending %s verification", channel)
+	}
+	var ok bool
+	if token != "" {
+		ok = v.Token != "" && subtle.ConstantTimeCompare([]byte(v.Token), []byte(token)) == 1
+	} else {
+		ok = subtle.ConstantTimeCompare([]byte(v.CodeHash), []byte(hashVerificationCode(code))) == 1
+	}
+	if !ok {
+		if attempts == CONTACT_VERIFICATION_MAX_ATTEMPTS {
+			if err := dropContactVerification(ctx, rdb, &v); err != nil {
+				return nil, err
+			}
+		}
+		return nil, validator.NewError("code", "verification code is invalid")
+	}
+	if err := dropContactVerification(ctx, rdb, &v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// dropContactVerification removes a pending verification together with its link token and attempt counter.
+func dropContactVerification(ctx context.Context, rdb rueidis.Client, v *contactVerification) error {
+	keys := []string{
+		fmt.Sprintf(CONTACT_VERIFICATION_KEY_TEMPLATE, v.Channel, v.UserId),
+		fmt.Sprintf(CONTACT_VERIFICATION_ATTEMPTS_KEY_TEMPLATE, v.Channel, v.UserId),
+	}
+	if v.Token != "" {
+		keys = append(keys, fmt.Sprintf(CONTACT_VERIFICATION_LINK_KEY_TEMPLATE, v.Token))
+	}
+	return rdb.Do(ctx, rdb.B().Del().Key(keys...).Build()).Error()
+}
+
+// throttleContactVerification allows to start a verification of the channel for a user only once per resend interval.
+func throttleContactVerification(ctx context.Context, rdb rueidis.Client, userId, channel string) error {
+	key := fmt.Sprintf(CONTACT_VERIFICATION_RESEND_KEY_TEMPLATE, channel, userId)
+	err := rdb.Do(ctx, rdb.B().Set().Key(key).Value("1").Nx().ExSeconds(int64(CONTACT_VERIFICATION_RESEND_INTERVAL.Seconds())).Build()).Error()
+	if err == rueidis.Nil {
+		return status.Errorf(codes.ResourceExhausted, "%s verification was sent recently, try again later", channel)
+	}
+	return err
+}
+
+// applyContactVerification writes a confirmed email address or phone number to the user and marks the channel as verified.
+func applyContactVerification(ctx context.Context, bdb bun.IDB, v *contactVerification) error {
+	_, err := bdb.NewUpdate().Model((*models.User)(nil)).
+		Set(`? = ?`, bun.Ident(v.Channel), v.Value).
+		Set(`"flags" = "flags" | ?`, contactVerifiedFlags[v.Channel]).
+		Set(`"verified" = TRUE`).
+		Set(`"updated_at" = ?`, time.Now()).
+		Where(`"id" = ?`, v.UserId).
+		Exec(ctx)
+	if drivers.IsUniqueViolation(err, contactUniqueIndexes[v.Channel]) {
+		return newAlreadyExistsError(v.Channel, fmt.Sprintf("%s is already in use", v.Channel))
+	} else if err != nil {
+		return status.Errorf(codes.Unknown, "error updating user: %v", err)
+	}
+	return nil
+}
+
+// notifyUser sends a message to the verified email address of the user, or to the verified phone number if there is none.
+// Users without any verified contact are silently skipped.
+func notifyUser(ctx context.Context, notifier notify.Notifier, user *models.User, subject, body string) error {
+	msg := &notify.Message{Subject: subject, Body: body}
+	if user.EmailAddressVerified() {
+		msg.Channel, msg.Recipient = notify.CHANNEL_EMAIL, user.EmailAddress.String
+	} else if user.PhoneNumberVerified() {
+		msg.Channel, msg.Recipient = notify.CHANNEL_SMS, user.PhoneNumber.String
+	} else {
+		return nil
+	}
+	return notifier.Notify(ctx, msg)
+}
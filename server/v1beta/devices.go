@@ -0,0 +1,145 @@
+package v1beta
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	iam "github.com/choral-io/gommerce-protobuf-go/iam/v1beta"
+	sqlpb "github.com/choral-io/gommerce-protobuf-go/types/v1/sqlpb"
+	"github.com/choral-io/gommerce-server-aio/data/models"
+	"github.com/choral-io/gommerce-server-core/secure"
+	"github.com/choral-io/gommerce-server-core/validator"
+	"github.com/uptrace/bun"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	DEVICE_TRACE_CODE_MAX_LENGTH = 64
+	DEVICE_PUSH_TOKEN_MAX_LENGTH = 255
+)
+
+func toDevicePB(m models.Device) *iam.Device {
+	// never expose push tokens
+	return &iam.Device{
+		Id:           m.Id,
+		UserId:       sqlpb.FromNullString(m.UserId),
+		ClientId:     m.ClientId.String,
+		CreatedAt:    timestamppb.New(m.CreatedAt),
+		UpdatedAt:    sqlpb.FromNullTime(m.UpdatedAt),
+		TraceCode:    m.TraceCode,
+		HasPushToken: m.PushToken.Valid,
+		Metadata:     m.Metadata,
+	}
+}
+
+// callerClientId returns the id of the client a request is made through,
+// which is the subject of basic identities and the client of bearer identities.
+func callerClientId(ctx context.Context) string {
+	token := secure.IdentityFromContext(ctx).Token()
+	if secure.Authorize(ctx, secure.AuthFuncRequireSchema(secure.AUTH_SCHEMA_BEARER)) == nil {
+		return token.Client()
+	}
+	return token.Subject()
+}
+
+// getClientDevice returns the device with the given id, which must have been registered through the client.
+func getClientDevice(ctx context.Context, bdb bun.IDB, clientId, deviceId string) (*models.Device, error) {
+	device := &models.Device{Id: deviceId}
+	if err := bdb.NewSelect().Model(device).WherePK().Scan(ctx); errors.Is(err, sql.ErrNoRows) {
+		return nil, validator.NewError("device_id", fmt.Sprintf("device %s not found", deviceId))
+	} else if err != nil {
+		return nil, err
+	}
+	if device.ClientId.String != clientId {
+		return nil, validator.NewError("device_id", fmt.Sprintf("device %s is not registered through this client", deviceId))
+	}
+	return device, nil
+}
+
+// deviceBound reports whether the device is bound to the user.
+func deviceBound(ctx context.Context, bdb bun.IDB, userId, deviceId string) (bool, error) {
+	return bdb.NewSelect().Model((*models.UserDevice)(nil)).
+		Where(`"user_device"."user_id" = ?`, userId).
+		Where(`"user_device"."device_id" = ?`, deviceId).
+		Exists(ctx)
+}
+
+// bindDevice binds the device to the user and makes it the current device of the user.
+// Devices bound to another user are rejected, they have to be unbound by their owner first.
+func bindDevice(ctx context.Context, bdb bun.IDB, userId string, device *models.Device) error {
+	return bdb.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		// lock the device, so two users can not bind it at the same time
+		if err := tx.NewSelect().Model(device).WherePK().For("UPDATE").Scan(ctx); err != nil {
+			return status.Errorf(codes.Unknown, "error retrieving device: %v", err)
+		}
+		if device.UserId.Valid && device.UserId.String != userId {
+			return status.Errorf(codes.FailedPrecondition, "device %s is bound to another user", device.Id)
+		}
+		if bound, err := tx.NewSelect().Model((*models.UserDevice)(nil)).
+			Where(`"user_device"."device_id" = ?`, device.Id).
+			Where(`"user_device"."user_id" <> ?`, userId).
+			Exists(ctx); err != nil {
+			return status.Errorf(codes.Unknown, "error retrieving device bindings: %v", err)
+		} else if bound {
+			return status.Errorf(codes.FailedPrecondition, "device %s is bound to another user", device.Id)
+		}
+		binding := &models.UserDevice{UserId: userId, DeviceId: device.Id}
+		if _, err := tx.NewInsert().Model(binding).
+			On(`CONFLICT ("user_id", "device_id") DO UPDATE`).
+			Set(`"deleted_at" = NULL`).
+			Set(`"updated_at" = EXCLUDED."created_at"`).
+			Exec(ctx); err != nil {
+			return status.Errorf(codes.Unknown, "error binding device: %v", err)
+		}
+		device.UserId = sql.NullString{Valid: true, String: userId}
+		if _, err := tx.NewUpdate().Model(device).Column("user_id", "updated_at").WherePK().Exec(ctx); err != nil {
+			return status.Errorf(codes.Unknown, "error updating device: %v", err)
+		}
+		return nil
+	})
+}
+
+// applyDeviceUpdate copies the fields in the update mask of the request into the device and returns the updated columns.
+func applyDeviceUpdate(d *models.Device, req *iam.UpdateDeviceRequest) ([]string, error) {
+	paths := req.GetUpdateMask().GetPaths()
+	if len(paths) == 0 {
+		paths = []string{"push_token", "metadata"}
+	}
+	columns := make([]string, 0, len(paths))
+	for _, path := range paths {
+		switch path {
+		case "push_token":
+			if len(req.GetPushToken().GetValue()) > DEVICE_PUSH_TOKEN_MAX_LENGTH {
+				return nil, validator.NewError("push_token", fmt.Sprintf("push_token must not exceed %d characters", DEVICE_PUSH_TOKEN_MAX_LENGTH))
+			}
+			d.PushToken = sqlpb.ToNullString(req.PushToken)
+		case "metadata":
+			d.Metadata = req.GetMetadata()
+		default:
+			return nil, validator.NewError("update_mask", fmt.Sprintf("field %s can not be updated", path))
+		}
+		columns = append(columns, path)
+	}
+	return columns, nil
+}
+
+// removeDevice deletes a device with all its bindings, the caller is expected to revoke its sessions.
+func removeDevice(ctx context.Context, bdb bun.IDB, deviceId string) error {
+	return bdb.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		if _, err := tx.NewDelete().Model((*models.UserDevice)(nil)).Where(`"device_id" = ?`, deviceId).ForceDelete().Exec(ctx); err != nil {
+			return status.Errorf(codes.Unknown, "error deleting device bindings: %v", err)
+		}
+		res, err := tx.NewDelete().Model((*models.Device)(nil)).Where(`"id" = ?`, deviceId).Exec(ctx)
+		if err != nil {
+			return status.Errorf(codes.Unknown, "error deleting device: %v", err)
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return status.Errorf(codes.NotFound, "device %s not found", deviceId)
+		}
+		return nil
+	})
+}
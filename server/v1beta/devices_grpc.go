@@ -0,0 +1,230 @@
+package v1beta
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	iam "github.com/choral-io/gommerce-protobuf-go/iam/v1beta"
+	sqlpb "github.com/choral-io/gommerce-protobuf-go/types/v1/sqlpb"
+	"github.com/choral-io/gommerce-server-aio/data/models"
+	srv "github.com/choral-io/gommerce-server-aio/server"
+	"github.com/choral-io/gommerce-server-core/secure"
+	"github.com/choral-io/gommerce-server-core/validator"
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/uptrace/bun"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type devicesServiceServer struct {
+	iam.UnimplementedDevicesServiceServer
+
+	bdb bun.IDB
+	ss  *srv.SessionStore
+}
+
+func NewDevicesServiceServer(bdb bun.IDB, ss *srv.SessionStore) iam.DevicesServiceServer {
+	return &devicesServiceServer{
+		bdb: bdb,
+		ss:  ss,
+	}
+}
+
+func (s *devicesServiceServer) RegisterServerService(reg grpc.ServiceRegistrar) {
+	reg.RegisterService(&iam.DevicesService_ServiceDesc, s)
+}
+
+func (s *devicesServiceServer) RegisterGatewayClient(ctx context.Context, mux *runtime.ServeMux, conn *grpc.ClientConn) error {
+	return iam.RegisterDevicesServiceHandler(ctx, mux, conn)
+}
+
+func (s *devicesServiceServer) Authorize(ctx context.Context, procedure string) error {
+	if procedure == iam.DevicesService_RegisterDevice_FullMethodName ||
+		procedure == iam.DevicesService_UpdateDevice_FullMethodName {
+		// devices are registered by the client before any user is signed in
+		return secure.Authorize(ctx, secure.AuthFuncAuthenticated)
+	}
+	return secure.Authorize(ctx, secure.AuthFuncAuthenticated, secure.AuthFuncRequireSchema(secure.AUTH_SCHEMA_BEARER))
+}
+
+func (s *devicesServiceServer) AllowGuest(procedure string) bool {
+	// guests keep the push token of their own device up to date
+	return procedure == iam.DevicesService_UpdateDevice_FullMethodName
+}
+
+func (s *devicesServiceServer) Mutating(procedure string) bool {
+	switch procedure {
+	case iam.DevicesService_RegisterDevice_FullMethodName,
+		iam.DevicesService_UpdateDevice_FullMethodName,
+		iam.DevicesService_BindDevice_FullMethodName,
+		iam.DevicesService_UnbindDevice_FullMethodName,
+		iam.DevicesService_RemoveDevice_FullMethodName:
+		return true
+	}
+	return false
+}
+
+// RegisterDevice registers a device by its trace code for the calling client, registering a known trace code
+// again returns the existing device.
+func (s *devicesServiceServer) RegisterDevice(ctx context.Context, req *iam.RegisterDeviceRequest) (*iam.RegisterDeviceResponse, error) {
+	if req.GetTraceCode() == "" || len(req.GetTraceCode()) > DEVICE_TRACE_CODE_MAX_LENGTH {
+		return nil, validator.NewError("trace_code", fmt.Sprintf("trace_code is required and must not exceed %d characters", DEVICE_TRACE_CODE_MAX_LENGTH))
+	}
+	if len(req.GetPushToken().GetValue()) > DEVICE_PUSH_TOKEN_MAX_LENGTH {
+		return nil, validator.NewError("push_token", fmt.Sprintf("push_token must not exceed %d characters", DEVICE_PUSH_TOKEN_MAX_LENGTH))
+	}
+	clientId := callerClientId(ctx)
+	device := &models.Device{}
+	err := s.bdb.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		err := tx.NewSelect().Model(device).Where(`"device"."trace_code" = ?`, req.GetTraceCode()).For("UPDATE").Scan(ctx)
+		if errors.Is(err, sql.ErrNoRows) {
+			device = &models.Device{
+				ClientId:  sql.NullString{Valid: true, String: clientId},
+				TraceCode: req.GetTraceCode(),
+				PushToken: sqlpb.ToNullString(req.PushToken),
+				Metadata:  req.GetMetadata(),
+			}
+			if _, err := tx.NewInsert().Model(device).Exec(ctx); err != nil {
+				return status.Errorf(codes.Unknown, "error creating device: %v", err)
+			}
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if device.ClientId.String != clientId {
+			return newAlreadyExistsError("trace_code", "trace_code is registered through another client")
+		}
+		columns := []string{"updated_at"}
+		if req.GetPushToken() != nil {
+			device.PushToken = sqlpb.ToNullString(req.PushToken)
+			columns = append(columns, "push_token")
+		}
+		if req.GetMetadata() != nil {
+			device.Metadata = req.GetMetadata()
+			columns = append(columns, "metadata")
+		}
+		if _, err := tx.NewUpdate().Model(device).Column(columns...).WherePK().Exec(ctx); err != nil {
+			return status.Errorf(codes.Unknown, "error updating device: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &iam.RegisterDeviceResponse{
+		Device: toDevicePB(*device),
+	}, nil
+}
+
+// UpdateDevice updates the push token and metadata of a device registered through the calling client.
+func (s *devicesServiceServer) UpdateDevice(ctx context.Context, req *iam.UpdateDeviceRequest) (*iam.UpdateDeviceResponse, error) {
+	if srv.IsGuest(ctx) && req.GetId() != secure.IdentityFromContext(ctx).Token().Subject() {
+		return nil, status.Errorf(codes.PermissionDenied, "guests can only update their own device")
+	}
+	device, err := getClientDevice(ctx, s.bdb, callerClientId(ctx), req.GetId())
+	if err != nil {
+		return nil, err
+	}
+	columns, err := applyDeviceUpdate(device, req)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.bdb.NewUpdate().Model(device).Column(append(columns, "updated_at")...).WherePK().Exec(ctx); err != nil {
+		return nil, status.Errorf(codes.Unknown, "error updating device: %v", err)
+	}
+	return &iam.UpdateDeviceResponse{
+		Device: toDevicePB(*device),
+	}, nil
+}
+
+// BindDevice binds a device of the calling client to the bearer user, the device becomes the current device of the user.
+func (s *devicesServiceServer) BindDevice(ctx context.Context, req *iam.BindDeviceRequest) (*iam.BindDeviceResponse, error) {
+	userId := secure.IdentityFromContext(ctx).Token().Subject()
+	device, err := getClientDevice(ctx, s.bdb, callerClientId(ctx), req.GetId())
+	if err != nil {
+		return nil, err
+	}
+	if err := bindDevice(ctx, s.bdb, userId, device); err != nil {
+		return nil, err
+	}
+	return &iam.BindDeviceResponse{
+		Device: toDevicePB(*device),
+	}, nil
+}
+
+// UnbindDevice unbinds a device from the bearer user and revokes the sessions issued on it.
+func (s *devicesServiceServer) UnbindDevice(ctx context.Context, req *iam.UnbindDeviceRequest) (*iam.UnbindDeviceResponse, error) {
+	userId := secure.IdentityFromContext(ctx).Token().Subject()
+	err := s.bdb.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		res, err := tx.NewDelete().Model((*models.UserDevice)(nil)).
+			Where(`"user_id" = ?`, userId).
+			Where(`"device_id" = ?`, req.GetId()).
+			Exec(ctx)
+		if err != nil {
+			return status.Errorf(codes.Unknown, "error unbinding device: %v", err)
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return status.Errorf(codes.NotFound, "device %s is not bound to user %s", req.GetId(), userId)
+		}
+		if _, err := tx.NewUpdate().Model((*models.Device)(nil)).
+			Set(`"user_id" = NULL`).
+			Set(`"updated_at" = NOW()`).
+			Where(`"id" = ?`, req.GetId()).
+			Where(`"user_id" = ?`, userId).
+			Exec(ctx); err != nil {
+			return status.Errorf(codes.Unknown, "error updating device: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.ss.RevokeDevice(ctx, req.GetId()); err != nil {
+		return nil, err
+	}
+	return &iam.UnbindDeviceResponse{}, nil
+}
+
+// ListDevices lists the devices bound to a user, only admins can list devices of other users.
+func (s *devicesServiceServer) ListDevices(ctx context.Context, req *iam.ListDevicesRequest) (*iam.ListDevicesResponse, error) {
+	userId, err := profileUserId(ctx, req.GetUserId())
+	if err != nil {
+		return nil, err
+	}
+	var devices []models.Device
+	if err := s.bdb.NewSelect().Model(&devices).
+		Where(`"device"."id" IN (?)`, s.bdb.NewSelect().Model((*models.UserDevice)(nil)).
+			Column("device_id").Where(`"user_device"."user_id" = ?`, userId)).
+		OrderExpr(`"device"."id" ASC`).
+		Scan(ctx); err != nil {
+		return nil, err
+	}
+	res := &iam.ListDevicesResponse{
+		Items: make([]*iam.Device, len(devices)),
+	}
+	for i, d := range devices {
+		res.Items[i] = toDevicePB(d)
+	}
+	return res, nil
+}
+
+// RemoveDevice deletes a device bound to the bearer user, or any device for admins, and revokes the sessions issued on it.
+func (s *devicesServiceServer) RemoveDevice(ctx context.Context, req *iam.RemoveDeviceRequest) (*iam.RemoveDeviceResponse, error) {
+	if !isAdmin(ctx) {
+		if bound, err := deviceBound(ctx, s.bdb, secure.IdentityFromContext(ctx).Token().Subject(), req.GetId()); err != nil {
+			return nil, err
+		} else if !bound {
+			return nil, status.Errorf(codes.PermissionDenied, "not allowed to remove device %s", req.GetId())
+		}
+	}
+	if err := removeDevice(ctx, s.bdb, req.GetId()); err != nil {
+		return nil, err
+	}
+	if _, err := s.ss.RevokeDevice(ctx, req.GetId()); err != nil {
+		return nil, err
+	}
+	return &iam.RemoveDeviceResponse{}, nil
+}
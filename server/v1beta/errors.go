@@ -0,0 +1,18 @@
+package v1beta
+
+import (
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// newAlreadyExistsError returns an AlreadyExists status error carrying the offending field as a bad request detail.
+func newAlreadyExistsError(field, message string) error {
+	st := status.New(codes.AlreadyExists, message)
+	if ds, err := st.WithDetails(&errdetails.BadRequest{
+		FieldViolations: []*errdetails.BadRequest_FieldViolation{{Field: field, Description: message}},
+	}); err == nil {
+		st = ds
+	}
+	return st.Err()
+}
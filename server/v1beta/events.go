@@ -0,0 +1,30 @@
+package v1beta
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	EVENT_SUBJECT_USER_APPROVED = "gommerce.iam.v1beta.users.approved"
+	EVENT_SUBJECT_USER_REJECTED = "gommerce.iam.v1beta.users.rejected"
+)
+
+// UserEvent is published to nats when the state of a user is changed by someone else, e.g. an admin.
+type UserEvent struct {
+	UserId  string    `json:"user_id"`
+	RealmId string    `json:"realm_id"`
+	ActorId string    `json:"actor_id,omitempty"`
+	Reason  string    `json:"reason,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+func publishEvent(nc *nats.Conn, subject string, event any) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return nc.Publish(subject, payload)
+}
@@ -0,0 +1,231 @@
+package v1beta
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/choral-io/gommerce-server-aio/data/models"
+	srv "github.com/choral-io/gommerce-server-aio/server"
+	"github.com/redis/rueidis"
+	"github.com/uptrace/bun"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	EXPORT_CONTENT_TYPE      = "application/json"
+	EXPORT_FILE_NAME_PATTERN = "user-data-%s-%s.json"
+	EXPORT_SCAN_COUNT        = 100
+)
+
+type userExport struct {
+	Id             string            `json:"id"`
+	Realm          string            `json:"realm"`
+	CreatorId      string            `json:"creator_id,omitempty"`
+	Disabled       bool              `json:"disabled"`
+	Approved       bool              `json:"approved"`
+	Verified       bool              `json:"verified"`
+	CreatedAt      time.Time         `json:"created_at"`
+	UpdatedAt      *time.Time        `json:"updated_at,omitempty"`
+	ExpiresAt      *time.Time        `json:"expires_at,omitempty"`
+	FirstLoginTime *time.Time        `json:"first_login_time,omitempty"`
+	LastActiveTime *time.Time        `json:"last_active_time,omitempty"`
+	EraseAt        *time.Time        `json:"erase_at,omitempty"`
+	Attributes     map[string]string `json:"attributes,omitempty"`
+	PhoneNumber    string            `json:"phone_number,omitempty"`
+	EmailAddress   string            `json:"email_address,omitempty"`
+	Description    string            `json:"description,omitempty"`
+}
+
+type profileExport struct {
+	DisplayName  string     `json:"display_name,omitempty"`
+	AvatarUrl    string     `json:"avatar_url,omitempty"`
+	Gender       string     `json:"gender,omitempty"`
+	Birthdate    *time.Time `json:"birthdate,omitempty"`
+	Introduction string     `json:"introduction,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+	UpdatedAt    *time.Time `json:"updated_at,omitempty"`
+}
+
+type loginExport struct {
+	Id         string            `json:"id"`
+	Provider   string            `json:"provider"`
+	Identifier string            `json:"identifier"`
+	Disabled   bool              `json:"disabled"`
+	CreatedAt  time.Time         `json:"created_at"`
+	ExpiresAt  *time.Time        `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time        `json:"last_used_at,omitempty"`
+	Metadata   map[string]string `json:"metadata,omitempty"`
+}
+
+type deviceExport struct {
+	Id        string            `json:"id"`
+	TraceCode string            `json:"trace_code"`
+	CreatedAt time.Time         `json:"created_at"`
+	UpdatedAt *time.Time        `json:"updated_at,omitempty"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+}
+
+type loginEventExport struct {
+	CreatedAt     time.Time `json:"created_at"`
+	Provider      string    `json:"provider"`
+	Identifier    string    `json:"identifier"`
+	IpAddress     string    `json:"ip_address,omitempty"`
+	UserAgent     string    `json:"user_agent,omitempty"`
+	Outcome       string    `json:"outcome"`
+	FailureReason string    `json:"failure_reason,omitempty"`
+}
+
+type userDataExport struct {
+	ExportedAt  time.Time          `json:"exported_at"`
+	User        userExport         `json:"user"`
+	Profile     *profileExport     `json:"profile,omitempty"`
+	Logins      []loginExport      `json:"logins"`
+	Devices     []deviceExport     `json:"devices"`
+	LoginEvents []loginEventExport `json:"login_events"`
+	Sessions    int64              `json:"active_sessions"`
+	State       map[string][]byte  `json:"state"`
+}
+
+func nullTimePtr(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+// exportUserData assembles a json archive of the personal data of a user, credentials are never included.
+func exportUserData(ctx context.Context, bdb bun.IDB, rdb rueidis.Client, ss *srv.SessionStore, userId string) ([]byte, string, error) {
+	user := &models.User{Id: userId}
+	if err := bdb.NewSelect().Model(user).WherePK().
+		Relation("Realm", func(sq *bun.SelectQuery) *bun.SelectQuery { return sq.Column("name") }).
+		Relation("Profile").
+		Scan(ctx); errors.Is(err, sql.ErrNoRows) {
+		return nil, "", status.Errorf(codes.NotFound, "user %s not found", userId)
+	} else if err != nil {
+		return nil, "", err
+	}
+	now := time.Now()
+	data := &userDataExport{
+		ExportedAt: now,
+		User: userExport{
+			Id:             user.Id,
+			CreatorId:      user.CreatorId.String,
+			Disabled:       user.Disabled,
+			Approved:       user.Approved,
+			Verified:       user.Verified,
+			CreatedAt:      user.CreatedAt,
+			UpdatedAt:      nullTimePtr(user.UpdatedAt),
+			ExpiresAt:      nullTimePtr(user.ExpiresAt),
+			FirstLoginTime: nullTimePtr(user.FirstLoginTime),
+			LastActiveTime: nullTimePtr(user.LastActiveTime),
+			EraseAt:        nullTimePtr(user.EraseAt),
+			Attributes:     user.Attributes,
+			PhoneNumber:    user.PhoneNumber.String,
+			EmailAddress:   user.EmailAddress.String,
+			Description:    user.Description.String,
+		},
+		Logins:      []loginExport{},
+		Devices:     []deviceExport{},
+		LoginEvents: []loginEventExport{},
+		State:       map[string][]byte{},
+	}
+	if user.Realm != nil {
+		data.User.Realm = user.Realm.Name
+	}
+	if p := user.Profile; p != nil {
+		data.Profile = &profileExport{
+			DisplayName:  p.DisplayName.String,
+			AvatarUrl:    p.AvatarUrl.String,
+			Gender:       p.Gender.String,
+			Birthdate:    nullTimePtr(p.Birthdate),
+			Introduction: p.Introduction.String,
+			CreatedAt:    p.CreatedAt,
+			UpdatedAt:    nullTimePtr(p.UpdatedAt),
+		}
+	}
+	var logins []models.Login
+	if err := bdb.NewSelect().Model(&logins).ExcludeColumn("credential").
+		Where(`"login"."user_id" = ?`, userId).Scan(ctx); err != nil {
+		return nil, "", err
+	}
+	for _, l := range logins {
+		data.Logins = append(data.Logins, loginExport{
+			Id:         l.Id,
+			Provider:   l.Provider,
+			Identifier: l.Identifier,
+			Disabled:   l.Disabled,
+			CreatedAt:  l.CreatedAt,
+			ExpiresAt:  nullTimePtr(l.ExpiresAt),
+			LastUsedAt: nullTimePtr(l.LastUsedAt),
+			Metadata:   l.Metadata,
+		})
+	}
+	var devices []models.Device
+	if err := bdb.NewSelect().Model(&devices).ExcludeColumn("push_token").
+		WhereOr(`"device"."user_id" = ?`, userId).
+		WhereOr(`"device"."id" IN (?)`, bdb.NewSelect().Model((*models.UserDevice)(nil)).Column("device_id").Where(`"user_device"."user_id" = ?`, userId)).
+		Scan(ctx); err != nil {
+		return nil, "", err
+	}
+	for _, d := range devices {
+		data.Devices = append(data.Devices, deviceExport{
+			Id:        d.Id,
+			TraceCode: d.TraceCode,
+			CreatedAt: d.CreatedAt,
+			UpdatedAt: nullTimePtr(d.UpdatedAt),
+			Metadata:  d.Metadata,
+		})
+	}
+	var events []models.LoginEvent
+	if err := bdb.NewSelect().Model(&events).Where(`"login_event"."user_id" = ?`, userId).
+		OrderExpr(`"login_event"."created_at" DESC`).Scan(ctx); err != nil {
+		return nil, "", err
+	}
+	for _, e := range events {
+		data.LoginEvents = append(data.LoginEvents, loginEventExport{
+			CreatedAt:     e.CreatedAt,
+			Provider:      e.Provider,
+			Identifier:    e.Identifier,
+			IpAddress:     e.IpAddress.String,
+			UserAgent:     e.UserAgent.String,
+			Outcome:       e.Outcome,
+			FailureReason: e.FailureReason.String,
+		})
+	}
+	if n, err := ss.CountUser(ctx, userId); err != nil {
+		return nil, "", err
+	} else {
+		data.Sessions = n
+	}
+	prefix := srv.StateUserKeyPrefix(userId)
+	var cursor uint64
+	for {
+		entry, err := rdb.Do(ctx, rdb.B().Scan().Cursor(cursor).Match(prefix+"*").Count(EXPORT_SCAN_COUNT).Build()).AsScanEntry()
+		if err != nil {
+			return nil, "", err
+		}
+		for _, key := range entry.Elements {
+			value, _, err := parseStateValue(stateGetScript.Exec(ctx, rdb, []string{key}, nil))
+			if rueidis.IsRedisNil(err) {
+				continue
+			} else if err != nil {
+				return nil, "", err
+			}
+			data.State[strings.TrimPrefix(key, prefix)] = value
+		}
+		if cursor = entry.Cursor; cursor == 0 {
+			break
+		}
+	}
+	payload, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return nil, "", err
+	}
+	return payload, fmt.Sprintf(EXPORT_FILE_NAME_PATTERN, userId, now.Format("20060102150405")), nil
+}
@@ -0,0 +1,167 @@
+package v1beta
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+
+	iam "github.com/choral-io/gommerce-protobuf-go/iam/v1beta"
+	sqlpb "github.com/choral-io/gommerce-protobuf-go/types/v1/sqlpb"
+	"github.com/choral-io/gommerce-server-aio/data/models"
+	"github.com/choral-io/gommerce-server-core/validator"
+	"github.com/uptrace/bun"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	GROUP_FIELD_PARENT_ID = "parent_id"
+)
+
+// userRolesQuery selects the names of the roles assigned to a user directly and through its groups,
+// the recursive part walks from the groups of the user up to the roots, UNION stops on cycles.
+const userRolesQuery = `WITH RECURSIVE "user_groups" ("id") AS (
+	SELECT "group_user"."group_id" FROM "group_users" AS "group_user" WHERE "group_user"."user_id" = ?0
+	UNION
+	SELECT "group"."parent_id" FROM "groups" AS "group" INNER JOIN "user_groups" ON "user_groups"."id" = "group"."id" WHERE "group"."parent_id" IS NOT NULL
+)
+SELECT "role"."name" FROM "roles" AS "role"
+WHERE "role"."deleted_at" IS NULL AND (
+	"role"."id" IN (SELECT "role_user"."role_id" FROM "role_users" AS "role_user" WHERE "role_user"."user_id" = ?0 AND "role_user"."deleted_at" IS NULL) OR
+	"role"."id" IN (SELECT "group_role"."role_id" FROM "group_roles" AS "group_role" INNER JOIN "user_groups" ON "user_groups"."id" = "group_role"."group_id")
+)
+ORDER BY "role"."name" ASC`
+
+func toGroupPB(m models.Group) *iam.Group {
+	return &iam.Group{
+		Id:          m.Id,
+		ParentId:    sqlpb.FromNullString(m.ParentId),
+		CreatedAt:   timestamppb.New(m.CreatedAt),
+		UpdatedAt:   sqlpb.FromNullTime(m.UpdatedAt),
+		Name:        m.Name,
+		Description: sqlpb.FromNullString(m.Description),
+	}
+}
+
+// userRoleNames returns the names of the roles of a user, including the roles inherited through all ancestors of its groups.
+func userRoleNames(ctx context.Context, bdb bun.IDB, userId string) ([]string, error) {
+	var names []string
+	if err := bdb.NewRaw(userRolesQuery, userId).Scan(ctx, &names); err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// getRealmGroups returns all groups of a realm keyed by id.
+func getRealmGroups(ctx context.Context, bdb bun.IDB, realmId string) (map[string]models.Group, error) {
+	var items []models.Group
+	if err := bdb.NewSelect().Model(&items).Where(`"group"."realm_id" = ?`, realmId).Scan(ctx); err != nil {
+		return nil, status.Errorf(codes.Unknown, "error retrieving groups: %v", err)
+	}
+	groups := make(map[string]models.Group, len(items))
+	for _, item := range items {
+		groups[item.Id] = item
+	}
+	return groups, nil
+}
+
+// groupPath returns the group and its ancestors, nearest first.
+func groupPath(groups map[string]models.Group, id string) []models.Group {
+	var path []models.Group
+	seen := map[string]bool{}
+	for id != "" && !seen[id] {
+		g, ok := groups[id]
+		if !ok {
+			break
+		}
+		seen[id] = true
+		path = append(path, g)
+		id = g.ParentId.String
+	}
+	return path
+}
+
+// lockRealmGroups locks the realm of a group tree until the end of the transaction, every change of a parent
+// takes the lock before checkGroupParent so that two concurrent moves can not form a cycle together. The lock
+// does not conflict with the key share locks taken by foreign keys to the realm.
+func lockRealmGroups(ctx context.Context, tx bun.Tx, realmId string) error {
+	realm := &models.Realm{Id: realmId}
+	if err := tx.NewSelect().Model(realm).Column("id").WherePK().For("NO KEY UPDATE").Scan(ctx); err != nil {
+		return fmt.Errorf("failed to lock groups of realm %s: %w", realmId, err)
+	}
+	return nil
+}
+
+// checkGroupParent verifies that parentId can become the parent of the group, it must be a group of the same
+// realm which is neither the group itself nor one of its descendants.
+func checkGroupParent(ctx context.Context, bdb bun.IDB, group *models.Group, parentId string) error {
+	groups, err := getRealmGroups(ctx, bdb, group.RealmId)
+	if err != nil {
+		return err
+	}
+	if _, ok := groups[parentId]; !ok {
+		return validator.NewError(GROUP_FIELD_PARENT_ID, fmt.Sprintf("group %s not found", parentId))
+	}
+	for _, g := range groupPath(groups, parentId) {
+		if g.Id == group.Id {
+			return validator.NewError(GROUP_FIELD_PARENT_ID, "group can not be nested in itself or its descendants")
+		}
+	}
+	return nil
+}
+
+// explainUserRole lists how a user is granted a role: directly, through the groups of the user, or both.
+// Each group grant carries the path from a group of the user up to a group the role is assigned to.
+func explainUserRole(ctx context.Context, bdb bun.IDB, user *models.User, roleName string) ([]*iam.RoleGrant, error) {
+	role := &models.Role{}
+	if err := bdb.NewSelect().Model(role).
+		Where(`"role"."realm_id" = ?`, user.RealmId).
+		Where(`"role"."name" = ?`, roleName).
+		Scan(ctx); errors.Is(err, sql.ErrNoRows) {
+		return nil, status.Errorf(codes.NotFound, "role %s not found", roleName)
+	} else if err != nil {
+		return nil, err
+	}
+	var grants []*iam.RoleGrant
+	if n, err := bdb.NewSelect().Model((*models.RoleUser)(nil)).
+		Where(`"role_user"."role_id" = ?`, role.Id).
+		Where(`"role_user"."user_id" = ?`, user.Id).
+		Count(ctx); err != nil {
+		return nil, err
+	} else if n > 0 {
+		grants = append(grants, &iam.RoleGrant{Direct: true})
+	}
+	var holders []string
+	if err := bdb.NewSelect().Model((*models.GroupRole)(nil)).Column("group_id").
+		Where(`"group_role"."role_id" = ?`, role.Id).
+		Scan(ctx, &holders); err != nil {
+		return nil, err
+	}
+	if len(holders) == 0 {
+		return grants, nil
+	}
+	var memberOf []string
+	if err := bdb.NewSelect().Model((*models.GroupUser)(nil)).Column("group_id").
+		Where(`"group_user"."user_id" = ?`, user.Id).
+		Order("group_user.group_id ASC").
+		Scan(ctx, &memberOf); err != nil {
+		return nil, err
+	}
+	groups, err := getRealmGroups(ctx, bdb, user.RealmId)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range memberOf {
+		var path []*iam.Group
+		for _, g := range groupPath(groups, id) {
+			path = append(path, toGroupPB(g))
+			if slices.Contains(holders, g.Id) {
+				grants = append(grants, &iam.RoleGrant{Groups: slices.Clone(path)})
+			}
+		}
+	}
+	return grants, nil
+}
@@ -0,0 +1,341 @@
+package v1beta
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	iam "github.com/choral-io/gommerce-protobuf-go/iam/v1beta"
+	sqlpb "github.com/choral-io/gommerce-protobuf-go/types/v1/sqlpb"
+	drivers "github.com/choral-io/gommerce-server-aio/data/drivers"
+	"github.com/choral-io/gommerce-server-aio/data/models"
+	"github.com/choral-io/gommerce-server-core/data"
+	"github.com/choral-io/gommerce-server-core/secure"
+	"github.com/choral-io/gommerce-server-core/validator"
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/uptrace/bun"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type groupsServiceServer struct {
+	iam.UnimplementedGroupsServiceServer
+
+	bdb bun.IDB
+}
+
+func NewGroupsServiceServer(bdb bun.IDB) iam.GroupsServiceServer {
+	return &groupsServiceServer{bdb: bdb}
+}
+
+func (s *groupsServiceServer) RegisterServerService(reg grpc.ServiceRegistrar) {
+	reg.RegisterService(&iam.GroupsService_ServiceDesc, s)
+}
+
+func (s *groupsServiceServer) RegisterGatewayClient(ctx context.Context, mux *runtime.ServeMux, conn *grpc.ClientConn) error {
+	return iam.RegisterGroupsServiceHandler(ctx, mux, conn)
+}
+
+func (s *groupsServiceServer) Authorize(ctx context.Context, procedure string) error {
+	return secure.Authorize(ctx, secure.AuthFuncAuthenticated, secure.AuthFuncRequireSchema(secure.AUTH_SCHEMA_BEARER), secure.AuthFuncRequireRealm(REALM_ADMIN))
+}
+
+func (s *groupsServiceServer) Mutating(procedure string) bool {
+	switch procedure {
+	case iam.GroupsService_CreateGroup_FullMethodName,
+		iam.GroupsService_UpdateGroup_FullMethodName,
+		iam.GroupsService_DeleteGroup_FullMethodName,
+		iam.GroupsService_AddGroupMembers_FullMethodName,
+		iam.GroupsService_RemoveGroupMembers_FullMethodName,
+		iam.GroupsService_AssignGroupRoles_FullMethodName,
+		iam.GroupsService_UnassignGroupRoles_FullMethodName:
+		return true
+	}
+	return false
+}
+
+func (s *groupsServiceServer) getRealm(ctx context.Context, name string) (*models.Realm, error) {
+	realm := &models.Realm{}
+	if err := s.bdb.NewSelect().Model(realm).Where(`"realm"."name" = ?`, name).Scan(ctx); errors.Is(err, sql.ErrNoRows) {
+		return nil, validator.NewError("realm", fmt.Sprintf("realm %s not found", name))
+	} else if err != nil {
+		return nil, err
+	}
+	return realm, nil
+}
+
+func (s *groupsServiceServer) getGroup(ctx context.Context, db bun.IDB, id string) (*models.Group, error) {
+	group := &models.Group{}
+	if err := db.NewSelect().Model(group).Where(`"group"."id" = ?`, id).Scan(ctx); errors.Is(err, sql.ErrNoRows) {
+		return nil, status.Errorf(codes.NotFound, "group %s not found", id)
+	} else if err != nil {
+		return nil, err
+	}
+	return group, nil
+}
+
+func (s *groupsServiceServer) CreateGroup(ctx context.Context, req *iam.CreateGroupRequest) (*iam.CreateGroupResponse, error) {
+	realm, err := s.getRealm(ctx, req.GetRealm())
+	if err != nil {
+		return nil, err
+	}
+	group := &models.Group{
+		RealmId:     realm.Id,
+		ParentId:    sqlpb.ToNullString(req.ParentId),
+		Name:        req.GetName(),
+		Description: sqlpb.ToNullString(req.Description),
+	}
+	err = s.bdb.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		if group.ParentId.Valid {
+			if err := lockRealmGroups(ctx, tx, realm.Id); err != nil {
+				return err
+			}
+			if err := checkGroupParent(ctx, tx, group, group.ParentId.String); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.NewInsert().Model(group).Exec(ctx); drivers.IsUniqueViolation(err, models.GROUP_UNIQUE_INDEX) {
+			return newAlreadyExistsError("name", fmt.Sprintf("group %s already exists", group.Name))
+		} else if err != nil {
+			return status.Errorf(codes.Unknown, "error creating group: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &iam.CreateGroupResponse{
+		Group: toGroupPB(*group),
+	}, nil
+}
+
+func (s *groupsServiceServer) ListGroups(ctx context.Context, req *iam.ListGroupsRequest) (*iam.ListGroupsResponse, error) {
+	realm, err := s.getRealm(ctx, req.GetRealm())
+	if err != nil {
+		return nil, err
+	}
+	var groups []models.Group
+	query := s.bdb.NewSelect().Model(&groups).Where(`"group"."realm_id" = ?`, realm.Id)
+	if req.ParentId != nil {
+		query = query.Where(`"group"."parent_id" = ?`, req.GetParentId().GetValue())
+	}
+	total, err := query.Apply(data.WithPaging(req)).OrderExpr(`"group"."name" ASC`).ScanAndCount(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res := &iam.ListGroupsResponse{
+		Page:  req.Page,
+		Size:  req.Size,
+		Total: int64(total),
+		Items: make([]*iam.Group, len(groups)),
+	}
+	for i, group := range groups {
+		res.Items[i] = toGroupPB(group)
+	}
+	return res, nil
+}
+
+// UpdateGroup renames, describes or moves a group, an empty parent id moves the group to the root.
+func (s *groupsServiceServer) UpdateGroup(ctx context.Context, req *iam.UpdateGroupRequest) (*iam.UpdateGroupResponse, error) {
+	var group *models.Group
+	err := s.bdb.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		var err error
+		if group, err = s.getGroup(ctx, tx, req.GetId()); err != nil {
+			return err
+		}
+		columns := []string{"updated_at"}
+		if req.Name != nil {
+			group.Name = req.GetName().GetValue()
+			columns = append(columns, "name")
+		}
+		if req.Description != nil {
+			group.Description = sqlpb.ToNullString(req.Description)
+			columns = append(columns, "description")
+		}
+		if req.ParentId != nil {
+			group.ParentId = sql.NullString{Valid: req.GetParentId().GetValue() != "", String: req.GetParentId().GetValue()}
+			if group.ParentId.Valid {
+				if err := lockRealmGroups(ctx, tx, group.RealmId); err != nil {
+					return err
+				}
+				if err := checkGroupParent(ctx, tx, group, group.ParentId.String); err != nil {
+					return err
+				}
+			}
+			columns = append(columns, "parent_id")
+		}
+		if _, err := tx.NewUpdate().Model(group).Column(columns...).WherePK().Exec(ctx); drivers.IsUniqueViolation(err, models.GROUP_UNIQUE_INDEX) {
+			return newAlreadyExistsError("name", fmt.Sprintf("group %s already exists", group.Name))
+		} else if err != nil {
+			return status.Errorf(codes.Unknown, "error updating group: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &iam.UpdateGroupResponse{
+		Group: toGroupPB(*group),
+	}, nil
+}
+
+// DeleteGroup deletes a group with its memberships and role assignments, groups with children can't be deleted.
+func (s *groupsServiceServer) DeleteGroup(ctx context.Context, req *iam.DeleteGroupRequest) (*iam.DeleteGroupResponse, error) {
+	err := s.bdb.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		group, err := s.getGroup(ctx, tx, req.GetId())
+		if err != nil {
+			return err
+		}
+		if exists, err := tx.NewSelect().Model((*models.Group)(nil)).Where(`"group"."parent_id" = ?`, group.Id).Exists(ctx); err != nil {
+			return err
+		} else if exists {
+			return status.Errorf(codes.FailedPrecondition, "group %s has child groups", group.Id)
+		}
+		_, err = tx.NewDelete().Model(group).WherePK().Exec(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &iam.DeleteGroupResponse{}, nil
+}
+
+func (s *groupsServiceServer) ListGroupMembers(ctx context.Context, req *iam.ListGroupMembersRequest) (*iam.ListGroupMembersResponse, error) {
+	if _, err := s.getGroup(ctx, s.bdb, req.GetId()); err != nil {
+		return nil, err
+	}
+	var users []models.User
+	total, err := s.bdb.NewSelect().Model(&users).
+		Where(`"user"."id" IN (?)`, s.bdb.NewSelect().Model((*models.GroupUser)(nil)).Column("user_id").
+			Where(`"group_user"."group_id" = ?`, req.GetId())).
+		Apply(data.WithPaging(req)).
+		OrderExpr(`"user"."id" ASC`).
+		ScanAndCount(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res := &iam.ListGroupMembersResponse{
+		Page:  req.Page,
+		Size:  req.Size,
+		Total: int64(total),
+		Items: make([]*iam.User, len(users)),
+	}
+	for i, user := range users {
+		res.Items[i] = toUserPB(user)
+	}
+	return res, nil
+}
+
+// AddGroupMembers adds users of the realm of the group to it, existing members are kept.
+func (s *groupsServiceServer) AddGroupMembers(ctx context.Context, req *iam.AddGroupMembersRequest) (*iam.AddGroupMembersResponse, error) {
+	group, err := s.getGroup(ctx, s.bdb, req.GetId())
+	if err != nil {
+		return nil, err
+	}
+	if len(req.GetUserIds()) == 0 {
+		return &iam.AddGroupMembersResponse{}, nil
+	}
+	var userIds []string
+	if err := s.bdb.NewSelect().Model((*models.User)(nil)).Column("id").
+		Where(`"user"."realm_id" = ?`, group.RealmId).
+		Where(`"user"."id" IN (?)`, bun.In(req.GetUserIds())).
+		Scan(ctx, &userIds); err != nil {
+		return nil, err
+	}
+	if len(userIds) != len(req.GetUserIds()) {
+		return nil, validator.NewError("user_ids", "some users do not exist in the realm of the group")
+	}
+	members := make([]models.GroupUser, len(userIds))
+	for i, id := range userIds {
+		members[i] = models.GroupUser{GroupId: group.Id, UserId: id}
+	}
+	if _, err := s.bdb.NewInsert().Model(&members).On("CONFLICT DO NOTHING").Exec(ctx); err != nil {
+		return nil, status.Errorf(codes.Unknown, "error adding group members: %v", err)
+	}
+	return &iam.AddGroupMembersResponse{}, nil
+}
+
+func (s *groupsServiceServer) RemoveGroupMembers(ctx context.Context, req *iam.RemoveGroupMembersRequest) (*iam.RemoveGroupMembersResponse, error) {
+	if _, err := s.getGroup(ctx, s.bdb, req.GetId()); err != nil {
+		return nil, err
+	}
+	if len(req.GetUserIds()) == 0 {
+		return &iam.RemoveGroupMembersResponse{}, nil
+	}
+	if _, err := s.bdb.NewDelete().Model((*models.GroupUser)(nil)).
+		Where(`"group_id" = ?`, req.GetId()).
+		Where(`"user_id" IN (?)`, bun.In(req.GetUserIds())).
+		Exec(ctx); err != nil {
+		return nil, err
+	}
+	return &iam.RemoveGroupMembersResponse{}, nil
+}
+
+// AssignGroupRoles assigns roles of the realm of the group to it, the roles are inherited by the members
+// of the group and of all its descendants.
+func (s *groupsServiceServer) AssignGroupRoles(ctx context.Context, req *iam.AssignGroupRolesRequest) (*iam.AssignGroupRolesResponse, error) {
+	group, err := s.getGroup(ctx, s.bdb, req.GetId())
+	if err != nil {
+		return nil, err
+	}
+	if len(req.GetRoleNames()) == 0 {
+		return &iam.AssignGroupRolesResponse{}, nil
+	}
+	var roleIds []string
+	if err := s.bdb.NewSelect().Model((*models.Role)(nil)).Column("id").
+		Where(`"role"."realm_id" = ?`, group.RealmId).
+		Where(`"role"."name" IN (?)`, bun.In(req.GetRoleNames())).
+		Scan(ctx, &roleIds); err != nil {
+		return nil, err
+	}
+	if len(roleIds) != len(req.GetRoleNames()) {
+		return nil, validator.NewError("role_names", "some roles do not exist in the realm of the group")
+	}
+	groupRoles := make([]models.GroupRole, len(roleIds))
+	for i, id := range roleIds {
+		groupRoles[i] = models.GroupRole{GroupId: group.Id, RoleId: id}
+	}
+	if _, err := s.bdb.NewInsert().Model(&groupRoles).On("CONFLICT DO NOTHING").Exec(ctx); err != nil {
+		return nil, status.Errorf(codes.Unknown, "error assigning roles: %v", err)
+	}
+	return &iam.AssignGroupRolesResponse{}, nil
+}
+
+func (s *groupsServiceServer) UnassignGroupRoles(ctx context.Context, req *iam.UnassignGroupRolesRequest) (*iam.UnassignGroupRolesResponse, error) {
+	group, err := s.getGroup(ctx, s.bdb, req.GetId())
+	if err != nil {
+		return nil, err
+	}
+	if len(req.GetRoleNames()) == 0 {
+		return &iam.UnassignGroupRolesResponse{}, nil
+	}
+	if _, err := s.bdb.NewDelete().Model((*models.GroupRole)(nil)).
+		Where(`"group_id" = ?`, group.Id).
+		Where(`"role_id" IN (?)`, s.bdb.NewSelect().Model((*models.Role)(nil)).Column("id").
+			Where(`"role"."realm_id" = ?`, group.RealmId).
+			Where(`"role"."name" IN (?)`, bun.In(req.GetRoleNames()))).
+		Exec(ctx); err != nil {
+		return nil, err
+	}
+	return &iam.UnassignGroupRolesResponse{}, nil
+}
+
+// ExplainUserRole reports why a user has a role, the response is empty if the user does not have it.
+func (s *groupsServiceServer) ExplainUserRole(ctx context.Context, req *iam.ExplainUserRoleRequest) (*iam.ExplainUserRoleResponse, error) {
+	user := &models.User{}
+	if err := s.bdb.NewSelect().Model(user).Where(`"user"."id" = ?`, req.GetUserId()).Scan(ctx); errors.Is(err, sql.ErrNoRows) {
+		return nil, status.Errorf(codes.NotFound, "user %s not found", req.GetUserId())
+	} else if err != nil {
+		return nil, err
+	}
+	grants, err := explainUserRole(ctx, s.bdb, user, req.GetRoleName())
+	if err != nil {
+		return nil, err
+	}
+	return &iam.ExplainUserRoleResponse{
+		Granted: len(grants) > 0,
+		Grants:  grants,
+	}, nil
+}
@@ -0,0 +1,72 @@
+package v1beta
+
+import (
+	"context"
+	"strings"
+
+	"github.com/choral-io/gommerce-server-aio/data/models"
+	srv "github.com/choral-io/gommerce-server-aio/server"
+	"github.com/choral-io/gommerce-server-core/secure"
+	"github.com/choral-io/gommerce-server-core/validator"
+	"github.com/redis/rueidis"
+	"github.com/uptrace/bun"
+)
+
+const (
+	GUEST_FIELD_TOKEN = "guest_token"
+	GUEST_SCAN_COUNT  = 100
+)
+
+// verifyGuestToken verifies a guest token issued through the client in the realm and returns the guest device.
+func verifyGuestToken(ctx context.Context, bdb bun.IDB, ts secure.TokenStore, clientId, realm, value string) (*models.Device, error) {
+	token, err := ts.Verify(value)
+	if err != nil || token == nil || !srv.IsGuestScope(token.Scope()) {
+		return nil, validator.NewError(GUEST_FIELD_TOKEN, "guest token is invalid or expired")
+	}
+	if token.Client() != clientId || token.Realm() != realm {
+		return nil, validator.NewError(GUEST_FIELD_TOKEN, "guest token was issued to another client or realm")
+	}
+	device, err := getClientDevice(ctx, bdb, clientId, token.Subject())
+	if err != nil {
+		return nil, validator.NewErrorWithCause(GUEST_FIELD_TOKEN, "device of guest token is no longer registered", err)
+	}
+	return device, nil
+}
+
+// claimGuest transfers the data owned by the guest of the device to the user: the device is bound to the user, the
+// state of the guest is moved into the key space of the user and the guest sessions are revoked. Keys the user already
+// owns are kept, the conflicting guest values are dropped. Nothing is claimed if the device is bound to another user.
+// Claiming is best effort, callers run it once the user is signed in or registered and only log its errors.
+func claimGuest(ctx context.Context, bdb bun.IDB, rdb rueidis.Client, ss *srv.SessionStore, device *models.Device, userId string) error {
+	if err := bindDevice(ctx, bdb, userId, device); err != nil {
+		return err
+	}
+	guestPrefix := srv.StateUserKeyPrefix(device.Id)
+	userPrefix := srv.StateUserKeyPrefix(userId)
+	var cursor uint64
+	for {
+		entry, err := rdb.Do(ctx, rdb.B().Scan().Cursor(cursor).Match(guestPrefix+"*").Count(GUEST_SCAN_COUNT).Build()).AsScanEntry()
+		if err != nil {
+			return err
+		}
+		for _, key := range entry.Elements {
+			target := userPrefix + strings.TrimPrefix(key, guestPrefix)
+			moved, err := rdb.Do(ctx, rdb.B().Renamenx().Key(key).Newkey(target).Build()).AsBool()
+			if err != nil && strings.Contains(err.Error(), "no such key") {
+				continue // expired meanwhile
+			} else if err != nil {
+				return err
+			}
+			if !moved {
+				if err := rdb.Do(ctx, rdb.B().Unlink().Key(key).Build()).Error(); err != nil {
+					return err
+				}
+			}
+		}
+		if cursor = entry.Cursor; cursor == 0 {
+			break
+		}
+	}
+	_, err := ss.RevokeUser(ctx, device.Id)
+	return err
+}
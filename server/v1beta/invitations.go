@@ -0,0 +1,88 @@
+package v1beta
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	iam "github.com/choral-io/gommerce-protobuf-go/iam/v1beta"
+	sqlpb "github.com/choral-io/gommerce-protobuf-go/types/v1/sqlpb"
+	"github.com/choral-io/gommerce-server-aio/data/models"
+	"github.com/choral-io/gommerce-server-core/secure"
+	"github.com/choral-io/gommerce-server-core/validator"
+	"github.com/uptrace/bun"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	INVITATION_CODE_LENGTH      = 12
+	INVITATION_CODE_SYMBOLS     = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+	INVITATION_DEFAULT_TTL      = 7 * 24 * time.Hour
+	INVITATION_MAX_TTL          = 90 * 24 * time.Hour
+	INVITATION_USER_MAX_USES    = 5
+	INVITATION_ADMIN_MAX_USES   = 10000
+	INVITATION_FIELD_CODE       = "invitation_code"
+	INVITATION_FIELD_ROLE_NAMES = "role_names"
+)
+
+func toInvitationPB(m models.Invitation) *iam.Invitation {
+	r := &iam.Invitation{
+		Id:                 m.Id,
+		CreatorId:          m.CreatorId,
+		Disabled:           m.Disabled,
+		CreatedAt:          timestamppb.New(m.CreatedAt),
+		UpdatedAt:          sqlpb.FromNullTime(m.UpdatedAt),
+		ExpiresAt:          sqlpb.FromNullTime(m.ExpiresAt),
+		Code:               m.Code,
+		MaxUses:            m.MaxUses,
+		UsedCount:          m.UsedCount,
+		MaskedEmailAddress: sqlpb.FromNullString(sql.NullString{Valid: m.EmailAddress.Valid, String: secure.MaskString(m.EmailAddress.String)}),
+		RoleIds:            m.RoleIds,
+		Description:        sqlpb.FromNullString(m.Description),
+	}
+	if m.Realm != nil {
+		r.Realm = m.Realm.Name
+	}
+	return r
+}
+
+// redeemInvitation validates an invitation code for a registration and consumes one use of it.
+// Invitations bound to an email address only match the given address, the caller must have it verified before the user can sign in.
+// It must be called inside a transaction, the invitation row is locked until the registration is committed.
+func redeemInvitation(ctx context.Context, tx bun.Tx, realmId, code, emailAddress string) (*models.Invitation, error) {
+	inv := &models.Invitation{}
+	if err := tx.NewSelect().Model(inv).Where(`"invitation"."code" = ?`, code).For("UPDATE").Scan(ctx); errors.Is(err, sql.ErrNoRows) {
+		return nil, validator.NewError(INVITATION_FIELD_CODE, "invitation code is invalid")
+	} else if err != nil {
+		return nil, status.Errorf(codes.Unknown, "error retrieving invitation: %v", err)
+	}
+	if inv.RealmId != realmId || !inv.Usable(time.Now()) {
+		return nil, validator.NewError(INVITATION_FIELD_CODE, "invitation code is invalid or expired")
+	}
+	if inv.EmailAddress.Valid && inv.EmailAddress.String != emailAddress {
+		return nil, validator.NewError(INVITATION_FIELD_CODE, "invitation code is bound to another email address")
+	}
+	inv.UsedCount++
+	if _, err := tx.NewUpdate().Model(inv).Column("used_count", "updated_at").WherePK().Exec(ctx); err != nil {
+		return nil, status.Errorf(codes.Unknown, "error updating invitation: %v", err)
+	}
+	return inv, nil
+}
+
+// assignInvitationRoles grants the preassigned roles of an invitation to a newly registered user.
+func assignInvitationRoles(ctx context.Context, tx bun.Tx, inv *models.Invitation, userId string) error {
+	if len(inv.RoleIds) == 0 {
+		return nil
+	}
+	roleUsers := make([]models.RoleUser, len(inv.RoleIds))
+	for i, id := range inv.RoleIds {
+		roleUsers[i] = models.RoleUser{RoleId: id, UserId: userId}
+	}
+	if _, err := tx.NewInsert().Model(&roleUsers).Exec(ctx); err != nil {
+		return status.Errorf(codes.Unknown, "error assigning roles: %v", err)
+	}
+	return nil
+}
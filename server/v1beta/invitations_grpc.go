@@ -0,0 +1,172 @@
+package v1beta
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	iam "github.com/choral-io/gommerce-protobuf-go/iam/v1beta"
+	"github.com/choral-io/gommerce-server-aio/data/models"
+	"github.com/choral-io/gommerce-server-core/data"
+	"github.com/choral-io/gommerce-server-core/secure"
+	"github.com/choral-io/gommerce-server-core/validator"
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/uptrace/bun"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type invitationsServiceServer struct {
+	iam.UnimplementedInvitationsServiceServer
+
+	bdb bun.IDB
+}
+
+func NewInvitationsServiceServer(bdb bun.IDB) iam.InvitationsServiceServer {
+	return &invitationsServiceServer{bdb: bdb}
+}
+
+func (s *invitationsServiceServer) RegisterServerService(reg grpc.ServiceRegistrar) {
+	reg.RegisterService(&iam.InvitationsService_ServiceDesc, s)
+}
+
+func (s *invitationsServiceServer) RegisterGatewayClient(ctx context.Context, mux *runtime.ServeMux, conn *grpc.ClientConn) error {
+	return iam.RegisterInvitationsServiceHandler(ctx, mux, conn)
+}
+
+func (s *invitationsServiceServer) Authorize(ctx context.Context, procedure string) error {
+	return secure.Authorize(ctx, secure.AuthFuncAuthenticated, secure.AuthFuncRequireSchema(secure.AUTH_SCHEMA_BEARER))
+}
+
+func (s *invitationsServiceServer) Mutating(procedure string) bool {
+	switch procedure {
+	case iam.InvitationsService_CreateInvitation_FullMethodName,
+		iam.InvitationsService_RevokeInvitation_FullMethodName:
+		return true
+	}
+	return false
+}
+
+func (s *invitationsServiceServer) CreateInvitation(ctx context.Context, req *iam.CreateInvitationRequest) (*iam.CreateInvitationResponse, error) {
+	admin := isAdmin(ctx)
+	realmName := secure.IdentityFromContext(ctx).Token().Realm()
+	if req.GetRealm() != "" && req.GetRealm() != realmName {
+		if !admin {
+			return nil, status.Errorf(codes.PermissionDenied, "not allowed to invite users into realm %s", req.GetRealm())
+		}
+		realmName = req.GetRealm()
+	}
+	realm := &models.Realm{}
+	if err := s.bdb.NewSelect().Model(realm).Where(`"realm"."name" = ?`, realmName).Scan(ctx); errors.Is(err, sql.ErrNoRows) {
+		return nil, validator.NewError("realm", fmt.Sprintf("realm %s not found", realmName))
+	} else if err != nil {
+		return nil, err
+	}
+	maxUses := req.GetMaxUses()
+	if maxUses <= 0 {
+		maxUses = 1
+	}
+	if !admin && maxUses > INVITATION_USER_MAX_USES {
+		return nil, validator.NewError("max_uses", fmt.Sprintf("max_uses must not exceed %d", INVITATION_USER_MAX_USES))
+	} else if maxUses > INVITATION_ADMIN_MAX_USES {
+		return nil, validator.NewError("max_uses", fmt.Sprintf("max_uses must not exceed %d", INVITATION_ADMIN_MAX_USES))
+	}
+	now := time.Now()
+	expiresAt := now.Add(INVITATION_DEFAULT_TTL)
+	if req.GetExpiresAt() != nil {
+		expiresAt = req.GetExpiresAt().AsTime()
+	}
+	if !expiresAt.After(now) || expiresAt.Sub(now) > INVITATION_MAX_TTL {
+		return nil, validator.NewError("expires_at", "expires_at must be in the future and within 90 days")
+	}
+	inv := &models.Invitation{
+		RealmId:     realm.Id,
+		CreatorId:   secure.IdentityFromContext(ctx).Token().Subject(),
+		ExpiresAt:   sql.NullTime{Valid: true, Time: expiresAt},
+		MaxUses:     maxUses,
+		RoleIds:     []string{},
+		Description: sql.NullString{Valid: req.GetDescription() != "", String: req.GetDescription()},
+		Realm:       realm,
+	}
+	if req.GetEmailAddress() != "" {
+		value, err := normalizeEmailAddress(CONTACT_CHANNEL_EMAIL_ADDRESS, req.GetEmailAddress())
+		if err != nil {
+			return nil, err
+		}
+		inv.EmailAddress = sql.NullString{Valid: true, String: value}
+	}
+	if len(req.GetRoleNames()) > 0 {
+		if !admin {
+			return nil, status.Errorf(codes.PermissionDenied, "only admins can preassign roles")
+		}
+		if err := s.bdb.NewSelect().Model((*models.Role)(nil)).Column("id").
+			Where(`"role"."realm_id" = ?`, realm.Id).
+			Where(`"role"."name" IN (?)`, bun.In(req.GetRoleNames())).
+			Scan(ctx, &inv.RoleIds); err != nil {
+			return nil, err
+		}
+		if len(inv.RoleIds) != len(req.GetRoleNames()) {
+			return nil, validator.NewError(INVITATION_FIELD_ROLE_NAMES, "some roles do not exist in the realm")
+		}
+	}
+	if code, err := secure.RandString(INVITATION_CODE_LENGTH, INVITATION_CODE_SYMBOLS); err != nil {
+		return nil, err
+	} else {
+		inv.Code = code
+	}
+	if _, err := s.bdb.NewInsert().Model(inv).Exec(ctx); err != nil {
+		return nil, status.Errorf(codes.Unknown, "error creating invitation: %v", err)
+	}
+	return &iam.CreateInvitationResponse{
+		Invitation: toInvitationPB(*inv),
+	}, nil
+}
+
+func (s *invitationsServiceServer) ListInvitations(ctx context.Context, req *iam.ListInvitationsRequest) (*iam.ListInvitationsResponse, error) {
+	var invs []models.Invitation
+	query := s.bdb.NewSelect().Model(&invs).
+		Relation("Realm", func(sq *bun.SelectQuery) *bun.SelectQuery { return sq.Column("name") })
+	if !isAdmin(ctx) {
+		query = query.Where(`"invitation"."creator_id" = ?`, secure.IdentityFromContext(ctx).Token().Subject())
+	}
+	if req.GetRealm() != "" {
+		query = query.Where(`"realm"."name" = ?`, req.GetRealm())
+	}
+	total, err := query.Apply(data.WithPaging(req)).OrderExpr(`"invitation"."id" DESC`).ScanAndCount(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res := &iam.ListInvitationsResponse{
+		Page:  req.Page,
+		Size:  req.Size,
+		Total: int64(total),
+		Items: make([]*iam.Invitation, len(invs)),
+	}
+	for i, inv := range invs {
+		res.Items[i] = toInvitationPB(inv)
+	}
+	return res, nil
+}
+
+func (s *invitationsServiceServer) RevokeInvitation(ctx context.Context, req *iam.RevokeInvitationRequest) (*iam.RevokeInvitationResponse, error) {
+	query := s.bdb.NewUpdate().Model((*models.Invitation)(nil)).
+		Set(`"disabled" = TRUE`).
+		Set(`"updated_at" = ?`, time.Now()).
+		Where(`"id" = ?`, req.GetId())
+	if !isAdmin(ctx) {
+		query = query.Where(`"creator_id" = ?`, secure.IdentityFromContext(ctx).Token().Subject())
+	}
+	res, err := query.Exec(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return nil, err
+	} else if n == 0 {
+		return nil, status.Errorf(codes.NotFound, "invitation %s not found", req.GetId())
+	}
+	return &iam.RevokeInvitationResponse{}, nil
+}
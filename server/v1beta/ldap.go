@@ -0,0 +1,400 @@
+package v1beta
+
+import (
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/choral-io/gommerce-server-aio/data/models"
+	"github.com/choral-io/gommerce-server-aio/server/normalize"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/uptrace/bun"
+)
+
+const (
+	LDAP_URL_ENV             = "GOMMERCE_LDAP_URL"
+	LDAP_START_TLS_ENV       = "GOMMERCE_LDAP_START_TLS"
+	LDAP_BIND_DN_ENV         = "GOMMERCE_LDAP_BIND_DN"
+	LDAP_BIND_PASSWORD_ENV   = "GOMMERCE_LDAP_BIND_PASSWORD"
+	LDAP_BASE_DN_ENV         = "GOMMERCE_LDAP_BASE_DN"
+	LDAP_USER_FILTER_ENV     = "GOMMERCE_LDAP_USER_FILTER"
+	LDAP_EMAIL_ATTRIBUTE_ENV = "GOMMERCE_LDAP_EMAIL_ATTRIBUTE"
+	LDAP_NAME_ATTRIBUTE_ENV  = "GOMMERCE_LDAP_NAME_ATTRIBUTE"
+	LDAP_GROUP_ATTRIBUTE_ENV = "GOMMERCE_LDAP_GROUP_ATTRIBUTE"
+	LDAP_GROUP_ROLES_ENV     = "GOMMERCE_LDAP_GROUP_ROLES"
+	LDAP_REALM_ENV           = "GOMMERCE_LDAP_REALM"
+	LDAP_TIMEOUT_ENV         = "GOMMERCE_LDAP_TIMEOUT"
+
+	LDAP_DEFAULT_USER_FILTER     = "(uid=%s)"
+	LDAP_DEFAULT_EMAIL_ATTRIBUTE = "mail"
+	LDAP_DEFAULT_NAME_ATTRIBUTE  = "displayName"
+	LDAP_DEFAULT_GROUP_ATTRIBUTE = "memberOf"
+	LDAP_DEFAULT_TIMEOUT         = 10 * time.Second
+
+	LDAP_ATTRIBUTE_CN         = "cn"
+	LDAP_LOGIN_METADATA_DN    = "dn"
+	LDAP_LOGIN_METADATA_ROLES = "roles"
+)
+
+// LDAPConn is the part of an ldap connection used by the login provider, it is satisfied by *ldap.Conn.
+type LDAPConn interface {
+	Bind(username, password string) error
+	Search(req *ldap.SearchRequest) (*ldap.SearchResult, error)
+	Close() error
+}
+
+// LDAPConfig configures the ldap login provider. Dial may be set to connect to another server than the
+// one at URL, e.g. an in-process fake directory.
+type LDAPConfig struct {
+	URL            string
+	StartTLS       bool
+	BindDN         string
+	BindPassword   string
+	BaseDN         string
+	UserFilter     string
+	EmailAttribute string
+	NameAttribute  string
+	GroupAttribute string
+	GroupRoles     map[string]string
+	Realm          string
+	Timeout        time.Duration
+	Dial           func(ctx context.Context) (LDAPConn, error)
+
+	err error
+}
+
+// LDAPConfigFromEnv reads the ldap configuration from environment, the provider is disabled without url.
+// Group roles are given as a json object mapping group dns to role names, without mapping no roles are
+// granted through directory groups. An invalid mapping fails every login rather than granting no roles.
+func LDAPConfigFromEnv() LDAPConfig {
+	cfg := LDAPConfig{
+		URL:            os.Getenv(LDAP_URL_ENV),
+		StartTLS:       strings.EqualFold(os.Getenv(LDAP_START_TLS_ENV), "true"),
+		BindDN:         os.Getenv(LDAP_BIND_DN_ENV),
+		BindPassword:   os.Getenv(LDAP_BIND_PASSWORD_ENV),
+		BaseDN:         os.Getenv(LDAP_BASE_DN_ENV),
+		UserFilter:     envOrDefault(LDAP_USER_FILTER_ENV, LDAP_DEFAULT_USER_FILTER),
+		EmailAttribute: envOrDefault(LDAP_EMAIL_ATTRIBUTE_ENV, LDAP_DEFAULT_EMAIL_ATTRIBUTE),
+		NameAttribute:  envOrDefault(LDAP_NAME_ATTRIBUTE_ENV, LDAP_DEFAULT_NAME_ATTRIBUTE),
+		GroupAttribute: envOrDefault(LDAP_GROUP_ATTRIBUTE_ENV, LDAP_DEFAULT_GROUP_ATTRIBUTE),
+		Realm:          envOrDefault(LDAP_REALM_ENV, REALM_ADMIN),
+		Timeout:        LDAP_DEFAULT_TIMEOUT,
+	}
+	if v, err := time.ParseDuration(os.Getenv(LDAP_TIMEOUT_ENV)); err == nil && v > 0 {
+		cfg.Timeout = v
+	}
+	if v := os.Getenv(LDAP_GROUP_ROLES_ENV); v != "" {
+		if err := json.Unmarshal([]byte(v), &cfg.GroupRoles); err != nil {
+			cfg.err = fmt.Errorf("invalid %s: %w", LDAP_GROUP_ROLES_ENV, err)
+		}
+	}
+	return cfg
+}
+
+func envOrDefault(key, value string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return value
+}
+
+// LDAPLoginProvider signs users of one realm in with directory credentials: the user is searched with the
+// configured filter, the password is verified by binding as the user, and the local user, login and roles
+// are provisioned or updated from the directory entry on each login.
+type LDAPLoginProvider struct {
+	bdb bun.IDB
+	cfg LDAPConfig
+}
+
+// NewLDAPLoginProvider returns the ldap login provider, or nil if no ldap server is configured.
+func NewLDAPLoginProvider(bdb bun.IDB, cfg LDAPConfig) LoginProvider {
+	if cfg.URL == "" && cfg.Dial == nil {
+		return nil
+	}
+	if cfg.UserFilter == "" {
+		cfg.UserFilter = LDAP_DEFAULT_USER_FILTER
+	}
+	if cfg.Realm == "" {
+		cfg.Realm = REALM_ADMIN
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = LDAP_DEFAULT_TIMEOUT
+	}
+	return &LDAPLoginProvider{bdb: bdb, cfg: cfg}
+}
+
+func (p *LDAPLoginProvider) Name() string {
+	return LOGIN_PROVIDER_LDAP
+}
+
+func (p *LDAPLoginProvider) dial(ctx context.Context) (LDAPConn, error) {
+	if p.cfg.Dial != nil {
+		return p.cfg.Dial(ctx)
+	}
+	conn, err := ldap.DialURL(p.cfg.URL, ldap.DialWithDialer(&net.Dialer{Timeout: p.cfg.Timeout}))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(p.cfg.Timeout)
+	if p.cfg.StartTLS {
+		host, _, _ := strings.Cut(strings.TrimPrefix(p.cfg.URL, "ldap://"), ":")
+		if err := conn.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (p *LDAPLoginProvider) Login(ctx context.Context, realmId, username, password, idToken string, scope []string) (*models.Login, error) {
+	if p.cfg.err != nil {
+		return nil, p.cfg.err
+	}
+	username = strings.TrimSpace(username)
+	if username == "" || password == "" {
+		// an empty password would be an unauthenticated bind, which succeeds on most servers
+		return nil, errors.New("username and password are required")
+	}
+	realm := &models.Realm{}
+	if err := p.bdb.NewSelect().Model(realm).Where(`"realm"."id" = ?`, realmId).Scan(ctx); err != nil {
+		return nil, err
+	}
+	if realm.Name != p.cfg.Realm {
+		return nil, fmt.Errorf("login provider '%s' is not enabled for realm %s", LOGIN_PROVIDER_LDAP, realm.Name)
+	}
+	identifier, err := normalize.Username(username)
+	if err != nil {
+		return nil, err
+	}
+	entry, err := p.authenticate(ctx, username, password)
+	if err != nil {
+		return nil, err
+	}
+	return p.provision(ctx, realm, identifier, entry)
+}
+
+// Verify binds as the directory entry of the login with the password, the user and its roles are left untouched.
+// The entry must still be the one the login was provisioned from.
+func (p *LDAPLoginProvider) Verify(ctx context.Context, login *models.Login, password string) error {
+	if p.cfg.err != nil {
+		return p.cfg.err
+	}
+	if password == "" {
+		return errors.New("password is required")
+	}
+	entry, err := p.authenticate(ctx, login.Identifier, password)
+	if err != nil {
+		return err
+	}
+	if dn := login.Metadata[LDAP_LOGIN_METADATA_DN]; dn != "" && !strings.EqualFold(dn, entry.DN) {
+		return errors.New("directory entry of login has changed")
+	}
+	return nil
+}
+
+// authenticate searches the directory entry of the user and binds as it with the password.
+func (p *LDAPLoginProvider) authenticate(ctx context.Context, username, password string) (*ldap.Entry, error) {
+	conn, err := p.dial(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to directory: %w", err)
+	}
+	defer conn.Close()
+	if p.cfg.BindDN != "" {
+		if err := conn.Bind(p.cfg.BindDN, p.cfg.BindPassword); err != nil {
+			return nil, fmt.Errorf("failed to bind to directory: %w", err)
+		}
+	}
+	attrs := []string{p.cfg.EmailAttribute, p.cfg.NameAttribute, LDAP_ATTRIBUTE_CN}
+	if p.cfg.GroupAttribute != "" {
+		attrs = append(attrs, p.cfg.GroupAttribute)
+	}
+	res, err := conn.Search(ldap.NewSearchRequest(p.cfg.BaseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(p.cfg.Timeout.Seconds()), false,
+		fmt.Sprintf(p.cfg.UserFilter, ldap.EscapeFilter(username)), attrs, nil))
+	if err != nil {
+		return nil, fmt.Errorf("failed to search directory: %w", err)
+	}
+	if len(res.Entries) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	if len(res.Entries) > 1 {
+		return nil, errors.New("username is ambiguous in directory")
+	}
+	entry := res.Entries[0]
+	if err := conn.Bind(entry.DN, password); err != nil {
+		return nil, errors.New("password not match")
+	}
+	return entry, nil
+}
+
+// groupRoles maps the groups of a directory entry to role names, only groups listed in the mapping grant roles,
+// so that a directory group named like a role of the realm does not grant it silently.
+func (p *LDAPLoginProvider) groupRoles(entry *ldap.Entry) []string {
+	if p.cfg.GroupAttribute == "" || len(p.cfg.GroupRoles) == 0 {
+		return nil
+	}
+	var roles []string
+	for _, group := range entry.GetAttributeValues(p.cfg.GroupAttribute) {
+		for dn, role := range p.cfg.GroupRoles {
+			if strings.EqualFold(dn, group) {
+				roles = append(roles, role)
+			}
+		}
+	}
+	return roles
+}
+
+// provision creates or updates the local user and login of a directory entry and synchronizes the roles granted
+// through directory groups. Roles assigned locally are kept, roles which do not exist in the realm are ignored.
+func (p *LDAPLoginProvider) provision(ctx context.Context, realm *models.Realm, identifier string, entry *ldap.Entry) (*models.Login, error) {
+	login := &models.Login{}
+	err := p.bdb.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		err := tx.NewSelect().Model(login).Relation("User").
+			Where(`"login"."realm_id" = ?`, realm.Id).
+			Where(`"login"."provider" = ?`, LOGIN_PROVIDER_LDAP).
+			Where(`"login"."identifier" = ?`, identifier).
+			For(`UPDATE OF "login"`).
+			Scan(ctx)
+		var user *models.User
+		if errors.Is(err, sql.ErrNoRows) {
+			user = &models.User{
+				RealmId:    realm.Id,
+				Approved:   true,
+				Verified:   true,
+				Attributes: map[string]string{},
+			}
+			if _, err := tx.NewInsert().Model(user).Exec(ctx); err != nil {
+				return fmt.Errorf("failed to create user: %w", err)
+			}
+			if _, err := tx.NewInsert().Model(&models.Profile{Id: user.Id}).Exec(ctx); err != nil {
+				return fmt.Errorf("failed to create profile: %w", err)
+			}
+			login = &models.Login{
+				UserId:     user.Id,
+				RealmId:    realm.Id,
+				Provider:   LOGIN_PROVIDER_LDAP,
+				Identifier: identifier,
+				Metadata:   map[string]string{},
+			}
+			if _, err := tx.NewInsert().Model(login).Exec(ctx); err != nil {
+				return fmt.Errorf("failed to create login: %w", err)
+			}
+		} else if err != nil {
+			return err
+		} else if user = login.User; user == nil {
+			return sql.ErrNoRows
+		}
+		if err := p.updateUser(ctx, tx, user, entry); err != nil {
+			return err
+		}
+		roles, err := p.syncRoles(ctx, tx, realm.Id, user.Id, login.Metadata[LDAP_LOGIN_METADATA_ROLES], p.groupRoles(entry))
+		if err != nil {
+			return err
+		}
+		if login.Metadata == nil {
+			login.Metadata = map[string]string{}
+		}
+		login.Metadata[LDAP_LOGIN_METADATA_DN] = entry.DN
+		login.Metadata[LDAP_LOGIN_METADATA_ROLES] = strings.Join(roles, ",")
+		if _, err := tx.NewUpdate().Model(login).Column("metadata", "updated_at").WherePK().Exec(ctx); err != nil {
+			return fmt.Errorf("failed to update login: %w", err)
+		}
+		login.User = user
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return login, nil
+}
+
+// updateUser copies the email address and display name of the directory entry into the user, an email address
+// used by another user of the realm is not taken over.
+func (p *LDAPLoginProvider) updateUser(ctx context.Context, tx bun.Tx, user *models.User, entry *ldap.Entry) error {
+	columns := []string{"updated_at"}
+	if email, err := normalizeEmailAddress(CONTACT_CHANNEL_EMAIL_ADDRESS, entry.GetAttributeValue(p.cfg.EmailAttribute)); err == nil && email != user.EmailAddress.String {
+		if err := checkContactAvailable(ctx, tx, user.RealmId, user.Id, CONTACT_CHANNEL_EMAIL_ADDRESS, email); err == nil {
+			user.EmailAddress = sql.NullString{Valid: true, String: email}
+			user.Flags |= models.USER_FLAGS_EMAIL_ADDRESS_VERIFIED
+			columns = append(columns, "email_address", "flags")
+		}
+	}
+	name := entry.GetAttributeValue(p.cfg.NameAttribute)
+	if name == "" {
+		name = entry.GetAttributeValue(LDAP_ATTRIBUTE_CN)
+	}
+	if name != "" {
+		profile := &models.Profile{Id: user.Id, DisplayName: sql.NullString{Valid: true, String: name}}
+		if _, err := tx.NewUpdate().Model(profile).Column("display_name", "updated_at").WherePK().Exec(ctx); err != nil {
+			return fmt.Errorf("failed to update profile: %w", err)
+		}
+		if user.Attributes == nil {
+			user.Attributes = map[string]string{}
+		}
+		user.Attributes[models.USER_ATTRIBUTE_PROFILE_DISPLAY_NAME] = name
+		columns = append(columns, "attributes")
+	}
+	if _, err := tx.NewUpdate().Model(user).Column(columns...).WherePK().Exec(ctx); err != nil {
+		return fmt.Errorf("failed to update user: %w", err)
+	}
+	return nil
+}
+
+// syncRoles grants the roles of the directory groups to the user and revokes those granted by a previous
+// login which the user lost in the directory, the names of the granted roles are returned.
+func (p *LDAPLoginProvider) syncRoles(ctx context.Context, tx bun.Tx, realmId, userId, previous string, names []string) ([]string, error) {
+	var roles []models.Role
+	if len(names) > 0 {
+		if err := tx.NewSelect().Model(&roles).
+			Where(`"role"."realm_id" = ?`, realmId).
+			Where(`"role"."name" IN (?)`, bun.In(names)).
+			Where(`"role"."disabled" = FALSE`).
+			Scan(ctx); err != nil {
+			return nil, fmt.Errorf("failed to query roles: %w", err)
+		}
+	}
+	granted := make([]string, len(roles))
+	for i, r := range roles {
+		granted[i] = r.Name
+		if _, err := tx.NewInsert().Model(&models.RoleUser{RoleId: r.Id, UserId: userId}).
+			On(`CONFLICT ("role_id", "user_id") DO UPDATE`).
+			Set(`"deleted_at" = NULL`).
+			Set(`"updated_at" = EXCLUDED."created_at"`).
+			Where(`"role_user"."deleted_at" IS NOT NULL`).
+			Exec(ctx); err != nil {
+			return nil, fmt.Errorf("failed to grant role %s: %w", r.Name, err)
+		}
+	}
+	if revoked := revokedRoles(previous, granted); len(revoked) > 0 {
+		if _, err := tx.NewDelete().Model((*models.RoleUser)(nil)).
+			Where(`"user_id" = ?`, userId).
+			Where(`"immutable" = FALSE`).
+			Where(`"role_id" IN (?)`, tx.NewSelect().Model((*models.Role)(nil)).Column("id").
+				Where(`"role"."realm_id" = ?`, realmId).
+				Where(`"role"."name" IN (?)`, bun.In(revoked))).
+			Exec(ctx); err != nil {
+			return nil, fmt.Errorf("failed to revoke roles: %w", err)
+		}
+	}
+	slices.Sort(granted)
+	return granted, nil
+}
+
+// revokedRoles returns the roles granted by a previous login, a comma separated list, which are not granted anymore.
+func revokedRoles(previous string, granted []string) []string {
+	var revoked []string
+	for _, name := range strings.Split(previous, ",") {
+		if name != "" && !slices.Contains(granted, name) {
+			revoked = append(revoked, name)
+		}
+	}
+	return revoked
+}
@@ -0,0 +1,312 @@
+package v1beta
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/choral-io/gommerce-server-aio/data/models"
+	"github.com/go-ldap/ldap/v3"
+)
+
+const (
+	testLDAPBindDN       = "cn=service,dc=example,dc=com"
+	testLDAPBindPassword = "service-secret"
+)
+
+// fakeDirectory is an in-process directory, entries are searched by evaluating simple equality and substring filters
+// like "(uid=a*e)" and bound with their password. The filters received are recorded.
+type fakeDirectory struct {
+	entries   []*ldap.Entry
+	passwords map[string]string
+	filters   []string
+	dials     int
+}
+
+func newFakeDirectory() *fakeDirectory {
+	d := &fakeDirectory{passwords: map[string]string{testLDAPBindDN: testLDAPBindPassword}}
+	d.add("uid=alice,ou=people,dc=example,dc=com", "alice-secret", map[string][]string{
+		"uid":         {"alice"},
+		"mail":        {"alice@example.com"},
+		"displayName": {"Alice"},
+		"memberOf":    {"cn=admins,ou=groups,dc=example,dc=com", "cn=staff,ou=groups,dc=example,dc=com"},
+	})
+	d.add("uid=bob,ou=people,dc=example,dc=com", "bob-secret", map[string][]string{"uid": {"bob"}})
+	d.add("uid=bob,ou=contractors,dc=example,dc=com", "bob-secret", map[string][]string{"uid": {"bob"}})
+	return d
+}
+
+func (d *fakeDirectory) add(dn, password string, attrs map[string][]string) {
+	d.entries = append(d.entries, ldap.NewEntry(dn, attrs))
+	d.passwords[dn] = password
+}
+
+func (d *fakeDirectory) dial(ctx context.Context) (LDAPConn, error) {
+	d.dials++
+	return &fakeLDAPConn{dir: d}, nil
+}
+
+type fakeLDAPConn struct {
+	dir   *fakeDirectory
+	bound string
+}
+
+func (c *fakeLDAPConn) Bind(username, password string) error {
+	if password == "" {
+		// like most servers, an empty password is an unauthenticated bind which succeeds
+		c.bound = ""
+		return nil
+	}
+	if p, ok := c.dir.passwords[username]; !ok || p != password {
+		return ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("invalid credentials"))
+	}
+	c.bound = username
+	return nil
+}
+
+func (c *fakeLDAPConn) Search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	if c.bound != testLDAPBindDN {
+		return nil, ldap.NewError(ldap.LDAPResultInsufficientAccessRights, errors.New("search requires the service account"))
+	}
+	c.dir.filters = append(c.dir.filters, req.Filter)
+	attr, value, ok := strings.Cut(strings.TrimSuffix(strings.TrimPrefix(req.Filter, "("), ")"), "=")
+	if !ok {
+		return nil, ldap.NewError(ldap.LDAPResultFilterError, fmt.Errorf("unsupported filter %s", req.Filter))
+	}
+	// unescaped asterisks are wildcards, escaped ones are hex encoded and match literally
+	parts := strings.Split(value, "*")
+	for i, part := range parts {
+		unescaped, err := unescapeFilterValue(part)
+		if err != nil {
+			return nil, ldap.NewError(ldap.LDAPResultFilterError, err)
+		}
+		parts[i] = unescaped
+	}
+	res := &ldap.SearchResult{}
+	for _, entry := range c.dir.entries {
+		if slices.ContainsFunc(entry.GetAttributeValues(attr), func(v string) bool { return matchFilterValue(v, parts) }) {
+			res.Entries = append(res.Entries, entry)
+		}
+	}
+	return res, nil
+}
+
+func unescapeFilterValue(s string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+2 >= len(s) {
+			return "", fmt.Errorf("invalid escape in filter value %q", s)
+		}
+		v, err := hex.DecodeString(s[i+1 : i+3])
+		if err != nil {
+			return "", err
+		}
+		b.Write(v)
+		i += 2
+	}
+	return b.String(), nil
+}
+
+// matchFilterValue matches a value against the parts of a filter value split at its wildcards, case insensitive.
+func matchFilterValue(v string, parts []string) bool {
+	v = strings.ToLower(v)
+	if len(parts) == 1 {
+		return v == strings.ToLower(parts[0])
+	}
+	if !strings.HasPrefix(v, strings.ToLower(parts[0])) {
+		return false
+	}
+	v = v[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(v, strings.ToLower(part))
+		if i < 0 {
+			return false
+		}
+		v = v[i+len(part):]
+	}
+	return strings.HasSuffix(v, strings.ToLower(parts[len(parts)-1]))
+}
+
+func (c *fakeLDAPConn) Close() error {
+	return nil
+}
+
+func newTestLDAPLoginProvider(d *fakeDirectory, groupRoles map[string]string) *LDAPLoginProvider {
+	return NewLDAPLoginProvider(nil, LDAPConfig{
+		BindDN:         testLDAPBindDN,
+		BindPassword:   testLDAPBindPassword,
+		BaseDN:         "dc=example,dc=com",
+		EmailAttribute: LDAP_DEFAULT_EMAIL_ATTRIBUTE,
+		NameAttribute:  LDAP_DEFAULT_NAME_ATTRIBUTE,
+		GroupAttribute: LDAP_DEFAULT_GROUP_ATTRIBUTE,
+		GroupRoles:     groupRoles,
+		Dial:           d.dial,
+	}).(*LDAPLoginProvider)
+}
+
+func TestLDAPAuthenticate(t *testing.T) {
+	tests := []struct {
+		name     string
+		username string
+		password string
+		filter   string
+		want     string
+		wantErr  bool
+	}{
+		{"search and bind", "alice", "alice-secret", "(uid=alice)", "uid=alice,ou=people,dc=example,dc=com", false},
+		{"wrong password", "alice", "bob-secret", "(uid=alice)", "", true},
+		{"ambiguous user", "bob", "bob-secret", "(uid=bob)", "", true},
+		{"filter injection", "a*", "alice-secret", `(uid=a\2a)`, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newFakeDirectory()
+			p := newTestLDAPLoginProvider(d, nil)
+			entry, err := p.authenticate(context.Background(), tt.username, tt.password)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("authenticate(%q) error = %v, want error %v", tt.username, err, tt.wantErr)
+			}
+			if entry != nil && entry.DN != tt.want {
+				t.Errorf("authenticate(%q) = %q, want %q", tt.username, entry.DN, tt.want)
+			}
+			if !slices.Equal(d.filters, []string{tt.filter}) {
+				t.Errorf("authenticate(%q) searched %q, want %q", tt.username, d.filters, tt.filter)
+			}
+		})
+	}
+}
+
+// TestLDAPFakeDirectoryWildcard ensures the fake evaluates wildcards, so an unescaped username would have matched.
+func TestLDAPFakeDirectoryWildcard(t *testing.T) {
+	conn, _ := newFakeDirectory().dial(context.Background())
+	if err := conn.Bind(testLDAPBindDN, testLDAPBindPassword); err != nil {
+		t.Fatalf("Bind() error = %v", err)
+	}
+	tests := []struct {
+		filter string
+		want   int
+	}{
+		{"(uid=a*)", 1},
+		{"(uid=*)", 3},
+		{`(uid=a\2a)`, 0},
+	}
+	for _, tt := range tests {
+		res, err := conn.Search(&ldap.SearchRequest{Filter: tt.filter})
+		if err != nil {
+			t.Fatalf("Search(%q) error = %v", tt.filter, err)
+		}
+		if len(res.Entries) != tt.want {
+			t.Errorf("Search(%q) found %d entries, want %d", tt.filter, len(res.Entries), tt.want)
+		}
+	}
+}
+
+func TestLDAPAuthenticateUnknownUser(t *testing.T) {
+	p := newTestLDAPLoginProvider(newFakeDirectory(), nil)
+	if _, err := p.authenticate(context.Background(), "carol", "carol-secret"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("authenticate(%q) error = %v, want %v", "carol", err, sql.ErrNoRows)
+	}
+}
+
+func TestLDAPLoginRequiresPassword(t *testing.T) {
+	tests := []struct {
+		name     string
+		username string
+		password string
+	}{
+		{"empty password", "alice", ""},
+		{"empty username", "  ", "alice-secret"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newFakeDirectory()
+			p := newTestLDAPLoginProvider(d, nil)
+			if _, err := p.Login(context.Background(), "realm", tt.username, tt.password, "", nil); err == nil {
+				t.Fatalf("Login(%q, %q) succeeded, want error", tt.username, tt.password)
+			}
+			if d.dials != 0 {
+				t.Errorf("Login(%q, %q) connected to the directory %d times, want 0", tt.username, tt.password, d.dials)
+			}
+		})
+	}
+}
+
+// TestLDAPVerify ensures re-authentication only binds, the provider has no database so provisioning would fail.
+func TestLDAPVerify(t *testing.T) {
+	tests := []struct {
+		name     string
+		dn       string
+		password string
+		wantErr  bool
+	}{
+		{"matching password", "uid=alice,ou=people,dc=example,dc=com", "alice-secret", false},
+		{"wrong password", "uid=alice,ou=people,dc=example,dc=com", "bob-secret", true},
+		{"empty password", "uid=alice,ou=people,dc=example,dc=com", "", true},
+		{"entry changed", "uid=alice,ou=former,dc=example,dc=com", "alice-secret", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestLDAPLoginProvider(newFakeDirectory(), nil)
+			login := &models.Login{Identifier: "alice", Metadata: map[string]string{LDAP_LOGIN_METADATA_DN: tt.dn}}
+			if err := p.Verify(context.Background(), login, tt.password); (err != nil) != tt.wantErr {
+				t.Errorf("Verify(%q) error = %v, want error %v", tt.password, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLDAPGroupRoles(t *testing.T) {
+	tests := []struct {
+		name       string
+		groupRoles map[string]string
+		want       []string
+	}{
+		{"without mapping", nil, nil},
+		{"mapped groups", map[string]string{"CN=Admins,OU=Groups,DC=Example,DC=Com": "ADMIN"}, []string{"ADMIN"}},
+		{"unmapped groups", map[string]string{"cn=auditors,ou=groups,dc=example,dc=com": "AUDITOR"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestLDAPLoginProvider(newFakeDirectory(), tt.groupRoles)
+			entry, err := p.authenticate(context.Background(), "alice", "alice-secret")
+			if err != nil {
+				t.Fatalf("authenticate(%q) error = %v", "alice", err)
+			}
+			got := p.groupRoles(entry)
+			slices.Sort(got)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("groupRoles() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLDAPRevokedRoles(t *testing.T) {
+	tests := []struct {
+		name     string
+		previous string
+		granted  []string
+		want     []string
+	}{
+		{"first login", "", []string{"admins"}, nil},
+		{"unchanged", "admins,staff", []string{"admins", "staff"}, nil},
+		{"group removed", "admins,staff", []string{"staff"}, []string{"admins"}},
+		{"all groups removed", "admins,staff", nil, []string{"admins", "staff"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := revokedRoles(tt.previous, tt.granted); !slices.Equal(got, tt.want) {
+				t.Errorf("revokedRoles(%q, %v) = %v, want %v", tt.previous, tt.granted, got, tt.want)
+			}
+		})
+	}
+}
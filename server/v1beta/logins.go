@@ -0,0 +1,69 @@
+package v1beta
+
+import (
+	"strings"
+
+	iam "github.com/choral-io/gommerce-protobuf-go/iam/v1beta"
+	sqlpb "github.com/choral-io/gommerce-protobuf-go/types/v1/sqlpb"
+	"github.com/choral-io/gommerce-server-aio/data/models"
+	"github.com/uptrace/bun"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func toLoginPB(m models.Login) *iam.Login {
+	// never expose credentials
+	return &iam.Login{
+		Id:         m.Id,
+		Disabled:   m.Disabled,
+		Immutable:  m.Immutable,
+		CreatedAt:  timestamppb.New(m.CreatedAt),
+		UpdatedAt:  sqlpb.FromNullTime(m.UpdatedAt),
+		ExpiresAt:  sqlpb.FromNullTime(m.ExpiresAt),
+		LastUsedAt: sqlpb.FromNullTime(m.LastUsedAt),
+		Provider:   m.Provider,
+		Identifier: m.Identifier,
+	}
+}
+
+func toLoginEventPB(m models.LoginEvent) *iam.LoginEvent {
+	return &iam.LoginEvent{
+		Id:            m.Id,
+		CreatedAt:     timestamppb.New(m.CreatedAt),
+		Realm:         m.Realm,
+		Provider:      m.Provider,
+		Identifier:    m.Identifier,
+		UserId:        sqlpb.FromNullString(m.UserId),
+		ClientId:      sqlpb.FromNullString(m.ClientId),
+		IpAddress:     sqlpb.FromNullString(m.IpAddress),
+		UserAgent:     sqlpb.FromNullString(m.UserAgent),
+		Outcome:       m.Outcome,
+		FailureReason: sqlpb.FromNullString(m.FailureReason),
+	}
+}
+
+// loginEventFilter is implemented by the requests which list login events.
+type loginEventFilter interface {
+	GetOutcome() string
+	GetProvider() string
+	GetCreatedAfter() *timestamppb.Timestamp
+	GetCreatedBefore() *timestamppb.Timestamp
+}
+
+// withLoginEventFilters applies the filters shared by the admin and the self-service listing of login events.
+func withLoginEventFilters(req loginEventFilter) func(*bun.SelectQuery) *bun.SelectQuery {
+	return func(q *bun.SelectQuery) *bun.SelectQuery {
+		if req.GetOutcome() != "" {
+			q = q.Where(`"login_event"."outcome" = ?`, req.GetOutcome())
+		}
+		if req.GetProvider() != "" {
+			q = q.Where(`"login_event"."provider" = ?`, strings.ToUpper(req.GetProvider()))
+		}
+		if req.GetCreatedAfter() != nil {
+			q = q.Where(`"login_event"."created_at" >= ?`, req.GetCreatedAfter().AsTime())
+		}
+		if req.GetCreatedBefore() != nil {
+			q = q.Where(`"login_event"."created_at" < ?`, req.GetCreatedBefore().AsTime())
+		}
+		return q.OrderExpr(`"login_event"."created_at" DESC, "login_event"."id" DESC`)
+	}
+}
@@ -0,0 +1,263 @@
+package v1beta
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	iam "github.com/choral-io/gommerce-protobuf-go/iam/v1beta"
+	drivers "github.com/choral-io/gommerce-server-aio/data/drivers"
+	"github.com/choral-io/gommerce-server-aio/data/models"
+	srv "github.com/choral-io/gommerce-server-aio/server"
+	"github.com/choral-io/gommerce-server-core/data"
+	"github.com/choral-io/gommerce-server-core/secure"
+	"github.com/choral-io/gommerce-server-core/validator"
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/uptrace/bun"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	LOGIN_REAUTH_MAX_AGE = 5 * time.Minute
+)
+
+type loginsServiceServer struct {
+	iam.UnimplementedLoginsServiceServer
+
+	bdb bun.IDB
+	lps map[string]LoginProvider
+}
+
+func NewLoginsServiceServer(bdb bun.IDB) iam.LoginsServiceServer {
+	return &loginsServiceServer{
+		bdb: bdb,
+		lps: newLoginProviders(bdb),
+	}
+}
+
+func (s *loginsServiceServer) RegisterServerService(reg grpc.ServiceRegistrar) {
+	reg.RegisterService(&iam.LoginsService_ServiceDesc, s)
+}
+
+func (s *loginsServiceServer) RegisterGatewayClient(ctx context.Context, mux *runtime.ServeMux, conn *grpc.ClientConn) error {
+	return iam.RegisterLoginsServiceHandler(ctx, mux, conn)
+}
+
+func (s *loginsServiceServer) Authorize(ctx context.Context, procedure string) error {
+	if procedure == iam.LoginsService_LinkLogin_FullMethodName || procedure == iam.LoginsService_UnlinkLogin_FullMethodName {
+		if err := srv.DenyImpersonation(ctx); err != nil {
+			return err
+		}
+	}
+	if procedure == iam.LoginsService_ListLoginEvents_FullMethodName {
+		return secure.Authorize(ctx, secure.AuthFuncAuthenticated, secure.AuthFuncRequireSchema(secure.AUTH_SCHEMA_BEARER), secure.AuthFuncRequireRealm(REALM_ADMIN))
+	}
+	return secure.Authorize(ctx, secure.AuthFuncAuthenticated, secure.AuthFuncRequireSchema(secure.AUTH_SCHEMA_BEARER))
+}
+
+func (s *loginsServiceServer) Mutating(procedure string) bool {
+	switch procedure {
+	case iam.LoginsService_LinkLogin_FullMethodName,
+		iam.LoginsService_UnlinkLogin_FullMethodName:
+		return true
+	}
+	return false
+}
+
+func (s *loginsServiceServer) ListLogins(ctx context.Context, req *iam.ListLoginsRequest) (*iam.ListLoginsResponse, error) {
+	var logins []models.Login
+	if err := s.bdb.NewSelect().Model(&logins).
+		Where(`"login"."user_id" = ?`, secure.IdentityFromContext(ctx).Token().Subject()).
+		OrderExpr(`"login"."id" ASC`).
+		Scan(ctx); err != nil {
+		return nil, err
+	}
+	res := &iam.ListLoginsResponse{
+		Items: make([]*iam.Login, len(logins)),
+	}
+	for i, l := range logins {
+		res.Items[i] = toLoginPB(l)
+	}
+	return res, nil
+}
+
+func (s *loginsServiceServer) LinkLogin(ctx context.Context, req *iam.LinkLoginRequest) (*iam.LinkLoginResponse, error) {
+	provider, ok := s.lps[strings.ToUpper(req.GetProvider())]
+	if !ok || provider == nil {
+		return nil, validator.NewError("provider", fmt.Sprintf("login provider %s not found", req.GetProvider()))
+	}
+	linker, ok := provider.(LoginLinker)
+	if !ok {
+		return nil, validator.NewError("provider", fmt.Sprintf("login provider %s does not support linking", provider.Name()))
+	}
+	user := &models.User{Id: secure.IdentityFromContext(ctx).Token().Subject()}
+	if err := s.bdb.NewSelect().Model(user).Column("id", "realm_id").WherePK().Scan(ctx); err != nil {
+		return nil, err
+	}
+	if err := s.reauthenticate(ctx, user, req.GetCurrentPassword().GetValue()); err != nil {
+		return nil, err
+	}
+	login, err := linker.Link(ctx, user.RealmId, req.GetUsername().GetValue(), req.GetPassword().GetValue(), req.GetIdToken().GetValue())
+	if err != nil {
+		return nil, validator.NewError("", err.Error())
+	}
+	login.UserId = user.Id
+	login.RealmId = user.RealmId
+	if _, err := s.bdb.NewInsert().Model(login).Exec(ctx); drivers.IsUniqueViolation(err, models.LOGIN_UNIQUE_INDEX) {
+		return nil, newAlreadyExistsError("username", "login is already linked to a user")
+	} else if err != nil {
+		return nil, status.Errorf(codes.Unknown, "error creating login: %v", err)
+	}
+	return &iam.LinkLoginResponse{
+		Login: toLoginPB(*login),
+	}, nil
+}
+
+// reauthenticate proves that the bearer still knows a primary credential of the user, so a stolen access token alone
+// can not attach a permanent login to the account. The password is verified against every usable login whose provider
+// can check it without side effects. Users without such a login, e.g. users of one-time code logins or users whose
+// password was never set, prove a recent sign-in instead: one of their logins must have been used within
+// LOGIN_REAUTH_MAX_AGE.
+func (s *loginsServiceServer) reauthenticate(ctx context.Context, user *models.User, password string) error {
+	var logins []models.Login
+	if err := s.bdb.NewSelect().Model(&logins).
+		Where(`"login"."user_id" = ?`, user.Id).
+		Scan(ctx); err != nil {
+		return status.Errorf(codes.Unknown, "error retrieving logins: %v", err)
+	}
+	now := time.Now()
+	verifiable, recent := false, false
+	for i := range logins {
+		l := &logins[i]
+		if !l.Usable(now) {
+			continue
+		}
+		if l.LastUsedAt.Valid && now.Sub(l.LastUsedAt.Time) <= LOGIN_REAUTH_MAX_AGE {
+			recent = true
+		}
+		verifier, ok := s.lps[l.Provider].(CredentialVerifier)
+		if !ok {
+			continue
+		}
+		err := verifier.Verify(ctx, l, password)
+		if errors.Is(err, errNoCredential) {
+			continue
+		}
+		verifiable = true
+		if password != "" && err == nil {
+			return nil
+		}
+	}
+	if verifiable {
+		if password == "" {
+			return validator.NewError("current_password", "current password is required")
+		}
+		return status.Error(codes.PermissionDenied, "current password is invalid")
+	}
+	if !recent {
+		return status.Errorf(codes.FailedPrecondition, "sign in again within %s to link a login", LOGIN_REAUTH_MAX_AGE)
+	}
+	return nil
+}
+
+func (s *loginsServiceServer) UnlinkLogin(ctx context.Context, req *iam.UnlinkLoginRequest) (*iam.UnlinkLoginResponse, error) {
+	userId := secure.IdentityFromContext(ctx).Token().Subject()
+	err := s.bdb.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		var logins []models.Login
+		if err := tx.NewSelect().Model(&logins).Where(`"login"."user_id" = ?`, userId).For("UPDATE").Scan(ctx); err != nil {
+			return err
+		}
+		var target *models.Login
+		var usable int
+		now := time.Now()
+		for i := range logins {
+			if logins[i].Id == req.GetId() {
+				target = &logins[i]
+			} else if logins[i].Usable(now) {
+				usable++
+			}
+		}
+		if target == nil {
+			return status.Errorf(codes.NotFound, "login %s not found", req.GetId())
+		}
+		if target.Immutable {
+			return status.Errorf(codes.FailedPrecondition, "login %s is immutable", target.Id)
+		}
+		if usable == 0 {
+			return status.Errorf(codes.FailedPrecondition, "the last enabled login can not be unlinked")
+		}
+		if _, err := tx.NewDelete().Model(target).WherePK().ForceDelete().Exec(ctx); errors.Is(err, sql.ErrNoRows) {
+			return status.Errorf(codes.NotFound, "login %s not found", req.GetId())
+		} else if err != nil {
+			return status.Errorf(codes.Unknown, "error deleting login: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &iam.UnlinkLoginResponse{}, nil
+}
+
+// ListMyLoginEvents lists the recent login attempts of the bearer user.
+func (s *loginsServiceServer) ListMyLoginEvents(ctx context.Context, req *iam.ListMyLoginEventsRequest) (*iam.ListMyLoginEventsResponse, error) {
+	var events []models.LoginEvent
+	total, err := s.bdb.NewSelect().Model(&events).Apply(data.WithPaging(req)).
+		Where(`"login_event"."user_id" = ?`, secure.IdentityFromContext(ctx).Token().Subject()).
+		Apply(withLoginEventFilters(req)).
+		ScanAndCount(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res := &iam.ListMyLoginEventsResponse{
+		Page:  req.Page,
+		Size:  req.Size,
+		Total: int64(total),
+		Items: make([]*iam.LoginEvent, len(events)),
+	}
+	for i, e := range events {
+		res.Items[i] = toLoginEventPB(e)
+	}
+	return res, nil
+}
+
+// ListLoginEvents lists login attempts of all users, including attempts which could not be resolved to a user.
+func (s *loginsServiceServer) ListLoginEvents(ctx context.Context, req *iam.ListLoginEventsRequest) (*iam.ListLoginEventsResponse, error) {
+	var events []models.LoginEvent
+	total, err := s.bdb.NewSelect().Model(&events).Apply(data.WithPaging(req)).
+		Apply(func(q *bun.SelectQuery) *bun.SelectQuery {
+			if req.GetRealm() != "" {
+				q = q.Where(`"login_event"."realm" = ?`, req.GetRealm())
+			}
+			if req.GetUserId() != "" {
+				q = q.Where(`"login_event"."user_id" = ?`, req.GetUserId())
+			}
+			if req.GetIdentifier() != "" {
+				q = q.Where(`"login_event"."identifier" = ?`, req.GetIdentifier())
+			}
+			if req.GetIpAddress() != "" {
+				q = q.Where(`"login_event"."ip_address" = ?`, req.GetIpAddress())
+			}
+			return q
+		}).
+		Apply(withLoginEventFilters(req)).
+		ScanAndCount(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res := &iam.ListLoginEventsResponse{
+		Page:  req.Page,
+		Size:  req.Size,
+		Total: int64(total),
+		Items: make([]*iam.LoginEvent, len(events)),
+	}
+	for i, e := range events {
+		res.Items[i] = toLoginEventPB(e)
+	}
+	return res, nil
+}
@@ -0,0 +1,141 @@
+package v1beta
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	iam "github.com/choral-io/gommerce-protobuf-go/iam/v1beta"
+	"github.com/choral-io/gommerce-server-aio/data/models"
+	srv "github.com/choral-io/gommerce-server-aio/server"
+	"github.com/choral-io/gommerce-server-aio/server/notify"
+	"github.com/choral-io/gommerce-server-core/secure"
+	"github.com/choral-io/gommerce-server-core/validator"
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/uptrace/bun"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	NOTIFICATION_MAX_RECIPIENTS = 500
+	NOTIFICATION_MAX_BODY_SIZE  = 4096
+)
+
+type notificationsServiceServer struct {
+	iam.UnimplementedNotificationsServiceServer
+
+	bdb bun.IDB
+	pd  *srv.PushDispatcher
+}
+
+func NewNotificationsServiceServer(bdb bun.IDB, pd *srv.PushDispatcher) iam.NotificationsServiceServer {
+	return &notificationsServiceServer{
+		bdb: bdb,
+		pd:  pd,
+	}
+}
+
+func (s *notificationsServiceServer) RegisterServerService(reg grpc.ServiceRegistrar) {
+	reg.RegisterService(&iam.NotificationsService_ServiceDesc, s)
+}
+
+func (s *notificationsServiceServer) RegisterGatewayClient(ctx context.Context, mux *runtime.ServeMux, conn *grpc.ClientConn) error {
+	return iam.RegisterNotificationsServiceHandler(ctx, mux, conn)
+}
+
+func (s *notificationsServiceServer) Authorize(ctx context.Context, procedure string) error {
+	if err := secure.Authorize(ctx, secure.AuthFuncAuthenticated, secure.AuthFuncRequireSchema(secure.AUTH_SCHEMA_BASIC)); err != nil {
+		return err
+	}
+	clientId := secure.IdentityFromContext(ctx).Token().Subject()
+	client := &models.Client{Id: clientId}
+	if err := s.bdb.NewSelect().Model(client).WherePK().Scan(ctx); errors.Is(err, sql.ErrNoRows) {
+		return status.Errorf(codes.PermissionDenied, "client %s not found", clientId)
+	} else if err != nil {
+		return err
+	}
+	if !client.Trusted() {
+		return status.Errorf(codes.PermissionDenied, "client %s is not trusted to send notifications", clientId)
+	}
+	return nil
+}
+
+func (s *notificationsServiceServer) Mutating(procedure string) bool {
+	return procedure == iam.NotificationsService_SendNotification_FullMethodName
+}
+
+// SendNotification pushes a message to all devices of the given users, deliveries to single devices may fail
+// without failing the call, they are reported in the counts of the response.
+func (s *notificationsServiceServer) SendNotification(ctx context.Context, req *iam.SendNotificationRequest) (*iam.SendNotificationResponse, error) {
+	if len(req.GetUserIds()) == 0 || len(req.GetUserIds()) > NOTIFICATION_MAX_RECIPIENTS {
+		return nil, validator.NewError("user_ids", fmt.Sprintf("between 1 and %d user ids are required", NOTIFICATION_MAX_RECIPIENTS))
+	}
+	if req.GetBody() == "" || len(req.GetBody()) > NOTIFICATION_MAX_BODY_SIZE {
+		return nil, validator.NewError("body", fmt.Sprintf("body is required and must not exceed %d bytes", NOTIFICATION_MAX_BODY_SIZE))
+	}
+	msg := &notify.PushMessage{
+		Title:    req.GetTitle(),
+		Body:     req.GetBody(),
+		Data:     req.GetData(),
+		Sound:    req.GetSound(),
+		Category: req.GetCategory(),
+		TTL:      req.GetTtl().AsDuration(),
+	}
+	if req.Badge != nil {
+		badge := req.GetBadge().GetValue()
+		msg.Badge = &badge
+	}
+	userIds, err := s.recipients(ctx, req.GetUserIds())
+	if err != nil {
+		return nil, err
+	}
+	res := &iam.SendNotificationResponse{}
+	for _, userId := range userIds {
+		result, err := s.pd.PushToUser(ctx, userId, msg)
+		if err != nil {
+			return nil, err
+		}
+		res.Delivered += int32(result.Delivered)
+		res.Failed += int32(result.Failed)
+		res.Pruned += int32(result.Pruned)
+	}
+	return res, nil
+}
+
+// recipients returns the users to push to, all of them must belong to the realm of the calling client. Disabled and
+// deleted users are skipped.
+func (s *notificationsServiceServer) recipients(ctx context.Context, userIds []string) ([]string, error) {
+	clientId := secure.IdentityFromContext(ctx).Token().Subject()
+	client := &models.Client{Id: clientId}
+	if err := s.bdb.NewSelect().Model(client).Column("id", "realm_id").WherePK().Scan(ctx); err != nil {
+		return nil, err
+	}
+	if !client.RealmId.Valid {
+		return nil, status.Errorf(codes.PermissionDenied, "client %s does not belong to a realm", clientId)
+	}
+	var users []models.User
+	if err := s.bdb.NewSelect().Model(&users).Column("id", "disabled", "deleted_at").
+		Where(`"user"."id" IN (?)`, bun.In(userIds)).
+		Where(`"user"."realm_id" = ?`, client.RealmId.String).
+		WhereAllWithDeleted().
+		Scan(ctx); err != nil {
+		return nil, err
+	}
+	found := make(map[string]bool, len(users))
+	recipients := make([]string, 0, len(users))
+	for _, u := range users {
+		found[u.Id] = true
+		if !u.Disabled && !u.DeletedAt.Valid {
+			recipients = append(recipients, u.Id)
+		}
+	}
+	for _, userId := range userIds {
+		if !found[userId] {
+			return nil, validator.NewError("user_ids", fmt.Sprintf("user %s not found in the realm of the client", userId))
+		}
+	}
+	return recipients, nil
+}
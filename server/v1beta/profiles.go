@@ -0,0 +1,161 @@
+package v1beta
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	iam "github.com/choral-io/gommerce-protobuf-go/iam/v1beta"
+	gender "github.com/choral-io/gommerce-protobuf-go/types/v1/gender"
+	sqlpb "github.com/choral-io/gommerce-protobuf-go/types/v1/sqlpb"
+	"github.com/choral-io/gommerce-server-aio/data/models"
+	"github.com/choral-io/gommerce-server-core/validator"
+	"github.com/uptrace/bun"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func toProfilePB(p models.Profile) *iam.Profile {
+	return &iam.Profile{
+		CreatedAt:    timestamppb.New(p.CreatedAt),
+		UpdatedAt:    sqlpb.FromNullTime(p.UpdatedAt),
+		DisplayName:  sqlpb.FromNullString(p.DisplayName),
+		AvatarUrl:    sqlpb.FromNullString(p.AvatarUrl),
+		Gender:       gender.FromSqlNullString(p.Gender),
+		Birthdate:    sqlpb.FromNullTime(p.Birthdate),
+		Introduction: sqlpb.FromNullString(p.Introduction),
+	}
+}
+
+// applyProfileUpdate copies the fields of an update profile request into the profile and returns the changed columns.
+// Fields listed in the update mask are always written, so they can be cleared; without a mask only present fields are written.
+func applyProfileUpdate(p *models.Profile, req *iam.UpdateProfileRequest) ([]string, error) {
+	paths := req.GetUpdateMask().GetPaths()
+	if len(paths) == 0 {
+		if req.DisplayName != nil {
+			paths = append(paths, "display_name")
+		}
+		if req.AvatarUrl != nil {
+			paths = append(paths, "avatar_url")
+		}
+		if req.Gender != nil {
+			paths = append(paths, "gender")
+		}
+		if req.Birthdate != nil {
+			paths = append(paths, "birthdate")
+		}
+		if req.Introduction != nil {
+			paths = append(paths, "introduction")
+		}
+	}
+	columns := make([]string, 0, len(paths))
+	for _, path := range paths {
+		switch path {
+		case "display_name":
+			p.DisplayName = sqlpb.ToNullString(req.DisplayName)
+		case "avatar_url":
+			p.AvatarUrl = sqlpb.ToNullString(req.AvatarUrl)
+		case "gender":
+			p.Gender = gender.ToSqlNullString(req.Gender)
+		case "birthdate":
+			p.Birthdate = sqlpb.ToNullTime(req.Birthdate)
+		case "introduction":
+			p.Introduction = sqlpb.ToNullString(req.Introduction)
+		default:
+			return nil, validator.NewError("update_mask", fmt.Sprintf("field %s can not be updated", path))
+		}
+		columns = append(columns, path)
+	}
+	return columns, nil
+}
+
+// saveProfile updates the given profile columns and keeps the denormalized user attributes in sync.
+// It must be called inside a transaction, the user row is locked while its attributes are rewritten.
+func saveProfile(ctx context.Context, tx bun.Tx, p *models.Profile, writer string, columns ...string) error {
+	if len(columns) == 0 {
+		return nil
+	}
+	user := &models.User{Id: p.Id}
+	if err := tx.NewSelect().Model(user).Column("id", "realm_id", "attributes").WherePK().For("UPDATE").Scan(ctx); err != nil {
+		return status.Errorf(codes.Unknown, "error retrieving user: %v", err)
+	}
+	schemas, err := getAttributeSchemas(ctx, tx, user.RealmId)
+	if err != nil {
+		return err
+	}
+	if err := validateAttributes(schemas, writer, user.Attributes, profileAttributes(p)); err != nil {
+		return err
+	}
+	if _, err := tx.NewUpdate().Model(p).Column(append(columns, "updated_at")...).WherePK().Exec(ctx); err != nil {
+		return status.Errorf(codes.Unknown, "error updating profile: %v", err)
+	}
+	if user.Attributes == nil {
+		user.Attributes = map[string]string{}
+	}
+	p.ApplyAttributes(user.Attributes)
+	if _, err := tx.NewUpdate().Model(user).Column("attributes", "updated_at").WherePK().Exec(ctx); err != nil {
+		return status.Errorf(codes.Unknown, "error updating user: %v", err)
+	}
+	return nil
+}
+
+// profileAttributes returns the denormalized profile fields as attribute changes, unset fields are empty.
+func profileAttributes(p *models.Profile) map[string]string {
+	attrs := map[string]string{}
+	p.ApplyAttributes(attrs)
+	for _, key := range []string{
+		models.USER_ATTRIBUTE_PROFILE_DISPLAY_NAME,
+		models.USER_ATTRIBUTE_PROFILE_AVATAR_URL,
+		models.USER_ATTRIBUTE_PROFILE_GENDER,
+	} {
+		if _, ok := attrs[key]; !ok {
+			attrs[key] = ""
+		}
+	}
+	return attrs
+}
+
+// getProfile returns the profile of the given user, an empty profile if the user has none yet.
+func getProfile(ctx context.Context, bdb bun.IDB, userId string) (*models.Profile, error) {
+	profile := &models.Profile{Id: userId}
+	err := bdb.NewSelect().Model(profile).WherePK().Scan(ctx)
+	if errors.Is(err, sql.ErrNoRows) {
+		user := &models.User{Id: userId}
+		if err := bdb.NewSelect().Model(user).Column("id", "created_at").WherePK().Scan(ctx); errors.Is(err, sql.ErrNoRows) {
+			return nil, status.Errorf(codes.NotFound, "user %s not found", userId)
+		} else if err != nil {
+			return nil, status.Errorf(codes.Unknown, "error retrieving user: %v", err)
+		}
+		profile.CreatedAt = user.CreatedAt
+		return profile, nil
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Unknown, "error retrieving profile: %v", err)
+	}
+	return profile, nil
+}
+
+// lockProfile returns the profile of the given user locked for update, an empty profile is created if the user has none.
+// It must be called inside a transaction, changes are applied to the locked row so that concurrent updates of different
+// fields do not overwrite each other.
+func lockProfile(ctx context.Context, tx bun.Tx, userId string) (*models.Profile, error) {
+	profile := &models.Profile{Id: userId}
+	err := tx.NewSelect().Model(profile).WherePK().For("UPDATE").Scan(ctx)
+	if errors.Is(err, sql.ErrNoRows) {
+		if exists, err := tx.NewSelect().Model((*models.User)(nil)).Where(`"user"."id" = ?`, userId).Exists(ctx); err != nil {
+			return nil, err
+		} else if !exists {
+			return nil, status.Errorf(codes.NotFound, "user %s not found", userId)
+		}
+		if _, err := tx.NewInsert().Model(profile).On("CONFLICT DO NOTHING").Exec(ctx); err != nil {
+			return nil, status.Errorf(codes.Unknown, "error creating profile: %v", err)
+		}
+		err = tx.NewSelect().Model(profile).WherePK().For("UPDATE").Scan(ctx)
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Unknown, "error retrieving profile: %v", err)
+	}
+	return profile, nil
+}
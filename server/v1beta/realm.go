@@ -1,5 +1,16 @@
 package v1beta
 
+import (
+	"context"
+
+	"github.com/choral-io/gommerce-server-core/secure"
+)
+
 const (
 	REALM_ADMIN = "admin"
 )
+
+// isAdmin reports whether the caller is authenticated as a user of the admin realm.
+func isAdmin(ctx context.Context) bool {
+	return secure.Authorize(ctx, secure.AuthFuncRequireRealm(REALM_ADMIN)) == nil
+}
@@ -0,0 +1,347 @@
+package v1beta
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	srv "github.com/choral-io/gommerce-server-aio/server"
+	"github.com/choral-io/gommerce-server-core/data"
+	"github.com/choral-io/gommerce-server-core/secure"
+	"github.com/choral-io/gommerce-server-core/validator"
+	"github.com/redis/rueidis"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	STATE_SCOPE_CLIENT = "client"
+	STATE_SCOPE_USER   = "user"
+	STATE_SCOPE_SHARED = "shared"
+
+	STATE_SHARED_KEY_TEMPLATE  = "state:shared:%s:%s"
+	STATE_NAMESPACE_KEY_PREFIX = "state:namespace:"
+	STATE_NAMESPACE_MAX_LENGTH = 64
+
+	STATE_FIELD_SCOPE     = "scope"
+	STATE_FIELD_NAMESPACE = "namespace"
+	STATE_FIELD_ITEMS     = "items"
+	STATE_FIELD_KEYS      = "keys"
+	STATE_FIELD_ETAG      = "etag"
+	STATE_FIELD_CURSOR    = "cursor"
+	STATE_FIELD_LIMIT     = "limit"
+	STATE_FIELD_OWNER_ID  = "owner_id"
+
+	STATE_BULK_MAX_ITEMS = 100
+
+	STATE_LIST_DEFAULT_LIMIT = 100
+	STATE_LIST_MAX_LIMIT     = 1000
+	STATE_SCAN_COUNT         = 1000
+	STATE_SCAN_MAX_CALLS     = 16
+
+	STATE_RESULT_OK            = 0
+	STATE_RESULT_ETAG_MISMATCH = 1
+	STATE_RESULT_EXISTS        = 2
+)
+
+// State values are stored as hashes of their data and etag, the scripts below read and write them atomically.
+// Values written before etags were introduced are plain strings, they are read with an empty etag and
+// replaced by hashes when they are written again.
+var (
+	stateGetScript = rueidis.NewLuaScriptReadOnly(`
+local t = redis.call('TYPE', KEYS[1])['ok']
+if t == 'hash' then
+	return redis.call('HMGET', KEYS[1], 'data', 'etag')
+elseif t == 'string' then
+	return {redis.call('GET', KEYS[1]), ''}
+end
+return false`)
+
+	// stateSetScript takes data, new etag, ttl in seconds, expected etag and the first write flag.
+	stateSetScript = rueidis.NewLuaScript(`
+local t = redis.call('TYPE', KEYS[1])['ok']
+local cur = false
+if t == 'hash' then
+	cur = redis.call('HGET', KEYS[1], 'etag') or ''
+elseif t ~= 'none' then
+	cur = ''
+end
+if ARGV[5] == '1' and cur then
+	return 2
+end
+if ARGV[4] ~= '' and cur ~= ARGV[4] then
+	return 1
+end
+redis.call('DEL', KEYS[1])
+redis.call('HSET', KEYS[1], 'data', ARGV[1], 'etag', ARGV[2])
+if tonumber(ARGV[3]) > 0 then
+	redis.call('EXPIRE', KEYS[1], ARGV[3])
+end
+return 0`)
+
+	// stateDelScript takes the expected etag, an empty etag deletes unconditionally.
+	stateDelScript = rueidis.NewLuaScript(`
+if ARGV[1] ~= '' then
+	local t = redis.call('TYPE', KEYS[1])['ok']
+	local cur = false
+	if t == 'hash' then
+		cur = redis.call('HGET', KEYS[1], 'etag') or ''
+	elseif t ~= 'none' then
+		cur = ''
+	end
+	if cur ~= ARGV[1] then
+		return 1
+	end
+end
+redis.call('DEL', KEYS[1])
+return 0`)
+)
+
+var (
+	stateNamespacePattern = regexp.MustCompile(`^[a-z][a-z0-9_.-]*$`)
+
+	// stateGlobReplacer escapes the characters of a key prefix which are special in scan patterns.
+	stateGlobReplacer = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
+)
+
+// stateKeyspace is the part of the state store a request operates on.
+type stateKeyspace struct {
+	scope  string
+	prefix string
+}
+
+// Key returns the storage key of a state key in the keyspace.
+func (k stateKeyspace) Key(key string) string {
+	return k.prefix + key
+}
+
+// Match returns the scan pattern matching the keys of the keyspace starting with prefix.
+func (k stateKeyspace) Match(prefix string) string {
+	return stateGlobReplacer.Replace(k.prefix+prefix) + "*"
+}
+
+// Strip returns the state key of a storage key in the keyspace.
+func (k stateKeyspace) Strip(key string) string {
+	return strings.TrimPrefix(key, k.prefix)
+}
+
+// validateStateNamespace checks the name of a shared namespace.
+func validateStateNamespace(namespace string) error {
+	if len(namespace) > STATE_NAMESPACE_MAX_LENGTH || !stateNamespacePattern.MatchString(namespace) {
+		return validator.NewError(STATE_FIELD_NAMESPACE, "namespace must start with a lowercase letter and contain only lowercase letters, digits, '_', '.' and '-'")
+	}
+	return nil
+}
+
+// resolveStateKeyspace authorizes the caller for the requested scope and returns its keyspace. Without scope,
+// clients use their own keyspace and users theirs. Keys written before scopes were introduced are moved into
+// these keyspaces by the sweeper.
+//
+//   - client: private to the client, only with basic tokens.
+//   - user: private to the user or guest of the bearer token.
+//   - shared: a named namespace, only with basic tokens of a client listed in the acl of the namespace.
+func resolveStateKeyspace(ctx context.Context, rdb rueidis.Client, scope, namespace string) (stateKeyspace, error) {
+	basic := secure.Authorize(ctx, secure.AuthFuncRequireSchema(secure.AUTH_SCHEMA_BASIC)) == nil
+	if scope == "" {
+		if basic {
+			scope = STATE_SCOPE_CLIENT
+		} else {
+			scope = STATE_SCOPE_USER
+		}
+	}
+	if scope != STATE_SCOPE_SHARED && namespace != "" {
+		return stateKeyspace{}, validator.NewError(STATE_FIELD_NAMESPACE, "namespace is only allowed with shared scope")
+	}
+	sub := secure.IdentityFromContext(ctx).Token().Subject()
+	switch scope {
+	case STATE_SCOPE_CLIENT:
+		if !basic {
+			return stateKeyspace{}, status.Errorf(codes.PermissionDenied, "client scope requires client credentials")
+		}
+		return stateKeyspace{scope: scope, prefix: srv.StateClientKeyPrefix(sub)}, nil
+	case STATE_SCOPE_USER:
+		if basic {
+			return stateKeyspace{}, status.Errorf(codes.PermissionDenied, "user scope requires a bearer token")
+		}
+		return stateKeyspace{scope: scope, prefix: srv.StateUserKeyPrefix(sub)}, nil
+	case STATE_SCOPE_SHARED:
+		if err := validateStateNamespace(namespace); err != nil {
+			return stateKeyspace{}, err
+		}
+		if !basic {
+			// the client of a bearer token is chosen by whoever requested the token, so users and guests could
+			// reach any namespace of a public client
+			return stateKeyspace{}, status.Errorf(codes.PermissionDenied, "shared scope requires client credentials")
+		}
+		allowed, err := rdb.Do(ctx, rdb.B().Sismember().Key(STATE_NAMESPACE_KEY_PREFIX+namespace).Member(sub).Build()).AsBool()
+		if err != nil {
+			return stateKeyspace{}, err
+		}
+		if !allowed {
+			return stateKeyspace{}, status.Errorf(codes.PermissionDenied, "client is not allowed to access namespace %s", namespace)
+		}
+		return stateKeyspace{scope: scope, prefix: fmt.Sprintf(STATE_SHARED_KEY_TEMPLATE, namespace, "")}, nil
+	}
+	return stateKeyspace{}, validator.NewError(STATE_FIELD_SCOPE, fmt.Sprintf("scope must be one of %s, %s or %s", STATE_SCOPE_CLIENT, STATE_SCOPE_USER, STATE_SCOPE_SHARED))
+}
+
+// ownerStateKeyspace returns the keyspace of the given client or user, or of a shared namespace, for admins
+// managing the state of others.
+func ownerStateKeyspace(scope, ownerId, namespace string) (stateKeyspace, error) {
+	switch scope {
+	case STATE_SCOPE_CLIENT, STATE_SCOPE_USER:
+		if ownerId == "" {
+			return stateKeyspace{}, validator.NewError(STATE_FIELD_OWNER_ID, fmt.Sprintf("owner_id is required with %s scope", scope))
+		}
+		if scope == STATE_SCOPE_CLIENT {
+			return stateKeyspace{scope: scope, prefix: srv.StateClientKeyPrefix(ownerId)}, nil
+		}
+		return stateKeyspace{scope: scope, prefix: srv.StateUserKeyPrefix(ownerId)}, nil
+	case STATE_SCOPE_SHARED:
+		if err := validateStateNamespace(namespace); err != nil {
+			return stateKeyspace{}, err
+		}
+		return stateKeyspace{scope: scope, prefix: fmt.Sprintf(STATE_SHARED_KEY_TEMPLATE, namespace, "")}, nil
+	}
+	return stateKeyspace{}, validator.NewError(STATE_FIELD_SCOPE, fmt.Sprintf("scope must be one of %s, %s or %s", STATE_SCOPE_CLIENT, STATE_SCOPE_USER, STATE_SCOPE_SHARED))
+}
+
+// scanStateKeys scans the keys of a keyspace starting with prefix from the cursor until at least limit keys are
+// found, the scan is complete or STATE_SCAN_MAX_CALLS scan calls are made, so that a sparse keyspace in a large
+// database does not hold the request. The last batch is returned whole, so the number of keys may exceed the limit
+// slightly, and fewer keys or none may be returned with a cursor to continue, which is 0 once the scan is complete.
+func scanStateKeys(ctx context.Context, rdb rueidis.Client, ks stateKeyspace, prefix string, cursor uint64, limit int) ([]string, uint64, error) {
+	var keys []string
+	for calls := 1; ; calls++ {
+		entry, err := rdb.Do(ctx, rdb.B().Scan().Cursor(cursor).Match(ks.Match(prefix)).Count(int64(limit-len(keys))).Build()).AsScanEntry()
+		if err != nil {
+			return nil, 0, err
+		}
+		keys = append(keys, entry.Elements...)
+		if cursor = entry.Cursor; cursor == 0 || len(keys) >= limit || calls >= STATE_SCAN_MAX_CALLS {
+			return keys, cursor, nil
+		}
+	}
+}
+
+// deleteStateKeys deletes the keys of a keyspace starting with prefix and returns the number of deleted keys.
+func deleteStateKeys(ctx context.Context, rdb rueidis.Client, ks stateKeyspace, prefix string) (int64, error) {
+	var cursor uint64
+	var deleted int64
+	for {
+		entry, err := rdb.Do(ctx, rdb.B().Scan().Cursor(cursor).Match(ks.Match(prefix)).Count(STATE_SCAN_COUNT).Build()).AsScanEntry()
+		if err != nil {
+			return deleted, err
+		}
+		if len(entry.Elements) > 0 {
+			n, err := rdb.Do(ctx, rdb.B().Unlink().Key(entry.Elements...).Build()).AsInt64()
+			if err != nil {
+				return deleted, err
+			}
+			deleted += n
+		}
+		if cursor = entry.Cursor; cursor == 0 {
+			return deleted, nil
+		}
+	}
+}
+
+// getStateNamespaceClients returns the clients allowed to access a shared namespace, none if it has no acl.
+func getStateNamespaceClients(ctx context.Context, rdb rueidis.Client, namespace string) ([]string, error) {
+	return rdb.Do(ctx, rdb.B().Smembers().Key(STATE_NAMESPACE_KEY_PREFIX+namespace).Build()).AsStrSlice()
+}
+
+// putStateNamespaceClients replaces the acl of a shared namespace atomically, an empty list revokes all clients
+// while the data of the namespace is kept.
+func putStateNamespaceClients(ctx context.Context, rdb rueidis.Client, namespace string, clientIds []string) error {
+	key := STATE_NAMESPACE_KEY_PREFIX + namespace
+	cmds := rueidis.Commands{
+		rdb.B().Multi().Build(),
+		rdb.B().Del().Key(key).Build(),
+	}
+	if len(clientIds) > 0 {
+		cmds = append(cmds, rdb.B().Sadd().Key(key).Member(clientIds...).Build())
+	}
+	cmds = append(cmds, rdb.B().Exec().Build())
+	for _, res := range rdb.DoMulti(ctx, cmds...) {
+		if err := res.Error(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stateWrite is a prepared conditional write of a state value.
+type stateWrite struct {
+	exec rueidis.LuaExec
+	etag string
+}
+
+// newStateWrite prepares storing value at key under a new etag, the ttl is taken from the ttlInSeconds metadata.
+// With an etag the write only succeeds if the stored value still carries it, with firstWrite only if there is none.
+func newStateWrite(key string, value []byte, metadata map[string]string, field, etag string, firstWrite bool) (*stateWrite, error) {
+	var ttl int64
+	if val, ok := metadata[TTL_IN_SECONDS_KEY]; ok {
+		v, err := strconv.ParseInt(val, 10, 0)
+		if err != nil {
+			return nil, validator.NewErrorWithCause(field+TTL_IN_SECONDS_KEY, field+TTL_IN_SECONDS_KEY+" must be an integer", err)
+		}
+		if v <= 0 {
+			return nil, validator.NewError(field+TTL_IN_SECONDS_KEY, field+TTL_IN_SECONDS_KEY+" must be positive")
+		}
+		ttl = v
+	}
+	if etag != "" && firstWrite {
+		return nil, validator.NewError(STATE_FIELD_ETAG, "etag can not be combined with first write")
+	}
+	next := data.DefaultIdWorker().NextHex()
+	first := "0"
+	if firstWrite {
+		first = "1"
+	}
+	return &stateWrite{
+		exec: rueidis.LuaExec{
+			Keys: []string{key},
+			Args: []string{rueidis.BinaryString(value), next, strconv.FormatInt(ttl, 10), etag, first},
+		},
+		etag: next,
+	}, nil
+}
+
+// stateResultError maps the result code of a conditional state script to a status error.
+func stateResultError(key string, code int64) error {
+	switch code {
+	case STATE_RESULT_ETAG_MISMATCH:
+		return status.Errorf(codes.Aborted, "etag of state %s does not match", key)
+	case STATE_RESULT_EXISTS:
+		return status.Errorf(codes.FailedPrecondition, "state %s already exists", key)
+	}
+	return nil
+}
+
+// parseStateValue reads the data and etag of a state value, rueidis.Nil is returned for missing keys.
+func parseStateValue(r rueidis.RedisResult) ([]byte, string, error) {
+	values, err := r.ToArray()
+	if err != nil {
+		return nil, "", err
+	}
+	if len(values) != 2 {
+		return nil, "", fmt.Errorf("unexpected state value of %d elements", len(values))
+	}
+	data, err := values[0].AsBytes()
+	if err != nil {
+		return nil, "", err
+	}
+	etag, _ := values[1].ToString()
+	return data, etag, nil
+}
+
+// validateStateBulkSize checks the number of items of a bulk request.
+func validateStateBulkSize(field string, n int) error {
+	if n > STATE_BULK_MAX_ITEMS {
+		return validator.NewError(field, fmt.Sprintf("%s must not contain more than %d items", field, STATE_BULK_MAX_ITEMS))
+	}
+	return nil
+}
@@ -3,29 +3,33 @@ package v1beta
 import (
 	"context"
 	"fmt"
+	"slices"
 	"strconv"
 
 	state "github.com/choral-io/gommerce-protobuf-go/state/v1beta"
+	"github.com/choral-io/gommerce-server-aio/data/models"
 	"github.com/choral-io/gommerce-server-core/secure"
 	"github.com/choral-io/gommerce-server-core/validator"
 	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
 	"github.com/redis/rueidis"
+	"github.com/uptrace/bun"
 	"google.golang.org/grpc"
 )
 
 const (
-	TTL_IN_SECONDS_KEY   = "ttlInSeconds"
-	STORAGE_KEY_TEMPLATE = "state:store:%s:%s"
+	TTL_IN_SECONDS_KEY = "ttlInSeconds"
 )
 
 type stateStoreServiceServer struct {
 	state.UnimplementedStateStoreServiceServer
 
+	bdb bun.IDB
 	rdb rueidis.Client
 }
 
-func NewStateStoreServiceServer(rdb rueidis.Client) state.StateStoreServiceServer {
+func NewStateStoreServiceServer(bdb bun.IDB, rdb rueidis.Client) state.StateStoreServiceServer {
 	return &stateStoreServiceServer{
+		bdb: bdb,
 		rdb: rdb,
 	}
 }
@@ -38,48 +42,335 @@ func (s *stateStoreServiceServer) RegisterGatewayClient(ctx context.Context, mux
 	return state.RegisterStateStoreServiceHandler(ctx, mux, conn)
 }
 
+// Authorize accepts clients as well as users and guests, the scope of each request is authorized when its keyspace is resolved.
+// Shared namespaces and clean-ups are managed by admins.
 func (s *stateStoreServiceServer) Authorize(ctx context.Context, procedure string) error {
-	return secure.Authorize(ctx, secure.AuthFuncAuthenticated, secure.AuthFuncRequireSchema(secure.AUTH_SCHEMA_BASIC))
+	if procedure == state.StateStoreService_GetStateNamespace_FullMethodName ||
+		procedure == state.StateStoreService_PutStateNamespace_FullMethodName ||
+		procedure == state.StateStoreService_DeleteStatePrefix_FullMethodName {
+		return secure.Authorize(ctx, secure.AuthFuncAuthenticated, secure.AuthFuncRequireSchema(secure.AUTH_SCHEMA_BEARER), secure.AuthFuncRequireRealm(REALM_ADMIN))
+	}
+	return secure.Authorize(ctx, secure.AuthFuncAuthenticated)
+}
+
+func (s *stateStoreServiceServer) AllowGuest(procedure string) bool {
+	switch procedure {
+	case state.StateStoreService_GetState_FullMethodName,
+		state.StateStoreService_SetState_FullMethodName,
+		state.StateStoreService_DelState_FullMethodName,
+		state.StateStoreService_GetBulkState_FullMethodName,
+		state.StateStoreService_SetBulkState_FullMethodName,
+		state.StateStoreService_DelBulkState_FullMethodName,
+		state.StateStoreService_ListStateKeys_FullMethodName:
+		return true
+	}
+	return false
+}
+
+func (s *stateStoreServiceServer) Mutating(procedure string) bool {
+	switch procedure {
+	case state.StateStoreService_SetState_FullMethodName,
+		state.StateStoreService_DelState_FullMethodName,
+		state.StateStoreService_SetBulkState_FullMethodName,
+		state.StateStoreService_DelBulkState_FullMethodName,
+		state.StateStoreService_PutStateNamespace_FullMethodName,
+		state.StateStoreService_DeleteStatePrefix_FullMethodName:
+		return true
+	}
+	return false
 }
 
+// GetState returns the data of a key with its etag, both are empty if the key does not exist.
 func (s *stateStoreServiceServer) GetState(ctx context.Context, req *state.GetStateRequest) (*state.GetStateResponse, error) {
-	sub := secure.IdentityFromContext(ctx).Token().Subject()
-	key := fmt.Sprintf(STORAGE_KEY_TEMPLATE, sub, req.GetKey())
-	cmd := s.rdb.B().Get().Key(key)
-	data, err := s.rdb.Do(ctx, cmd.Build()).AsBytes()
+	ks, err := resolveStateKeyspace(ctx, s.rdb, req.GetScope(), req.GetNamespace())
+	if err != nil {
+		return nil, err
+	}
+	key := ks.Key(req.GetKey())
+	data, etag, err := parseStateValue(stateGetScript.Exec(ctx, s.rdb, []string{key}, nil))
 	if err != nil && err != rueidis.Nil {
 		return nil, err
 	}
 	return &state.GetStateResponse{
 		Data: data,
+		Etag: etag,
 	}, nil
 }
 
+// SetState stores the data of a key and returns its new etag. With an etag the write fails with Aborted if the key
+// was changed since it was read, with first write it fails with FailedPrecondition if the key already exists.
 func (s *stateStoreServiceServer) SetState(ctx context.Context, req *state.SetStateRequest) (*state.SetStateResponse, error) {
-	sub := secure.IdentityFromContext(ctx).Token().Subject()
-	key := fmt.Sprintf(STORAGE_KEY_TEMPLATE, sub, req.GetKey())
-	cmd := s.rdb.B().Set().Key(key).Value(rueidis.BinaryString(req.GetData()))
-	if val, ok := req.Metadata[TTL_IN_SECONDS_KEY]; ok {
-		ttl, err := strconv.ParseInt(val, 10, 0)
-		if err != nil {
-			return nil, validator.NewErrorWithCause("metadata."+TTL_IN_SECONDS_KEY, "metadata.ttlInSeconds must be an integer", err)
-		}
-		cmd.ExSeconds(ttl)
+	ks, err := resolveStateKeyspace(ctx, s.rdb, req.GetScope(), req.GetNamespace())
+	if err != nil {
+		return nil, err
 	}
-	err := s.rdb.Do(ctx, cmd.Build()).Error()
+	w, err := newStateWrite(ks.Key(req.GetKey()), req.GetData(), req.GetMetadata(), "metadata.", req.GetEtag(), req.GetFirstWrite())
 	if err != nil {
 		return nil, err
 	}
-	return &state.SetStateResponse{}, nil
+	code, err := stateSetScript.Exec(ctx, s.rdb, w.exec.Keys, w.exec.Args).AsInt64()
+	if err != nil {
+		return nil, err
+	}
+	if err := stateResultError(req.GetKey(), code); err != nil {
+		return nil, err
+	}
+	return &state.SetStateResponse{
+		Etag: w.etag,
+	}, nil
 }
 
+// DelState deletes a key, with an etag it fails with Aborted if the key was changed since it was read.
 func (s *stateStoreServiceServer) DelState(ctx context.Context, req *state.DelStateRequest) (*state.DelStateResponse, error) {
-	sub := secure.IdentityFromContext(ctx).Token().Subject()
-	key := fmt.Sprintf(STORAGE_KEY_TEMPLATE, sub, req.GetKey())
-	cmd := s.rdb.B().Del().Key(key)
-	err := s.rdb.Do(ctx, cmd.Build()).Error()
+	ks, err := resolveStateKeyspace(ctx, s.rdb, req.GetScope(), req.GetNamespace())
+	if err != nil {
+		return nil, err
+	}
+	code, err := stateDelScript.Exec(ctx, s.rdb, []string{ks.Key(req.GetKey())}, []string{req.GetEtag()}).AsInt64()
 	if err != nil {
 		return nil, err
 	}
+	if err := stateResultError(req.GetKey(), code); err != nil {
+		return nil, err
+	}
 	return &state.DelStateResponse{}, nil
 }
+
+// GetBulkState reads many keys in one pipeline, missing keys are returned without data.
+func (s *stateStoreServiceServer) GetBulkState(ctx context.Context, req *state.GetBulkStateRequest) (*state.GetBulkStateResponse, error) {
+	if err := validateStateBulkSize(STATE_FIELD_KEYS, len(req.GetKeys())); err != nil {
+		return nil, err
+	}
+	ks, err := resolveStateKeyspace(ctx, s.rdb, req.GetScope(), req.GetNamespace())
+	if err != nil {
+		return nil, err
+	}
+	res := &state.GetBulkStateResponse{
+		Items: make([]*state.BulkStateItem, len(req.GetKeys())),
+	}
+	if len(req.GetKeys()) == 0 {
+		return res, nil
+	}
+	execs := make([]rueidis.LuaExec, len(req.GetKeys()))
+	for i, key := range req.GetKeys() {
+		execs[i] = rueidis.LuaExec{Keys: []string{ks.Key(key)}}
+	}
+	for i, r := range stateGetScript.ExecMulti(ctx, s.rdb, execs...) {
+		item := &state.BulkStateItem{Key: req.GetKeys()[i]}
+		if data, etag, err := parseStateValue(r); err == nil {
+			item.Data = data
+			item.Etag = etag
+		} else if err != rueidis.Nil {
+			item.Error = err.Error()
+		}
+		res.Items[i] = item
+	}
+	return res, nil
+}
+
+// SetBulkState writes many keys in one pipeline, each item may carry its own ttl in its metadata and its own
+// etag or first write condition. Items failing validation, their condition or in redis are reported in the
+// response while the others are written.
+func (s *stateStoreServiceServer) SetBulkState(ctx context.Context, req *state.SetBulkStateRequest) (*state.SetBulkStateResponse, error) {
+	if err := validateStateBulkSize(STATE_FIELD_ITEMS, len(req.GetItems())); err != nil {
+		return nil, err
+	}
+	ks, err := resolveStateKeyspace(ctx, s.rdb, req.GetScope(), req.GetNamespace())
+	if err != nil {
+		return nil, err
+	}
+	res := &state.SetBulkStateResponse{
+		Results: make([]*state.BulkStateResult, len(req.GetItems())),
+	}
+	writes := make([]*stateWrite, 0, len(req.GetItems()))
+	execs := make([]rueidis.LuaExec, 0, len(req.GetItems()))
+	idx := make([]int, 0, len(req.GetItems()))
+	for i, item := range req.GetItems() {
+		res.Results[i] = &state.BulkStateResult{Key: item.GetKey()}
+		w, err := newStateWrite(ks.Key(item.GetKey()), item.GetData(), item.GetMetadata(), fmt.Sprintf("%s[%d].metadata.", STATE_FIELD_ITEMS, i), item.GetEtag(), item.GetFirstWrite())
+		if err != nil {
+			res.Results[i].Error = err.Error()
+			continue
+		}
+		writes = append(writes, w)
+		execs = append(execs, w.exec)
+		idx = append(idx, i)
+	}
+	if len(execs) == 0 {
+		return res, nil
+	}
+	for i, r := range stateSetScript.ExecMulti(ctx, s.rdb, execs...) {
+		result := res.Results[idx[i]]
+		if code, err := r.AsInt64(); err != nil {
+			result.Error = err.Error()
+		} else if err := stateResultError(result.Key, code); err != nil {
+			result.Error = err.Error()
+		} else {
+			result.Etag = writes[i].etag
+		}
+	}
+	return res, nil
+}
+
+// DelBulkState deletes many keys in one pipeline.
+func (s *stateStoreServiceServer) DelBulkState(ctx context.Context, req *state.DelBulkStateRequest) (*state.DelBulkStateResponse, error) {
+	if err := validateStateBulkSize(STATE_FIELD_KEYS, len(req.GetKeys())); err != nil {
+		return nil, err
+	}
+	ks, err := resolveStateKeyspace(ctx, s.rdb, req.GetScope(), req.GetNamespace())
+	if err != nil {
+		return nil, err
+	}
+	res := &state.DelBulkStateResponse{
+		Results: make([]*state.BulkStateResult, len(req.GetKeys())),
+	}
+	if len(req.GetKeys()) == 0 {
+		return res, nil
+	}
+	execs := make([]rueidis.LuaExec, len(req.GetKeys()))
+	for i, key := range req.GetKeys() {
+		execs[i] = rueidis.LuaExec{Keys: []string{ks.Key(key)}, Args: []string{""}}
+	}
+	for i, r := range stateDelScript.ExecMulti(ctx, s.rdb, execs...) {
+		res.Results[i] = &state.BulkStateResult{Key: req.GetKeys()[i]}
+		if err := r.Error(); err != nil {
+			res.Results[i].Error = err.Error()
+		}
+	}
+	return res, nil
+}
+
+// ListStateKeys lists the keys of the keyspace starting with the prefix, optionally with their values and remaining
+// ttl. Pages follow the redis scan cursor, so a key may be listed twice and a page may hold slightly more keys than the limit,
+// or fewer and even none while a next cursor is returned.
+func (s *stateStoreServiceServer) ListStateKeys(ctx context.Context, req *state.ListStateKeysRequest) (*state.ListStateKeysResponse, error) {
+	ks, err := resolveStateKeyspace(ctx, s.rdb, req.GetScope(), req.GetNamespace())
+	if err != nil {
+		return nil, err
+	}
+	var cursor uint64
+	if req.GetCursor() != "" {
+		if cursor, err = strconv.ParseUint(req.GetCursor(), 10, 64); err != nil {
+			return nil, validator.NewErrorWithCause(STATE_FIELD_CURSOR, "cursor is invalid", err)
+		}
+	}
+	limit := int(req.GetLimit())
+	if limit <= 0 {
+		limit = STATE_LIST_DEFAULT_LIMIT
+	} else if limit > STATE_LIST_MAX_LIMIT {
+		return nil, validator.NewError(STATE_FIELD_LIMIT, fmt.Sprintf("limit must not exceed %d", STATE_LIST_MAX_LIMIT))
+	}
+	keys, cursor, err := scanStateKeys(ctx, s.rdb, ks, req.GetPrefix(), cursor, limit)
+	if err != nil {
+		return nil, err
+	}
+	res := &state.ListStateKeysResponse{
+		Items: make([]*state.StateKeyItem, 0, len(keys)),
+	}
+	if cursor != 0 {
+		res.NextCursor = strconv.FormatUint(cursor, 10)
+	}
+	if len(keys) == 0 {
+		return res, nil
+	}
+	var values []rueidis.RedisResult
+	if req.GetIncludeValues() {
+		execs := make([]rueidis.LuaExec, len(keys))
+		for i, key := range keys {
+			execs[i] = rueidis.LuaExec{Keys: []string{key}}
+		}
+		values = stateGetScript.ExecMulti(ctx, s.rdb, execs...)
+	}
+	var ttls []rueidis.RedisResult
+	if req.GetIncludeTtl() {
+		cmds := make(rueidis.Commands, len(keys))
+		for i, key := range keys {
+			cmds[i] = s.rdb.B().Ttl().Key(key).Build()
+		}
+		ttls = s.rdb.DoMulti(ctx, cmds...)
+	}
+	for i, key := range keys {
+		item := &state.StateKeyItem{Key: ks.Strip(key)}
+		if values != nil {
+			data, etag, err := parseStateValue(values[i])
+			if rueidis.IsRedisNil(err) {
+				continue // expired or deleted since it was scanned
+			} else if err != nil {
+				return nil, err
+			}
+			item.Data = data
+			item.Etag = etag
+		}
+		if ttls != nil {
+			ttl, err := ttls[i].AsInt64()
+			if err != nil {
+				return nil, err
+			}
+			if ttl == -2 {
+				continue // expired or deleted since it was scanned
+			}
+			// -1 marks keys without ttl
+			item.TtlInSeconds = ttl
+		}
+		res.Items = append(res.Items, item)
+	}
+	return res, nil
+}
+
+// DeleteStatePrefix deletes all keys of a client, user or shared namespace starting with the prefix,
+// an empty prefix clears the whole keyspace.
+func (s *stateStoreServiceServer) DeleteStatePrefix(ctx context.Context, req *state.DeleteStatePrefixRequest) (*state.DeleteStatePrefixResponse, error) {
+	ks, err := ownerStateKeyspace(req.GetScope(), req.GetOwnerId(), req.GetNamespace())
+	if err != nil {
+		return nil, err
+	}
+	n, err := deleteStateKeys(ctx, s.rdb, ks, req.GetPrefix())
+	if err != nil {
+		return nil, err
+	}
+	return &state.DeleteStatePrefixResponse{
+		Deleted: n,
+	}, nil
+}
+
+func (s *stateStoreServiceServer) GetStateNamespace(ctx context.Context, req *state.GetStateNamespaceRequest) (*state.GetStateNamespaceResponse, error) {
+	if err := validateStateNamespace(req.GetNamespace()); err != nil {
+		return nil, err
+	}
+	clientIds, err := getStateNamespaceClients(ctx, s.rdb, req.GetNamespace())
+	if err != nil {
+		return nil, err
+	}
+	return &state.GetStateNamespaceResponse{
+		Namespace: req.GetNamespace(),
+		ClientIds: clientIds,
+	}, nil
+}
+
+// PutStateNamespace replaces the clients allowed to access a shared namespace.
+func (s *stateStoreServiceServer) PutStateNamespace(ctx context.Context, req *state.PutStateNamespaceRequest) (*state.PutStateNamespaceResponse, error) {
+	if err := validateStateNamespace(req.GetNamespace()); err != nil {
+		return nil, err
+	}
+	clientIds := slices.Clone(req.GetClientIds())
+	slices.Sort(clientIds)
+	clientIds = slices.Compact(clientIds)
+	if len(clientIds) > 0 {
+		n, err := s.bdb.NewSelect().Model((*models.Client)(nil)).
+			Where(`"client"."id" IN (?)`, bun.In(clientIds)).
+			Count(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if n != len(clientIds) {
+			return nil, validator.NewError("client_ids", "some clients do not exist")
+		}
+	}
+	if err := putStateNamespaceClients(ctx, s.rdb, req.GetNamespace(), clientIds); err != nil {
+		return nil, err
+	}
+	return &state.PutStateNamespaceResponse{
+		Namespace: req.GetNamespace(),
+		ClientIds: clientIds,
+	}, nil
+}
@@ -2,10 +2,13 @@ package v1beta
 
 import (
 	"context"
+	"database/sql"
 	"errors"
 	"fmt"
+	"strings"
 
 	"github.com/choral-io/gommerce-server-aio/data/models"
+	"github.com/choral-io/gommerce-server-aio/server/normalize"
 	"github.com/uptrace/bun"
 	"golang.org/x/crypto/bcrypt"
 )
@@ -13,6 +16,7 @@ import (
 const (
 	LOGIN_PROVIDER_FORM_PASSWORD = models.LOGIN_PROVIDER_FORM_PASSWORD
 	LOGIN_PROVIDER_SMS_OTP_CODE  = models.LOGIN_PROVIDER_SMS_OTP_CODE
+	LOGIN_PROVIDER_LDAP          = models.LOGIN_PROVIDER_LDAP
 )
 
 type LoginProvider interface {
@@ -20,6 +24,34 @@ type LoginProvider interface {
 	Login(ctx context.Context, realm, username, password, idToken string, scope []string) (*models.Login, error)
 }
 
+// LoginLinker is implemented by login providers that can attach a new login to an existing user.
+// Link proves the ownership of the given credentials and returns an unsaved login without user,
+// providers of external identities must verify the signature, audience and expiry of the id token.
+// The caller has already re-authenticated the user with one of its existing credentials.
+type LoginLinker interface {
+	Link(ctx context.Context, realmId, username, password, idToken string) (*models.Login, error)
+}
+
+// CredentialVerifier is implemented by login providers that can check the password of an existing login without side
+// effects, unlike Login it neither provisions users nor updates them. Verify returns errNoCredential for logins without
+// a password.
+type CredentialVerifier interface {
+	Verify(ctx context.Context, login *models.Login, password string) error
+}
+
+var errNoCredential = errors.New("login has no credential")
+
+func newLoginProviders(bdb bun.IDB) map[string]LoginProvider {
+	lps := map[string]LoginProvider{
+		LOGIN_PROVIDER_FORM_PASSWORD: NewFormPasswordLoginProvider(bdb),
+		LOGIN_PROVIDER_SMS_OTP_CODE:  NewSMSOTPCodeLoginProvider(),
+	}
+	if lp := NewLDAPLoginProvider(bdb, LDAPConfigFromEnv()); lp != nil {
+		lps[LOGIN_PROVIDER_LDAP] = lp
+	}
+	return lps
+}
+
 type FormPasswordLoginProvider struct {
 	bdb bun.IDB
 }
@@ -32,13 +64,58 @@ func (p *FormPasswordLoginProvider) Name() string {
 	return LOGIN_PROVIDER_FORM_PASSWORD
 }
 
+// loginIdentifiers returns the identifiers a username may be stored as, the normalized form first and
+// the username as given for legacy logins whose identifiers could not be normalized.
+func loginIdentifiers(username string) []string {
+	var identifiers []string
+	if v, err := normalize.Username(username); err == nil {
+		identifiers = append(identifiers, v)
+	}
+	if v := strings.TrimSpace(username); v != "" && (len(identifiers) == 0 || v != identifiers[0]) {
+		identifiers = append(identifiers, v)
+	}
+	return identifiers
+}
+
+// resolveLoginUserId returns the id of the user owning the login of a provider with the given username, or an empty string.
+// It is used to attribute failed login attempts to the user.
+func resolveLoginUserId(ctx context.Context, bdb bun.IDB, realmId, provider, username string) string {
+	identifiers := []string{strings.TrimSpace(username)}
+	if provider == LOGIN_PROVIDER_FORM_PASSWORD {
+		identifiers = loginIdentifiers(username)
+	}
+	for _, identifier := range identifiers {
+		var userId string
+		if err := bdb.NewSelect().Model((*models.Login)(nil)).Column("user_id").
+			Where(`"login"."provider" = ?`, provider).
+			Where(`"login"."identifier" = ?`, identifier).
+			Where(`"login"."realm_id" = ?`, realmId).
+			Scan(ctx, &userId); err == nil {
+			return userId
+		}
+	}
+	return ""
+}
+
+// Login looks the login up by the normalized username first, and by the username as given for legacy logins
+// whose identifiers could not be normalized because of a collision or an invalid character.
 func (p *FormPasswordLoginProvider) Login(ctx context.Context, realmId, username, password, idToken string, scope []string) (*models.Login, error) {
+	identifiers := loginIdentifiers(username)
+	if len(identifiers) == 0 {
+		return nil, normalize.ErrInvalidUsername
+	}
 	var login models.Login
-	if err := p.bdb.NewSelect().Model(&login).
-		Where(`"login"."provider" = ?`, LOGIN_PROVIDER_FORM_PASSWORD).
-		Where(`"login"."identifier" = ?`, username).
-		Where(`"user"."realm_id" = ?`, realmId).
-		Relation("User").Scan(ctx); err != nil {
+	var err error
+	for _, identifier := range identifiers {
+		if err = p.bdb.NewSelect().Model(&login).
+			Where(`"login"."provider" = ?`, LOGIN_PROVIDER_FORM_PASSWORD).
+			Where(`"login"."identifier" = ?`, identifier).
+			Where(`"login"."realm_id" = ?`, realmId).
+			Relation("User").Scan(ctx); !errors.Is(err, sql.ErrNoRows) {
+			break
+		}
+	}
+	if err != nil {
 		return nil, err
 	}
 	if !login.Credential.Valid {
@@ -50,6 +127,41 @@ func (p *FormPasswordLoginProvider) Login(ctx context.Context, realmId, username
 	return &login, nil
 }
 
+// Link creates a new username and password login, the caller proves the ownership of the account by re-authenticating
+// with its current credential, the new password proves nothing as it is chosen right now.
+func (p *FormPasswordLoginProvider) Link(ctx context.Context, realmId, username, password, idToken string) (*models.Login, error) {
+	username, err := normalize.Username(username)
+	if err != nil {
+		return nil, err
+	}
+	if password == "" {
+		return nil, errors.New("password is required")
+	}
+	login := &models.Login{
+		RealmId:    realmId,
+		Provider:   LOGIN_PROVIDER_FORM_PASSWORD,
+		Identifier: username,
+		Metadata:   map[string]string{},
+	}
+	if hp, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost); err != nil {
+		return nil, err
+	} else {
+		login.Credential = sql.NullString{Valid: true, String: string(hp)}
+	}
+	return login, nil
+}
+
+// Verify compares the password with the hash stored in the login.
+func (p *FormPasswordLoginProvider) Verify(ctx context.Context, login *models.Login, password string) error {
+	if !login.Credential.Valid {
+		return errNoCredential
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(login.Credential.String), []byte(password)); err != nil {
+		return errors.New("password not match")
+	}
+	return nil
+}
+
 type SMSOTPCodeLoginProvider struct{}
 
 func NewSMSOTPCodeLoginProvider() LoginProvider {
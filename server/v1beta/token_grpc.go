@@ -10,10 +10,13 @@ import (
 
 	iam "github.com/choral-io/gommerce-protobuf-go/iam/v1beta"
 	"github.com/choral-io/gommerce-server-aio/data/models"
+	srv "github.com/choral-io/gommerce-server-aio/server"
 	"github.com/choral-io/gommerce-server-core/config"
+	"github.com/choral-io/gommerce-server-core/logging"
 	"github.com/choral-io/gommerce-server-core/secure"
 	"github.com/choral-io/gommerce-server-core/validator"
 	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/redis/rueidis"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -21,6 +24,11 @@ import (
 	"github.com/uptrace/bun"
 )
 
+const (
+	IMPERSONATION_DEFAULT_TTL = 15 * time.Minute
+	IMPERSONATION_MAX_TTL     = time.Hour
+)
+
 func (p *FormPasswordLoginProvider) Validate(req *iam.CreateTokenRequest) error {
 	if req.GetUsername().GetValue() == "" {
 		return validator.NewError("username", "username is required when using form password login provider")
@@ -36,24 +44,46 @@ type tokensServiceServer struct {
 
 	cfg config.TokenConfig
 	bdb bun.IDB
+	rdb rueidis.Client
 	ts  secure.TokenStore
+	ss  *srv.SessionStore
+	ia  *srv.ImpersonationAuditor
+	ler *srv.LoginEventRecorder
 	lps map[string]LoginProvider
+
+	logger logging.Logger
 }
 
-func NewTokensServiceServer(cfg config.TokenConfig, bdb bun.IDB, ts secure.TokenStore) iam.TokensServiceServer {
+func NewTokensServiceServer(cfg config.TokenConfig, bdb bun.IDB, rdb rueidis.Client, ts secure.TokenStore, ss *srv.SessionStore, ia *srv.ImpersonationAuditor, ler *srv.LoginEventRecorder, logger logging.Logger) iam.TokensServiceServer {
 	s := &tokensServiceServer{
-		cfg: cfg,
-		bdb: bdb,
-		ts:  ts,
-		lps: make(map[string]LoginProvider, 2),
+		cfg:    cfg,
+		bdb:    bdb,
+		rdb:    rdb,
+		ts:     ts,
+		ss:     ss,
+		ia:     ia,
+		ler:    ler,
+		lps:    newLoginProviders(bdb),
+		logger: logger,
 	}
 
-	s.lps[LOGIN_PROVIDER_FORM_PASSWORD] = NewFormPasswordLoginProvider(bdb)
-	s.lps[LOGIN_PROVIDER_SMS_OTP_CODE] = NewSMSOTPCodeLoginProvider()
-
 	return s
 }
 
+// userScope returns the scope of tokens issued to the user, one entry for each role of the user
+// including the roles inherited through its groups.
+func userScope(ctx context.Context, bdb bun.IDB, userId string) ([]string, error) {
+	roles, err := userRoleNames(ctx, bdb, userId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query roles: %w", err)
+	}
+	scope := make([]string, len(roles))
+	for i, r := range roles {
+		scope[i] = "ROLE_" + strings.ToUpper(r)
+	}
+	return scope, nil
+}
+
 func (s *tokensServiceServer) RegisterServerService(reg grpc.ServiceRegistrar) {
 	reg.RegisterService(&iam.TokensService_ServiceDesc, s)
 }
@@ -63,13 +93,51 @@ func (s *tokensServiceServer) RegisterGatewayClient(ctx context.Context, mux *ru
 }
 
 func (s *tokensServiceServer) Authorize(ctx context.Context, procedure string) error {
-	if procedure == iam.TokensService_CreateToken_FullMethodName || procedure == iam.TokensService_RefreshToken_FullMethodName {
+	if procedure == iam.TokensService_CreateToken_FullMethodName ||
+		procedure == iam.TokensService_CreateGuestToken_FullMethodName ||
+		procedure == iam.TokensService_RefreshToken_FullMethodName {
 		return secure.Authorize(ctx, secure.AuthFuncAuthenticated, secure.AuthFuncRequireSchema(secure.AUTH_SCHEMA_BASIC))
 	}
+	if procedure == iam.TokensService_Impersonate_FullMethodName {
+		if err := srv.DenyImpersonation(ctx); err != nil {
+			return err
+		}
+		if err := secure.Authorize(ctx, secure.AuthFuncAuthenticated, secure.AuthFuncRequireSchema(secure.AUTH_SCHEMA_BEARER), secure.AuthFuncRequireRealm(REALM_ADMIN)); err != nil {
+			return err
+		}
+		return srv.RequireImpersonator(ctx)
+	}
 	return nil
 }
 
+func (s *tokensServiceServer) Mutating(procedure string) bool {
+	switch procedure {
+	case iam.TokensService_CreateGuestToken_FullMethodName,
+		iam.TokensService_Impersonate_FullMethodName:
+		return true
+	}
+	return false
+}
+
 func (s *tokensServiceServer) CreateToken(ctx context.Context, req *iam.CreateTokenRequest) (*iam.CreateTokenResponse, error) {
+	event := models.LoginEvent{
+		Realm:      req.GetRealm(),
+		Provider:   strings.ToUpper(req.GetProvider()),
+		Identifier: req.GetUsername().GetValue(),
+		ClientId:   sql.NullString{Valid: true, String: secure.IdentityFromContext(ctx).Token().Subject()},
+		Outcome:    models.LOGIN_EVENT_OUTCOME_SUCCESS,
+	}
+	res, err := s.createToken(ctx, req, &event)
+	if err != nil {
+		event.Outcome = models.LOGIN_EVENT_OUTCOME_FAILURE
+		event.FailureReason = sql.NullString{Valid: true, String: status.Convert(err).Message()}
+	}
+	s.ler.Record(ctx, event)
+	return res, err
+}
+
+// createToken authenticates the login of a user and issues a pair of tokens, the resolved user is reported to the event.
+func (s *tokensServiceServer) createToken(ctx context.Context, req *iam.CreateTokenRequest, event *models.LoginEvent) (*iam.CreateTokenResponse, error) {
 	now := time.Now()
 	provider, ok := s.lps[strings.ToUpper(req.Provider)]
 	if !ok {
@@ -89,7 +157,20 @@ func (s *tokensServiceServer) CreateToken(ctx context.Context, req *iam.CreateTo
 	if err := s.bdb.NewSelect().Model(&realm).Where(`"realm"."name" = ?`, req.Realm).Scan(ctx); err != nil {
 		return nil, fmt.Errorf("realm with name %s not found", req.Realm)
 	}
+	var guest *models.Device
+	if req.GetGuestToken() != "" {
+		var err error
+		if guest, err = verifyGuestToken(ctx, s.bdb, s.ts, secure.IdentityFromContext(ctx).Token().Subject(), realm.Name, req.GetGuestToken()); err != nil {
+			return nil, err
+		}
+	}
 	login, err := provider.Login(ctx, realm.Id, req.Username.GetValue(), req.Password.GetValue(), req.IdToken.GetValue(), nil)
+	if err != nil {
+		// report failed attempts, e.g. wrong passwords, to the user owning the login
+		if userId := resolveLoginUserId(ctx, s.bdb, realm.Id, provider.Name(), req.Username.GetValue()); userId != "" {
+			event.UserId = sql.NullString{Valid: true, String: userId}
+		}
+	}
 	if errors.Is(err, sql.ErrNoRows) {
 		return nil, validator.NewError("username", "username not found")
 	} else if err != nil {
@@ -98,6 +179,10 @@ func (s *tokensServiceServer) CreateToken(ctx context.Context, req *iam.CreateTo
 	if login.User == nil {
 		return nil, validator.NewError("username", "username not found")
 	}
+	event.UserId = sql.NullString{Valid: true, String: login.User.Id}
+	if login.Identifier != "" {
+		event.Identifier = login.Identifier
+	}
 	if login.User.ExpiresAt.Valid && !login.User.ExpiresAt.Time.After(time.Now()) {
 		return nil, errors.New("user expired")
 	}
@@ -116,15 +201,15 @@ func (s *tokensServiceServer) CreateToken(ctx context.Context, req *iam.CreateTo
 	if login.ExpiresAt.Valid && !login.ExpiresAt.Time.After(time.Now()) {
 		return nil, errors.New("login expired")
 	}
-	var roles []string
-	if err := s.bdb.NewSelect().Model((*models.RoleUser)(nil)).Relation("Role", func(sq *bun.SelectQuery) *bun.SelectQuery {
-		return sq.ExcludeColumn("*")
-	}).Column("role.name").Where(`"role_user"."user_id" = ?`, login.User.Id).Scan(ctx, &roles); err != nil {
-		return nil, fmt.Errorf("failed to query roles: %w", err)
+	scope, err := userScope(ctx, s.bdb, login.User.Id)
+	if err != nil {
+		return nil, err
 	}
-	scope := make([]string, len(roles))
-	for i, r := range roles {
-		scope[i] = "ROLE_" + strings.ToUpper(r)
+	if req.GetDeviceId() != "" {
+		if _, err := getClientDevice(ctx, s.bdb, secure.IdentityFromContext(ctx).Token().Subject(), req.GetDeviceId()); err != nil {
+			return nil, err
+		}
+		scope = append(scope, srv.DeviceScope(req.GetDeviceId()))
 	}
 	uat, err := s.ts.Issue(secure.NewToken(secure.TOKEN_TYPE_BEARER, realm.Name, secure.IdentityFromContext(ctx).Token().Subject(), login.User.Id, scope), s.cfg.GetAccessTokenTTL())
 	if err != nil {
@@ -134,6 +219,14 @@ func (s *tokensServiceServer) CreateToken(ctx context.Context, req *iam.CreateTo
 	if err != nil {
 		return nil, err
 	}
+	if err := s.ss.Add(ctx, login.User.Id, secure.IdentityFromContext(ctx).Token().Subject(), uat, urt); err != nil {
+		return nil, err
+	}
+	if req.GetDeviceId() != "" {
+		if err := s.ss.AddDevice(ctx, req.GetDeviceId(), uat, urt); err != nil {
+			return nil, err
+		}
+	}
 	if err := s.bdb.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
 		res, err := tx.NewUpdate().Model((*models.User)(nil)).
 			Set(`"updated_at" = ?`, now).
@@ -148,10 +241,21 @@ func (s *tokensServiceServer) CreateToken(ctx context.Context, req *iam.CreateTo
 		} else if erc == 0 {
 			return errors.New("failed to update user")
 		}
+		if _, err := tx.NewUpdate().Model((*models.Login)(nil)).
+			Set(`"last_used_at" = ?`, now).
+			Where(`"id" = ?`, login.Id).Exec(ctx); err != nil {
+			return errors.New("failed to update login")
+		}
 		return nil
 	}); err != nil {
 		return nil, err
 	}
+	if guest != nil {
+		// a shared device may be bound to another user, the login must not fail because of the guest
+		if err := claimGuest(ctx, s.bdb, s.rdb, s.ss, guest, login.User.Id); err != nil {
+			s.logger.Warn("failed to claim guest", "device_id", guest.Id, "user_id", login.User.Id, "error", err)
+		}
+	}
 	return &iam.CreateTokenResponse{
 		TokenType:    secure.TOKEN_TYPE_BEARER,
 		ExpiresIn:    int32(time.Until(now.Add(s.cfg.GetAccessTokenTTL())).Seconds()),
@@ -160,6 +264,49 @@ func (s *tokensServiceServer) CreateToken(ctx context.Context, req *iam.CreateTo
 	}, nil
 }
 
+// CreateGuestToken issues a pair of anonymous tokens to a device registered through the client. The subject of guest
+// tokens is the device, they are accepted only by services opened to guests and can be claimed by the user who
+// later signs in or registers on the device.
+func (s *tokensServiceServer) CreateGuestToken(ctx context.Context, req *iam.CreateGuestTokenRequest) (*iam.CreateGuestTokenResponse, error) {
+	now := time.Now()
+	clientId := secure.IdentityFromContext(ctx).Token().Subject()
+	var realm models.Realm
+	if err := s.bdb.NewSelect().Model(&realm).Where(`"realm"."name" = ?`, req.GetRealm()).Scan(ctx); errors.Is(err, sql.ErrNoRows) {
+		return nil, validator.NewError("realm", fmt.Sprintf("realm %s not found", req.GetRealm()))
+	} else if err != nil {
+		return nil, err
+	}
+	if realm.Name == REALM_ADMIN {
+		return nil, status.Errorf(codes.PermissionDenied, "realm %s does not allow guests", REALM_ADMIN)
+	}
+	device, err := getClientDevice(ctx, s.bdb, clientId, req.GetDeviceId())
+	if err != nil {
+		return nil, err
+	}
+	scope := srv.GuestScope(device.Id)
+	uat, err := s.ts.Issue(secure.NewToken(secure.TOKEN_TYPE_BEARER, realm.Name, clientId, device.Id, scope), s.cfg.GetAccessTokenTTL())
+	if err != nil {
+		return nil, err
+	}
+	urt, err := s.ts.Issue(secure.NewToken(secure.TOKEN_TYPE_REFRESH, realm.Name, clientId, device.Id, scope), s.cfg.GetRefreshTokenTTL())
+	if err != nil {
+		return nil, err
+	}
+	if err := s.ss.Add(ctx, device.Id, clientId, uat, urt); err != nil {
+		return nil, err
+	}
+	if err := s.ss.AddDevice(ctx, device.Id, uat, urt); err != nil {
+		return nil, err
+	}
+	return &iam.CreateGuestTokenResponse{
+		TokenType:    secure.TOKEN_TYPE_BEARER,
+		ExpiresIn:    int32(time.Until(now.Add(s.cfg.GetAccessTokenTTL())).Seconds()),
+		AccessToken:  uat,
+		RefreshToken: urt,
+		GuestId:      device.Id,
+	}, nil
+}
+
 func (s *tokensServiceServer) RefreshToken(ctx context.Context, req *iam.RefreshTokenRequest) (*iam.RefreshTokenResponse, error) {
 	now := time.Now()
 	uat, err := s.ts.Renew(req.GetRefreshToken(), s.cfg.GetAccessTokenTTL())
@@ -171,6 +318,14 @@ func (s *tokensServiceServer) RefreshToken(ctx context.Context, req *iam.Refresh
 	if err != nil {
 		return nil, err
 	}
+	if err := s.ss.Add(ctx, token.Subject(), token.Client(), uat, urt); err != nil {
+		return nil, err
+	}
+	if deviceId := srv.DeviceFromScope(token.Scope()); deviceId != "" {
+		if err := s.ss.AddDevice(ctx, deviceId, uat, urt); err != nil {
+			return nil, err
+		}
+	}
 	return &iam.RefreshTokenResponse{
 		TokenType:    secure.TOKEN_TYPE_BEARER,
 		ExpiresIn:    int32(time.Until(now.Add(s.cfg.GetAccessTokenTTL())).Seconds()),
@@ -178,3 +333,54 @@ func (s *tokensServiceServer) RefreshToken(ctx context.Context, req *iam.Refresh
 		RefreshToken: urt,
 	}, nil
 }
+
+// Impersonate issues a short-lived access token for the target user to the acting admin, which must hold the
+// impersonator role. The token carries
+// the id of the admin in its scope and can not be refreshed, every call made with it is audited.
+func (s *tokensServiceServer) Impersonate(ctx context.Context, req *iam.ImpersonateRequest) (*iam.ImpersonateResponse, error) {
+	now := time.Now()
+	ttl := IMPERSONATION_DEFAULT_TTL
+	if req.GetTtl() != nil {
+		ttl = req.GetTtl().AsDuration()
+	}
+	if ttl <= 0 || ttl > IMPERSONATION_MAX_TTL {
+		return nil, validator.NewError("ttl", fmt.Sprintf("ttl must be positive and within %s", IMPERSONATION_MAX_TTL))
+	}
+	if strings.TrimSpace(req.GetReason()) == "" {
+		return nil, validator.NewError("reason", "reason is required to impersonate a user")
+	}
+	user := &models.User{Id: req.GetUserId()}
+	if err := s.bdb.NewSelect().Model(user).WherePK().
+		Relation("Realm", func(sq *bun.SelectQuery) *bun.SelectQuery { return sq.Column("name") }).
+		Scan(ctx); errors.Is(err, sql.ErrNoRows) {
+		return nil, status.Errorf(codes.NotFound, "user %s not found", req.GetUserId())
+	} else if err != nil {
+		return nil, err
+	}
+	if user.Realm == nil || user.Realm.Name == REALM_ADMIN {
+		return nil, status.Errorf(codes.PermissionDenied, "users of realm %s can not be impersonated", REALM_ADMIN)
+	}
+	if user.Disabled || !user.Approved || (user.ExpiresAt.Valid && !user.ExpiresAt.Time.After(now)) {
+		return nil, status.Errorf(codes.FailedPrecondition, "user %s is not active", user.Id)
+	}
+	scope, err := userScope(ctx, s.bdb, user.Id)
+	if err != nil {
+		return nil, err
+	}
+	actor := secure.IdentityFromContext(ctx).Token().Subject()
+	client := secure.IdentityFromContext(ctx).Token().Client()
+	uat, err := s.ts.Issue(secure.NewToken(secure.TOKEN_TYPE_BEARER, user.Realm.Name, client, user.Id, append(scope, srv.ImpersonationScope(actor)...)), ttl)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.ss.Add(ctx, user.Id, client, uat); err != nil {
+		return nil, err
+	}
+	s.ia.Issued(ctx, actor, user.Id, client, req.GetReason(), ttl)
+	return &iam.ImpersonateResponse{
+		TokenType:   secure.TOKEN_TYPE_BEARER,
+		ExpiresIn:   int32(time.Until(now.Add(ttl)).Seconds()),
+		AccessToken: uat,
+		ActorId:     actor,
+	}, nil
+}
@@ -2,14 +2,34 @@ package v1beta
 
 import (
 	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"strings"
 
 	iam "github.com/choral-io/gommerce-protobuf-go/iam/v1beta"
 	sqlpb "github.com/choral-io/gommerce-protobuf-go/types/v1/sqlpb"
 	"github.com/choral-io/gommerce-server-aio/data/models"
+	"github.com/choral-io/gommerce-server-aio/server/normalize"
 	"github.com/choral-io/gommerce-server-core/secure"
+	"github.com/choral-io/gommerce-server-core/validator"
+	"github.com/uptrace/bun"
 	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
+const (
+	USERS_DEFAULT_PAGE_SIZE = 20
+	USERS_MAX_PAGE_SIZE     = 1000
+)
+
+var userSortColumns = map[string]string{
+	"id":               `"user"."id"`,
+	"created_at":       `"user"."created_at"`,
+	"updated_at":       `"user"."updated_at"`,
+	"expires_at":       `"user"."expires_at"`,
+	"first_login_time": `"user"."first_login_time"`,
+	"last_active_time": `"user"."last_active_time"`,
+}
+
 func toUserPB(u models.User) *iam.User {
 	// mask sensitive data
 	// convert to proto
@@ -39,3 +59,125 @@ func toUserPB(u models.User) *iam.User {
 	}
 	return r
 }
+
+// withUserFilters applies the filters of a list users request to a query selecting from the users table.
+// The realm relation must be joined to the query when filtering by realm.
+func withUserFilters(req *iam.ListUsersRequest) func(*bun.SelectQuery) *bun.SelectQuery {
+	return func(q *bun.SelectQuery) *bun.SelectQuery {
+		if req.GetRealm() != "" {
+			q = q.Where(`"realm"."name" = ?`, req.GetRealm())
+		}
+		if req.GetDisabled() != nil {
+			q = q.Where(`"user"."disabled" = ?`, req.GetDisabled().GetValue())
+		}
+		if req.GetApproved() != nil {
+			q = q.Where(`"user"."approved" = ?`, req.GetApproved().GetValue())
+		}
+		if req.GetVerified() != nil {
+			q = q.Where(`"user"."verified" = ?`, req.GetVerified().GetValue())
+		}
+		if req.GetCreatedAfter() != nil {
+			q = q.Where(`"user"."created_at" >= ?`, req.GetCreatedAfter().AsTime())
+		}
+		if req.GetCreatedBefore() != nil {
+			q = q.Where(`"user"."created_at" < ?`, req.GetCreatedBefore().AsTime())
+		}
+		if req.GetLastActiveAfter() != nil {
+			q = q.Where(`"user"."last_active_time" >= ?`, req.GetLastActiveAfter().AsTime())
+		}
+		if req.GetLastActiveBefore() != nil {
+			q = q.Where(`"user"."last_active_time" < ?`, req.GetLastActiveBefore().AsTime())
+		}
+		if text := strings.TrimSpace(req.GetQuery()); text != "" {
+			// display names match by substring, contacts only as a whole, so that the search can not be used
+			// to guess email addresses and phone numbers piece by piece
+			pattern := "%" + escapeLikePattern(text) + "%"
+			q = q.WhereGroup(" AND ", func(q *bun.SelectQuery) *bun.SelectQuery {
+				q = q.WhereOr(`"user"."attributes"->>'profile.display_name' ILIKE ?`, pattern)
+				if v, err := normalize.EmailAddress(text); err == nil {
+					q = q.WhereOr(`"user"."email_address" = ?`, v)
+				}
+				if v, err := normalize.PhoneNumber(text, normalize.DefaultPhoneRegion()); err == nil {
+					q = q.WhereOr(`"user"."phone_number" = ?`, v)
+				}
+				return q
+			})
+		}
+		for k, v := range req.GetAttributes() {
+			q = q.Where(`"user"."attributes"->>? = ?`, k, v)
+		}
+		return q
+	}
+}
+
+// withUserSorting applies the sort expression of a list users request, e.g. "created_at desc,id".
+// Only columns in the allow list can be sorted, and the id is always appended as a tie breaker.
+func withUserSorting(sort string) (func(*bun.SelectQuery) *bun.SelectQuery, error) {
+	var orders []string
+	var hasId bool
+	for _, s := range strings.Split(sort, ",") {
+		fields := strings.Fields(s)
+		if len(fields) == 0 {
+			continue
+		}
+		column, ok := userSortColumns[strings.ToLower(fields[0])]
+		if !ok {
+			return nil, validator.NewError("sort", fmt.Sprintf("sorting by %s is not supported", fields[0]))
+		}
+		direction := "ASC"
+		if len(fields) > 1 {
+			direction = strings.ToUpper(fields[1])
+		}
+		if len(fields) > 2 || (direction != "ASC" && direction != "DESC") {
+			return nil, validator.NewError("sort", fmt.Sprintf("invalid sort expression %q", s))
+		}
+		if column == userSortColumns["id"] {
+			hasId = true
+		}
+		orders = append(orders, column+" "+direction)
+	}
+	if !hasId {
+		orders = append(orders, userSortColumns["id"]+" ASC")
+	}
+	return func(q *bun.SelectQuery) *bun.SelectQuery {
+		return q.OrderExpr(strings.Join(orders, ", "))
+	}, nil
+}
+
+// withUserCursor applies keyset pagination based on the snowflake ids of users.
+// Ids are fixed length hex strings, their lexical order follows the order of creation only roughly,
+// so pages are sorted by id and no other sort is supported.
+func withUserCursor(cursor string, desc bool, size int) (func(*bun.SelectQuery) *bun.SelectQuery, error) {
+	var after string
+	if cursor != "" {
+		if v, err := base64.RawURLEncoding.DecodeString(cursor); err != nil {
+			return nil, validator.NewErrorWithCause("cursor", "invalid cursor", err)
+		} else {
+			after = string(v)
+		}
+	}
+	return func(q *bun.SelectQuery) *bun.SelectQuery {
+		if after != "" {
+			if desc {
+				q = q.Where(`"user"."id" < ?`, after)
+			} else {
+				q = q.Where(`"user"."id" > ?`, after)
+			}
+		}
+		if desc {
+			q = q.OrderExpr(`"user"."id" DESC`)
+		} else {
+			q = q.OrderExpr(`"user"."id" ASC`)
+		}
+		// fetch one more row to detect if there is a next page
+		return q.Limit(size + 1)
+	}, nil
+}
+
+func encodeUserCursor(id string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(id))
+}
+
+func escapeLikePattern(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
@@ -4,16 +4,27 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"fmt"
+	"strings"
+	"time"
 
+	drivers "github.com/choral-io/gommerce-server-aio/data/drivers"
 	"github.com/choral-io/gommerce-server-aio/data/models"
+	srv "github.com/choral-io/gommerce-server-aio/server"
+	"github.com/choral-io/gommerce-server-aio/server/notify"
 	"github.com/choral-io/gommerce-server-core/data"
+	"github.com/choral-io/gommerce-server-core/logging"
 	"github.com/choral-io/gommerce-server-core/secure"
+	"github.com/choral-io/gommerce-server-core/validator"
 	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/nats-io/nats.go"
+	"github.com/redis/rueidis"
 	"github.com/uptrace/bun"
 	"golang.org/x/crypto/bcrypt"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 
 	iam "github.com/choral-io/gommerce-protobuf-go/iam/v1beta"
 	gender "github.com/choral-io/gommerce-protobuf-go/types/v1/gender"
@@ -24,10 +35,25 @@ type usersServiceServer struct {
 	iam.UnimplementedUsersServiceServer
 
 	bdb bun.IDB
+	rdb rueidis.Client
+	nc  *nats.Conn
+	ntf notify.Notifier
+	ts  secure.TokenStore
+	ss  *srv.SessionStore
+
+	logger logging.Logger
 }
 
-func NewUsersServiceServer(bdb bun.IDB) iam.UsersServiceServer {
-	return &usersServiceServer{bdb: bdb}
+func NewUsersServiceServer(bdb bun.IDB, rdb rueidis.Client, nc *nats.Conn, ntf notify.Notifier, ts secure.TokenStore, ss *srv.SessionStore, logger logging.Logger) iam.UsersServiceServer {
+	return &usersServiceServer{
+		bdb:    bdb,
+		rdb:    rdb,
+		nc:     nc,
+		ntf:    ntf,
+		ts:     ts,
+		ss:     ss,
+		logger: logger,
+	}
 }
 
 func (s *usersServiceServer) RegisterServerService(reg grpc.ServiceRegistrar) {
@@ -39,15 +65,62 @@ func (s *usersServiceServer) RegisterGatewayClient(ctx context.Context, mux *run
 }
 
 func (s *usersServiceServer) Authorize(ctx context.Context, procedure string) error {
-	if procedure == iam.UsersService_GetIdentity_FullMethodName {
+	if procedure == iam.UsersService_ChangeEmailAddress_FullMethodName ||
+		procedure == iam.UsersService_ChangePhoneNumber_FullMethodName ||
+		procedure == iam.UsersService_ConfirmEmailAddress_FullMethodName ||
+		procedure == iam.UsersService_ConfirmPhoneNumber_FullMethodName ||
+		procedure == iam.UsersService_ExportMyData_FullMethodName ||
+		procedure == iam.UsersService_DeleteMyAccount_FullMethodName ||
+		procedure == iam.UsersService_CancelAccountDeletion_FullMethodName {
+		if err := srv.DenyImpersonation(ctx); err != nil {
+			return err
+		}
+	}
+	if procedure == iam.UsersService_GetIdentity_FullMethodName ||
+		procedure == iam.UsersService_GetProfile_FullMethodName ||
+		procedure == iam.UsersService_UpdateProfile_FullMethodName ||
+		procedure == iam.UsersService_UpdateAttributes_FullMethodName ||
+		procedure == iam.UsersService_ChangeEmailAddress_FullMethodName ||
+		procedure == iam.UsersService_ChangePhoneNumber_FullMethodName ||
+		procedure == iam.UsersService_ConfirmPhoneNumber_FullMethodName ||
+		procedure == iam.UsersService_ExportMyData_FullMethodName ||
+		procedure == iam.UsersService_DeleteMyAccount_FullMethodName ||
+		procedure == iam.UsersService_CancelAccountDeletion_FullMethodName {
 		return secure.Authorize(ctx, secure.AuthFuncAuthenticated, secure.AuthFuncRequireSchema(secure.AUTH_SCHEMA_BEARER))
 	}
-	if procedure == iam.UsersService_ListUsers_FullMethodName {
+	if procedure == iam.UsersService_ConfirmEmailAddress_FullMethodName ||
+		procedure == iam.UsersService_ResendVerification_FullMethodName {
+		return secure.Authorize(ctx, secure.AuthFuncAuthenticated)
+	}
+	if procedure == iam.UsersService_ListUsers_FullMethodName ||
+		procedure == iam.UsersService_ListPendingUsers_FullMethodName ||
+		procedure == iam.UsersService_ApproveUser_FullMethodName ||
+		procedure == iam.UsersService_RejectUser_FullMethodName ||
+		procedure == iam.UsersService_ExportUserData_FullMethodName {
 		return secure.Authorize(ctx, secure.AuthFuncAuthenticated, secure.AuthFuncRequireRealm(REALM_ADMIN))
 	}
 	return nil
 }
 
+func (s *usersServiceServer) Mutating(procedure string) bool {
+	switch procedure {
+	case iam.UsersService_Register_FullMethodName,
+		iam.UsersService_UpdateProfile_FullMethodName,
+		iam.UsersService_UpdateAttributes_FullMethodName,
+		iam.UsersService_ChangeEmailAddress_FullMethodName,
+		iam.UsersService_ChangePhoneNumber_FullMethodName,
+		iam.UsersService_ConfirmEmailAddress_FullMethodName,
+		iam.UsersService_ConfirmPhoneNumber_FullMethodName,
+		iam.UsersService_ResendVerification_FullMethodName,
+		iam.UsersService_ApproveUser_FullMethodName,
+		iam.UsersService_RejectUser_FullMethodName,
+		iam.UsersService_DeleteMyAccount_FullMethodName,
+		iam.UsersService_CancelAccountDeletion_FullMethodName:
+		return true
+	}
+	return false
+}
+
 func (s *usersServiceServer) Register(ctx context.Context, req *iam.RegisterRequest) (*iam.RegisterResponse, error) {
 	realm := &models.Realm{}
 	if err := s.bdb.NewSelect().Model(realm).Where("name = ?", req.Realm).Scan(ctx); err != nil {
@@ -56,14 +129,44 @@ func (s *usersServiceServer) Register(ctx context.Context, req *iam.RegisterRequ
 		}
 		return nil, status.Errorf(codes.Unknown, "error retrieving realm %s: %v", req.Realm, err)
 	}
-	if !realm.AllowRegistration() {
+	if !realm.AllowRegistration() && !realm.RequireInvitation() {
 		return nil, status.Errorf(codes.PermissionDenied, "realm %s does not allow registration", req.Realm)
 	}
+	username, err := normalizeUsername("username", req.Username)
+	if err != nil {
+		return nil, err
+	}
+	var emailAddress string
+	if req.GetEmailAddress() != nil {
+		if emailAddress, err = normalizeEmailAddress(CONTACT_CHANNEL_EMAIL_ADDRESS, req.GetEmailAddress().GetValue()); err != nil {
+			return nil, err
+		}
+	} else if realm.RequireVerification() {
+		return nil, validator.NewError(CONTACT_CHANNEL_EMAIL_ADDRESS, "email address is required to register in this realm")
+	}
+	if emailAddress != "" {
+		if err := checkContactAvailable(ctx, s.bdb, realm.Id, "", CONTACT_CHANNEL_EMAIL_ADDRESS, emailAddress); err != nil {
+			return nil, err
+		}
+	}
+	if realm.RequireInvitation() && req.GetInvitationCode() == "" {
+		return nil, validator.NewError(INVITATION_FIELD_CODE, "invitation code is required to register in this realm")
+	}
+	var guest *models.Device
+	if req.GetGuestToken() != "" {
+		// guest tokens are bound to a client, so the client registering the user must authenticate itself
+		if err := secure.Authorize(ctx, secure.AuthFuncAuthenticated, secure.AuthFuncRequireSchema(secure.AUTH_SCHEMA_BASIC)); err != nil {
+			return nil, err
+		}
+		if guest, err = verifyGuestToken(ctx, s.bdb, s.ts, secure.IdentityFromContext(ctx).Token().Subject(), realm.Name, req.GetGuestToken()); err != nil {
+			return nil, err
+		}
+	}
 	user := &models.User{
 		RealmId:    realm.Id,
 		Disabled:   false,
-		Approved:   true,
-		Verified:   true,
+		Approved:   !realm.RequireApproval(),
+		Verified:   !realm.RequireVerification(),
 		Attributes: map[string]string{},
 	}
 	profile := &models.Profile{
@@ -71,18 +174,25 @@ func (s *usersServiceServer) Register(ctx context.Context, req *iam.RegisterRequ
 		AvatarUrl:   sqlpb.ToNullString(req.AvatarUrl),
 		Gender:      gender.ToSqlNullString(req.Gender),
 	}
-	if profile.DisplayName.Valid {
-		user.Attributes["profile.display_name"] = profile.DisplayName.String
+	changes := profileAttributes(profile)
+	for k, v := range req.GetAttributes() {
+		if isBuiltinAttribute(k) {
+			return nil, validator.NewError(attributeField(k), fmt.Sprintf("attribute %s can not be written", k))
+		}
+		changes[k] = v
 	}
-	if profile.AvatarUrl.Valid {
-		user.Attributes["profile.avatar_url"] = profile.AvatarUrl.String
+	schemas, err := getAttributeSchemas(ctx, s.bdb, realm.Id)
+	if err != nil {
+		return nil, err
 	}
-	if profile.Gender.Valid {
-		user.Attributes["profile.gender"] = profile.Gender.String
+	if err := validateAttributes(schemas, models.ATTRIBUTE_WRITER_USER, nil, changes); err != nil {
+		return nil, err
 	}
+	applyAttributes(user.Attributes, changes)
 	login := &models.Login{
+		RealmId:    realm.Id,
 		Provider:   LOGIN_PROVIDER_FORM_PASSWORD,
-		Identifier: req.Username,
+		Identifier: username,
 		Metadata:   map[string]string{},
 	}
 	if hp, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost); err != nil {
@@ -90,35 +200,82 @@ func (s *usersServiceServer) Register(ctx context.Context, req *iam.RegisterRequ
 	} else {
 		login.Credential = sql.NullString{Valid: true, String: string(hp)}
 	}
-	err := s.bdb.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+	var msg *notify.Message
+	err = s.bdb.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		var inv *models.Invitation
+		if req.GetInvitationCode() != "" {
+			var err error
+			if inv, err = redeemInvitation(ctx, tx, realm.Id, req.GetInvitationCode(), emailAddress); err != nil {
+				return err
+			}
+			user.CreatorId = sql.NullString{Valid: true, String: inv.CreatorId}
+			if inv.EmailAddress.Valid {
+				// the typed email address only matches the binding, the user stays unverified until it is confirmed
+				user.Verified = false
+			}
+		}
 		if _, err := tx.NewInsert().Model(user).Exec(ctx); err != nil {
 			return status.Errorf(codes.Unknown, "error creating user: %v", err)
 		}
+		if inv != nil {
+			if err := assignInvitationRoles(ctx, tx, inv, user.Id); err != nil {
+				return err
+			}
+		}
 		profile.Id = user.Id
 		if _, err := tx.NewInsert().Model(profile).Exec(ctx); err != nil {
 			return status.Errorf(codes.Unknown, "error creating profile: %v", err)
 		}
 		login.UserId = user.Id
-		if _, err := tx.NewInsert().Model(login).Exec(ctx); err != nil {
+		if _, err := tx.NewInsert().Model(login).Exec(ctx); drivers.IsUniqueViolation(err, models.LOGIN_UNIQUE_INDEX) {
+			return newAlreadyExistsError("username", fmt.Sprintf("username %s is already taken", username))
+		} else if err != nil {
 			return status.Errorf(codes.Unknown, "error creating login: %v", err)
 		}
+		if emailAddress != "" {
+			// the verification is pending before the user is committed, sending it is best effort as the user
+			// can request it again through ResendVerification
+			var err error
+			if msg, err = storeContactVerification(ctx, s.rdb, user.Id, CONTACT_CHANNEL_EMAIL_ADDRESS, emailAddress); err != nil {
+				return err
+			}
+		}
 		return nil
 	})
 	if err != nil {
 		return nil, err
 	}
+	if msg != nil {
+		if err := s.ntf.Notify(ctx, msg); err != nil {
+			s.logger.Warn("failed to send verification code", "user_id", user.Id, "error", err)
+		}
+	}
+	if guest != nil {
+		if err := claimGuest(ctx, s.bdb, s.rdb, s.ss, guest, user.Id); err != nil {
+			s.logger.Warn("failed to claim guest", "device_id", guest.Id, "user_id", user.Id, "error", err)
+		}
+	}
 	return &iam.RegisterResponse{
 		User: toUserPB(*user),
 	}, nil
 }
 
 func (s *usersServiceServer) ListUsers(ctx context.Context, req *iam.ListUsersRequest) (*iam.ListUsersResponse, error) {
+	if req.GetCursor() != nil {
+		return s.listUsersByCursor(ctx, req)
+	}
+	sorting, err := withUserSorting(req.GetSort())
+	if err != nil {
+		return nil, err
+	}
 	var users []models.User
 	query := s.bdb.NewSelect().Model(&users)
 	total, err := query.Apply(data.WithPaging(req)).
 		Relation("Realm", func(sq *bun.SelectQuery) *bun.SelectQuery { return sq.Column("name") }).
 		Relation("Creator").
 		Relation("Creator.Realm", func(sq *bun.SelectQuery) *bun.SelectQuery { return sq.Column("name") }).
+		Apply(withUserFilters(req)).
+		Apply(sorting).
 		ScanAndCount(ctx)
 	if err != nil {
 		return nil, err
@@ -135,18 +292,503 @@ func (s *usersServiceServer) ListUsers(ctx context.Context, req *iam.ListUsersRe
 	return res, nil
 }
 
+// listUsersByCursor lists users with keyset pagination, which skips the count query on large tables.
+func (s *usersServiceServer) listUsersByCursor(ctx context.Context, req *iam.ListUsersRequest) (*iam.ListUsersResponse, error) {
+	var desc bool
+	switch strings.ToLower(strings.Join(strings.Fields(req.GetSort()), " ")) {
+	case "", "id", "id asc":
+	case "id desc":
+		desc = true
+	default:
+		return nil, validator.NewError("sort", "only sorting by id is supported when using cursor")
+	}
+	size := int(req.GetSize())
+	if size <= 0 {
+		size = USERS_DEFAULT_PAGE_SIZE
+	} else if size > USERS_MAX_PAGE_SIZE {
+		size = USERS_MAX_PAGE_SIZE
+	}
+	cursor, err := withUserCursor(req.GetCursor().GetValue(), desc, size)
+	if err != nil {
+		return nil, err
+	}
+	var users []models.User
+	if err := s.bdb.NewSelect().Model(&users).
+		Relation("Realm", func(sq *bun.SelectQuery) *bun.SelectQuery { return sq.Column("name") }).
+		Relation("Creator").
+		Relation("Creator.Realm", func(sq *bun.SelectQuery) *bun.SelectQuery { return sq.Column("name") }).
+		Apply(withUserFilters(req)).
+		Apply(cursor).
+		Scan(ctx); err != nil {
+		return nil, err
+	}
+	res := &iam.ListUsersResponse{
+		Size: req.Size,
+	}
+	if len(users) > size {
+		users = users[:size]
+		res.NextCursor = encodeUserCursor(users[size-1].Id)
+	}
+	res.Items = make([]*iam.User, len(users))
+	for i, u := range users {
+		res.Items[i] = toUserPB(u)
+	}
+	return res, nil
+}
+
 func (s *usersServiceServer) GetIdentity(ctx context.Context, req *iam.GetIdentityRequest) (*iam.GetIdentityResponse, error) {
 	user := models.User{
 		Id: secure.IdentityFromContext(ctx).Token().Subject(),
 	}
-	err := s.bdb.NewSelect().Model(&user).WherePK().
-		Relation("Realm", func(sq *bun.SelectQuery) *bun.SelectQuery { return sq.Column("name") }).
-		Scan(ctx)
+	query := s.bdb.NewSelect().Model(&user).WherePK().
+		Relation("Realm", func(sq *bun.SelectQuery) *bun.SelectQuery { return sq.Column("name") })
+	if req.GetIncludeProfile() {
+		query = query.Relation("Profile")
+	}
+	if err := query.Scan(ctx); err != nil {
+		return nil, err
+	}
+	res := &iam.GetIdentityResponse{
+		User:    toUserPB(user),
+		Scope:   secure.IdentityFromContext(ctx).Token().Scope(),
+		ActorId: srv.ActorFromContext(ctx),
+	}
+	if user.Profile != nil {
+		res.Profile = toProfilePB(*user.Profile)
+	}
+	return res, nil
+}
+
+// profileUserId returns the id of the user whose profile is requested, only admins can access profiles of other users.
+func profileUserId(ctx context.Context, userId string) (string, error) {
+	sub := secure.IdentityFromContext(ctx).Token().Subject()
+	if userId == "" || userId == sub {
+		return sub, nil
+	}
+	if !isAdmin(ctx) {
+		return "", status.Errorf(codes.PermissionDenied, "not allowed to access profile of user %s", userId)
+	}
+	return userId, nil
+}
+
+func (s *usersServiceServer) GetProfile(ctx context.Context, req *iam.GetProfileRequest) (*iam.GetProfileResponse, error) {
+	userId, err := profileUserId(ctx, req.GetUserId())
+	if err != nil {
+		return nil, err
+	}
+	profile, err := getProfile(ctx, s.bdb, userId)
 	if err != nil {
 		return nil, err
 	}
-	return &iam.GetIdentityResponse{
-		User:  toUserPB(user),
-		Scope: secure.IdentityFromContext(ctx).Token().Scope(),
+	return &iam.GetProfileResponse{
+		Profile: toProfilePB(*profile),
 	}, nil
 }
+
+func (s *usersServiceServer) UpdateProfile(ctx context.Context, req *iam.UpdateProfileRequest) (*iam.UpdateProfileResponse, error) {
+	userId, err := profileUserId(ctx, req.GetUserId())
+	if err != nil {
+		return nil, err
+	}
+	var profile *models.Profile
+	if err := s.bdb.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		var err error
+		if profile, err = lockProfile(ctx, tx, userId); err != nil {
+			return err
+		}
+		columns, err := applyProfileUpdate(profile, req)
+		if err != nil {
+			return err
+		}
+		return saveProfile(ctx, tx, profile, attributeWriter(ctx), columns...)
+	}); err != nil {
+		return nil, err
+	}
+	return &iam.UpdateProfileResponse{
+		Profile: toProfilePB(*profile),
+	}, nil
+}
+
+// UpdateAttributes writes custom attributes of a user, only admins can update attributes of other users.
+func (s *usersServiceServer) UpdateAttributes(ctx context.Context, req *iam.UpdateAttributesRequest) (*iam.UpdateAttributesResponse, error) {
+	userId, err := profileUserId(ctx, req.GetUserId())
+	if err != nil {
+		return nil, err
+	}
+	user := &models.User{Id: userId}
+	err = s.bdb.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		if err := tx.NewSelect().Model(user).WherePK().For("UPDATE").Scan(ctx); errors.Is(err, sql.ErrNoRows) {
+			return status.Errorf(codes.NotFound, "user %s not found", userId)
+		} else if err != nil {
+			return status.Errorf(codes.Unknown, "error retrieving user: %v", err)
+		}
+		for k := range req.GetAttributes() {
+			if isBuiltinAttribute(k) {
+				return validator.NewError(attributeField(k), fmt.Sprintf("attribute %s can not be written", k))
+			}
+		}
+		schemas, err := getAttributeSchemas(ctx, tx, user.RealmId)
+		if err != nil {
+			return err
+		}
+		if user.Attributes == nil {
+			user.Attributes = map[string]string{}
+		}
+		if err := validateAttributes(schemas, attributeWriter(ctx), user.Attributes, req.GetAttributes()); err != nil {
+			return err
+		}
+		applyAttributes(user.Attributes, req.GetAttributes())
+		if _, err := tx.NewUpdate().Model(user).Column("attributes", "updated_at").WherePK().Exec(ctx); err != nil {
+			return status.Errorf(codes.Unknown, "error updating user: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &iam.UpdateAttributesResponse{
+		Attributes: user.Attributes,
+	}, nil
+}
+
+// changeContact validates a new email address or phone number of the bearer user and starts its verification.
+func (s *usersServiceServer) changeContact(ctx context.Context, channel, value string) error {
+	user := models.User{
+		Id: secure.IdentityFromContext(ctx).Token().Subject(),
+	}
+	if err := s.bdb.NewSelect().Model(&user).WherePK().Scan(ctx); err != nil {
+		return err
+	}
+	current := user.EmailAddress
+	if channel == CONTACT_CHANNEL_PHONE_NUMBER {
+		current = user.PhoneNumber
+	}
+	if current.Valid && current.String == value && user.Flags&contactVerifiedFlags[channel] != 0 {
+		return status.Errorf(codes.AlreadyExists, "%s is already verified", channel)
+	}
+	if err := checkContactAvailable(ctx, s.bdb, user.RealmId, user.Id, channel, value); err != nil {
+		return err
+	}
+	return startContactVerification(ctx, s.rdb, s.ntf, user.Id, channel, value)
+}
+
+func (s *usersServiceServer) ChangeEmailAddress(ctx context.Context, req *iam.ChangeEmailAddressRequest) (*iam.ChangeEmailAddressResponse, error) {
+	value, err := normalizeEmailAddress(CONTACT_CHANNEL_EMAIL_ADDRESS, req.GetEmailAddress())
+	if err != nil {
+		return nil, err
+	}
+	if err := s.changeContact(ctx, CONTACT_CHANNEL_EMAIL_ADDRESS, value); err != nil {
+		return nil, err
+	}
+	return &iam.ChangeEmailAddressResponse{
+		ExpiresIn: int32(CONTACT_VERIFICATION_TTL.Seconds()),
+	}, nil
+}
+
+func (s *usersServiceServer) ChangePhoneNumber(ctx context.Context, req *iam.ChangePhoneNumberRequest) (*iam.ChangePhoneNumberResponse, error) {
+	value, err := normalizePhoneNumber(CONTACT_CHANNEL_PHONE_NUMBER, req.GetPhoneNumber())
+	if err != nil {
+		return nil, err
+	}
+	if err := s.changeContact(ctx, CONTACT_CHANNEL_PHONE_NUMBER, value); err != nil {
+		return nil, err
+	}
+	return &iam.ChangePhoneNumberResponse{
+		ExpiresIn: int32(CONTACT_VERIFICATION_TTL.Seconds()),
+	}, nil
+}
+
+// unverifiedUser returns the user of a username login in a realm, as long as the user is not verified yet.
+// It lets users which can not get a bearer token finish their registration.
+func (s *usersServiceServer) unverifiedUser(ctx context.Context, realmName, username string) (*models.Login, error) {
+	username, err := normalizeUsername("username", username)
+	if err != nil {
+		return nil, err
+	}
+	login := &models.Login{}
+	if err := s.bdb.NewSelect().Model(login).
+		Join(`INNER JOIN "realms" AS "realm" ON "realm"."id" = "login"."realm_id"`).
+		Where(`"realm"."name" = ?`, realmName).
+		Where(`"login"."provider" = ?`, LOGIN_PROVIDER_FORM_PASSWORD).
+		Where(`"login"."identifier" = ?`, username).
+		Relation("User").
+		Scan(ctx); errors.Is(err, sql.ErrNoRows) {
+		return nil, status.Errorf(codes.FailedPrecondition, "no pending %s verification", CONTACT_CHANNEL_EMAIL_ADDRESS)
+	} else if err != nil {
+		return nil, status.Errorf(codes.Unknown, "error retrieving login: %v", err)
+	}
+	if login.User == nil || login.User.Verified {
+		return nil, status.Errorf(codes.FailedPrecondition, "no pending %s verification", CONTACT_CHANNEL_EMAIL_ADDRESS)
+	}
+	return login, nil
+}
+
+// ConfirmEmailAddress confirms a pending email address either by code for the bearer user, by code for an unverified
+// user given by realm and username, or by the token of a verification link, the latter two only require an authenticated client.
+func (s *usersServiceServer) ConfirmEmailAddress(ctx context.Context, req *iam.ConfirmEmailAddressRequest) (*iam.ConfirmEmailAddressResponse, error) {
+	var userId string
+	if req.GetToken() != "" {
+		id, channel, err := resolveContactLink(ctx, s.rdb, req.GetToken())
+		if err != nil {
+			return nil, err
+		}
+		if channel != CONTACT_CHANNEL_EMAIL_ADDRESS {
+			return nil, validator.NewError("token", "verification token is invalid or expired")
+		}
+		userId = id
+	} else if req.GetCode() == "" {
+		return nil, validator.NewError("code", "code or token is required")
+	} else if req.GetRealm() != "" && req.GetUsername() != "" {
+		login, err := s.unverifiedUser(ctx, req.GetRealm(), req.GetUsername())
+		if err != nil {
+			return nil, err
+		}
+		userId = login.UserId
+	} else if err := secure.Authorize(ctx, secure.AuthFuncRequireSchema(secure.AUTH_SCHEMA_BEARER)); err != nil {
+		return nil, err
+	} else {
+		userId = secure.IdentityFromContext(ctx).Token().Subject()
+	}
+	v, err := confirmContactVerification(ctx, s.rdb, userId, CONTACT_CHANNEL_EMAIL_ADDRESS, req.GetCode(), req.GetToken())
+	if err != nil {
+		return nil, err
+	}
+	if err := applyContactVerification(ctx, s.bdb, v); err != nil {
+		return nil, err
+	}
+	return &iam.ConfirmEmailAddressResponse{}, nil
+}
+
+// ResendVerification starts the email verification of a user which has not been verified yet, e.g. because the
+// first message expired or got lost. The user proves the ownership of the account with its username and password.
+func (s *usersServiceServer) ResendVerification(ctx context.Context, req *iam.ResendVerificationRequest) (*iam.ResendVerificationResponse, error) {
+	emailAddress, err := normalizeEmailAddress(CONTACT_CHANNEL_EMAIL_ADDRESS, req.GetEmailAddress())
+	if err != nil {
+		return nil, err
+	}
+	login, err := s.unverifiedUser(ctx, req.GetRealm(), req.GetUsername())
+	if st, ok := status.FromError(err); err != nil && ok && st.Code() == codes.FailedPrecondition {
+		return nil, status.Error(codes.Unauthenticated, "username or password is invalid")
+	} else if err != nil {
+		return nil, err
+	}
+	if !login.Credential.Valid || bcrypt.CompareHashAndPassword([]byte(login.Credential.String), []byte(req.GetPassword())) != nil {
+		return nil, status.Error(codes.Unauthenticated, "username or password is invalid")
+	}
+	if err := checkContactAvailable(ctx, s.bdb, login.RealmId, login.UserId, CONTACT_CHANNEL_EMAIL_ADDRESS, emailAddress); err != nil {
+		return nil, err
+	}
+	if err := throttleContactVerification(ctx, s.rdb, login.UserId, CONTACT_CHANNEL_EMAIL_ADDRESS); err != nil {
+		return nil, err
+	}
+	if err := startContactVerification(ctx, s.rdb, s.ntf, login.UserId, CONTACT_CHANNEL_EMAIL_ADDRESS, emailAddress); err != nil {
+		return nil, err
+	}
+	return &iam.ResendVerificationResponse{
+		ExpiresIn: int32(CONTACT_VERIFICATION_TTL.Seconds()),
+	}, nil
+}
+
+func (s *usersServiceServer) ConfirmPhoneNumber(ctx context.Context, req *iam.ConfirmPhoneNumberRequest) (*iam.ConfirmPhoneNumberResponse, error) {
+	if req.GetCode() == "" {
+		return nil, validator.NewError("code", "code is required")
+	}
+	userId := secure.IdentityFromContext(ctx).Token().Subject()
+	v, err := confirmContactVerification(ctx, s.rdb, userId, CONTACT_CHANNEL_PHONE_NUMBER, req.GetCode(), "")
+	if err != nil {
+		return nil, err
+	}
+	if err := applyContactVerification(ctx, s.bdb, v); err != nil {
+		return nil, err
+	}
+	return &iam.ConfirmPhoneNumberResponse{}, nil
+}
+
+func (s *usersServiceServer) ListPendingUsers(ctx context.Context, req *iam.ListPendingUsersRequest) (*iam.ListPendingUsersResponse, error) {
+	res, err := s.ListUsers(ctx, &iam.ListUsersRequest{
+		Page:     req.Page,
+		Size:     req.Size,
+		Realm:    req.GetRealm(),
+		Approved: wrapperspb.Bool(false),
+		Sort:     "created_at asc",
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &iam.ListPendingUsersResponse{
+		Page:  res.Page,
+		Size:  res.Size,
+		Total: res.Total,
+		Items: res.Items,
+	}, nil
+}
+
+// decideUser approves or rejects a pending user. Rejected users are soft deleted, their logins are removed
+// and their contacts are cleared, so the identifiers can be used again by a new registration.
+func (s *usersServiceServer) decideUser(ctx context.Context, id string, approved bool, reason string) (*models.User, error) {
+	user := &models.User{Id: id}
+	err := s.bdb.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		if err := tx.NewSelect().Model(user).WherePK().For("UPDATE").Scan(ctx); errors.Is(err, sql.ErrNoRows) {
+			return status.Errorf(codes.NotFound, "user %s not found", id)
+		} else if err != nil {
+			return status.Errorf(codes.Unknown, "error retrieving user: %v", err)
+		}
+		if user.Approved {
+			return status.Errorf(codes.FailedPrecondition, "user %s is not pending approval", id)
+		}
+		if approved {
+			user.Approved = true
+			if err := setDecisionReason(ctx, tx, user, models.USER_ATTRIBUTE_APPROVED_REASON, reason); err != nil {
+				return err
+			}
+			if _, err := tx.NewUpdate().Model(user).Column("approved", "attributes", "updated_at").WherePK().Exec(ctx); err != nil {
+				return status.Errorf(codes.Unknown, "error updating user: %v", err)
+			}
+			return nil
+		}
+		if _, err := tx.NewDelete().Model((*models.Login)(nil)).Where(`"user_id" = ?`, id).ForceDelete().Exec(ctx); err != nil {
+			return status.Errorf(codes.Unknown, "error deleting logins: %v", err)
+		}
+		if err := setDecisionReason(ctx, tx, user, models.USER_ATTRIBUTE_REJECTED_REASON, reason); err != nil {
+			return err
+		}
+		// keep the contacts of the user in memory for the notification only
+		rejected := *user
+		rejected.EmailAddress = sql.NullString{}
+		rejected.PhoneNumber = sql.NullString{}
+		if _, err := tx.NewUpdate().Model(&rejected).Column("attributes", "email_address", "phone_number", "updated_at").WherePK().Exec(ctx); err != nil {
+			return status.Errorf(codes.Unknown, "error updating user: %v", err)
+		}
+		if _, err := tx.NewDelete().Model(&rejected).WherePK().Exec(ctx); err != nil {
+			return status.Errorf(codes.Unknown, "error deleting user: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	event := UserEvent{
+		UserId:  user.Id,
+		RealmId: user.RealmId,
+		ActorId: secure.IdentityFromContext(ctx).Token().Subject(),
+		Reason:  reason,
+		Time:    time.Now(),
+	}
+	// the decision is already committed, so failures of the event and the notification are logged but not reported to the caller
+	subject, title, body := EVENT_SUBJECT_USER_APPROVED, "Registration approved", "Your registration has been approved, you can sign in now."
+	if !approved {
+		subject, title, body = EVENT_SUBJECT_USER_REJECTED, "Registration rejected", "Your registration has been rejected."
+		if reason != "" {
+			body += " Reason: " + reason
+		}
+	}
+	if err := publishEvent(s.nc, subject, event); err != nil {
+		s.logger.Warn("failed to publish user event", "subject", subject, "user_id", user.Id, "error", err)
+	}
+	if err := notifyUser(ctx, s.ntf, user, title, body); err != nil {
+		s.logger.Warn("failed to notify user", "subject", subject, "user_id", user.Id, "error", err)
+	}
+	return user, nil
+}
+
+// setDecisionReason stores the optional reason of an approval decision in a system attribute of the user.
+func setDecisionReason(ctx context.Context, tx bun.Tx, user *models.User, key, reason string) error {
+	if reason == "" {
+		return nil
+	}
+	changes := map[string]string{key: reason}
+	schemas, err := getAttributeSchemas(ctx, tx, user.RealmId)
+	if err != nil {
+		return err
+	}
+	if err := validateAttributes(schemas, models.ATTRIBUTE_WRITER_SYSTEM, user.Attributes, changes); err != nil {
+		return err
+	}
+	if user.Attributes == nil {
+		user.Attributes = map[string]string{}
+	}
+	applyAttributes(user.Attributes, changes)
+	return nil
+}
+
+func (s *usersServiceServer) ApproveUser(ctx context.Context, req *iam.ApproveUserRequest) (*iam.ApproveUserResponse, error) {
+	user, err := s.decideUser(ctx, req.GetId(), true, req.GetReason())
+	if err != nil {
+		return nil, err
+	}
+	return &iam.ApproveUserResponse{
+		User: toUserPB(*user),
+	}, nil
+}
+
+func (s *usersServiceServer) RejectUser(ctx context.Context, req *iam.RejectUserRequest) (*iam.RejectUserResponse, error) {
+	if _, err := s.decideUser(ctx, req.GetId(), false, req.GetReason()); err != nil {
+		return nil, err
+	}
+	return &iam.RejectUserResponse{}, nil
+}
+
+func (s *usersServiceServer) ExportMyData(ctx context.Context, req *iam.ExportMyDataRequest) (*iam.ExportMyDataResponse, error) {
+	payload, name, err := exportUserData(ctx, s.bdb, s.rdb, s.ss, secure.IdentityFromContext(ctx).Token().Subject())
+	if err != nil {
+		return nil, err
+	}
+	return &iam.ExportMyDataResponse{
+		ContentType: EXPORT_CONTENT_TYPE,
+		FileName:    name,
+		Data:        payload,
+	}, nil
+}
+
+func (s *usersServiceServer) ExportUserData(ctx context.Context, req *iam.ExportUserDataRequest) (*iam.ExportUserDataResponse, error) {
+	if req.GetUserId() == "" {
+		return nil, validator.NewError("user_id", "user id is required")
+	}
+	payload, name, err := exportUserData(ctx, s.bdb, s.rdb, s.ss, req.GetUserId())
+	if err != nil {
+		return nil, err
+	}
+	return &iam.ExportUserDataResponse{
+		ContentType: EXPORT_CONTENT_TYPE,
+		FileName:    name,
+		Data:        payload,
+	}, nil
+}
+
+// scheduleErasure sets or clears the erase time of the bearer user, immutable users can not be erased.
+func (s *usersServiceServer) scheduleErasure(ctx context.Context, eraseAt sql.NullTime) (*models.User, error) {
+	user := &models.User{Id: secure.IdentityFromContext(ctx).Token().Subject()}
+	if err := s.bdb.NewSelect().Model(user).WherePK().Scan(ctx); err != nil {
+		return nil, err
+	}
+	if user.Immutable {
+		return nil, status.Errorf(codes.FailedPrecondition, "user %s is immutable", user.Id)
+	}
+	user.EraseAt = eraseAt
+	if _, err := s.bdb.NewUpdate().Model(user).WherePK().Column("erase_at", "updated_at").Exec(ctx); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// DeleteMyAccount schedules the erasure of the bearer user and signs it out everywhere,
+// the user can still sign in again and cancel the deletion within the grace period.
+func (s *usersServiceServer) DeleteMyAccount(ctx context.Context, req *iam.DeleteMyAccountRequest) (*iam.DeleteMyAccountResponse, error) {
+	user, err := s.scheduleErasure(ctx, sql.NullTime{Time: time.Now().Add(srv.ErasureGracePeriod()), Valid: true})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.ss.RevokeUser(ctx, user.Id); err != nil {
+		return nil, status.Errorf(codes.Unknown, "error revoking sessions: %v", err)
+	}
+	return &iam.DeleteMyAccountResponse{
+		EraseAt: sqlpb.FromNullTime(user.EraseAt),
+	}, nil
+}
+
+func (s *usersServiceServer) CancelAccountDeletion(ctx context.Context, req *iam.CancelAccountDeletionRequest) (*iam.CancelAccountDeletionResponse, error) {
+	if _, err := s.scheduleErasure(ctx, sql.NullTime{}); err != nil {
+		return nil, err
+	}
+	return &iam.CancelAccountDeletionResponse{}, nil
+}